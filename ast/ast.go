@@ -1,12 +1,19 @@
 package ast
 
 import (
+	"errors"
 	"strconv"
 )
 
+// ErrDivisionByZero is the value of the panic raised when an expression
+// divides by zero
+var ErrDivisionByZero = errors.New("division by zero")
+
 // define the base interface that all expressions implement
+// Eval looks up variables in the environments in the given order,
+// it can be called without an environment if the expression has no variables
 type Exp interface {
-	Eval() int
+	Eval(env ...Env) int
 	Pretty() string
 }
 
@@ -18,8 +25,13 @@ type IntExp struct {
 
 // eval function for int expression
 // returns the value of the int expression
-func (int_exp IntExp) Eval() int {
-	return int_exp.Val
+func (int_exp IntExp) Eval(env ...Env) int {
+	return evaluate(int_exp, env)
+}
+
+// evaluates the int expression in a scope of the evaluation
+func (int_exp IntExp) eval(ev *evaluation, sc *scope) value {
+	return value{n: int_exp.Val}
 }
 
 // pretty function for int expression
@@ -36,8 +48,13 @@ type PlusExp struct {
 
 // eval function for plus expression
 // returns the value of the plus expression
-func (plus_exp PlusExp) Eval() int {
-	return plus_exp.Left.Eval() + plus_exp.Right.Eval()
+func (plus_exp PlusExp) Eval(env ...Env) int {
+	return evaluate(plus_exp, env)
+}
+
+// evaluates the plus expression in a scope of the evaluation
+func (plus_exp PlusExp) eval(ev *evaluation, sc *scope) value {
+	return value{n: ev.int(plus_exp.Left, sc) + ev.int(plus_exp.Right, sc)}
 }
 
 // pretty function for plus expression
@@ -54,11 +71,173 @@ type MultExp struct {
 
 // eval function for mult expression
 // returns the value of the mult expression
-func (mult_exp MultExp) Eval() int {
-	return mult_exp.Left.Eval() * mult_exp.Right.Eval()
+func (mult_exp MultExp) Eval(env ...Env) int {
+	return evaluate(mult_exp, env)
+}
+
+// evaluates the mult expression in a scope of the evaluation
+func (mult_exp MultExp) eval(ev *evaluation, sc *scope) value {
+	return value{n: ev.int(mult_exp.Left, sc) * ev.int(mult_exp.Right, sc)}
 }
 
 // pretty function for mult expression
 func (mult_exp MultExp) Pretty() string {
 	return "(" + mult_exp.Left.Pretty() + "*" + mult_exp.Right.Pretty() + ")"
 }
+
+// define the sub expression
+// implicitly implements the Exp interface
+type SubExp struct {
+	Left  Exp
+	Right Exp
+}
+
+// eval function for sub expression
+// returns the value of the sub expression
+func (sub_exp SubExp) Eval(env ...Env) int {
+	return evaluate(sub_exp, env)
+}
+
+// evaluates the sub expression in a scope of the evaluation
+func (sub_exp SubExp) eval(ev *evaluation, sc *scope) value {
+	return value{n: ev.int(sub_exp.Left, sc) - ev.int(sub_exp.Right, sc)}
+}
+
+// pretty function for sub expression
+func (sub_exp SubExp) Pretty() string {
+	return "(" + sub_exp.Left.Pretty() + "-" + sub_exp.Right.Pretty() + ")"
+}
+
+// define the div expression
+// implicitly implements the Exp interface
+type DivExp struct {
+	Left  Exp
+	Right Exp
+}
+
+// eval function for div expression
+// returns the value of the div expression truncated towards zero
+// panics with ErrDivisionByZero if the right expression evaluates to zero
+func (div_exp DivExp) Eval(env ...Env) int {
+	return evaluate(div_exp, env)
+}
+
+// evaluates the div expression in a scope of the evaluation
+func (div_exp DivExp) eval(ev *evaluation, sc *scope) value {
+	// the left expression is evaluated first, like in the vm
+	left, right := ev.int(div_exp.Left, sc), ev.int(div_exp.Right, sc)
+	if right == 0 {
+		panic(ErrDivisionByZero)
+	}
+	return value{n: left / right}
+}
+
+// pretty function for div expression
+func (div_exp DivExp) Pretty() string {
+	return "(" + div_exp.Left.Pretty() + "/" + div_exp.Right.Pretty() + ")"
+}
+
+// define the mod expression
+// implicitly implements the Exp interface
+type ModExp struct {
+	Left  Exp
+	Right Exp
+}
+
+// eval function for mod expression
+// returns the remainder of the division, it has the sign of the left value
+// panics with ErrDivisionByZero if the right expression evaluates to zero
+func (mod_exp ModExp) Eval(env ...Env) int {
+	return evaluate(mod_exp, env)
+}
+
+// evaluates the mod expression in a scope of the evaluation
+func (mod_exp ModExp) eval(ev *evaluation, sc *scope) value {
+	// the left expression is evaluated first, like in the vm
+	left, right := ev.int(mod_exp.Left, sc), ev.int(mod_exp.Right, sc)
+	if right == 0 {
+		panic(ErrDivisionByZero)
+	}
+	return value{n: left % right}
+}
+
+// pretty function for mod expression
+func (mod_exp ModExp) Pretty() string {
+	return "(" + mod_exp.Left.Pretty() + "%" + mod_exp.Right.Pretty() + ")"
+}
+
+// define the neg expression (unary minus)
+// implicitly implements the Exp interface
+type NegExp struct {
+	Exp Exp
+}
+
+// eval function for neg expression
+// returns the negated value of the expression
+func (neg_exp NegExp) Eval(env ...Env) int {
+	return evaluate(neg_exp, env)
+}
+
+// evaluates the neg expression in a scope of the evaluation
+func (neg_exp NegExp) eval(ev *evaluation, sc *scope) value {
+	return value{n: -ev.int(neg_exp.Exp, sc)}
+}
+
+// pretty function for neg expression
+func (neg_exp NegExp) Pretty() string {
+	return "(-" + neg_exp.Exp.Pretty() + ")"
+}
+
+// define the variable expression
+// implicitly implements the Exp interface
+type VarExp struct {
+	Name string
+}
+
+// eval function for variable expression
+// returns the value of the innermost let or parameter of the name,
+// otherwise of the variable in the first environment which binds it
+// panics with UnboundVariableError if no environment binds the variable
+func (var_exp VarExp) Eval(env ...Env) int {
+	return evaluate(var_exp, env)
+}
+
+// evaluates the variable expression in a scope of the evaluation
+func (var_exp VarExp) eval(ev *evaluation, sc *scope) value {
+	val, ok := ev.variable(var_exp.Name, sc)
+	if !ok {
+		panic(UnboundVariableError{var_exp.Name})
+	}
+	return val
+}
+
+// pretty function for variable expression
+func (var_exp VarExp) Pretty() string {
+	return var_exp.Name
+}
+
+// define the let expression, it binds the value of an expression to a name
+// implicitly implements the Exp interface
+type LetExp struct {
+	Name  string
+	Value Exp // the bound expression, the name is not visible in it
+	Body  Exp // the name is visible in the body and shadows outer variables
+}
+
+// eval function for let expression
+// the value is evaluated once, then the body is evaluated with the name
+// bound to it in front of the enclosing lets and the environments
+func (let_exp LetExp) Eval(env ...Env) int {
+	return evaluate(let_exp, env)
+}
+
+// evaluates the let expression in a scope of the evaluation
+func (let_exp LetExp) eval(ev *evaluation, sc *scope) value {
+	val := ev.eval(let_exp.Value, sc)
+	return ev.eval(let_exp.Body, &scope{name: let_exp.Name, val: val, outer: sc})
+}
+
+// pretty function for let expression
+func (let_exp LetExp) Pretty() string {
+	return "(let " + let_exp.Name + " = " + let_exp.Value.Pretty() + " in " + let_exp.Body.Pretty() + ")"
+}
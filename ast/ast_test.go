@@ -14,6 +14,14 @@ func TestAst(t *testing.T) {
 		{MultExp{IntExp{2}, IntExp{2}}, 4},
 		{PlusExp{IntExp{1}, MultExp{IntExp{2}, IntExp{2}}}, 5},
 		{MultExp{PlusExp{IntExp{1}, IntExp{1}}, IntExp{2}}, 4},
+		{SubExp{IntExp{1}, IntExp{3}}, -2},
+		{SubExp{SubExp{IntExp{5}, IntExp{2}}, IntExp{1}}, 2},
+		{DivExp{IntExp{7}, IntExp{2}}, 3},
+		{DivExp{IntExp{-7}, IntExp{2}}, -3},
+		{ModExp{IntExp{7}, IntExp{3}}, 1},
+		{ModExp{IntExp{-7}, IntExp{3}}, -1},
+		{NegExp{IntExp{4}}, -4},
+		{NegExp{SubExp{IntExp{1}, IntExp{4}}}, 3},
 	}
 
 	for _, tt := range tests {
@@ -26,3 +34,122 @@ func TestAst(t *testing.T) {
 	}
 
 }
+
+func TestDivisionByZero(t *testing.T) {
+	tests := []Exp{
+		DivExp{IntExp{1}, IntExp{0}},
+		ModExp{IntExp{1}, SubExp{IntExp{2}, IntExp{2}}},
+	}
+
+	for _, exp := range tests {
+		t.Run(exp.Pretty(), func(t *testing.T) {
+			defer func() {
+				if r := recover(); r != ErrDivisionByZero {
+					t.Errorf("eval(%q) panicked with %v, want %v", exp.Pretty(), r, ErrDivisionByZero)
+				}
+			}()
+			exp.Eval()
+		})
+	}
+}
+
+func TestVariables(t *testing.T) {
+	// price * qty - discount
+	exp := SubExp{MultExp{VarExp{"price"}, VarExp{"qty"}}, VarExp{"discount"}}
+	if got := exp.Pretty(); got != "((price*qty)-discount)" {
+		t.Errorf("Pretty() = %q, want %q", got, "((price*qty)-discount)")
+	}
+	env := Env{"price": 3, "qty": 4, "discount": 2}
+	if got := exp.Eval(env); got != 10 {
+		t.Errorf("Eval(env) = %d, want 10", got)
+	}
+	// the first environment which binds a variable wins
+	if got := exp.Eval(Env{"discount": 5}, env); got != 7 {
+		t.Errorf("Eval(inner, env) = %d, want 7", got)
+	}
+}
+
+func TestUnboundVariable(t *testing.T) {
+	exp := PlusExp{VarExp{"x"}, DivExp{VarExp{"y"}, IntExp{0}}}
+	defer func() {
+		want := UnboundVariableError{"x"}
+		if r := recover(); r != want {
+			t.Errorf("Eval() panicked with %v, want %v", r, want)
+		}
+	}()
+	exp.Eval()
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		exp  Exp
+		env  Env
+		want int
+		err  error
+	}{
+		{PlusExp{VarExp{"x"}, IntExp{1}}, Env{"x": 2}, 3, nil},
+		{PlusExp{VarExp{"x"}, IntExp{1}}, nil, 0, UnboundVariableError{"x"}},
+		// the left operand is evaluated first
+		{DivExp{VarExp{"x"}, VarExp{"y"}}, nil, 0, UnboundVariableError{"x"}},
+		{DivExp{VarExp{"x"}, VarExp{"y"}}, Env{"x": 1, "y": 0}, 0, ErrDivisionByZero},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.exp.Pretty(), func(t *testing.T) {
+			got, err := Evaluate(tt.exp, tt.env)
+			if got != tt.want || err != tt.err {
+				t.Errorf("Evaluate() = %d, %v, want %d, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+	if msg := (UnboundVariableError{"x"}).Error(); msg != `unbound variable "x"` {
+		t.Errorf("Error() = %q, want %q", msg, `unbound variable "x"`)
+	}
+}
+
+func TestLet(t *testing.T) {
+	// let x = 1 + 2 in x * x
+	square := LetExp{"x", PlusExp{IntExp{1}, IntExp{2}}, MultExp{VarExp{"x"}, VarExp{"x"}}}
+	tests := []struct {
+		exp    Exp
+		env    Env
+		want   int
+		pretty string
+	}{
+		{square, nil, 9, "(let x = (1+2) in (x*x))"},
+		// the let shadows the environment
+		{square, Env{"x": 10}, 9, "(let x = (1+2) in (x*x))"},
+		// the name is not visible in its own value
+		{LetExp{"x", PlusExp{VarExp{"x"}, IntExp{1}}, VarExp{"x"}}, Env{"x": 10}, 11, "(let x = (x+1) in x)"},
+		// the inner let shadows the outer one only in its body
+		{LetExp{"x", IntExp{1}, PlusExp{LetExp{"x", IntExp{2}, VarExp{"x"}}, VarExp{"x"}}}, nil, 3, "(let x = 1 in ((let x = 2 in x)+x))"},
+		{LetExp{"x", IntExp{2}, LetExp{"y", MultExp{VarExp{"x"}, VarExp{"z"}}, SubExp{VarExp{"y"}, VarExp{"x"}}}}, Env{"z": 5}, 8, "(let x = 2 in (let y = (x*z) in (y-x)))"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.exp.Pretty(); got != tt.pretty {
+			t.Errorf("Pretty() = %q, want %q", got, tt.pretty)
+		}
+		if got := tt.exp.Eval(tt.env); got != tt.want {
+			t.Errorf("%s.Eval(%v) = %d, want %d", tt.pretty, tt.env, got, tt.want)
+		}
+	}
+	// the variable is unbound outside of the body
+	_, err := Evaluate(PlusExp{LetExp{"x", IntExp{1}, VarExp{"x"}}, VarExp{"x"}})
+	if err != (UnboundVariableError{"x"}) {
+		t.Errorf("Evaluate() error = %v, want %v", err, UnboundVariableError{"x"})
+	}
+}
+
+func TestEvalAllocs(t *testing.T) {
+	// expressions without lets and functions are checked without
+	// inferring their types and evaluated without allocating
+	var exp Exp = IfExp{LtExp{VarExp{"a"}, IntExp{5}}, PlusExp{MultExp{VarExp{"a"}, IntExp{3}}, IntExp{4}}, IntExp{0}}
+	envs := []Env{{"a": 2}}
+	if allocs := testing.AllocsPerRun(100, func() { Evaluate(exp, envs...) }); allocs != 0 {
+		t.Errorf("Evaluate allocates %v times, want 0", allocs)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { IntExp{3}.Eval() }); allocs != 0 {
+		t.Errorf("IntExp.Eval allocates %v times, want 0", allocs)
+	}
+}
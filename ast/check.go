@@ -0,0 +1,543 @@
+package ast
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// values are ints, bools, strings or closures, arithmetic takes ints,
+// conditions and logical operators take bools, a string can only be
+// passed to a function of the host, a closure can only be applied and
+// nothing else can be applied, Check infers the types of an expression
+// and rejects expressions which mix them up before they are evaluated,
+// so both Eval and the vm report the same errors
+// a bool is evaluated to 1 for true and 0 for false
+//
+// the types are inferred like in ML: the parameters of functions and
+// lambdas get the types of their uses, and functions and closures bound
+// by a let can be used with arguments of different types, e.g.
+// let id = \x -> x in id(\y -> y)(id(1))
+
+// Kind is the type of a value which is not a function
+type Kind int
+
+const (
+	Int    Kind = iota // an integer
+	Bool               // true or false
+	String             // a string literal, only functions of the host take strings
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Bool:
+		return "bool"
+	case String:
+		return "string"
+	}
+	return "int"
+}
+
+// Signature is the type of a function of the host which expressions
+// can call by its name, e.g. a native function of the vm
+type Signature struct {
+	Params []Kind // the kinds of the parameters
+	// further arguments have the kind of the last parameter, which may
+	// also be left out
+	Variadic bool
+	Result   Kind // the kind of the result
+}
+
+// TypeError is the value of the panic raised when an expression has a
+// type which its use does not allow, e.g. a closure which is added
+type TypeError struct {
+	Exp  string // the expression
+	Want string // the type its use requires
+	Got  string // the type it has
+}
+
+func (e TypeError) Error() string {
+	return fmt.Sprintf("%s has the type %s, want %s", e.Exp, e.Got, e.Want)
+}
+
+// Check checks that the values of the expression are used according to
+// their types, the variables of the environments are ints, the result
+// is an int or a bool
+// natives returns the signature of a function of the host which a call
+// of a name without a definition calls, it may be nil
+// returns a TypeError, a NotAFunctionError, an UndefinedFunctionError or
+// an ArityError, a TypeError as well if the result is a closure or a string
+func Check(exp Exp, natives func(name string) (Signature, bool)) (err error) {
+	// most expressions have no functions, they are checked without
+	// inferring their types
+	if _, ok := plainKind(exp); ok {
+		return nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			rerr, ok := r.(error)
+			if !ok || !isEvalError(rerr) {
+				panic(r)
+			}
+			err = rerr
+		}
+	}()
+	c := checker{natives: natives}
+	t := c.infer(exp)
+	if _, ok := resolve(t).(*funcType); ok || resolve(t) == String {
+		panic(c.typeError(exp, Int, t))
+	}
+	return nil
+}
+
+// a type: a Kind, a *funcType or a *typeVar
+type typ interface{}
+
+// the type of a function or closure
+type funcType struct {
+	params []typ
+	result typ
+}
+
+// a type which is not known yet
+type typeVar struct {
+	ref   typ  // the type it stands for once it is known
+	level int  // the number of enclosing lets and functions at its creation
+	eq    bool // the values are compared, so it is no function
+}
+
+// the level of the type variables of a generalized type, which get new
+// type variables at every use
+const generic = -1
+
+// the types of the variables and functions around an expression,
+// innermost first, like the scope of an evaluation
+type typeScope struct {
+	name  string
+	t     typ
+	fn    bool // true for a function, false for a variable
+	outer *typeScope
+}
+
+// the state of a type check
+type checker struct {
+	natives func(name string) (Signature, bool)
+	scope   *typeScope
+	level   int // the number of enclosing lets and functions
+}
+
+// returns the type of the expression, panics if it is not well typed
+func (c *checker) infer(exp Exp) typ {
+	switch exp := exp.(type) {
+	case IntExp:
+		return Int
+	case BoolExp:
+		return Bool
+	case StringExp:
+		return String
+	case PlusExp, SubExp, MultExp, DivExp, ModExp, NegExp:
+		for _, operand := range operands(exp) {
+			c.expect(operand, Int)
+		}
+		return Int
+	case LtExp, LeExp, GtExp, GeExp:
+		for _, operand := range operands(exp) {
+			c.expect(operand, Int)
+		}
+		return Bool
+	case AndExp, OrExp, NotExp:
+		for _, operand := range operands(exp) {
+			c.expect(operand, Bool)
+		}
+		return Bool
+	case EqExp, NeqExp:
+		// ints or bools of the same kind, functions and strings can not
+		// be compared
+		ops := operands(exp)
+		left := &typeVar{level: c.level, eq: true}
+		c.expect(ops[0], left)
+		c.expect(ops[1], left)
+		return Bool
+	case IfExp:
+		c.expect(exp.Cond, Bool)
+		then := c.infer(exp.Then)
+		c.expect(exp.Else, then)
+		return then
+	case VarExp:
+		if t, ok := c.lookup(exp.Name, false); ok {
+			return c.instantiate(t)
+		}
+		// a variable of the environments
+		return Int
+	case LetExp:
+		c.level++
+		t := c.infer(exp.Value)
+		c.level--
+		c.push(exp.Name, c.generalize(t), false)
+		defer c.pop()
+		return c.infer(exp.Body)
+	case FuncExp:
+		// the function has its own type in its body,
+		// it is generalized for In
+		c.level++
+		f := &funcType{params: c.newVars(len(exp.Params)), result: c.newVar()}
+		c.push(exp.Name, f, true)
+		for i, param := range exp.Params {
+			c.push(param, f.params[i], false)
+		}
+		c.expect(exp.Body, f.result)
+		for range exp.Params {
+			c.pop()
+		}
+		c.pop()
+		c.level--
+		c.push(exp.Name, c.generalize(f), true)
+		defer c.pop()
+		return c.infer(exp.In)
+	case LambdaExp:
+		f := &funcType{params: c.newVars(len(exp.Params))}
+		for i, param := range exp.Params {
+			c.push(param, f.params[i], false)
+		}
+		f.result = c.infer(exp.Body)
+		for range exp.Params {
+			c.pop()
+		}
+		return f
+	case CallExp:
+		if t, ok := c.lookup(exp.Name, true); ok {
+			return c.apply(exp.Name, exp.Name, c.instantiate(t), exp.Args)
+		}
+		if t, ok := c.lookup(exp.Name, false); ok {
+			return c.apply(exp.Name, LambdaName, c.instantiate(t), exp.Args)
+		}
+		if c.natives != nil {
+			if sig, ok := c.natives(exp.Name); ok {
+				return c.callNative(exp.Name, sig, exp.Args)
+			}
+		}
+		panic(UndefinedFunctionError{exp.Name})
+	case AppExp:
+		return c.apply(exp.Fn.Pretty(), LambdaName, c.infer(exp.Fn), exp.Args)
+	}
+	// expressions of other packages evaluate to ints
+	return Int
+}
+
+// checks that the expression has the type want
+func (c *checker) expect(exp Exp, want typ) {
+	if got := c.infer(exp); !c.unify(got, want) {
+		panic(c.typeError(exp, want, got))
+	}
+}
+
+// returns the type of the result of applying the value of fn, which has
+// the type t, to the arguments, name is the name of fn in an ArityError
+func (c *checker) apply(fn, name string, t typ, args []Exp) typ {
+	switch t := resolve(t).(type) {
+	case *funcType:
+		if len(args) != len(t.params) {
+			panic(ArityError{name, len(t.params), len(args)})
+		}
+		for i, arg := range args {
+			c.expect(arg, t.params[i])
+		}
+		return t.result
+	case *typeVar:
+		// a parameter which is applied is a function
+		f := &funcType{params: make([]typ, len(args)), result: c.newVar()}
+		for i, arg := range args {
+			f.params[i] = c.infer(arg)
+		}
+		if !c.unify(t, f) {
+			panic(c.typeError(VarExp{fn}, f, t))
+		}
+		return f.result
+	}
+	panic(NotAFunctionError{fn})
+}
+
+// returns the kind of the result of a call of a function of the host
+func (c *checker) callNative(name string, sig Signature, args []Exp) typ {
+	if !sig.Variadic && len(args) != len(sig.Params) {
+		panic(ArityError{name, len(sig.Params), len(args)})
+	}
+	for i, arg := range args {
+		// too few arguments of a variadic function are left to the host
+		kind := Int
+		if i < len(sig.Params) {
+			kind = sig.Params[i]
+		} else if len(sig.Params) > 0 {
+			kind = sig.Params[len(sig.Params)-1]
+		}
+		c.expect(arg, kind)
+	}
+	return sig.Result
+}
+
+// binds the name to a type in the scope of the following expressions
+func (c *checker) push(name string, t typ, fn bool) {
+	c.scope = &typeScope{name: name, t: t, fn: fn, outer: c.scope}
+}
+
+// removes the innermost binding
+func (c *checker) pop() {
+	c.scope = c.scope.outer
+}
+
+// returns the type of the innermost function or variable of the name
+func (c *checker) lookup(name string, fn bool) (typ, bool) {
+	for sc := c.scope; sc != nil; sc = sc.outer {
+		if sc.fn == fn && sc.name == name {
+			return sc.t, true
+		}
+	}
+	return nil, false
+}
+
+// returns a new type variable
+func (c *checker) newVar() *typeVar {
+	return &typeVar{level: c.level}
+}
+
+// returns n new type variables
+func (c *checker) newVars(n int) []typ {
+	vars := make([]typ, n)
+	for i := range vars {
+		vars[i] = c.newVar()
+	}
+	return vars
+}
+
+// returns the type which a type variable stands for, the type itself
+// if it is no type variable or not known
+func resolve(t typ) typ {
+	for {
+		v, ok := t.(*typeVar)
+		if !ok || v.ref == nil {
+			return t
+		}
+		t = v.ref
+	}
+}
+
+// makes the types equal by binding type variables, returns false if
+// they can not be equal
+func (c *checker) unify(a, b typ) bool {
+	a, b = resolve(a), resolve(b)
+	if a == b {
+		return true
+	}
+	if v, ok := a.(*typeVar); ok {
+		return c.bind(v, b)
+	}
+	if v, ok := b.(*typeVar); ok {
+		return c.bind(v, a)
+	}
+	fa, ok := a.(*funcType)
+	fb, ok2 := b.(*funcType)
+	if !ok || !ok2 || len(fa.params) != len(fb.params) {
+		return false
+	}
+	for i := range fa.params {
+		if !c.unify(fa.params[i], fb.params[i]) {
+			return false
+		}
+	}
+	return c.unify(fa.result, fb.result)
+}
+
+// binds the type variable to the type, returns false if the type
+// contains the variable, a function can not take or return itself,
+// or if values which are compared would be functions or strings
+func (c *checker) bind(v *typeVar, t typ) bool {
+	if occurs(v, v.level, t) {
+		return false
+	}
+	if v.eq {
+		switch t := t.(type) {
+		case *funcType:
+			return false
+		case Kind:
+			if t == String {
+				return false
+			}
+		case *typeVar:
+			t.eq = true
+		}
+	}
+	v.ref = t
+	return true
+}
+
+// returns true if the type contains the type variable, and lowers the
+// level of its other type variables to level, they are then as old as v
+// and not generalized before it
+func occurs(v *typeVar, level int, t typ) bool {
+	switch t := resolve(t).(type) {
+	case *typeVar:
+		if t == v {
+			return true
+		}
+		if t.level > level {
+			t.level = level
+		}
+	case *funcType:
+		for _, param := range t.params {
+			if occurs(v, level, param) {
+				return true
+			}
+		}
+		return occurs(v, level, t.result)
+	}
+	return false
+}
+
+// returns the type in which the type variables which were created inside
+// the current let or function and are still unknown are generic
+func (c *checker) generalize(t typ) typ {
+	switch t := resolve(t).(type) {
+	case *typeVar:
+		if t.level > c.level {
+			t.level = generic
+		}
+		return t
+	case *funcType:
+		f := &funcType{params: make([]typ, len(t.params)), result: c.generalize(t.result)}
+		for i, param := range t.params {
+			f.params[i] = c.generalize(param)
+		}
+		return f
+	}
+	return t
+}
+
+// returns a copy of the type with new type variables for the generic ones
+func (c *checker) instantiate(t typ) typ {
+	vars := map[*typeVar]*typeVar{}
+	var copy func(t typ) typ
+	copy = func(t typ) typ {
+		switch t := resolve(t).(type) {
+		case *typeVar:
+			if t.level != generic {
+				return t
+			}
+			if _, ok := vars[t]; !ok {
+				vars[t] = &typeVar{level: c.level, eq: t.eq}
+			}
+			return vars[t]
+		case *funcType:
+			f := &funcType{params: make([]typ, len(t.params)), result: copy(t.result)}
+			for i, param := range t.params {
+				f.params[i] = copy(param)
+			}
+			return f
+		}
+		return t
+	}
+	return copy(t)
+}
+
+// returns a TypeError for the expression, the type variables of both
+// types are named a, b, … in their order
+func (c *checker) typeError(exp Exp, want, got typ) TypeError {
+	names := map[*typeVar]string{}
+	err := TypeError{Exp: exp.Pretty(), Got: typeName(got, names), Want: typeName(want, names)}
+	if v, ok := resolve(want).(*typeVar); ok && v.eq {
+		err.Want = "int or bool"
+	}
+	return err
+}
+
+// returns the name of a type, e.g. fn(int, a) a
+func typeName(t typ, names map[*typeVar]string) string {
+	switch t := resolve(t).(type) {
+	case *typeVar:
+		if _, ok := names[t]; !ok {
+			if len(names) < 26 {
+				names[t] = string(rune('a' + len(names)))
+			} else {
+				names[t] = "t" + strconv.Itoa(len(names))
+			}
+		}
+		return names[t]
+	case *funcType:
+		params := make([]string, len(t.params))
+		for i, param := range t.params {
+			params[i] = typeName(param, names)
+		}
+		return "fn(" + strings.Join(params, ", ") + ") " + typeName(t.result, names)
+	case Kind:
+		return t.String()
+	}
+	return "?"
+}
+
+// returns the kind of an expression of ints and bools without functions,
+// lambdas and lets of bools, which Check accepts
+// ok is false for other expressions and if the expression mixes up ints
+// and bools, Check then infers the types to report the error
+func plainKind(exp Exp) (kind Kind, ok bool) {
+	switch exp := exp.(type) {
+	case IntExp, VarExp:
+		return Int, true
+	case BoolExp:
+		return Bool, true
+	case PlusExp:
+		return Int, plainKinds(exp.Left, exp.Right, Int)
+	case SubExp:
+		return Int, plainKinds(exp.Left, exp.Right, Int)
+	case MultExp:
+		return Int, plainKinds(exp.Left, exp.Right, Int)
+	case DivExp:
+		return Int, plainKinds(exp.Left, exp.Right, Int)
+	case ModExp:
+		return Int, plainKinds(exp.Left, exp.Right, Int)
+	case NegExp:
+		return Int, hasPlainKind(exp.Exp, Int)
+	case LtExp:
+		return Bool, plainKinds(exp.Left, exp.Right, Int)
+	case LeExp:
+		return Bool, plainKinds(exp.Left, exp.Right, Int)
+	case GtExp:
+		return Bool, plainKinds(exp.Left, exp.Right, Int)
+	case GeExp:
+		return Bool, plainKinds(exp.Left, exp.Right, Int)
+	case EqExp:
+		kind, ok := plainKind(exp.Left)
+		return Bool, ok && hasPlainKind(exp.Right, kind)
+	case NeqExp:
+		kind, ok := plainKind(exp.Left)
+		return Bool, ok && hasPlainKind(exp.Right, kind)
+	case AndExp:
+		return Bool, plainKinds(exp.Left, exp.Right, Bool)
+	case OrExp:
+		return Bool, plainKinds(exp.Left, exp.Right, Bool)
+	case NotExp:
+		return Bool, hasPlainKind(exp.Exp, Bool)
+	case IfExp:
+		if !hasPlainKind(exp.Cond, Bool) {
+			return 0, false
+		}
+		kind, ok := plainKind(exp.Then)
+		return kind, ok && hasPlainKind(exp.Else, kind)
+	case LetExp:
+		// the variable is an int like the variables of the environments
+		if !hasPlainKind(exp.Value, Int) {
+			return 0, false
+		}
+		return plainKind(exp.Body)
+	}
+	return 0, false
+}
+
+// returns true if plainKind accepts the expression and returns the kind
+func hasPlainKind(exp Exp, kind Kind) bool {
+	k, ok := plainKind(exp)
+	return ok && k == kind
+}
+
+// returns true if plainKind accepts both expressions and returns the kind
+func plainKinds(left, right Exp, kind Kind) bool {
+	return hasPlainKind(left, kind) && hasPlainKind(right, kind)
+}
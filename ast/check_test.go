@@ -0,0 +1,62 @@
+package ast
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	a := VarExp{"a"}
+	id := LambdaExp{[]string{"a"}, a}
+	call := func(name string, args ...Exp) Exp { return CallExp{name, args} }
+	natives := func(name string) (Signature, bool) {
+		switch name {
+		case "max":
+			return Signature{Params: []Kind{Int, Int}, Result: Int}, true
+		case "sum":
+			return Signature{Params: []Kind{Int}, Variadic: true, Result: Int}, true
+		case "lookupRate":
+			return Signature{Params: []Kind{String}, Result: Int}, true
+		}
+		return Signature{}, false
+	}
+	tests := []struct {
+		exp  Exp
+		want error
+	}{
+		{PlusExp{VarExp{"x"}, IntExp{1}}, nil},
+		// fn apply(f, a) = f(a) in apply(\a -> a, 1)
+		{FuncExp{"apply", []string{"f", "a"}, call("f", a), call("apply", id, IntExp{1})}, nil},
+		// the function is generic in In, not in its own body
+		{FuncExp{"id", []string{"a"}, a, AppExp{call("id", id), []Exp{call("id", IntExp{1})}}}, nil},
+		{FuncExp{"g", []string{"a"}, PlusExp{a, call("g", id)}, IntExp{1}}, TypeError{"(\\a -> a)", "int", "fn(a) a"}},
+		// a parameter is not generic
+		{AppExp{LambdaExp{[]string{"f"}, AppExp{call("f", id), []Exp{call("f", IntExp{1})}}}, []Exp{id}},
+			TypeError{"1", "fn(a) a", "int"}},
+		{FuncExp{"g", []string{"a"}, a, call("g")}, ArityError{"g", 1, 0}},
+		{AppExp{LambdaExp{[]string{"f"}, call("f")}, []Exp{id}}, TypeError{"(\\a -> a)", "fn() b", "fn(a) a"}},
+		{call("max", IntExp{1}, IntExp{2}), nil},
+		{call("max", IntExp{1}), ArityError{"max", 2, 1}},
+		{call("max", IntExp{1}, id), TypeError{"(\\a -> a)", "int", "fn(a) a"}},
+		{call("sum"), nil},
+		{call("sum", IntExp{1}, IntExp{2}, IntExp{3}), nil},
+		{call("min", IntExp{1}), UndefinedFunctionError{"min"}},
+		{call("lookupRate", StringExp{"EUR"}), nil},
+		// let c = "EUR" in lookupRate(c)
+		{LetExp{"c", StringExp{"EUR"}, call("lookupRate", VarExp{"c"})}, nil},
+		{call("lookupRate", IntExp{1}), TypeError{"1", "string", "int"}},
+		{call("max", StringExp{"a"}, IntExp{1}), TypeError{`"a"`, "int", "string"}},
+		{PlusExp{StringExp{"a"}, IntExp{1}}, TypeError{`"a"`, "int", "string"}},
+		{EqExp{StringExp{"a"}, StringExp{"a"}}, TypeError{`"a"`, "int or bool", "string"}},
+		{StringExp{"a"}, TypeError{`"a"`, "int", "string"}},
+	}
+
+	for _, tt := range tests {
+		if err := Check(tt.exp, natives); !errors.Is(err, tt.want) {
+			t.Errorf("Check(%s) = %v, want %v", tt.exp.Pretty(), err, tt.want)
+		}
+	}
+	if err := Check(call("max", IntExp{1}, IntExp{2}), nil); !errors.Is(err, UndefinedFunctionError{"max"}) {
+		t.Errorf("Check(max(1, 2), nil) = %v, want UndefinedFunctionError", err)
+	}
+}
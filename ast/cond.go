@@ -0,0 +1,275 @@
+package ast
+
+// booleans have their own type: comparisons return bools, the logical
+// operators and the conditions take bools, Check rejects an int in their
+// place, e.g. if 5 then …, and a bool in arithmetic, e.g. true + 1
+// a bool is evaluated to 1 for true and 0 for false
+
+// returns 1 for true and 0 for false
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// define the boolean literal, it evaluates to 1 or 0
+// implicitly implements the Exp interface
+type BoolExp struct {
+	Val bool
+}
+
+// eval function for bool expression
+func (bool_exp BoolExp) Eval(env ...Env) int {
+	return evaluate(bool_exp, env)
+}
+
+// evaluates the bool expression in a scope of the evaluation
+func (bool_exp BoolExp) eval(ev *evaluation, sc *scope) value {
+	return value{n: boolToInt(bool_exp.Val)}
+}
+
+// pretty function for bool expression
+func (bool_exp BoolExp) Pretty() string {
+	if bool_exp.Val {
+		return "true"
+	}
+	return "false"
+}
+
+// define the equal expression
+// implicitly implements the Exp interface
+type EqExp struct {
+	Left  Exp
+	Right Exp
+}
+
+// eval function for equal expression
+// returns 1 if both values are equal, otherwise 0
+func (eq_exp EqExp) Eval(env ...Env) int {
+	return evaluate(eq_exp, env)
+}
+
+// evaluates the equal expression in a scope of the evaluation
+func (eq_exp EqExp) eval(ev *evaluation, sc *scope) value {
+	return value{n: boolToInt(ev.int(eq_exp.Left, sc) == ev.int(eq_exp.Right, sc))}
+}
+
+// pretty function for equal expression
+func (eq_exp EqExp) Pretty() string {
+	return "(" + eq_exp.Left.Pretty() + "==" + eq_exp.Right.Pretty() + ")"
+}
+
+// define the not equal expression
+// implicitly implements the Exp interface
+type NeqExp struct {
+	Left  Exp
+	Right Exp
+}
+
+// eval function for not equal expression
+// returns 1 if the values differ, otherwise 0
+func (neq_exp NeqExp) Eval(env ...Env) int {
+	return evaluate(neq_exp, env)
+}
+
+// evaluates the not equal expression in a scope of the evaluation
+func (neq_exp NeqExp) eval(ev *evaluation, sc *scope) value {
+	return value{n: boolToInt(ev.int(neq_exp.Left, sc) != ev.int(neq_exp.Right, sc))}
+}
+
+// pretty function for not equal expression
+func (neq_exp NeqExp) Pretty() string {
+	return "(" + neq_exp.Left.Pretty() + "!=" + neq_exp.Right.Pretty() + ")"
+}
+
+// define the less than expression
+// implicitly implements the Exp interface
+type LtExp struct {
+	Left  Exp
+	Right Exp
+}
+
+// eval function for less than expression
+func (lt_exp LtExp) Eval(env ...Env) int {
+	return evaluate(lt_exp, env)
+}
+
+// evaluates the less than expression in a scope of the evaluation
+func (lt_exp LtExp) eval(ev *evaluation, sc *scope) value {
+	return value{n: boolToInt(ev.int(lt_exp.Left, sc) < ev.int(lt_exp.Right, sc))}
+}
+
+// pretty function for less than expression
+func (lt_exp LtExp) Pretty() string {
+	return "(" + lt_exp.Left.Pretty() + "<" + lt_exp.Right.Pretty() + ")"
+}
+
+// define the less or equal expression
+// implicitly implements the Exp interface
+type LeExp struct {
+	Left  Exp
+	Right Exp
+}
+
+// eval function for less or equal expression
+func (le_exp LeExp) Eval(env ...Env) int {
+	return evaluate(le_exp, env)
+}
+
+// evaluates the less or equal expression in a scope of the evaluation
+func (le_exp LeExp) eval(ev *evaluation, sc *scope) value {
+	return value{n: boolToInt(ev.int(le_exp.Left, sc) <= ev.int(le_exp.Right, sc))}
+}
+
+// pretty function for less or equal expression
+func (le_exp LeExp) Pretty() string {
+	return "(" + le_exp.Left.Pretty() + "<=" + le_exp.Right.Pretty() + ")"
+}
+
+// define the greater than expression
+// implicitly implements the Exp interface
+type GtExp struct {
+	Left  Exp
+	Right Exp
+}
+
+// eval function for greater than expression
+func (gt_exp GtExp) Eval(env ...Env) int {
+	return evaluate(gt_exp, env)
+}
+
+// evaluates the greater than expression in a scope of the evaluation
+func (gt_exp GtExp) eval(ev *evaluation, sc *scope) value {
+	return value{n: boolToInt(ev.int(gt_exp.Left, sc) > ev.int(gt_exp.Right, sc))}
+}
+
+// pretty function for greater than expression
+func (gt_exp GtExp) Pretty() string {
+	return "(" + gt_exp.Left.Pretty() + ">" + gt_exp.Right.Pretty() + ")"
+}
+
+// define the greater or equal expression
+// implicitly implements the Exp interface
+type GeExp struct {
+	Left  Exp
+	Right Exp
+}
+
+// eval function for greater or equal expression
+func (ge_exp GeExp) Eval(env ...Env) int {
+	return evaluate(ge_exp, env)
+}
+
+// evaluates the greater or equal expression in a scope of the evaluation
+func (ge_exp GeExp) eval(ev *evaluation, sc *scope) value {
+	return value{n: boolToInt(ev.int(ge_exp.Left, sc) >= ev.int(ge_exp.Right, sc))}
+}
+
+// pretty function for greater or equal expression
+func (ge_exp GeExp) Pretty() string {
+	return "(" + ge_exp.Left.Pretty() + ">=" + ge_exp.Right.Pretty() + ")"
+}
+
+// define the logical and expression
+// implicitly implements the Exp interface
+type AndExp struct {
+	Left  Exp
+	Right Exp
+}
+
+// eval function for and expression
+// returns 1 if both values are true, otherwise 0
+// the right expression is only evaluated if the left one is true
+func (and_exp AndExp) Eval(env ...Env) int {
+	return evaluate(and_exp, env)
+}
+
+// evaluates the and expression in a scope of the evaluation
+func (and_exp AndExp) eval(ev *evaluation, sc *scope) value {
+	if ev.int(and_exp.Left, sc) == 0 {
+		return value{n: 0}
+	}
+	return value{n: boolToInt(ev.int(and_exp.Right, sc) != 0)}
+}
+
+// pretty function for and expression
+func (and_exp AndExp) Pretty() string {
+	return "(" + and_exp.Left.Pretty() + "&&" + and_exp.Right.Pretty() + ")"
+}
+
+// define the logical or expression
+// implicitly implements the Exp interface
+type OrExp struct {
+	Left  Exp
+	Right Exp
+}
+
+// eval function for or expression
+// returns 1 if one of the values is true, otherwise 0
+// the right expression is only evaluated if the left one is false
+func (or_exp OrExp) Eval(env ...Env) int {
+	return evaluate(or_exp, env)
+}
+
+// evaluates the or expression in a scope of the evaluation
+func (or_exp OrExp) eval(ev *evaluation, sc *scope) value {
+	if ev.int(or_exp.Left, sc) != 0 {
+		return value{n: 1}
+	}
+	return value{n: boolToInt(ev.int(or_exp.Right, sc) != 0)}
+}
+
+// pretty function for or expression
+func (or_exp OrExp) Pretty() string {
+	return "(" + or_exp.Left.Pretty() + "||" + or_exp.Right.Pretty() + ")"
+}
+
+// define the logical not expression
+// implicitly implements the Exp interface
+type NotExp struct {
+	Exp Exp
+}
+
+// eval function for not expression
+// returns 1 if the value is false, otherwise 0
+func (not_exp NotExp) Eval(env ...Env) int {
+	return evaluate(not_exp, env)
+}
+
+// evaluates the not expression in a scope of the evaluation
+func (not_exp NotExp) eval(ev *evaluation, sc *scope) value {
+	return value{n: boolToInt(ev.int(not_exp.Exp, sc) == 0)}
+}
+
+// pretty function for not expression
+func (not_exp NotExp) Pretty() string {
+	return "(!" + not_exp.Exp.Pretty() + ")"
+}
+
+// define the conditional expression
+// implicitly implements the Exp interface
+type IfExp struct {
+	Cond Exp
+	Then Exp
+	Else Exp
+}
+
+// eval function for if expression
+// only the branch which is chosen by the condition is evaluated
+func (if_exp IfExp) Eval(env ...Env) int {
+	return evaluate(if_exp, env)
+}
+
+// evaluates the if expression in a scope of the evaluation
+func (if_exp IfExp) eval(ev *evaluation, sc *scope) value {
+	if ev.int(if_exp.Cond, sc) != 0 {
+		return ev.eval(if_exp.Then, sc)
+	}
+	return ev.eval(if_exp.Else, sc)
+}
+
+// pretty function for if expression
+func (if_exp IfExp) Pretty() string {
+	return "(if " + if_exp.Cond.Pretty() + " then " + if_exp.Then.Pretty() + " else " + if_exp.Else.Pretty() + ")"
+}
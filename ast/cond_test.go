@@ -0,0 +1,88 @@
+package ast
+
+import "testing"
+
+func TestConditionals(t *testing.T) {
+	x, y := VarExp{"x"}, VarExp{"y"}
+	env := Env{"x": 3, "y": 5}
+	tests := []struct {
+		exp    Exp
+		want   int
+		pretty string
+	}{
+		{BoolExp{true}, 1, "true"},
+		{BoolExp{false}, 0, "false"},
+		{EqExp{x, IntExp{3}}, 1, "(x==3)"},
+		{NeqExp{x, IntExp{3}}, 0, "(x!=3)"},
+		{LtExp{x, y}, 1, "(x<y)"},
+		{LeExp{y, y}, 1, "(y<=y)"},
+		{GtExp{x, y}, 0, "(x>y)"},
+		{GeExp{x, y}, 0, "(x>=y)"},
+		{AndExp{LtExp{x, y}, GtExp{y, IntExp{4}}}, 1, "((x<y)&&(y>4))"},
+		{OrExp{GtExp{x, y}, BoolExp{false}}, 0, "((x>y)||false)"},
+		{NotExp{EqExp{x, y}}, 1, "(!(x==y))"},
+		{IfExp{GtExp{x, IntExp{2}}, MultExp{x, IntExp{10}}, IntExp{0}}, 30, "(if (x>2) then (x*10) else 0)"},
+		{IfExp{BoolExp{false}, IntExp{1}, IntExp{2}}, 2, "(if false then 1 else 2)"},
+		{EqExp{LtExp{x, y}, BoolExp{true}}, 1, "((x<y)==true)"},
+		{IfExp{NeqExp{x, IntExp{3}}, BoolExp{false}, LtExp{x, y}}, 1, "(if (x!=3) then false else (x<y))"},
+		// a discount with a threshold
+		{SubExp{y, IfExp{GeExp{y, IntExp{5}}, IntExp{1}, IntExp{0}}}, 4, "(y-(if (y>=5) then 1 else 0))"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.exp.Pretty(); got != tt.pretty {
+			t.Errorf("Pretty() = %q, want %q", got, tt.pretty)
+		}
+		if got := tt.exp.Eval(env); got != tt.want {
+			t.Errorf("%s.Eval(env) = %d, want %d", tt.pretty, got, tt.want)
+		}
+	}
+}
+
+func TestShortCircuit(t *testing.T) {
+	// the unbound variable and the division by zero are never evaluated
+	unbound, zero := EqExp{VarExp{"unbound"}, IntExp{0}}, EqExp{DivExp{IntExp{1}, IntExp{0}}, IntExp{0}}
+	tests := []Exp{
+		AndExp{BoolExp{false}, unbound},
+		OrExp{BoolExp{true}, zero},
+		IfExp{BoolExp{true}, BoolExp{true}, unbound},
+		IfExp{BoolExp{false}, zero, BoolExp{true}},
+	}
+	for _, exp := range tests {
+		if _, err := Evaluate(exp); err != nil {
+			t.Errorf("Evaluate(%s) returned error: %v", exp.Pretty(), err)
+		}
+	}
+	// the left operand is still evaluated first
+	if _, err := Evaluate(AndExp{unbound, zero}); err != (UnboundVariableError{"unbound"}) {
+		t.Errorf("Evaluate error = %v, want unbound variable", err)
+	}
+}
+
+func TestConditionTypes(t *testing.T) {
+	x := VarExp{"x"}
+	lt := LtExp{x, IntExp{1}}
+	tests := []struct {
+		exp  Exp
+		want error
+	}{
+		{PlusExp{BoolExp{true}, IntExp{1}}, TypeError{"true", "int", "bool"}},
+		{IfExp{IntExp{5}, IntExp{1}, IntExp{2}}, TypeError{"5", "bool", "int"}},
+		{AndExp{x, lt}, TypeError{"x", "bool", "int"}},
+		{NotExp{IntExp{7}}, TypeError{"7", "bool", "int"}},
+		{LtExp{lt, IntExp{1}}, TypeError{"(x<1)", "int", "bool"}},
+		{EqExp{lt, IntExp{1}}, TypeError{"1", "bool", "int"}},
+		{IfExp{lt, IntExp{1}, BoolExp{false}}, TypeError{"false", "int", "bool"}},
+		// functions can not be compared
+		{EqExp{LambdaExp{nil, x}, LambdaExp{nil, x}}, TypeError{"(\\ -> x)", "int or bool", "fn() int"}},
+		// fn eq(a, b) = a == b in eq(\ -> 1, \ -> 1)
+		{FuncExp{"eq", []string{"a", "b"}, EqExp{VarExp{"a"}, VarExp{"b"}},
+			CallExp{"eq", []Exp{LambdaExp{nil, IntExp{1}}, LambdaExp{nil, IntExp{1}}}}}, TypeError{"(\\ -> 1)", "int or bool", "fn() int"}},
+	}
+
+	for _, tt := range tests {
+		if _, err := Evaluate(tt.exp, Env{"x": 1}); err != tt.want {
+			t.Errorf("Evaluate(%s) error = %v, want %v", tt.exp.Pretty(), err, tt.want)
+		}
+	}
+}
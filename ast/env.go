@@ -0,0 +1,201 @@
+package ast
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Env maps the names of variables to their values
+type Env map[string]int
+
+// UnboundVariableError is the value of the panic raised when a variable
+// is evaluated which is not bound by any environment
+type UnboundVariableError struct {
+	Name string // name of the variable
+}
+
+func (e UnboundVariableError) Error() string {
+	return fmt.Sprintf("unbound variable %q", e.Name)
+}
+
+// returns the value of the variable in the first environment which binds it
+func lookup(name string, envs []Env) (int, bool) {
+	for _, env := range envs {
+		if val, ok := env[name]; ok {
+			return val, true
+		}
+	}
+	return 0, false
+}
+
+// Evaluate evaluates the expression like Eval, but returns the errors
+// Eval panics with, ErrDivisionByZero, ErrCallDepth, an UnboundVariableError,
+// and the errors of Check, as an error instead
+func Evaluate(exp Exp, env ...Env) (int, error) {
+	return Evaluator{}.Evaluate(exp, env...)
+}
+
+// Evaluator evaluates expressions with other limits than Eval,
+// the zero value has the limits of Eval
+type Evaluator struct {
+	// maximum number of nested calls of functions and lambdas,
+	// DefaultMaxCallDepth if zero
+	MaxCallDepth int
+}
+
+// Evaluate evaluates the expression like the function Evaluate
+// with the limits of the evaluator
+func (e Evaluator) Evaluate(exp Exp, env ...Env) (val int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			rerr, ok := r.(error)
+			if !ok || !isEvalError(rerr) {
+				panic(r)
+			}
+			err = rerr
+		}
+	}()
+	return e.eval(exp, env), nil
+}
+
+// the evaluations of the finished runs, a pool is safe for concurrent
+// use and avoids allocating an evaluation per call of Eval
+var evaluations = sync.Pool{
+	New: func() any { return new(evaluation) },
+}
+
+// checks the expression and evaluates it in a new evaluation,
+// panics like Eval
+func (e Evaluator) eval(exp Exp, env []Env) int {
+	if err := Check(exp, nil); err != nil {
+		panic(err)
+	}
+	ev := evaluations.Get().(*evaluation)
+	*ev = evaluation{env: env, maxDepth: e.MaxCallDepth}
+	if ev.maxDepth <= 0 {
+		ev.maxDepth = DefaultMaxCallDepth
+	}
+	// the result of a checked expression is an int, an evaluation which
+	// panics is not reused
+	val := ev.eval(exp, nil).n
+	*ev = evaluation{}
+	evaluations.Put(ev)
+	return val
+}
+
+// evaluates the expression with the limits of Eval, the Eval methods
+// of the expressions start a new evaluation with it
+func evaluate(exp Exp, env []Env) int {
+	return Evaluator{}.eval(exp, env)
+}
+
+// the state of an evaluation, which all of its expressions share
+type evaluation struct {
+	env      []Env // the environments of the variables of the host
+	maxDepth int   // maximum number of nested calls
+	depth    int   // number of active calls of functions and lambdas
+}
+
+// the value of an expression while it is evaluated: an int or a closure
+type value struct {
+	n  int
+	fn *closure // the closure, nil for an int
+}
+
+// the lets, parameters and function definitions around an expression,
+// innermost first, a scope is never changed, so closures and functions
+// can keep the scope of their definition
+type scope struct {
+	name  string
+	val   value     // value of a variable
+	fn    *function // function of a definition, nil for a variable
+	outer *scope
+}
+
+// an expression of this package, which is evaluated in a scope
+// of an evaluation
+type evaluable interface {
+	eval(ev *evaluation, sc *scope) value
+}
+
+// evaluates an operand in the scope
+// expressions of other packages only see the variables which are ints
+func (ev *evaluation) eval(exp Exp, sc *scope) value {
+	if exp, ok := exp.(evaluable); ok {
+		return exp.eval(ev, sc)
+	}
+	return value{n: exp.Eval(append([]Env{sc.vars()}, ev.env...)...)}
+}
+
+// evaluates an operand which Check has found to be an int
+func (ev *evaluation) int(exp Exp, sc *scope) int {
+	return ev.eval(exp, sc).n
+}
+
+// returns the value of the innermost let or parameter of the name,
+// otherwise the value of the variable of the host
+func (ev *evaluation) variable(name string, sc *scope) (value, bool) {
+	if val, ok := sc.variable(name); ok {
+		return val, true
+	}
+	val, ok := lookup(name, ev.env)
+	return value{n: val}, ok
+}
+
+// returns the value of the innermost let or parameter of the name
+func (sc *scope) variable(name string) (value, bool) {
+	for ; sc != nil; sc = sc.outer {
+		if sc.fn == nil && sc.name == name {
+			return sc.val, true
+		}
+	}
+	return value{}, false
+}
+
+// returns the innermost function of the name, nil if there is none
+func (sc *scope) function(name string) *function {
+	for ; sc != nil; sc = sc.outer {
+		if sc.fn != nil && sc.name == name {
+			return sc.fn
+		}
+	}
+	return nil
+}
+
+// returns the variables of the scope, the innermost one of every name
+func (sc *scope) vars() Env {
+	env := Env{}
+	for ; sc != nil; sc = sc.outer {
+		if _, ok := env[sc.name]; !ok && sc.fn == nil {
+			env[sc.name] = sc.val.n
+		}
+	}
+	return env
+}
+
+// counts a call, panics with ErrCallDepth if there are too many
+// nested calls, leave must be called when the call returns
+func (ev *evaluation) enter() {
+	if ev.depth == ev.maxDepth {
+		panic(ErrCallDepth)
+	}
+	ev.depth++
+}
+
+// ends a call which was counted by enter
+func (ev *evaluation) leave() {
+	ev.depth--
+}
+
+// returns true if err is one of the errors Eval panics with
+func isEvalError(err error) bool {
+	var unbound UnboundVariableError
+	var undefined UndefinedFunctionError
+	var arity ArityError
+	var notFunc NotAFunctionError
+	var typeErr TypeError
+	return errors.Is(err, ErrDivisionByZero) || errors.Is(err, ErrCallDepth) ||
+		errors.As(err, &unbound) || errors.As(err, &undefined) || errors.As(err, &arity) ||
+		errors.As(err, &notFunc) || errors.As(err, &typeErr)
+}
@@ -0,0 +1,161 @@
+package ast
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// functions and variables have separate names: a call looks up the
+// innermost function definition of its name, a variable never refers
+// to a function, a call of a name without a definition applies the
+// closure in the variable of the name, see LambdaExp
+
+// DefaultMaxCallDepth is the maximum number of nested calls of functions
+// and lambdas while an expression is evaluated, unless an Evaluator sets
+// another one
+const DefaultMaxCallDepth = 10000
+
+// ErrCallDepth is the value of the panic raised when more calls of
+// functions and lambdas are nested than the maximum call depth
+var ErrCallDepth = errors.New("maximum call depth exceeded")
+
+// UndefinedFunctionError is the value of the panic raised when a function
+// is called which is not defined by any enclosing function definition
+type UndefinedFunctionError struct {
+	Name string // name of the function
+}
+
+func (e UndefinedFunctionError) Error() string {
+	return fmt.Sprintf("undefined function %q", e.Name)
+}
+
+// ArityError is the value of the panic raised when a function is called
+// with the wrong number of arguments
+type ArityError struct {
+	Name string // name of the function
+	Want int    // number of parameters of the function
+	Got  int    // number of arguments of the call
+}
+
+func (e ArityError) Error() string {
+	return fmt.Sprintf("function %q expects %d arguments, got %d", e.Name, e.Want, e.Got)
+}
+
+// define the function definition, the function can be called in its
+// own body and in In, e.g. fn f(n) = n * 2 in f(3)
+// the body sees the parameters and the variables of the definition,
+// including the enclosing lets and parameters, not the ones of the caller
+// implicitly implements the Exp interface
+type FuncExp struct {
+	Name   string
+	Params []string
+	Body   Exp
+	In     Exp
+}
+
+// eval function for function definition
+// returns the value of In
+func (func_exp FuncExp) Eval(env ...Env) int {
+	return evaluate(func_exp, env)
+}
+
+// evaluates the function definition in a scope of the evaluation
+// the function is bound once, In and the body of the function see it
+func (func_exp FuncExp) eval(ev *evaluation, sc *scope) value {
+	f := &function{def: func_exp}
+	f.scope = &scope{name: func_exp.Name, fn: f, outer: sc}
+	return ev.eval(func_exp.In, f.scope)
+}
+
+// pretty function for function definition
+func (func_exp FuncExp) Pretty() string {
+	return "(fn " + func_exp.Name + "(" + strings.Join(func_exp.Params, ", ") + ") = " +
+		func_exp.Body.Pretty() + " in " + func_exp.In.Pretty() + ")"
+}
+
+// define the call of a function by its name
+// implicitly implements the Exp interface
+type CallExp struct {
+	Name string
+	Args []Exp
+}
+
+// eval function for call expression
+// calls the innermost function of the name, if there is none it applies
+// the closure in the let or parameter of the name, if there is none
+// either it panics with an UndefinedFunctionError, the variables of the
+// host are ints and can not be called
+func (call_exp CallExp) Eval(env ...Env) int {
+	return evaluate(call_exp, env)
+}
+
+// evaluates the call expression in a scope of the evaluation
+func (call_exp CallExp) eval(ev *evaluation, sc *scope) value {
+	if f := sc.function(call_exp.Name); f != nil {
+		return ev.call(f, call_exp.Args, sc)
+	}
+	fn, ok := sc.variable(call_exp.Name)
+	if !ok {
+		panic(UndefinedFunctionError{call_exp.Name})
+	}
+	return ev.apply(call_exp.Name, fn, call_exp.Args, sc)
+}
+
+// pretty function for call expression
+func (call_exp CallExp) Pretty() string {
+	args := make([]string, len(call_exp.Args))
+	for i, arg := range call_exp.Args {
+		args[i] = arg.Pretty()
+	}
+	return call_exp.Name + "(" + strings.Join(args, ", ") + ")"
+}
+
+// define the string literal, e.g. the "EUR" of lookupRate("EUR")
+// strings can only be passed to the functions of the host, Check rejects
+// them in arithmetic, comparisons and conditions and as the result,
+// e.g. "a" + 1 or "a" == "b"
+// implicitly implements the Exp interface
+type StringExp struct {
+	Val string
+}
+
+// eval function for string expression
+// Eval calls no functions of the host, so the value is never used
+func (string_exp StringExp) Eval(env ...Env) int {
+	return evaluate(string_exp, env)
+}
+
+// evaluates the string expression in a scope of the evaluation
+func (string_exp StringExp) eval(ev *evaluation, sc *scope) value {
+	return value{}
+}
+
+// pretty function for string expression
+func (string_exp StringExp) Pretty() string {
+	return strconv.Quote(string_exp.Val)
+}
+
+// a function while its definition is evaluated
+type function struct {
+	def   FuncExp
+	scope *scope // scope of the definition, which binds the function itself
+}
+
+// calls the function, the arguments are evaluated in the scope of the
+// caller, the body with the parameters in the scope of the definition
+func (ev *evaluation) call(f *function, args []Exp, sc *scope) value {
+	def := f.def
+	if len(args) != len(def.Params) {
+		panic(ArityError{def.Name, len(def.Params), len(args)})
+	}
+	body := f.scope
+	for i, arg := range args {
+		body = &scope{name: def.Params[i], val: ev.eval(arg, sc), outer: body}
+	}
+	ev.enter()
+	val := ev.eval(def.Body, body)
+	ev.leave()
+	return val
+}
@@ -0,0 +1,115 @@
+package ast
+
+import (
+	"errors"
+	"testing"
+)
+
+// fn fib(n) = if n < 2 then n else fib(n-1) + fib(n-2) in fib(x)
+func fibExp(arg Exp) Exp {
+	n := VarExp{"n"}
+	return FuncExp{
+		Name:   "fib",
+		Params: []string{"n"},
+		Body: IfExp{
+			LtExp{n, IntExp{2}},
+			n,
+			PlusExp{CallExp{"fib", []Exp{SubExp{n, IntExp{1}}}}, CallExp{"fib", []Exp{SubExp{n, IntExp{2}}}}},
+		},
+		In: CallExp{"fib", []Exp{arg}},
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	x, y, a := VarExp{"x"}, VarExp{"y"}, VarExp{"a"}
+	env := Env{"x": 10, "y": 2}
+	tests := []struct {
+		exp    Exp
+		want   int
+		pretty string
+	}{
+		{FuncExp{"double", []string{"a"}, MultExp{a, IntExp{2}}, CallExp{"double", []Exp{x}}}, 20,
+			"(fn double(a) = (a*2) in double(x))"},
+		{FuncExp{"sub", []string{"a", "b"}, SubExp{a, VarExp{"b"}}, CallExp{"sub", []Exp{x, y}}}, 8,
+			"(fn sub(a, b) = (a-b) in sub(x, y))"},
+		{FuncExp{"one", nil, IntExp{1}, PlusExp{CallExp{"one", nil}, CallExp{"one", nil}}}, 2,
+			"(fn one() = 1 in (one()+one()))"},
+		{fibExp(x), 55, "(fn fib(n) = (if (n<2) then n else (fib((n-1))+fib((n-2)))) in fib(x))"},
+		// the body sees the variables of the definition, not of the caller
+		{FuncExp{"addY", []string{"a"}, PlusExp{a, y}, LetExp{"y", IntExp{100}, CallExp{"addY", []Exp{y}}}}, 102,
+			"(fn addY(a) = (a+y) in (let y = 100 in addY(y)))"},
+		{LetExp{"y", IntExp{5}, FuncExp{"addY", []string{"a"}, PlusExp{a, y}, CallExp{"addY", []Exp{IntExp{1}}}}}, 6,
+			"(let y = 5 in (fn addY(a) = (a+y) in addY(1)))"},
+		// an inner definition hides the outer function in its body and in
+		{FuncExp{"f", []string{"a"}, IntExp{1}, FuncExp{"f", []string{"a"}, PlusExp{a, IntExp{1}}, CallExp{"f", []Exp{IntExp{5}}}}}, 6,
+			"(fn f(a) = 1 in (fn f(a) = (a+1) in f(5)))"},
+		// a function can call the functions defined around it
+		{FuncExp{"inc", []string{"a"}, PlusExp{a, IntExp{1}},
+			FuncExp{"twice", []string{"a"}, CallExp{"inc", []Exp{CallExp{"inc", []Exp{a}}}}, CallExp{"twice", []Exp{x}}}}, 12,
+			"(fn inc(a) = (a+1) in (fn twice(a) = inc(inc(a)) in twice(x)))"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.exp.Pretty(); got != tt.pretty {
+			t.Errorf("Pretty() = %q, want %q", got, tt.pretty)
+		}
+		if got, err := Evaluate(tt.exp, env); err != nil || got != tt.want {
+			t.Errorf("Evaluate(%s) = %d, %v, want %d", tt.pretty, got, err, tt.want)
+		}
+	}
+}
+
+func TestFunctionErrors(t *testing.T) {
+	a := VarExp{"a"}
+	// fn loop(a) = loop(a + 1) in loop(0)
+	loop := FuncExp{"loop", []string{"a"}, CallExp{"loop", []Exp{PlusExp{a, IntExp{1}}}}, CallExp{"loop", []Exp{IntExp{0}}}}
+	tests := []struct {
+		exp  Exp
+		want error
+	}{
+		{CallExp{"f", nil}, UndefinedFunctionError{"f"}},
+		{FuncExp{"f", []string{"a"}, a, CallExp{"f", nil}}, ArityError{"f", 1, 0}},
+		// the body can not see the variables of the caller
+		{FuncExp{"f", nil, a, LetExp{"a", IntExp{1}, CallExp{"f", nil}}}, UnboundVariableError{"a"}},
+		{FuncExp{"f", []string{"a"}, DivExp{IntExp{1}, a}, CallExp{"f", []Exp{IntExp{0}}}}, ErrDivisionByZero},
+		{loop, ErrCallDepth},
+	}
+
+	for _, tt := range tests {
+		if _, err := Evaluate(tt.exp); !errors.Is(err, tt.want) {
+			t.Errorf("Evaluate(%s) error = %v, want %v", tt.exp.Pretty(), err, tt.want)
+		}
+	}
+	if got := (ArityError{"f", 1, 0}).Error(); got != `function "f" expects 1 arguments, got 0` {
+		t.Errorf("Error() = %q", got)
+	}
+}
+
+func TestEvaluatorMaxCallDepth(t *testing.T) {
+	// fn down(n) = if n == 0 then 0 else down(n - 1) in down(x)
+	n := VarExp{"n"}
+	down := FuncExp{"down", []string{"n"},
+		IfExp{EqExp{n, IntExp{0}}, IntExp{0}, CallExp{"down", []Exp{SubExp{n, IntExp{1}}}}},
+		CallExp{"down", []Exp{VarExp{"x"}}}}
+
+	// down(9) nests 10 calls
+	e := Evaluator{MaxCallDepth: 10}
+	if got, err := e.Evaluate(down, Env{"x": 9}); err != nil || got != 0 {
+		t.Errorf("Evaluate(down(9)) = %d, %v, want 0", got, err)
+	}
+	if _, err := e.Evaluate(down, Env{"x": 10}); !errors.Is(err, ErrCallDepth) {
+		t.Errorf("Evaluate(down(10)) error = %v, want ErrCallDepth", err)
+	}
+	// the calls of lambdas count as well
+	apply := LetExp{"f", LambdaExp{[]string{"a"}, CallExp{"down", []Exp{VarExp{"a"}}}}, CallExp{"f", []Exp{IntExp{9}}}}
+	if _, err := e.Evaluate(FuncExp{down.Name, down.Params, down.Body, apply}); !errors.Is(err, ErrCallDepth) {
+		t.Errorf("Evaluate(f(9)) error = %v, want ErrCallDepth", err)
+	}
+	// the zero value uses the default
+	if got, err := (Evaluator{}).Evaluate(down, Env{"x": DefaultMaxCallDepth - 1}); err != nil || got != 0 {
+		t.Errorf("Evaluate(down(%d)) = %d, %v, want 0", DefaultMaxCallDepth-1, got, err)
+	}
+	if _, err := Evaluate(down, Env{"x": DefaultMaxCallDepth}); !errors.Is(err, ErrCallDepth) {
+		t.Errorf("Evaluate(down(%d)) error = %v, want ErrCallDepth", DefaultMaxCallDepth, err)
+	}
+}
@@ -0,0 +1,210 @@
+package ast
+
+import (
+	"fmt"
+	"strings"
+)
+
+// the value of a lambda is a closure: the lambda together with the
+// scope of its definition, a value is either an int or a closure,
+// Check makes sure that closures are only applied and ints are not,
+// and that the result of an expression is an int
+//
+// a call f(x) of a name which no enclosing function definition binds
+// applies the closure in the let or parameter f, so lambdas can be passed
+// to functions and called like them, e.g.
+// fn twice(f, x) = f(f(x)) in twice(\x -> x * 3, 1)
+
+// LambdaName is the name of a lambda in errors, e.g. of an ArityError
+const LambdaName = "lambda"
+
+// NotAFunctionError is the value of the panic raised when a value is
+// applied which is not a closure
+type NotAFunctionError struct {
+	Exp string // the applied expression
+}
+
+func (e NotAFunctionError) Error() string {
+	return fmt.Sprintf("%s is not a function", e.Exp)
+}
+
+// define the lambda expression, an anonymous function, \x y -> x + y
+// the body sees the parameters and the variables of the definition
+// implicitly implements the Exp interface
+type LambdaExp struct {
+	Params []string
+	Body   Exp
+}
+
+// eval function for lambda expression
+// a lambda can not be the result of an expression, it has to be applied,
+// the body is evaluated when the closure is applied
+func (lambda_exp LambdaExp) Eval(env ...Env) int {
+	return evaluate(lambda_exp, env)
+}
+
+// evaluates the lambda expression in a scope of the evaluation
+func (lambda_exp LambdaExp) eval(ev *evaluation, sc *scope) value {
+	return value{fn: &closure{lambda_exp, sc}}
+}
+
+// pretty function for lambda expression
+func (lambda_exp LambdaExp) Pretty() string {
+	return "(\\" + strings.Join(lambda_exp.Params, " ") + " -> " + lambda_exp.Body.Pretty() + ")"
+}
+
+// define the application of the closure which is the value of Fn,
+// e.g. (\x -> x + 1)(2) or make(1)(2)
+// implicitly implements the Exp interface
+type AppExp struct {
+	Fn   Exp
+	Args []Exp
+}
+
+// eval function for application
+// the function is evaluated before the arguments
+func (app_exp AppExp) Eval(env ...Env) int {
+	return evaluate(app_exp, env)
+}
+
+// evaluates the application in a scope of the evaluation
+func (app_exp AppExp) eval(ev *evaluation, sc *scope) value {
+	return ev.apply(app_exp.Fn.Pretty(), ev.eval(app_exp.Fn, sc), app_exp.Args, sc)
+}
+
+// pretty function for application
+func (app_exp AppExp) Pretty() string {
+	args := make([]string, len(app_exp.Args))
+	for i, arg := range app_exp.Args {
+		args[i] = arg.Pretty()
+	}
+	return app_exp.Fn.Pretty() + "(" + strings.Join(args, ", ") + ")"
+}
+
+// a lambda with the scope of its definition
+type closure struct {
+	def   LambdaExp
+	scope *scope
+}
+
+// applies the closure fn, the value of the expression callee, to the
+// arguments, which are evaluated in the scope of the application,
+// the body is evaluated with the parameters in the scope of the
+// definition of the lambda
+func (ev *evaluation) apply(callee string, fn value, args []Exp, sc *scope) value {
+	c := fn.fn
+	if c == nil {
+		panic(NotAFunctionError{callee})
+	}
+	vals := make([]value, len(args))
+	for i, arg := range args {
+		vals[i] = ev.eval(arg, sc)
+	}
+	if len(vals) != len(c.def.Params) {
+		panic(ArityError{LambdaName, len(c.def.Params), len(vals)})
+	}
+	body := c.scope
+	for i, val := range vals {
+		body = &scope{name: c.def.Params[i], val: val, outer: body}
+	}
+	ev.enter()
+	val := ev.eval(c.def.Body, body)
+	ev.leave()
+	return val
+}
+
+// FreeVars returns the names of the variables which exp uses without
+// binding them, in the order of their first use
+// a call of a name which exp does not define as a function counts as
+// a use of the variable, as it may apply the closure in it
+func FreeVars(exp Exp) []string {
+	var names []string
+	seen := map[string]bool{}
+	var walk func(exp Exp, bound, funcs []string)
+	walk = func(exp Exp, bound, funcs []string) {
+		use := func(name string) {
+			if !contains(bound, name) && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		switch exp := exp.(type) {
+		case VarExp:
+			use(exp.Name)
+		case LetExp:
+			walk(exp.Value, bound, funcs)
+			walk(exp.Body, append(bound[:len(bound):len(bound)], exp.Name), funcs)
+		case FuncExp:
+			funcs = append(funcs[:len(funcs):len(funcs)], exp.Name)
+			walk(exp.Body, append(bound[:len(bound):len(bound)], exp.Params...), funcs)
+			walk(exp.In, bound, funcs)
+		case LambdaExp:
+			walk(exp.Body, append(bound[:len(bound):len(bound)], exp.Params...), funcs)
+		case CallExp:
+			if !contains(funcs, exp.Name) {
+				use(exp.Name)
+			}
+			for _, arg := range exp.Args {
+				walk(arg, bound, funcs)
+			}
+		default:
+			for _, operand := range operands(exp) {
+				walk(operand, bound, funcs)
+			}
+		}
+	}
+	walk(exp, nil, nil)
+	return names
+}
+
+// returns true if names contains name
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the operands of an expression which binds no names,
+// nil for literals, variables and expressions of other packages
+func operands(exp Exp) []Exp {
+	switch exp := exp.(type) {
+	case PlusExp:
+		return []Exp{exp.Left, exp.Right}
+	case SubExp:
+		return []Exp{exp.Left, exp.Right}
+	case MultExp:
+		return []Exp{exp.Left, exp.Right}
+	case DivExp:
+		return []Exp{exp.Left, exp.Right}
+	case ModExp:
+		return []Exp{exp.Left, exp.Right}
+	case NegExp:
+		return []Exp{exp.Exp}
+	case EqExp:
+		return []Exp{exp.Left, exp.Right}
+	case NeqExp:
+		return []Exp{exp.Left, exp.Right}
+	case LtExp:
+		return []Exp{exp.Left, exp.Right}
+	case LeExp:
+		return []Exp{exp.Left, exp.Right}
+	case GtExp:
+		return []Exp{exp.Left, exp.Right}
+	case GeExp:
+		return []Exp{exp.Left, exp.Right}
+	case AndExp:
+		return []Exp{exp.Left, exp.Right}
+	case OrExp:
+		return []Exp{exp.Left, exp.Right}
+	case NotExp:
+		return []Exp{exp.Exp}
+	case IfExp:
+		return []Exp{exp.Cond, exp.Then, exp.Else}
+	case AppExp:
+		return append([]Exp{exp.Fn}, exp.Args...)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package ast
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestLambdas(t *testing.T) {
+	x, y, a, f := VarExp{"x"}, VarExp{"y"}, VarExp{"a"}, VarExp{"f"}
+	env := Env{"x": 10, "y": 2}
+	inc := LambdaExp{[]string{"a"}, PlusExp{a, IntExp{1}}}
+	call := func(name string, args ...Exp) Exp { return CallExp{name, args} }
+	tests := []struct {
+		exp    Exp
+		want   int
+		pretty string
+	}{
+		{AppExp{inc, []Exp{x}}, 11, "(\\a -> (a+1))(x)"},
+		{LetExp{"f", inc, call("f", call("f", x))}, 12, "(let f = (\\a -> (a+1)) in f(f(x)))"},
+		{AppExp{LambdaExp{nil, IntExp{7}}, nil}, 7, "(\\ -> 7)()"},
+		{AppExp{LambdaExp{[]string{"a", "b"}, SubExp{a, VarExp{"b"}}}, []Exp{x, y}}, 8, "(\\a b -> (a-b))(x, y)"},
+		// the lambda captures y of the let, not the one of the application
+		{LetExp{"y", IntExp{5}, LetExp{"f", LambdaExp{[]string{"a"}, PlusExp{a, y}}, LetExp{"y", IntExp{100}, call("f", y)}}}, 105,
+			"(let y = 5 in (let f = (\\a -> (a+y)) in (let y = 100 in f(y))))"},
+		// a closure returned by a function keeps the parameter
+		{FuncExp{"adder", []string{"n"}, LambdaExp{[]string{"a"}, PlusExp{a, VarExp{"n"}}},
+			LetExp{"add3", call("adder", IntExp{3}), call("add3", x)}}, 13,
+			"(fn adder(n) = (\\a -> (a+n)) in (let add3 = adder(3) in add3(x)))"},
+		{AppExp{AppExp{LambdaExp{[]string{"a"}, LambdaExp{[]string{"b"}, MultExp{a, VarExp{"b"}}}}, []Exp{x}}, []Exp{y}}, 20,
+			"(\\a -> (\\b -> (a*b)))(x)(y)"},
+		// a closure passed to a function
+		{FuncExp{"twice", []string{"f", "a"}, call("f", call("f", a)), call("twice", LambdaExp{[]string{"a"}, MultExp{a, IntExp{3}}}, x)}, 90,
+			"(fn twice(f, a) = f(f(a)) in twice((\\a -> (a*3)), x))"},
+		{AppExp{IfExp{GtExp{x, IntExp{5}}, inc, LambdaExp{[]string{"a"}, a}}, []Exp{y}}, 3,
+			"(if (x>5) then (\\a -> (a+1)) else (\\a -> a))(y)"},
+		// a function hides the variable of the same name
+		{LetExp{"f", inc, FuncExp{"f", []string{"a"}, NegExp{a}, call("f", x)}}, -10,
+			"(let f = (\\a -> (a+1)) in (fn f(a) = (-a) in f(x)))"},
+		// a closure bound by a let is used with arguments of different types
+		{LetExp{"id", LambdaExp{[]string{"a"}, a}, AppExp{call("id", inc), []Exp{call("id", x)}}}, 11,
+			"(let id = (\\a -> a) in id((\\a -> (a+1)))(id(x)))"},
+		{foldExp(f), 55, "(fn fold(f, acc, n) = (if (n==0) then acc else fold(f, f(acc, n), (n-1))) in fold((\\acc n -> (acc+n)), 0, x))"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.exp.Pretty(); got != tt.pretty {
+			t.Errorf("Pretty() = %q, want %q", got, tt.pretty)
+		}
+		if got, err := Evaluate(tt.exp, env); err != nil || got != tt.want {
+			t.Errorf("Evaluate(%s) = %d, %v, want %d", tt.pretty, got, err, tt.want)
+		}
+	}
+}
+
+// fn fold(f, acc, n) = if n == 0 then acc else fold(f, f(acc, n), n - 1)
+// in fold(\acc n -> acc + n, 0, x)
+func foldExp(f Exp) Exp {
+	acc, n := VarExp{"acc"}, VarExp{"n"}
+	return FuncExp{
+		Name:   "fold",
+		Params: []string{"f", "acc", "n"},
+		Body: IfExp{EqExp{n, IntExp{0}}, acc,
+			CallExp{"fold", []Exp{f, CallExp{"f", []Exp{acc, n}}, SubExp{n, IntExp{1}}}}},
+		In: CallExp{"fold", []Exp{LambdaExp{[]string{"acc", "n"}, PlusExp{acc, n}}, IntExp{0}, VarExp{"x"}}},
+	}
+}
+
+func TestLambdaErrors(t *testing.T) {
+	a := VarExp{"a"}
+	id := LambdaExp{[]string{"a"}, a}
+	inc := LambdaExp{[]string{"y"}, PlusExp{VarExp{"y"}, IntExp{1}}}
+	// let f = \f -> f(f) in f(f)
+	omega := LetExp{"f", LambdaExp{[]string{"f"}, CallExp{"f", []Exp{VarExp{"f"}}}}, CallExp{"f", []Exp{VarExp{"f"}}}}
+	// fn loop(a) = (\b -> loop(b))(a) in loop(0)
+	loop := FuncExp{"loop", []string{"a"}, AppExp{LambdaExp{[]string{"b"}, CallExp{"loop", []Exp{VarExp{"b"}}}}, []Exp{a}},
+		CallExp{"loop", []Exp{IntExp{0}}}}
+	tests := []struct {
+		exp  Exp
+		want error
+	}{
+		{AppExp{id, nil}, ArityError{LambdaName, 1, 0}},
+		{AppExp{IntExp{3}, nil}, NotAFunctionError{"3"}},
+		{LetExp{"f", IntExp{0}, CallExp{"f", nil}}, NotAFunctionError{"f"}},
+		{LetExp{"f", inc, AppExp{IntExp{0}, []Exp{IntExp{5}}}}, NotAFunctionError{"0"}},
+		// the expression is checked before it is evaluated
+		{AppExp{IntExp{3}, []Exp{DivExp{IntExp{1}, IntExp{0}}}}, NotAFunctionError{"3"}},
+		// the variables of the host are ints
+		{CallExp{"x", []Exp{IntExp{1}}}, UndefinedFunctionError{"x"}},
+		{AppExp{id, []Exp{VarExp{"b"}}}, UnboundVariableError{"b"}},
+		{PlusExp{id, IntExp{1}}, TypeError{"(\\a -> a)", "int", "fn(a) a"}},
+		{id, TypeError{"(\\a -> a)", "int", "fn(a) a"}},
+		{LetExp{"f", inc, CallExp{"f", []Exp{inc}}}, TypeError{"(\\y -> (y+1))", "int", "fn(int) int"}},
+		{IfExp{BoolExp{true}, IntExp{1}, id}, TypeError{"(\\a -> a)", "int", "fn(a) a"}},
+		// a function can not be applied to itself
+		{omega, TypeError{"f", "fn(a) b", "a"}},
+		{loop, ErrCallDepth},
+	}
+
+	for _, tt := range tests {
+		if _, err := Evaluate(tt.exp, Env{"x": 3, "a": 1}); !errors.Is(err, tt.want) {
+			t.Errorf("Evaluate(%s) error = %v, want %v", tt.exp.Pretty(), err, tt.want)
+		}
+	}
+	if got := (NotAFunctionError{"3"}).Error(); got != "3 is not a function" {
+		t.Errorf("Error() = %q", got)
+	}
+	if got := (TypeError{"f", "int", "fn(int) int"}).Error(); got != "f has the type fn(int) int, want int" {
+		t.Errorf("Error() = %q", got)
+	}
+}
+
+func TestFreeVars(t *testing.T) {
+	a, b := VarExp{"a"}, VarExp{"b"}
+	tests := []struct {
+		exp  Exp
+		want []string
+	}{
+		{PlusExp{b, PlusExp{a, b}}, []string{"b", "a"}},
+		{LetExp{"a", b, MultExp{a, VarExp{"c"}}}, []string{"b", "c"}},
+		{LambdaExp{[]string{"a"}, PlusExp{a, b}}, []string{"b"}},
+		// the call of f applies the variable f, g is a function
+		{FuncExp{"g", []string{"a"}, CallExp{"f", []Exp{a}}, CallExp{"g", []Exp{b}}}, []string{"f", "b"}},
+		{AppExp{VarExp{"f"}, []Exp{IfExp{a, b, IntExp{1}}}}, []string{"f", "a", "b"}},
+		{IntExp{1}, nil},
+	}
+
+	for _, tt := range tests {
+		if got := FreeVars(tt.exp); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("FreeVars(%s) = %v, want %v", tt.exp.Pretty(), got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package ast
+
+import "math"
+
+// Simplify returns a simplified expression with the same value as exp
+// the input is not modified, the result is a new tree
+//
+// constant subexpressions are folded, identities like x+0, x*1 and x*0
+// are applied and the constants of sums and products are collected into
+// a single constant, e.g. (1+x)+2 becomes (x+3)
+//
+// a division by zero is never folded and subexpressions which may panic,
+// e.g. unbound variables, are never dropped, so the simplified expression
+// panics if exp panics
+//
+// exp should be checked by Check before, constants whose types do not
+// fit, e.g. !0 or true == 1, are never folded, but a branch or an operand
+// which is dropped is not checked anymore
+func Simplify(exp Exp) Exp {
+	switch exp := exp.(type) {
+	case PlusExp:
+		return simplifySum(PlusExp{Simplify(exp.Left), Simplify(exp.Right)})
+	case SubExp:
+		return simplifySum(SubExp{Simplify(exp.Left), Simplify(exp.Right)})
+	case NegExp:
+		return simplifySum(NegExp{Simplify(exp.Exp)})
+	case MultExp:
+		return simplifyProduct(MultExp{Simplify(exp.Left), Simplify(exp.Right)})
+	case DivExp:
+		return simplifyDivision(DivExp{Simplify(exp.Left), Simplify(exp.Right)})
+	case ModExp:
+		return simplifyDivision(ModExp{Simplify(exp.Left), Simplify(exp.Right)})
+	case LetExp:
+		return simplifyLet(LetExp{exp.Name, Simplify(exp.Value), Simplify(exp.Body)})
+	case EqExp:
+		left, right := Simplify(exp.Left), Simplify(exp.Right)
+		return foldBoolean(EqExp{left, right}, left, right)
+	case NeqExp:
+		left, right := Simplify(exp.Left), Simplify(exp.Right)
+		return foldBoolean(NeqExp{left, right}, left, right)
+	case LtExp:
+		left, right := Simplify(exp.Left), Simplify(exp.Right)
+		return foldBoolean(LtExp{left, right}, left, right)
+	case LeExp:
+		left, right := Simplify(exp.Left), Simplify(exp.Right)
+		return foldBoolean(LeExp{left, right}, left, right)
+	case GtExp:
+		left, right := Simplify(exp.Left), Simplify(exp.Right)
+		return foldBoolean(GtExp{left, right}, left, right)
+	case GeExp:
+		left, right := Simplify(exp.Left), Simplify(exp.Right)
+		return foldBoolean(GeExp{left, right}, left, right)
+	case NotExp:
+		inner := Simplify(exp.Exp)
+		if val, ok := inner.(BoolExp); ok {
+			return BoolExp{!val.Val}
+		}
+		return NotExp{inner}
+	case AndExp:
+		// the right expression is not evaluated if the left one is false
+		left := Simplify(exp.Left)
+		if val, ok := left.(BoolExp); ok && !val.Val {
+			return BoolExp{false}
+		}
+		right := Simplify(exp.Right)
+		return foldBoolean(AndExp{left, right}, left, right)
+	case OrExp:
+		// the right expression is not evaluated if the left one is true
+		left := Simplify(exp.Left)
+		if val, ok := left.(BoolExp); ok && val.Val {
+			return BoolExp{true}
+		}
+		right := Simplify(exp.Right)
+		return foldBoolean(OrExp{left, right}, left, right)
+	case IfExp:
+		// only the chosen branch is evaluated, so the other one can be
+		// dropped even if it may panic
+		cond := Simplify(exp.Cond)
+		if val, ok := cond.(BoolExp); ok {
+			if val.Val {
+				return Simplify(exp.Then)
+			}
+			return Simplify(exp.Else)
+		}
+		return IfExp{cond, Simplify(exp.Then), Simplify(exp.Else)}
+	case FuncExp:
+		// calls are never inlined, only their arguments are simplified
+		return FuncExp{exp.Name, exp.Params, Simplify(exp.Body), Simplify(exp.In)}
+	case CallExp:
+		args := make([]Exp, len(exp.Args))
+		for i, arg := range exp.Args {
+			args[i] = Simplify(arg)
+		}
+		return CallExp{exp.Name, args}
+	case LambdaExp:
+		return LambdaExp{exp.Params, Simplify(exp.Body)}
+	case AppExp:
+		args := make([]Exp, len(exp.Args))
+		for i, arg := range exp.Args {
+			args[i] = Simplify(arg)
+		}
+		return AppExp{Simplify(exp.Fn), args}
+	default:
+		// int and string expressions and expressions of other packages are kept
+		return exp
+	}
+}
+
+// a term of a sum, which is subtracted if neg is true
+type term struct {
+	exp Exp
+	neg bool
+}
+
+// simplifies a sum of simplified expressions
+// the terms which are not constant keep their order,
+// the constants are added up and added at the end
+func simplifySum(exp Exp) Exp {
+	var terms []term
+	constant := 0
+	collectTerms(exp, false, &terms, &constant)
+
+	var sum Exp
+	for i, t := range terms {
+		switch {
+		case i == 0 && t.neg && constant != 0:
+			// 1-x instead of -x+1
+			sum = SubExp{IntExp{constant}, t.exp}
+			constant = 0
+		case i == 0 && t.neg:
+			sum = NegExp{t.exp}
+		case i == 0:
+			sum = t.exp
+		case t.neg:
+			sum = SubExp{sum, t.exp}
+		default:
+			sum = PlusExp{sum, t.exp}
+		}
+	}
+	switch {
+	case sum == nil:
+		return IntExp{constant}
+	case constant < 0 && constant != math.MinInt:
+		return SubExp{sum, IntExp{-constant}}
+	case constant != 0:
+		return PlusExp{sum, IntExp{constant}}
+	}
+	return sum
+}
+
+// collects the terms and the constant of a sum
+// the integers wrap around, so the constants can be added in any order
+func collectTerms(exp Exp, neg bool, terms *[]term, constant *int) {
+	switch exp := exp.(type) {
+	case IntExp:
+		if neg {
+			*constant -= exp.Val
+		} else {
+			*constant += exp.Val
+		}
+	case PlusExp:
+		collectTerms(exp.Left, neg, terms, constant)
+		collectTerms(exp.Right, neg, terms, constant)
+	case SubExp:
+		collectTerms(exp.Left, neg, terms, constant)
+		collectTerms(exp.Right, !neg, terms, constant)
+	case NegExp:
+		collectTerms(exp.Exp, !neg, terms, constant)
+	default:
+		*terms = append(*terms, term{exp, neg})
+	}
+}
+
+// simplifies a product of simplified expressions
+// the factors which are not constant keep their order,
+// the constants are multiplied and multiplied at the end
+func simplifyProduct(exp MultExp) Exp {
+	var factors []Exp
+	constant := 1
+	collectFactors(exp, &factors, &constant)
+
+	if constant == 0 && !anyCanPanic(factors) {
+		// x*0 is 0
+		return IntExp{0}
+	}
+	var product Exp
+	for _, factor := range factors {
+		if product == nil {
+			product = factor
+		} else {
+			product = MultExp{product, factor}
+		}
+	}
+	switch {
+	case product == nil:
+		return IntExp{constant}
+	case constant == 1:
+		return product
+	case constant == -1:
+		return simplifySum(NegExp{product})
+	}
+	return MultExp{product, IntExp{constant}}
+}
+
+// collects the factors and the constant of a product
+func collectFactors(exp Exp, factors *[]Exp, constant *int) {
+	switch exp := exp.(type) {
+	case IntExp:
+		*constant *= exp.Val
+	case MultExp:
+		collectFactors(exp.Left, factors, constant)
+		collectFactors(exp.Right, factors, constant)
+	case NegExp:
+		// -x is x*-1
+		*constant = -*constant
+		collectFactors(exp.Exp, factors, constant)
+	default:
+		*factors = append(*factors, exp)
+	}
+}
+
+// simplifies a division or a remainder of simplified expressions
+func simplifyDivision(exp Exp) Exp {
+	var left, right Exp
+	isDiv := false
+	switch exp := exp.(type) {
+	case DivExp:
+		left, right, isDiv = exp.Left, exp.Right, true
+	case ModExp:
+		left, right = exp.Left, exp.Right
+	}
+	divisor, ok := right.(IntExp)
+	// a division by zero must still panic
+	if !ok || divisor.Val == 0 {
+		return exp
+	}
+	if _, ok := left.(IntExp); ok {
+		return IntExp{exp.Eval()}
+	}
+	switch {
+	case isDiv && divisor.Val == 1:
+		return left
+	case isDiv && divisor.Val == -1:
+		return simplifySum(NegExp{left})
+	case !isDiv && (divisor.Val == 1 || divisor.Val == -1) && !canPanic(left):
+		// x%1 is 0
+		return IntExp{0}
+	}
+	return exp
+}
+
+// returns true if evaluating one of the expressions may panic
+func anyCanPanic(exps []Exp) bool {
+	for _, exp := range exps {
+		if canPanic(exp) {
+			return true
+		}
+	}
+	return false
+}
+
+// simplifies a let of simplified expressions
+// the let is dropped if the body does not use the name and evaluating
+// the value can not panic
+func simplifyLet(exp LetExp) Exp {
+	if !uses(exp.Body, exp.Name) && !canPanic(exp.Value) {
+		return exp.Body
+	}
+	return exp
+}
+
+// folds a comparison or logical operation of simplified operands
+// into a boolean literal if both operands are constants of the right types
+func foldBoolean(exp, left, right Exp) Exp {
+	if isConstant(left) && isConstant(right) && Check(exp, nil) == nil {
+		return BoolExp{exp.Eval() != 0}
+	}
+	return exp
+}
+
+// returns true if exp is an int or bool literal
+func isConstant(exp Exp) bool {
+	switch exp.(type) {
+	case IntExp, BoolExp:
+		return true
+	}
+	return false
+}
+
+// returns true if the variable occurs free in the expression,
+// i.e. not in the body of a let which binds the same name
+// expressions of other packages may always use the variable
+func uses(exp Exp, name string) bool {
+	switch exp := exp.(type) {
+	case IntExp:
+		return false
+	case VarExp:
+		return exp.Name == name
+	case PlusExp:
+		return uses(exp.Left, name) || uses(exp.Right, name)
+	case SubExp:
+		return uses(exp.Left, name) || uses(exp.Right, name)
+	case MultExp:
+		return uses(exp.Left, name) || uses(exp.Right, name)
+	case DivExp:
+		return uses(exp.Left, name) || uses(exp.Right, name)
+	case ModExp:
+		return uses(exp.Left, name) || uses(exp.Right, name)
+	case NegExp:
+		return uses(exp.Exp, name)
+	case LetExp:
+		return uses(exp.Value, name) || exp.Name != name && uses(exp.Body, name)
+	case BoolExp, StringExp:
+		return false
+	case EqExp:
+		return uses(exp.Left, name) || uses(exp.Right, name)
+	case NeqExp:
+		return uses(exp.Left, name) || uses(exp.Right, name)
+	case LtExp:
+		return uses(exp.Left, name) || uses(exp.Right, name)
+	case LeExp:
+		return uses(exp.Left, name) || uses(exp.Right, name)
+	case GtExp:
+		return uses(exp.Left, name) || uses(exp.Right, name)
+	case GeExp:
+		return uses(exp.Left, name) || uses(exp.Right, name)
+	case AndExp:
+		return uses(exp.Left, name) || uses(exp.Right, name)
+	case OrExp:
+		return uses(exp.Left, name) || uses(exp.Right, name)
+	case NotExp:
+		return uses(exp.Exp, name)
+	case IfExp:
+		return uses(exp.Cond, name) || uses(exp.Then, name) || uses(exp.Else, name)
+	case FuncExp:
+		// the parameters hide the variable in the body
+		for _, param := range exp.Params {
+			if param == name {
+				return uses(exp.In, name)
+			}
+		}
+		return uses(exp.Body, name) || uses(exp.In, name)
+	case CallExp:
+		// the call may apply the closure in the variable
+		if exp.Name == name {
+			return true
+		}
+		for _, arg := range exp.Args {
+			if uses(arg, name) {
+				return true
+			}
+		}
+		return false
+	case LambdaExp:
+		for _, param := range exp.Params {
+			if param == name {
+				return false
+			}
+		}
+		return uses(exp.Body, name)
+	case AppExp:
+		for _, arg := range exp.Args {
+			if uses(arg, name) {
+				return true
+			}
+		}
+		return uses(exp.Fn, name)
+	}
+	return true
+}
+
+// returns true if evaluating the expression may panic, i.e. it contains
+// a division whose divisor is not a constant other than zero
+// expressions of other packages may always panic
+func canPanic(exp Exp) bool {
+	switch exp := exp.(type) {
+	case IntExp:
+		return false
+	case PlusExp:
+		return canPanic(exp.Left) || canPanic(exp.Right)
+	case SubExp:
+		return canPanic(exp.Left) || canPanic(exp.Right)
+	case MultExp:
+		return canPanic(exp.Left) || canPanic(exp.Right)
+	case NegExp:
+		return canPanic(exp.Exp)
+	case DivExp:
+		return canPanic(exp.Left) || !isNonZeroConstant(exp.Right)
+	case ModExp:
+		return canPanic(exp.Left) || !isNonZeroConstant(exp.Right)
+	case VarExp:
+		// the variable may be unbound
+		return true
+	case LetExp:
+		return canPanic(exp.Value) || canPanic(exp.Body)
+	case BoolExp, StringExp:
+		return false
+	case EqExp:
+		return canPanic(exp.Left) || canPanic(exp.Right)
+	case NeqExp:
+		return canPanic(exp.Left) || canPanic(exp.Right)
+	case LtExp:
+		return canPanic(exp.Left) || canPanic(exp.Right)
+	case LeExp:
+		return canPanic(exp.Left) || canPanic(exp.Right)
+	case GtExp:
+		return canPanic(exp.Left) || canPanic(exp.Right)
+	case GeExp:
+		return canPanic(exp.Left) || canPanic(exp.Right)
+	case AndExp:
+		return canPanic(exp.Left) || canPanic(exp.Right)
+	case OrExp:
+		return canPanic(exp.Left) || canPanic(exp.Right)
+	case NotExp:
+		return canPanic(exp.Exp)
+	case IfExp:
+		return canPanic(exp.Cond) || canPanic(exp.Then) || canPanic(exp.Else)
+	case FuncExp:
+		// the definition itself can not panic, only the calls
+		return canPanic(exp.In)
+	case LambdaExp:
+		// the body is only evaluated by an application
+		return false
+	}
+	// calls and applications may divide by zero or recurse too deeply
+	return true
+}
+
+// returns true if exp is an int expression other than zero
+func isNonZeroConstant(exp Exp) bool {
+	i, ok := exp.(IntExp)
+	return ok && i.Val != 0
+}
@@ -0,0 +1,180 @@
+package ast
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestSimplify(t *testing.T) {
+	x := DivExp{IntExp{7}, SubExp{IntExp{1}, IntExp{1}}} // panics, stays in the tree
+	y := ModExp{IntExp{9}, NegExp{NegExp{IntExp{0}}}}
+	tests := []struct {
+		input Exp
+		want  string
+	}{
+		{PlusExp{IntExp{1}, MultExp{IntExp{2}, IntExp{3}}}, "7"},
+		{NegExp{IntExp{4}}, "-4"},
+		{DivExp{IntExp{7}, IntExp{2}}, "3"},
+		{ModExp{IntExp{-7}, IntExp{3}}, "-1"},
+		{DivExp{IntExp{7}, IntExp{0}}, "(7/0)"},
+		{x, "(7/0)"},
+		{y, "(9%0)"},
+		{PlusExp{x, IntExp{0}}, "(7/0)"},
+		{PlusExp{IntExp{0}, x}, "(7/0)"},
+		{SubExp{x, IntExp{0}}, "(7/0)"},
+		{SubExp{IntExp{0}, x}, "(-(7/0))"},
+		{MultExp{x, IntExp{1}}, "(7/0)"},
+		{MultExp{IntExp{1}, x}, "(7/0)"},
+		{DivExp{x, IntExp{1}}, "(7/0)"},
+		{DivExp{x, IntExp{-1}}, "(-(7/0))"},
+		{NegExp{NegExp{x}}, "(7/0)"},
+		// x*0 is only 0 if x can not panic
+		{MultExp{DivExp{IntExp{1}, IntExp{2}}, IntExp{0}}, "0"},
+		{MultExp{x, IntExp{0}}, "((7/0)*0)"},
+		{ModExp{x, IntExp{1}}, "((7/0)%1)"},
+		// a variable may be unbound
+		{MultExp{VarExp{"v"}, IntExp{0}}, "(v*0)"},
+		{PlusExp{PlusExp{IntExp{2}, VarExp{"v"}}, MultExp{IntExp{3}, VarExp{"w"}}}, "((v+(w*3))+2)"},
+		// the constants of sums and products are collected
+		{PlusExp{PlusExp{IntExp{1}, x}, IntExp{2}}, "((7/0)+3)"},
+		{SubExp{PlusExp{x, IntExp{1}}, IntExp{3}}, "((7/0)-2)"},
+		{SubExp{IntExp{1}, PlusExp{x, IntExp{4}}}, "(-3-(7/0))"},
+		{SubExp{IntExp{5}, x}, "(5-(7/0))"},
+		{PlusExp{PlusExp{x, IntExp{2}}, SubExp{y, IntExp{2}}}, "((7/0)+(9%0))"},
+		{MultExp{MultExp{IntExp{2}, x}, IntExp{3}}, "((7/0)*6)"},
+		{MultExp{MultExp{IntExp{-1}, x}, y}, "(-((7/0)*(9%0)))"},
+		// lets are dropped if the name is unused and the value can not panic
+		{LetExp{"a", PlusExp{IntExp{1}, IntExp{2}}, MultExp{VarExp{"a"}, IntExp{1}}}, "(let a = 3 in a)"},
+		{LetExp{"a", IntExp{1}, PlusExp{IntExp{2}, IntExp{3}}}, "5"},
+		{LetExp{"a", IntExp{1}, LetExp{"a", IntExp{2}, VarExp{"a"}}}, "(let a = 2 in a)"},
+		{LetExp{"a", x, IntExp{3}}, "(let a = (7/0) in 3)"},
+		{LetExp{"a", VarExp{"v"}, IntExp{3}}, "(let a = v in 3)"},
+		{FuncExp{"f", []string{"n"}, PlusExp{VarExp{"n"}, IntExp{0}}, CallExp{"f", []Exp{MultExp{IntExp{2}, IntExp{3}}}}}, "(fn f(n) = n in f(6))"},
+		// the let is used by the body of the function, but not if a parameter hides it
+		{LetExp{"a", IntExp{1}, FuncExp{"f", nil, VarExp{"a"}, CallExp{"f", nil}}}, "(let a = 1 in (fn f() = a in f()))"},
+		{LetExp{"a", IntExp{1}, FuncExp{"f", []string{"a"}, VarExp{"a"}, CallExp{"f", []Exp{IntExp{2}}}}}, "(fn f(a) = a in f(2))"},
+		// the body of a lambda is simplified, a call may apply the closure in the let
+		{LetExp{"f", LambdaExp{[]string{"n"}, MultExp{VarExp{"n"}, IntExp{1}}}, CallExp{"f", []Exp{PlusExp{IntExp{1}, IntExp{1}}}}}, "(let f = (\\n -> n) in f(2))"},
+		{LetExp{"f", LambdaExp{nil, x}, IntExp{1}}, "1"},
+		{AppExp{LambdaExp{[]string{"a"}, VarExp{"a"}}, []Exp{SubExp{IntExp{3}, IntExp{1}}}}, "(\\a -> a)(2)"},
+		// comparisons and logical operations of constants are folded
+		{LtExp{IntExp{1}, PlusExp{IntExp{1}, IntExp{1}}}, "true"},
+		{EqExp{BoolExp{true}, LtExp{IntExp{2}, IntExp{1}}}, "false"},
+		{NotExp{BoolExp{false}}, "true"},
+		{AndExp{BoolExp{true}, BoolExp{false}}, "false"},
+		{NeqExp{VarExp{"v"}, IntExp{1}}, "(v!=1)"},
+		// constants of the wrong type are not folded
+		{EqExp{BoolExp{true}, IntExp{1}}, "(true==1)"},
+		{NotExp{IntExp{0}}, "(!0)"},
+		{AndExp{IntExp{2}, BoolExp{false}}, "(2&&false)"},
+		{IfExp{IntExp{1}, IntExp{2}, IntExp{3}}, "(if 1 then 2 else 3)"},
+		// the operand which is not evaluated may be dropped even if it may panic
+		{AndExp{BoolExp{false}, EqExp{x, IntExp{0}}}, "false"},
+		{OrExp{BoolExp{true}, EqExp{x, IntExp{0}}}, "true"},
+		{OrExp{EqExp{x, IntExp{0}}, BoolExp{true}}, "(((7/0)==0)||true)"},
+		{IfExp{LtExp{IntExp{1}, IntExp{2}}, PlusExp{IntExp{1}, IntExp{1}}, x}, "2"},
+		{IfExp{BoolExp{false}, x, VarExp{"v"}}, "v"},
+		{IfExp{EqExp{VarExp{"v"}, IntExp{0}}, MultExp{IntExp{2}, IntExp{3}}, x}, "(if (v==0) then 6 else (7/0))"},
+		// overflowing constants wrap around like in Eval
+		{PlusExp{x, PlusExp{IntExp{math.MaxInt}, IntExp{1}}}, "((7/0)+" + IntExp{math.MinInt}.Pretty() + ")"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input.Pretty(), func(t *testing.T) {
+			before := tt.input.Pretty()
+			if got := Simplify(tt.input).Pretty(); got != tt.want {
+				t.Errorf("Simplify(%s) = %s, want %s", before, got, tt.want)
+			}
+			if tt.input.Pretty() != before {
+				t.Errorf("Simplify modified its input to %s", tt.input.Pretty())
+			}
+		})
+	}
+}
+
+// constants of the random expressions, small values make the
+// identities and divisions by zero likely
+var randomConstants = []int{0, 1, -1, 2, 3, -7, math.MaxInt, math.MinInt}
+
+// returns a random expression with at most depth levels, a bool if
+// boolean is true, otherwise an int
+func randomExp(r *rand.Rand, depth int, boolean bool) Exp {
+	if depth == 0 || r.Intn(4) == 0 {
+		switch {
+		case boolean:
+			return BoolExp{r.Intn(2) == 0}
+		case r.Intn(4) == 0:
+			// the variable is only bound inside of a let
+			return VarExp{"a"}
+		}
+		return IntExp{randomConstants[r.Intn(len(randomConstants))]}
+	}
+	if boolean {
+		op := r.Intn(6)
+		// the operands of the comparisons are ints
+		left, right := randomExp(r, depth-1, op > 1), randomExp(r, depth-1, op > 1)
+		switch op {
+		case 0:
+			return LtExp{left, right}
+		case 1:
+			return EqExp{left, right}
+		case 2:
+			return AndExp{left, right}
+		case 3:
+			return OrExp{left, right}
+		case 4:
+			return NotExp{left}
+		default:
+			return EqExp{left, right}
+		}
+	}
+	left, right := randomExp(r, depth-1, false), randomExp(r, depth-1, false)
+	switch r.Intn(8) {
+	case 0:
+		return PlusExp{left, right}
+	case 1:
+		return MultExp{left, right}
+	case 2:
+		return SubExp{left, right}
+	case 3:
+		return DivExp{left, right}
+	case 4:
+		return ModExp{left, right}
+	case 5:
+		return LetExp{"a", left, right}
+	case 6:
+		return IfExp{randomExp(r, depth-1, true), left, right}
+	default:
+		return NegExp{left}
+	}
+}
+
+// evaluates the expression and returns true if it panicked
+func safeEval(exp Exp) (val int, panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+		}
+	}()
+	return exp.Eval(), false
+}
+
+func TestSimplifyRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		exp := randomExp(r, 6, r.Intn(2) == 0)
+		if err := Check(exp, nil); err != nil {
+			t.Fatalf("Check(%s) = %v", exp.Pretty(), err)
+		}
+		simplified := Simplify(exp)
+		want, wantPanic := safeEval(exp)
+		got, gotPanic := safeEval(simplified)
+		if got != want || gotPanic != wantPanic {
+			t.Fatalf("Simplify(%s) = %s evaluates to %d (panic %v), want %d (panic %v)",
+				exp.Pretty(), simplified.Pretty(), got, gotPanic, want, wantPanic)
+		}
+		if again := Simplify(simplified); again.Pretty() != simplified.Pretty() {
+			t.Errorf("Simplify is not idempotent: %s becomes %s", simplified.Pretty(), again.Pretty())
+		}
+	}
+}
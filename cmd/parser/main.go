@@ -0,0 +1,63 @@
+// Command parser parses an example expression with the recursive descent
+// parser and prints the resulting AST and its value.
+// The variables of the expression are bound by the following arguments,
+// e.g. go run ./cmd/parser "price * qty" price=3 qty=4
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lennart01/learning_go/ast"
+	"github.com/lennart01/learning_go/parser"
+)
+
+// parses bindings of the form name=value into an environment
+func parseEnv(bindings []string) (ast.Env, error) {
+	env := ast.Env{}
+	for _, binding := range bindings {
+		name, lit, ok := strings.Cut(binding, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid binding %q, expected name=value", binding)
+		}
+		val, err := parser.ParseInt(lit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of %s: %v", name, err)
+		}
+		env[name] = val
+	}
+	return env, nil
+}
+
+func main() {
+	expr := "2 * (1 + 1)"
+	var bindings []string
+	if len(os.Args) > 1 {
+		expr, bindings = os.Args[1], os.Args[2:]
+	}
+	env, err := parseEnv(bindings)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	exp, err := parser.Parse(expr)
+	if err != nil {
+		var perr *parser.ParseError
+		if errors.As(err, &perr) {
+			fmt.Fprintln(os.Stderr, perr.Pretty())
+		} else {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+	fmt.Println("Expr:", expr)
+	fmt.Println("AST:", exp.Pretty())
+	result, err := ast.Evaluate(exp, env)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println("Result:", result)
+}
@@ -0,0 +1,38 @@
+// Command pratt parses an example expression with the Pratt parser and
+// prints the resulting expression and its value.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/lennart01/learning_go/ast"
+	"github.com/lennart01/learning_go/parser"
+	"github.com/lennart01/learning_go/parser/pratt"
+)
+
+func main() {
+	expr := "2 * (1 + 1 + 1) * 2 + 1"
+	if len(os.Args) > 1 {
+		expr = os.Args[1]
+	}
+	fmt.Println(expr)
+	result, err := pratt.Parse(expr)
+	if err != nil {
+		var perr *parser.ParseError
+		if errors.As(err, &perr) {
+			fmt.Fprintln(os.Stderr, perr.Pretty())
+		} else {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+	fmt.Println(result.Pretty())
+	val, err := ast.Evaluate(result)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(val)
+}
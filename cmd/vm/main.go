@@ -0,0 +1,62 @@
+// Command vm runs two example programs on the virtual machine and prints
+// the calculation and the result of each.
+package main
+
+import (
+	"github.com/lennart01/learning_go/ast"
+	"github.com/lennart01/learning_go/vm"
+)
+
+// prints the result of the vm
+func showVMResult(result vm.Value, err error) {
+	if err != nil {
+		println(err.Error())
+	} else {
+		println(int(result))
+	}
+}
+
+// prints the calculation
+func showCalculation(code []vm.Code) {
+	exp, err := vm.Decompile(code)
+	if err != nil {
+		println(err.Error())
+		return
+	}
+	println("The VM runs the following calculation: \n" + exp.Pretty())
+}
+
+// test the vm
+func main() {
+	// create a program with the code
+	code := []vm.Code{
+		vm.NewPushCode(1),
+		vm.NewPushCode(2),
+		vm.NewPlusCode(),
+		vm.NewPushCode(3),
+		vm.NewMultiplyCode(),
+	}
+	// print the calculation
+	showCalculation(code)
+	// run the vm
+	machine := vm.NewVM(code)
+	// print the result
+	showVMResult(machine.Run())
+
+	// create an ast
+	int_exp1 := ast.IntExp{Val: 1}
+	int_exp2 := ast.IntExp{Val: 2}
+	plus_exp := ast.PlusExp{Left: int_exp1, Right: int_exp2}
+	mult_exp := ast.MultExp{Left: plus_exp, Right: int_exp2}
+	// compile the ast into a program
+	prog, err := vm.Compile(mult_exp)
+	if err != nil {
+		println(err.Error())
+		return
+	}
+	// print the calculation
+	showCalculation(prog.Code())
+	// run the program
+	// print the result
+	showVMResult(prog.Run())
+}
@@ -0,0 +1,40 @@
+// Package formula compiles formulas with variables into vm programs which
+// can be evaluated many times with different bindings of the variables.
+package formula
+
+import (
+	"github.com/lennart01/learning_go/ast"
+	"github.com/lennart01/learning_go/parser"
+	"github.com/lennart01/learning_go/vm"
+)
+
+// Compile parses and simplifies a formula and compiles it into a program
+// the variables are resolved to slots at compile time, see vm.Program.Vars
+// returns a *parser.ParseError if the formula is invalid
+// the formula is checked before it is simplified, as simplifying may
+// drop a closure which is used like an int, e.g. in 0 * (\a -> a)
+func Compile(src string) (*vm.Program, error) {
+	return CompileWith(src, nil)
+}
+
+// CompileWith is like Compile, the formula can call the native functions
+// of natives, which may be nil
+func CompileWith(src string, natives *vm.Natives) (*vm.Program, error) {
+	exp, err := parser.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	if err := vm.CheckWith(exp, natives); err != nil {
+		return nil, err
+	}
+	return vm.CompileWith(ast.Simplify(exp), natives)
+}
+
+// MustCompile is like Compile but panics if the formula is invalid
+func MustCompile(src string) *vm.Program {
+	prog, err := Compile(src)
+	if err != nil {
+		panic(err)
+	}
+	return prog
+}
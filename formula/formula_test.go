@@ -0,0 +1,168 @@
+package formula
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/lennart01/learning_go/ast"
+	"github.com/lennart01/learning_go/parser"
+	"github.com/lennart01/learning_go/vm"
+)
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		src  string
+		vars []string
+		env  ast.Env
+		want vm.Value
+	}{
+		{"a*b + c", []string{"a", "b", "c"}, ast.Env{"a": 2, "b": 3, "c": 4}, 10},
+		{"price * qty - discount", []string{"price", "qty", "discount"}, ast.Env{"price": 3, "qty": 4, "discount": 2}, 10},
+		{"x * (1 + 1) + x", []string{"x"}, ast.Env{"x": 5}, 15},
+		{"2 * 3", nil, nil, 6},
+		// the shared subexpression is computed once
+		{"let t = a * b in t * t + t", []string{"a", "b"}, ast.Env{"a": 2, "b": 3}, 42},
+		{"if price > 100 && member == 0 then price * 9 / 10 else price", []string{"price", "member"}, ast.Env{"price": 200, "member": 0}, 180},
+		{"if price > 100 && member == 0 then price * 9 / 10 else price", []string{"price", "member"}, ast.Env{"price": 200, "member": 1}, 200},
+		{"a < b || a == 0", []string{"a", "b"}, ast.Env{"a": 3, "b": 2}, 0},
+		{"fn clamp(v, lo, hi) = if v < lo then lo else if v > hi then hi else v in clamp(a, 0, 100)", []string{"a"}, ast.Env{"a": 150}, 100},
+		{"fn fib(n) = if n < 2 then n else fib(n - 1) + fib(n - 2) in fib(n)", []string{"n"}, ast.Env{"n": 10}, 55},
+		{"let tax = \\p -> p * rate / 100 in price + tax(price)", []string{"price", "rate"}, ast.Env{"price": 200, "rate": 20}, 240},
+		{"fn fold(f, acc, n) = if n == 0 then acc else fold(f, f(acc, n), n - 1) in fold(\\acc i -> acc + i * i, 0, n)", []string{"n"}, ast.Env{"n": 4}, 30},
+	}
+	for _, test := range tests {
+		prog, err := Compile(test.src)
+		if err != nil {
+			t.Fatalf("Compile(%q) returned error: %v", test.src, err)
+		}
+		if got := prog.Vars(); len(got) != len(test.vars) || len(got) > 0 && !reflect.DeepEqual(got, test.vars) {
+			t.Errorf("Compile(%q).Vars() = %v, want %v", test.src, got, test.vars)
+		}
+		if got, err := prog.Eval(test.env); err != nil || got != test.want {
+			t.Errorf("Compile(%q).Eval(%v) = %d, %v, want %d", test.src, test.env, got, err, test.want)
+		}
+		// the same program evaluated with slots
+		slots := make([]vm.Value, len(test.vars))
+		for i, name := range test.vars {
+			slots[i] = vm.Value(test.env[name])
+		}
+		if got, err := prog.EvalSlots(slots); err != nil || got != test.want {
+			t.Errorf("Compile(%q).EvalSlots(%v) = %d, %v, want %d", test.src, slots, got, err, test.want)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	_, err := Compile("a * + b")
+	var perr *parser.ParseError
+	if !errors.As(err, &perr) {
+		t.Errorf("Compile error = %v, want a *parser.ParseError", err)
+	}
+	// the closure is rejected before it is simplified away
+	_, err = Compile("0 * (\\a -> a)")
+	var terr ast.TypeError
+	if !errors.As(err, &terr) {
+		t.Errorf("Compile error = %v, want an ast.TypeError", err)
+	}
+	prog := MustCompile("a / b")
+	_, err = prog.Eval(ast.Env{"a": 1, "b": 0})
+	var zero vm.ErrDivisionByZero
+	if !errors.As(err, &zero) {
+		t.Errorf("Eval error = %v, want a vm.ErrDivisionByZero", err)
+	}
+	prog = MustCompile("fn sum(n) = if n == 0 then 0 else n + sum(n - 1) in sum(n)")
+	if _, err = prog.Eval(ast.Env{"n": 1_000_000}); !errors.Is(err, ast.ErrCallDepth) {
+		t.Errorf("Eval error = %v, want an error wrapping ast.ErrCallDepth", err)
+	}
+	// a recursion in tail position has no depth limit
+	prog = MustCompile("fn sum(n, acc) = if n == 0 then acc else sum(n - 1, acc + n) in sum(n, 0)")
+	if got, err := prog.Eval(ast.Env{"n": 1_000_000}); err != nil || got != 500_000_500_000 {
+		t.Errorf("Eval = %d, %v, want 500000500000", got, err)
+	}
+}
+
+func TestEvalRows(t *testing.T) {
+	prog := MustCompile("a*b + c")
+	slots := make([]vm.Value, 3)
+	for i := 0; i < 1000; i++ {
+		slots[0], slots[1], slots[2] = vm.Value(i), vm.Value(i%7), vm.Value(-i)
+		want := vm.Value(i*(i%7) - i)
+		if got, err := prog.EvalSlots(slots); err != nil || got != want {
+			t.Fatalf("EvalSlots(%v) = %d, %v, want %d", slots, got, err, want)
+		}
+	}
+}
+
+func TestNativeFunctions(t *testing.T) {
+	natives := vm.NewNatives()
+	err := natives.RegisterGoFunc("roundTo", func(v, step int) (int, error) {
+		if step <= 0 {
+			return 0, errors.New("step must be positive")
+		}
+		return (v + step/2) / step * step, nil
+	})
+	if err != nil {
+		t.Fatalf("RegisterGoFunc returned error: %v", err)
+	}
+	err = natives.RegisterGoFunc("lookupRate", func(currency string) (int, error) {
+		if currency != "EUR" {
+			return 0, fmt.Errorf("unknown currency %q", currency)
+		}
+		return 108, nil
+	})
+	if err != nil {
+		t.Fatalf("RegisterGoFunc returned error: %v", err)
+	}
+	compile := func(src string) *vm.Program {
+		prog, err := CompileWith(src, natives)
+		if err != nil {
+			t.Fatalf("CompileWith(%q) returned error: %v", src, err)
+		}
+		return prog
+	}
+	prog := compile("roundTo(price * qty, 5) + 1")
+	if got, err := prog.Eval(ast.Env{"price": 3, "qty": 4}); err != nil || got != 11 {
+		t.Errorf("Eval = %d, %v, want 11", got, err)
+	}
+	prog = compile("roundTo(price, step)")
+	_, err = prog.Eval(ast.Env{"price": 3, "step": 0})
+	var nativeErr vm.NativeError
+	if !errors.As(err, &nativeErr) || nativeErr.Name != "roundTo" {
+		t.Errorf("Eval error = %v, want a vm.NativeError of roundTo", err)
+	}
+	// a string literal is an argument of a native function
+	prog = compile(`price * lookupRate("EUR") / 100`)
+	if got, err := prog.Eval(ast.Env{"price": 50}); err != nil || got != 54 {
+		t.Errorf("Eval = %d, %v, want 54", got, err)
+	}
+	prog = compile(`lookupRate("GBP")`)
+	if _, err := prog.Eval(nil); !errors.As(err, &nativeErr) || nativeErr.Name != "lookupRate" {
+		t.Errorf("Eval error = %v, want a vm.NativeError of lookupRate", err)
+	}
+	var typeErr ast.TypeError
+	if _, err := CompileWith("lookupRate(price)", natives); !errors.As(err, &typeErr) || typeErr.Want != "string" {
+		t.Errorf("CompileWith error = %v, want an ast.TypeError", err)
+	}
+	if _, err := CompileWith(`price + "EUR"`, natives); !errors.As(err, &typeErr) || typeErr.Got != "string" {
+		t.Errorf("CompileWith error = %v, want an ast.TypeError", err)
+	}
+	var arity ast.ArityError
+	if _, err := CompileWith("roundTo(price)", natives); !errors.As(err, &arity) {
+		t.Errorf("CompileWith error = %v, want an ast.ArityError", err)
+	}
+	// Compile knows no native functions
+	var undefined ast.UndefinedFunctionError
+	if _, err := Compile("roundTo(price, 5)"); !errors.As(err, &undefined) {
+		t.Errorf("Compile error = %v, want an ast.UndefinedFunctionError", err)
+	}
+}
+
+func BenchmarkEvalSlots(b *testing.B) {
+	prog := MustCompile("a*b + c")
+	slots := []vm.Value{2, 3, 4}
+	for i := 0; i < b.N; i++ {
+		prog.EvalSlots(slots)
+	}
+}
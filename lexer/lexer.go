@@ -0,0 +1,281 @@
+// Package lexer splits an input string into a stream of tokens which is
+// consumed by the parsers.
+package lexer
+
+import (
+	"strconv"
+	"unicode/utf8"
+)
+
+// Kind is the kind of a token
+type Kind int
+
+// define constants for the token kinds
+const (
+	EOF      Kind = iota // end of the input
+	ILLEGAL              // a character which does not start a token, or a string literal without its closing quote
+	NUMBER               // number literal, e.g. 42, 1_000, 0x2A
+	IDENT                // identifier, e.g. price or qty_2
+	PLUS                 // +
+	MINUS                // -
+	MULTIPLY             // *
+	DIVIDE               // /
+	MODULO               // %
+	LPAREN               // (
+	RPAREN               // )
+	ASSIGN               // =
+	LET                  // the keyword let
+	IN                   // the keyword in
+	EQ                   // ==
+	NEQ                  // !=
+	LT                   // <
+	LE                   // <=
+	GT                   // >
+	GE                   // >=
+	AND                  // &&
+	OR                   // ||
+	NOT                  // !
+	TRUE                 // the keyword true
+	FALSE                // the keyword false
+	IF                   // the keyword if
+	THEN                 // the keyword then
+	ELSE                 // the keyword else
+	COMMA                // ,
+	FN                   // the keyword fn
+	LAMBDA               // \ which starts a lambda
+	ARROW                // ->
+	STRING               // string literal in double quotes, e.g. "EUR"
+)
+
+// names of the token kinds, operators are named by their symbol
+var kindNames = [...]string{
+	EOF:      "EOF",
+	ILLEGAL:  "ILLEGAL",
+	NUMBER:   "NUMBER",
+	IDENT:    "IDENT",
+	PLUS:     "+",
+	MINUS:    "-",
+	MULTIPLY: "*",
+	DIVIDE:   "/",
+	MODULO:   "%",
+	LPAREN:   "(",
+	RPAREN:   ")",
+	ASSIGN:   "=",
+	LET:      "let",
+	IN:       "in",
+	EQ:       "==",
+	NEQ:      "!=",
+	LT:       "<",
+	LE:       "<=",
+	GT:       ">",
+	GE:       ">=",
+	AND:      "&&",
+	OR:       "||",
+	NOT:      "!",
+	TRUE:     "true",
+	FALSE:    "false",
+	IF:       "if",
+	THEN:     "then",
+	ELSE:     "else",
+	COMMA:    ",",
+	FN:       "fn",
+	LAMBDA:   "\\",
+	ARROW:    "->",
+	STRING:   "STRING",
+}
+
+// String returns the name of the kind
+func (k Kind) String() string {
+	if k < 0 || int(k) >= len(kindNames) {
+		return "Kind(" + strconv.Itoa(int(k)) + ")"
+	}
+	return kindNames[k]
+}
+
+// single character tokens
+var symbols = map[byte]Kind{
+	'+':  PLUS,
+	'-':  MINUS,
+	'*':  MULTIPLY,
+	'/':  DIVIDE,
+	'%':  MODULO,
+	'(':  LPAREN,
+	')':  RPAREN,
+	'=':  ASSIGN,
+	'<':  LT,
+	'>':  GT,
+	'!':  NOT,
+	',':  COMMA,
+	'\\': LAMBDA,
+}
+
+// two character tokens, they take precedence over the single character ones
+var doubleSymbols = map[string]Kind{
+	"==": EQ,
+	"!=": NEQ,
+	"<=": LE,
+	">=": GE,
+	"&&": AND,
+	"||": OR,
+	"->": ARROW,
+}
+
+// identifiers which are keywords
+var keywords = map[string]Kind{
+	"let":   LET,
+	"in":    IN,
+	"true":  TRUE,
+	"false": FALSE,
+	"if":    IF,
+	"then":  THEN,
+	"else":  ELSE,
+	"fn":    FN,
+}
+
+// Pos is a position in the input
+type Pos struct {
+	Offset int // byte offset, starting at 0
+	Line   int // line, starting at 1
+	Column int // column in characters, starting at 1
+}
+
+// Token is a single token of the input
+type Token struct {
+	Kind   Kind
+	Lexeme string // the text of the token, empty for EOF
+	Start  Pos    // position of the first character of the token
+	End    Pos    // position after the last character of the token
+}
+
+// Lexer produces the tokens of an input string one at a time
+type Lexer struct {
+	input string
+	pos   Pos
+}
+
+// New creates a new lexer for the given input string
+func New(input string) *Lexer {
+	return &Lexer{input: input, pos: Pos{Offset: 0, Line: 1, Column: 1}}
+}
+
+// Scan returns all tokens of the input string
+// the last token is always an EOF token
+func Scan(input string) []Token {
+	l := New(input)
+	var tokens []Token
+	for {
+		tok := l.Next()
+		tokens = append(tokens, tok)
+		if tok.Kind == EOF {
+			return tokens
+		}
+	}
+}
+
+// Next returns the next token of the input
+// once the end of the input is reached it keeps returning EOF tokens
+func (l *Lexer) Next() Token {
+	l.skipWhitespace()
+	start := l.pos
+	if l.pos.Offset >= len(l.input) {
+		return Token{Kind: EOF, Start: start, End: start}
+	}
+
+	c := l.input[l.pos.Offset]
+	kind := ILLEGAL
+	if k, ok := l.doubleSymbol(); ok {
+		kind = k
+		l.advance()
+		l.advance()
+	} else if k, ok := symbols[c]; ok {
+		kind = k
+		l.advance()
+	} else if isDigit(c) {
+		// consume all letters, digits, underscores and dots so that prefixes
+		// like 0x and invalid literals like 12ab end up in one token
+		kind = NUMBER
+		for l.pos.Offset < len(l.input) && isNumberChar(l.input[l.pos.Offset]) {
+			l.advance()
+		}
+	} else if c == '"' {
+		// the lexeme keeps the quotes and the escapes, an unterminated
+		// literal ends at the end of the line and is illegal
+		kind = ILLEGAL
+		l.advance()
+		for l.pos.Offset < len(l.input) && l.input[l.pos.Offset] != '\n' {
+			c := l.input[l.pos.Offset]
+			l.advance()
+			if c == '"' {
+				kind = STRING
+				break
+			}
+			if c == '\\' && l.pos.Offset < len(l.input) && l.input[l.pos.Offset] != '\n' {
+				l.advance()
+			}
+		}
+	} else if isIdentStart(c) {
+		kind = IDENT
+		for l.pos.Offset < len(l.input) && isIdentChar(l.input[l.pos.Offset]) {
+			l.advance()
+		}
+		if k, ok := keywords[l.input[start.Offset:l.pos.Offset]]; ok {
+			kind = k
+		}
+	} else {
+		l.advance()
+	}
+	return Token{Kind: kind, Lexeme: l.input[start.Offset:l.pos.Offset], Start: start, End: l.pos}
+}
+
+// returns the kind of the two character token at the position
+func (l *Lexer) doubleSymbol() (Kind, bool) {
+	if l.pos.Offset+2 > len(l.input) {
+		return ILLEGAL, false
+	}
+	k, ok := doubleSymbols[l.input[l.pos.Offset:l.pos.Offset+2]]
+	return k, ok
+}
+
+// skips spaces, tabs and newlines
+func (l *Lexer) skipWhitespace() {
+	for l.pos.Offset < len(l.input) {
+		switch l.input[l.pos.Offset] {
+		case ' ', '\t', '\n', '\r':
+			l.advance()
+		default:
+			return
+		}
+	}
+}
+
+// moves the position past the next character
+func (l *Lexer) advance() {
+	r, size := utf8.DecodeRuneInString(l.input[l.pos.Offset:])
+	l.pos.Offset += size
+	if r == '\n' {
+		l.pos.Line++
+		l.pos.Column = 1
+	} else {
+		l.pos.Column++
+	}
+}
+
+// returns true if the given character is a digit
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// returns true if c can be part of a number literal
+func isNumberChar(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '.'
+}
+
+// returns true if c can start an identifier
+func isIdentStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+// returns true if c can be part of an identifier
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || isDigit(c)
+}
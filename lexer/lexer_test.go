@@ -0,0 +1,83 @@
+package lexer
+
+import (
+	"testing"
+)
+
+func TestScan(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []Kind
+	}{
+		{"1 + 2", []Kind{NUMBER, PLUS, NUMBER, EOF}},
+		{"(1 + 2) * 3", []Kind{LPAREN, NUMBER, PLUS, NUMBER, RPAREN, MULTIPLY, NUMBER, EOF}},
+		{"1 + 2 * 3 - 4 / 5", []Kind{NUMBER, PLUS, NUMBER, MULTIPLY, NUMBER, MINUS, NUMBER, DIVIDE, NUMBER, EOF}},
+		{"-7 % 3", []Kind{MINUS, NUMBER, MODULO, NUMBER, EOF}},
+		{"0x2A*1_000", []Kind{NUMBER, MULTIPLY, NUMBER, EOF}},
+		{"1 $ 2", []Kind{NUMBER, ILLEGAL, NUMBER, EOF}},
+		{"price * qty_2", []Kind{IDENT, MULTIPLY, IDENT, EOF}},
+		{"_x-2y", []Kind{IDENT, MINUS, NUMBER, EOF}},
+		{"let x = 1 in x", []Kind{LET, IDENT, ASSIGN, NUMBER, IN, IDENT, EOF}},
+		{"fn f(a, b) = a in f(1,2)", []Kind{FN, IDENT, LPAREN, IDENT, COMMA, IDENT, RPAREN, ASSIGN, IDENT, IN, IDENT, LPAREN, NUMBER, COMMA, NUMBER, RPAREN, EOF}},
+		{"\\a b->a-b", []Kind{LAMBDA, IDENT, IDENT, ARROW, IDENT, MINUS, IDENT, EOF}},
+		{"letter inner", []Kind{IDENT, IDENT, EOF}},
+		{"a<=b&&!c||d!=1", []Kind{IDENT, LE, IDENT, AND, NOT, IDENT, OR, IDENT, NEQ, NUMBER, EOF}},
+		{"x == 1 < 2 > 3 >= 4", []Kind{IDENT, EQ, NUMBER, LT, NUMBER, GT, NUMBER, GE, NUMBER, EOF}},
+		{"if true then 1 else false", []Kind{IF, TRUE, THEN, NUMBER, ELSE, FALSE, EOF}},
+		{"a & b | c = d", []Kind{IDENT, ILLEGAL, IDENT, ILLEGAL, IDENT, ASSIGN, IDENT, EOF}},
+		{`lookupRate("EUR", "a \"b\" c")`, []Kind{IDENT, LPAREN, STRING, COMMA, STRING, RPAREN, EOF}},
+		{`"" + "\\"`, []Kind{STRING, PLUS, STRING, EOF}},
+		{"\"open\n1", []Kind{ILLEGAL, NUMBER, EOF}},
+		{`"escaped end\"`, []Kind{ILLEGAL, EOF}},
+		{"", []Kind{EOF}},
+	}
+
+	for _, test := range tests {
+		got := Scan(test.input)
+		if !kindsEqual(got, test.want) {
+			t.Errorf("Scan(%q) = %v, want %v", test.input, got, test.want)
+		}
+	}
+}
+
+// check if the tokens have the given kinds
+func kindsEqual(tokens []Token, kinds []Kind) bool {
+	if len(tokens) != len(kinds) {
+		return false
+	}
+	for i := range tokens {
+		if tokens[i].Kind != kinds[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNext(t *testing.T) {
+	l := New("12 +\n\t(ä) x1")
+	want := []Token{
+		{NUMBER, "12", Pos{0, 1, 1}, Pos{2, 1, 3}},
+		{PLUS, "+", Pos{3, 1, 4}, Pos{4, 1, 5}},
+		{LPAREN, "(", Pos{6, 2, 2}, Pos{7, 2, 3}},
+		{ILLEGAL, "ä", Pos{7, 2, 3}, Pos{9, 2, 4}},
+		{RPAREN, ")", Pos{9, 2, 4}, Pos{10, 2, 5}},
+		{IDENT, "x1", Pos{11, 2, 6}, Pos{13, 2, 8}},
+		{EOF, "", Pos{13, 2, 8}, Pos{13, 2, 8}},
+		{EOF, "", Pos{13, 2, 8}, Pos{13, 2, 8}},
+	}
+
+	for i, w := range want {
+		if got := l.Next(); got != w {
+			t.Errorf("token %d = %+v, want %+v", i, got, w)
+		}
+	}
+}
+
+func TestKindString(t *testing.T) {
+	tests := map[Kind]string{EOF: "EOF", NUMBER: "NUMBER", IDENT: "IDENT", MULTIPLY: "*", STRING: "STRING", Kind(-1): "Kind(-1)"}
+	for kind, want := range tests {
+		if got := kind.String(); got != want {
+			t.Errorf("Kind(%d).String() = %q, want %q", int(kind), got, want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lennart01/learning_go/lexer"
+)
+
+// ParseError describes a syntax error in the input of a parser
+type ParseError struct {
+	Input    string   // the complete input which was parsed
+	Offset   int      // byte offset of the offending token in the input
+	Line     int      // line of the offending token, starting at 1
+	Column   int      // column of the offending token, starting at 1
+	Token    string   // the offending token, empty at the end of the input
+	Expected []string // the tokens which would have been valid instead
+	Message  string   // describes an invalid token, e.g. an invalid number literal
+}
+
+// NewParseError creates a new parse error for the token at the given offset
+// the line and column are computed from the offset
+func NewParseError(input string, offset int, token string, expected ...string) *ParseError {
+	line, column := 1, 1
+	for _, c := range input[:offset] {
+		if c == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+	}
+	return &ParseError{
+		Input:    input,
+		Offset:   offset,
+		Line:     line,
+		Column:   column,
+		Token:    token,
+		Expected: expected,
+	}
+}
+
+// NewTokenError creates a new parse error for the given token
+func NewTokenError(input string, tok lexer.Token, expected ...string) *ParseError {
+	return &ParseError{
+		Input:    input,
+		Offset:   tok.Start.Offset,
+		Line:     tok.Start.Line,
+		Column:   tok.Start.Column,
+		Token:    tok.Lexeme,
+		Expected: expected,
+	}
+}
+
+// NewNumberError creates a new parse error for a number literal which
+// is not a valid int, e.g. because it overflows
+func NewNumberError(input string, tok lexer.Token) *ParseError {
+	err := NewTokenError(input, tok)
+	err.Message = fmt.Sprintf("invalid number literal %q", tok.Lexeme)
+	return err
+}
+
+// NewStringError creates a new parse error for a string literal which
+// has an invalid escape or no closing quote
+func NewStringError(input string, tok lexer.Token) *ParseError {
+	err := NewTokenError(input, tok)
+	if tok.Kind == lexer.ILLEGAL {
+		err.Message = fmt.Sprintf("unterminated string literal %s", tok.Lexeme)
+	} else {
+		err.Message = fmt.Sprintf("invalid string literal %s", tok.Lexeme)
+	}
+	return err
+}
+
+// Error implements the error interface
+// e.g. "1:5: unexpected '*', expected number or '('"
+// or "1:1: invalid number literal "99999999999999999999""
+func (e *ParseError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Message)
+	}
+	return fmt.Sprintf("%d:%d: unexpected %s, %s", e.Line, e.Column, e.found(), e.expected())
+}
+
+// Pretty renders the line of the input containing the error with a caret
+// pointing at the offending token, e.g.
+//
+//	1 + * 2
+//	    ^ expected number or '('
+func (e *ParseError) Pretty() string {
+	start := strings.LastIndexByte(e.Input[:e.Offset], '\n') + 1
+	end := strings.IndexByte(e.Input[e.Offset:], '\n')
+	if end < 0 {
+		end = len(e.Input)
+	} else {
+		end += e.Offset
+	}
+	// keep tabs in the indentation so the caret lines up with the token
+	var indent strings.Builder
+	for _, c := range e.Input[start:e.Offset] {
+		if c == '\t' {
+			indent.WriteRune('\t')
+		} else {
+			indent.WriteRune(' ')
+		}
+	}
+	return e.Input[start:end] + "\n" + indent.String() + "^ " + e.describe()
+}
+
+// returns a description of the offending token
+func (e *ParseError) found() string {
+	if e.Token == "" {
+		return "end of input"
+	}
+	return "'" + e.Token + "'"
+}
+
+// returns the message or a description of the expected tokens
+func (e *ParseError) describe() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	return e.expected()
+}
+
+// returns a description of the expected tokens
+func (e *ParseError) expected() string {
+	switch len(e.Expected) {
+	case 0:
+		return "expected nothing"
+	case 1:
+		return "expected " + e.Expected[0]
+	default:
+		last := len(e.Expected) - 1
+		return "expected " + strings.Join(e.Expected[:last], ", ") + " or " + e.Expected[last]
+	}
+}
@@ -0,0 +1,66 @@
+package parser
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		input    string
+		line     int
+		column   int
+		token    string
+		expected []string
+		message  string
+		pretty   string
+	}{
+		{"1 + * 2", 1, 5, "*", []string{"number", "string", "identifier", "'true'", "'false'", "'('", "'-'", "'!'", "'let'", "'if'", "'fn'", "'\\'"},
+			"1:5: unexpected '*', expected number, string, identifier, 'true', 'false', '(', '-', '!', 'let', 'if', 'fn' or '\\'",
+			"1 + * 2\n    ^ expected number, string, identifier, 'true', 'false', '(', '-', '!', 'let', 'if', 'fn' or '\\'"},
+		{"(1 + 2", 1, 7, "", []string{"'+'", "'-'", "'*'", "'/'", "'%'", "'=='", "'!='", "'<'", "'<='", "'>'", "'>='", "'&&'", "'||'", "')'"},
+			"1:7: unexpected end of input, expected '+', '-', '*', '/', '%', '==', '!=', '<', '<=', '>', '>=', '&&', '||' or ')'",
+			"(1 + 2\n      ^ expected '+', '-', '*', '/', '%', '==', '!=', '<', '<=', '>', '>=', '&&', '||' or ')'"},
+		{"1 +\n\t2 )", 2, 4, ")", []string{"'+'", "'-'", "'*'", "'/'", "'%'", "'=='", "'!='", "'<'", "'<='", "'>'", "'>='", "'&&'", "'||'", "end of input"},
+			"2:4: unexpected ')', expected '+', '-', '*', '/', '%', '==', '!=', '<', '<=', '>', '>=', '&&', '||' or end of input",
+			"\t2 )\n\t  ^ expected '+', '-', '*', '/', '%', '==', '!=', '<', '<=', '>', '>=', '&&', '||' or end of input"},
+		{"f(1 2)", 1, 5, "2", []string{"'+'", "'-'", "'*'", "'/'", "'%'", "'=='", "'!='", "'<'", "'<='", "'>'", "'>='", "'&&'", "'||'", "','", "')'"},
+			"1:5: unexpected '2', expected '+', '-', '*', '/', '%', '==', '!=', '<', '<=', '>', '>=', '&&', '||', ',' or ')'",
+			"f(1 2)\n    ^ expected '+', '-', '*', '/', '%', '==', '!=', '<', '<=', '>', '>=', '&&', '||', ',' or ')'"},
+		{"1 $ 2", 1, 3, "$", []string{"'+'", "'-'", "'*'", "'/'", "'%'", "'=='", "'!='", "'<'", "'<='", "'>'", "'>='", "'&&'", "'||'", "end of input"},
+			"1:3: unexpected '$', expected '+', '-', '*', '/', '%', '==', '!=', '<', '<=', '>', '>=', '&&', '||' or end of input",
+			"1 $ 2\n  ^ expected '+', '-', '*', '/', '%', '==', '!=', '<', '<=', '>', '>=', '&&', '||' or end of input"},
+		{"1 - 99999999999999999999", 1, 5, "99999999999999999999", nil,
+			"1:5: invalid number literal \"99999999999999999999\"",
+			"1 - 99999999999999999999\n    ^ invalid number literal \"99999999999999999999\""},
+		{`f("\q")`, 1, 3, `"\q"`, nil,
+			`1:3: invalid string literal "\q"`,
+			"f(\"\\q\")\n  ^ invalid string literal \"\\q\""},
+		{"f(\"EUR\n)", 1, 3, `"EUR`, nil,
+			`1:3: unterminated string literal "EUR`,
+			"f(\"EUR\n  ^ unterminated string literal \"EUR"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := Parse(tt.input)
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("parse(%q) error = %v, want a *ParseError", tt.input, err)
+			}
+			if perr.Line != tt.line || perr.Column != tt.column || perr.Token != tt.token {
+				t.Errorf("parse(%q) error at %d:%d %q, want %d:%d %q", tt.input, perr.Line, perr.Column, perr.Token, tt.line, tt.column, tt.token)
+			}
+			if !reflect.DeepEqual(perr.Expected, tt.expected) {
+				t.Errorf("parse(%q) expected %v, want %v", tt.input, perr.Expected, tt.expected)
+			}
+			if got := perr.Error(); got != tt.message {
+				t.Errorf("parse(%q).Error() = %q, want %q", tt.input, got, tt.message)
+			}
+			if got := perr.Pretty(); got != tt.pretty {
+				t.Errorf("parse(%q).Pretty() = %q, want %q", tt.input, got, tt.pretty)
+			}
+		})
+	}
+}
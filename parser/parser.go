@@ -1,175 +1,471 @@
-package main
+// Package parser implements a recursive descent parser which turns simple
+// arithmetic expressions into an ast.Exp.
+package parser
 
 import (
-	"fmt"
+	"math"
 	"strconv"
-)
+	"strings"
 
-type Token int
-
-const (
-	EOS Token = iota // End of string
-	ZERO
-	ONE
-	TWO
-	OPEN
-	CLOSE
-	PLUS
-	MULT
+	"github.com/lennart01/learning_go/ast"
+	"github.com/lennart01/learning_go/lexer"
 )
 
-type EXP interface {
-	String() string
-	Eval() int
+type Parser struct {
+	input  string
+	tokens []lexer.Token // tokens of the input, the last one is always EOF
+	pos    int           // index of the next token
+	err    *ParseError   // first error encountered while parsing
 }
 
-type Int struct {
-	val int
+// Parse parses the given string and returns the resulting expression
+func Parse(s string) (ast.Exp, error) {
+	return NewParser(s).Parse()
 }
 
-func (i *Int) String() string {
-	return strconv.Itoa(i.val)
+// NewParser creates a new parser for the given input string
+func NewParser(s string) *Parser {
+	return &Parser{
+		input:  s,
+		tokens: lexer.Scan(s),
+		pos:    0,
+	}
 }
 
-func (i *Int) Eval() int {
-	return i.val
+// returns the next token without consuming it
+func (p *Parser) peek() lexer.Token {
+	return p.tokens[p.pos]
 }
 
-type BinOp struct {
-	left  EXP
-	right EXP
-	op    Token
+// consumes and returns the next token
+// the EOF token is never consumed
+func (p *Parser) next() lexer.Token {
+	tok := p.tokens[p.pos]
+	if tok.Kind != lexer.EOF {
+		p.pos++
+	}
+	return tok
 }
 
-func (b *BinOp) String() string {
-	op := ""
-	switch b.op {
-	case PLUS:
-		op = "+"
-	case MULT:
-		op = "*"
+// Parse parses the input string and returns the resulting expression
+func (p *Parser) Parse() (ast.Exp, error) {
+	exp := p.parseOr()
+	// the whole input has to be consumed
+	if p.err == nil && p.peek().Kind != lexer.EOF {
+		p.fail(p.peek(), Expected("")...)
 	}
-	return fmt.Sprintf("(%s %s %s)", b.left.String(), op, b.right.String())
-}
-func (b *BinOp) Eval() int {
-	switch b.op {
-	case PLUS:
-		return b.left.Eval() + b.right.Eval()
-	case MULT:
-		return b.left.Eval() * b.right.Eval()
-	default:
-		return 0
+	if p.err != nil {
+		return nil, p.err
 	}
+	return exp, nil
 }
 
-type Parser struct {
-	s   string
-	pos int
-}
-
-func NewParser(s string) *Parser {
-	return &Parser{
-		s:   s,
-		pos: 0,
+// parses a disjunction of conjunctions, the operator with the lowest precedence
+func (p *Parser) parseOr() ast.Exp {
+	left := p.parseAnd()
+	for p.err == nil && p.peek().Kind == lexer.OR {
+		p.next()
+		left = ast.OrExp{Left: left, Right: p.parseAnd()}
 	}
+	return left
 }
 
-func (p *Parser) skipWhitespace() {
-	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t' || p.s[p.pos] == '\n') {
-		p.pos++
+// parses a conjunction of comparisons
+func (p *Parser) parseAnd() ast.Exp {
+	left := p.parseCmp()
+	for p.err == nil && p.peek().Kind == lexer.AND {
+		p.next()
+		left = ast.AndExp{Left: left, Right: p.parseCmp()}
 	}
+	return left
 }
 
-func (p *Parser) next() Token {
-	p.skipWhitespace()
-	if p.pos >= len(p.s) {
-		return EOS
-	}
-	switch p.s[p.pos] {
-	case '0':
-		p.pos++
-		return ZERO
-	case '1':
-		p.pos++
-		return ONE
-	case '2':
-		p.pos++
-		return TWO
-	case '(':
-		p.pos++
-		return OPEN
-	case ')':
-		p.pos++
-		return CLOSE
-	case '+':
-		p.pos++
-		return PLUS
-	case '*':
-		p.pos++
-		return MULT
-	default:
-		return EOS
+// parses a comparison of sums, comparisons are left associative
+func (p *Parser) parseCmp() ast.Exp {
+	left := p.parseE()
+	for p.err == nil {
+		switch p.peek().Kind {
+		case lexer.EQ:
+			p.next()
+			left = ast.EqExp{Left: left, Right: p.parseE()}
+		case lexer.NEQ:
+			p.next()
+			left = ast.NeqExp{Left: left, Right: p.parseE()}
+		case lexer.LT:
+			p.next()
+			left = ast.LtExp{Left: left, Right: p.parseE()}
+		case lexer.LE:
+			p.next()
+			left = ast.LeExp{Left: left, Right: p.parseE()}
+		case lexer.GT:
+			p.next()
+			left = ast.GtExp{Left: left, Right: p.parseE()}
+		case lexer.GE:
+			p.next()
+			left = ast.GeExp{Left: left, Right: p.parseE()}
+		default:
+			return left
+		}
 	}
+	return left
 }
 
-func (p *Parser) parse() EXP {
-	return p.parseE()
-}
-
-func (p *Parser) parseE() EXP {
+// parses a sum or difference of terms
+func (p *Parser) parseE() ast.Exp {
 	left := p.parseT()
-	for {
-		switch p.next() {
-		case PLUS:
-			right := p.parseT()
-			left = &BinOp{left, right, PLUS}
+	for p.err == nil {
+		switch p.peek().Kind {
+		case lexer.PLUS:
+			p.next()
+			left = ast.PlusExp{Left: left, Right: p.parseT()}
+		case lexer.MINUS:
+			p.next()
+			left = ast.SubExp{Left: left, Right: p.parseT()}
 		default:
-			p.pos--
 			return left
 		}
 	}
+	return left
 }
 
-func (p *Parser) parseT() EXP {
+// parses a product, quotient or remainder of factors
+func (p *Parser) parseT() ast.Exp {
 	left := p.parseF()
-	for {
-		switch p.next() {
-		case MULT:
-			right := p.parseF()
-			left = &BinOp{left, right, MULT}
+	for p.err == nil {
+		switch p.peek().Kind {
+		case lexer.MULTIPLY:
+			p.next()
+			left = ast.MultExp{Left: left, Right: p.parseF()}
+		case lexer.DIVIDE:
+			p.next()
+			left = ast.DivExp{Left: left, Right: p.parseF()}
+		case lexer.MODULO:
+			p.next()
+			left = ast.ModExp{Left: left, Right: p.parseF()}
 		default:
-			p.pos--
 			return left
 		}
 	}
+	return left
 }
 
-func (p *Parser) parseF() EXP {
+// parses a number, a string, a boolean, a variable, a call, a negated factor, a let,
+// an if, a function definition, a lambda or an expression in parentheses
+// a call or an expression in parentheses may be followed by applications
+func (p *Parser) parseF() ast.Exp {
 	tok := p.next()
-	switch tok {
-	case ZERO, ONE, TWO:
-		val, err := strconv.Atoi(p.s[p.pos-1 : p.pos])
+	switch tok.Kind {
+	case lexer.NUMBER:
+		val, err := ParseInt(tok.Lexeme)
+		if err != nil {
+			return p.failNumber(tok)
+		}
+		return ast.IntExp{Val: val}
+	case lexer.STRING:
+		val, err := strconv.Unquote(tok.Lexeme)
 		if err != nil {
+			return p.failString(tok)
+		}
+		return ast.StringExp{Val: val}
+	case lexer.TRUE:
+		return ast.BoolExp{Val: true}
+	case lexer.FALSE:
+		return ast.BoolExp{Val: false}
+	case lexer.IDENT:
+		if p.peek().Kind == lexer.LPAREN {
+			p.next()
+			args := p.parseArgs()
+			if p.err != nil {
+				return nil
+			}
+			return p.parseApps(ast.CallExp{Name: tok.Lexeme, Args: args})
+		}
+		return ast.VarExp{Name: tok.Lexeme}
+	case lexer.MINUS:
+		if num := p.peek(); num.Kind == lexer.NUMBER && MinIntLiteral(num.Lexeme) {
+			p.next()
+			return ast.IntExp{Val: math.MinInt}
+		}
+		exp := p.parseF()
+		if p.err != nil {
+			return nil
+		}
+		return ast.NegExp{Exp: exp}
+	case lexer.NOT:
+		exp := p.parseF()
+		if p.err != nil {
 			return nil
 		}
-		return &Int{val}
-	case OPEN:
-		expr := p.parseE()
-		if p.next() == CLOSE {
-			return expr
-		} else {
+		return ast.NotExp{Exp: exp}
+	case lexer.LPAREN:
+		expr := p.parseOr()
+		if p.err != nil {
 			return nil
 		}
+		if tok := p.next(); tok.Kind != lexer.RPAREN {
+			return p.fail(tok, Expected(")")...)
+		}
+		return p.parseApps(expr)
+	case lexer.LET:
+		return p.parseLet()
+	case lexer.IF:
+		return p.parseIf()
+	case lexer.FN:
+		return p.parseFn()
+	case lexer.LAMBDA:
+		return p.parseLambda()
 	default:
+		if UnterminatedString(tok) {
+			return p.failString(tok)
+		}
+		return p.fail(tok, Operands()...)
+	}
+}
+
+// parses the rest of let name = value in body after the keyword let
+// the body extends as far as possible, e.g. let x = 1 in x + 1 is
+// let x = 1 in (x + 1)
+func (p *Parser) parseLet() ast.Exp {
+	name := p.next()
+	if name.Kind != lexer.IDENT {
+		return p.fail(name, "identifier")
+	}
+	if tok := p.next(); tok.Kind != lexer.ASSIGN {
+		return p.fail(tok, "'='")
+	}
+	value := p.parseOr()
+	if p.err != nil {
+		return nil
+	}
+	if tok := p.next(); tok.Kind != lexer.IN {
+		return p.fail(tok, Expected("in")...)
+	}
+	body := p.parseOr()
+	if p.err != nil {
+		return nil
+	}
+	return ast.LetExp{Name: name.Lexeme, Value: value, Body: body}
+}
+
+// parses the rest of if cond then a else b after the keyword if
+// like the body of a let, the else branch extends as far as possible
+func (p *Parser) parseIf() ast.Exp {
+	cond := p.parseOr()
+	if p.err != nil {
+		return nil
+	}
+	if tok := p.next(); tok.Kind != lexer.THEN {
+		return p.fail(tok, Expected("then")...)
+	}
+	then := p.parseOr()
+	if p.err != nil {
+		return nil
+	}
+	if tok := p.next(); tok.Kind != lexer.ELSE {
+		return p.fail(tok, Expected("else")...)
+	}
+	els := p.parseOr()
+	if p.err != nil {
+		return nil
+	}
+	return ast.IfExp{Cond: cond, Then: then, Else: els}
+}
+
+// parses the rest of the arguments (a, b) of a call or an application
+// after the opening parenthesis
+func (p *Parser) parseArgs() []ast.Exp {
+	args := []ast.Exp{}
+	if p.peek().Kind == lexer.RPAREN {
+		p.next()
+		return args
+	}
+	for {
+		arg := p.parseOr()
+		if p.err != nil {
+			return nil
+		}
+		args = append(args, arg)
+		switch tok := p.next(); tok.Kind {
+		case lexer.COMMA:
+		case lexer.RPAREN:
+			return args
+		default:
+			p.fail(tok, append(Expected(","), "')'")...)
+			return nil
+		}
+	}
+}
+
+// parses the applications which follow fn, e.g. the (2) of f(1)(2)
+func (p *Parser) parseApps(fn ast.Exp) ast.Exp {
+	for p.peek().Kind == lexer.LPAREN {
+		p.next()
+		args := p.parseArgs()
+		if p.err != nil {
+			return nil
+		}
+		fn = ast.AppExp{Fn: fn, Args: args}
+	}
+	return fn
+}
+
+// parses the rest of the lambda \a b -> body after the backslash
+// like the body of a let, the body extends as far as possible
+func (p *Parser) parseLambda() ast.Exp {
+	params := []string{}
+	for {
+		tok := p.next()
+		if tok.Kind == lexer.ARROW {
+			break
+		}
+		if tok.Kind != lexer.IDENT {
+			return p.fail(tok, "identifier", "'->'")
+		}
+		params = append(params, tok.Lexeme)
+	}
+	body := p.parseOr()
+	if p.err != nil {
 		return nil
 	}
+	return ast.LambdaExp{Params: params, Body: body}
 }
 
-func main() {
-	expr := "2 * (1 + 1)"
-	parser := NewParser(expr)
-	ast := parser.parse()
-	fmt.Println("Expr:", expr)
-	fmt.Println("AST:", ast)
-	fmt.Println("Result:", ast.Eval())
+// parses the rest of fn name(a, b) = body in exp after the keyword fn
+// like the body of a let, exp extends as far as possible
+func (p *Parser) parseFn() ast.Exp {
+	name := p.next()
+	if name.Kind != lexer.IDENT {
+		return p.fail(name, "identifier")
+	}
+	if tok := p.next(); tok.Kind != lexer.LPAREN {
+		return p.fail(tok, "'('")
+	}
+	params := []string{}
+	if p.peek().Kind == lexer.RPAREN {
+		p.next()
+	} else {
+		for {
+			param := p.next()
+			if param.Kind != lexer.IDENT {
+				return p.fail(param, "identifier")
+			}
+			params = append(params, param.Lexeme)
+			tok := p.next()
+			if tok.Kind == lexer.RPAREN {
+				break
+			}
+			if tok.Kind != lexer.COMMA {
+				return p.fail(tok, "','", "')'")
+			}
+		}
+	}
+	if tok := p.next(); tok.Kind != lexer.ASSIGN {
+		return p.fail(tok, "'='")
+	}
+	body := p.parseOr()
+	if p.err != nil {
+		return nil
+	}
+	if tok := p.next(); tok.Kind != lexer.IN {
+		return p.fail(tok, Expected("in")...)
+	}
+	in := p.parseOr()
+	if p.err != nil {
+		return nil
+	}
+	return ast.FuncExp{Name: name.Lexeme, Params: params, Body: body, In: in}
+}
+
+// Operands returns the tokens which may start an expression
+func Operands() []string {
+	return []string{"number", "string", "identifier", "'true'", "'false'", "'('", "'-'", "'!'", "'let'", "'if'", "'fn'", "'\\'"}
+}
+
+// Expected returns the tokens which may follow a complete expression:
+// the binary operators and the given closing token,
+// an empty token stands for the end of the input
+func Expected(closing string) []string {
+	expected := []string{"'+'", "'-'", "'*'", "'/'", "'%'", "'=='", "'!='", "'<'", "'<='", "'>'", "'>='", "'&&'", "'||'"}
+	if closing == "" {
+		return append(expected, "end of input")
+	}
+	return append(expected, "'"+closing+"'")
+}
+
+// ParseInt converts an integer literal into its value
+// decimal literals and the prefixes 0x, 0b and 0o are supported,
+// underscores may be used to separate digits, e.g. 1_000_000 or 0xFF_FF
+// a leading minus is part of the value, so the smallest int
+// -9223372036854775808 can be parsed although 9223372036854775808 overflows
+func ParseInt(lit string) (int, error) {
+	sign, digits := "", lit
+	if strings.HasPrefix(digits, "-") {
+		sign, digits = "-", digits[1:]
+	}
+	base := 10
+	if len(digits) > 2 && digits[0] == '0' {
+		switch digits[1] {
+		case 'x', 'X':
+			base = 16
+		case 'b', 'B':
+			base = 2
+		case 'o', 'O':
+			base = 8
+		}
+		if base != 10 {
+			digits = digits[2:]
+		}
+	}
+	// underscores are only allowed between digits
+	if strings.HasPrefix(digits, "_") || strings.HasSuffix(digits, "_") || strings.Contains(digits, "__") {
+		return 0, &strconv.NumError{Func: "ParseInt", Num: lit, Err: strconv.ErrSyntax}
+	}
+	val, err := strconv.ParseInt(sign+strings.ReplaceAll(digits, "_", ""), base, strconv.IntSize)
+	if err != nil {
+		return 0, &strconv.NumError{Func: "ParseInt", Num: lit, Err: err.(*strconv.NumError).Err}
+	}
+	return int(val), nil
+}
+
+// UnterminatedString reports whether the token is a string literal
+// without its closing quote, which the lexer scans as an illegal token
+func UnterminatedString(tok lexer.Token) bool {
+	return tok.Kind == lexer.ILLEGAL && strings.HasPrefix(tok.Lexeme, `"`)
+}
+
+// MinIntLiteral reports whether the literal is the magnitude of the
+// smallest int, which overflows on its own and is only valid after a minus
+func MinIntLiteral(lit string) bool {
+	if _, err := ParseInt(lit); err == nil {
+		return false
+	}
+	val, err := ParseInt("-" + lit)
+	return err == nil && val == math.MinInt
+}
+
+// failString records a parse error for an invalid string literal and
+// returns a nil expression, only the first error is kept
+func (p *Parser) failString(tok lexer.Token) ast.Exp {
+	if p.err == nil {
+		p.err = NewStringError(p.input, tok)
+	}
+	return nil
+}
+
+// fail records a parse error for the given token and returns a nil
+// expression, only the first error is kept
+func (p *Parser) fail(tok lexer.Token, expected ...string) ast.Exp {
+	if p.err == nil {
+		p.err = NewTokenError(p.input, tok, expected...)
+	}
+	return nil
+}
+
+// failNumber records a parse error for an invalid number literal and
+// returns a nil expression, only the first error is kept
+func (p *Parser) failNumber(tok lexer.Token) ast.Exp {
+	if p.err == nil {
+		p.err = NewNumberError(p.input, tok)
+	}
+	return nil
 }
@@ -1,29 +1,372 @@
-package main
+package parser
 
 import (
+	"math"
 	"testing"
+
+	"github.com/lennart01/learning_go/ast"
+	"github.com/lennart01/learning_go/vm"
 )
 
 func TestParse(t *testing.T) {
+	tests := []struct {
+		input  string
+		want   int
+		pretty string
+	}{
+		{"1 + 2 * 0", 1, "(1+(2*0))"},
+		{"2 * (1 + 1)", 4, "(2*(1+1))"},
+		{"(2 + 1) * 0", 0, "((2+1)*0)"},
+		{"1 + (2 * 1) + 2", 5, "((1+(2*1))+2)"},
+		{"1+2+1 * 2", 5, "((1+2)+(1*2))"},
+		{"10 + 3", 13, "(10+3)"},
+		{"1_000 * 0x10", 16000, "(1000*16)"},
+		{"0b101 + 0o17 + 007", 27, "((5+15)+7)"},
+		{"1 - 2 - 3", -4, "((1-2)-3)"},
+		{"7 / 2 * 2", 6, "((7/2)*2)"},
+		{"7 % 3 + 1", 2, "((7%3)+1)"},
+		{"-2 * 3", -6, "((-2)*3)"},
+		{"2 - -3", 5, "(2-(-3))"},
+		{"-(1 + 2)", -3, "(-(1+2))"},
+		// the smallest int only fits as one negative literal
+		{"-9223372036854775808 + 1", math.MinInt + 1, "(-9223372036854775808+1)"},
+		{"--0x8000_0000_0000_0000", math.MinInt, "(--9223372036854775808)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			exp, err := Parse(tt.input)
+			if err != nil {
+				t.Fatalf("parse(%q) returned error: %v", tt.input, err)
+			}
+			if got := exp.Pretty(); got != tt.pretty {
+				t.Errorf("parse(%q).Pretty() = %q, want %q", tt.input, got, tt.pretty)
+			}
+			got := exp.Eval()
+			if got != tt.want {
+				t.Errorf("eval(parse(%q)) = %d, want %d", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+// the parsed ast can be compiled and run by the vm without any conversion
+func TestParseCompileRun(t *testing.T) {
 	tests := []struct {
 		input string
 		want  int
 	}{
 		{"1 + 2 * 0", 1},
 		{"2 * (1 + 1)", 4},
-		{"(2 + 1) * 0", 0},
-		{"1 + (2 * 1) + 2", 5},
-		{"1+2+1 * 2", 5},
+		{"(2 + 1) * (2 + 2)", 12},
+		{"10 - 4 / 2 % 3 - -1", 9},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
-			parser := NewParser(tt.input)
-			ast := parser.parse()
-			got := ast.Eval()
-			if got != tt.want {
+			exp, err := Parse(tt.input)
+			if err != nil {
+				t.Fatalf("parse(%q) returned error: %v", tt.input, err)
+			}
+			prog, err := vm.Compile(exp)
+			if err != nil {
+				t.Fatalf("compile(%q) returned error: %v", tt.input, err)
+			}
+			result, err := prog.Run()
+			if err != nil || result != vm.Value(tt.want) {
+				t.Errorf("run(compile(parse(%q))) = %d, %v, want %d", tt.input, result, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseVariables(t *testing.T) {
+	env := ast.Env{"price": 3, "qty": 4, "_tax2": 2}
+	tests := []struct {
+		input  string
+		want   int
+		pretty string
+	}{
+		{"price * qty", 12, "(price*qty)"},
+		{"price * qty - _tax2", 10, "((price*qty)-_tax2)"},
+		{"-(price + 1) % qty", 0, "((-(price+1))%qty)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			exp, err := Parse(tt.input)
+			if err != nil {
+				t.Fatalf("parse(%q) returned error: %v", tt.input, err)
+			}
+			if got := exp.Pretty(); got != tt.pretty {
+				t.Errorf("parse(%q).Pretty() = %q, want %q", tt.input, got, tt.pretty)
+			}
+			if got := exp.Eval(env); got != tt.want {
+				t.Errorf("eval(parse(%q)) = %d, want %d", tt.input, got, tt.want)
+			}
+			prog, err := vm.Compile(exp)
+			if err != nil {
+				t.Fatalf("compile(%q) returned error: %v", tt.input, err)
+			}
+			if result, err := prog.RunEnv(env); err != nil || result != vm.Value(tt.want) {
+				t.Errorf("run(compile(parse(%q))) = %d, %v, want %d", tt.input, result, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLet(t *testing.T) {
+	env := ast.Env{"x": 10, "price": 3}
+	tests := []struct {
+		input  string
+		want   int
+		pretty string
+	}{
+		{"let x = 1 + 2 in x * x", 9, "(let x = (1+2) in (x*x))"},
+		// the body extends as far as possible
+		{"let y = 2 in y + 1 * y", 4, "(let y = 2 in (y+(1*y)))"},
+		{"1 + let y = 2 in y * 3", 7, "(1+(let y = 2 in (y*3)))"},
+		{"(let y = 2 in y) * 3", 6, "((let y = 2 in y)*3)"},
+		// the name is not visible in its own value
+		{"let x = x + 1 in x", 11, "(let x = (x+1) in x)"},
+		{"let a = price * 2 in let b = a + 1 in a * b - x", 32, "(let a = (price*2) in (let b = (a+1) in ((a*b)-x)))"},
+		{"let x = let x = 2 in x * x in x + x", 8, "(let x = (let x = 2 in (x*x)) in (x+x))"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			exp, err := Parse(tt.input)
+			if err != nil {
+				t.Fatalf("parse(%q) returned error: %v", tt.input, err)
+			}
+			if got := exp.Pretty(); got != tt.pretty {
+				t.Errorf("parse(%q).Pretty() = %q, want %q", tt.input, got, tt.pretty)
+			}
+			if got := exp.Eval(env); got != tt.want {
+				t.Errorf("eval(parse(%q)) = %d, want %d", tt.input, got, tt.want)
+			}
+			prog, err := vm.Compile(exp)
+			if err != nil {
+				t.Fatalf("compile(%q) returned error: %v", tt.input, err)
+			}
+			if result, err := prog.Eval(env); err != nil || result != vm.Value(tt.want) {
+				t.Errorf("run(compile(parse(%q))) = %d, %v, want %d", tt.input, result, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseConditionals(t *testing.T) {
+	env := ast.Env{"total": 120, "qty": 3}
+	tests := []struct {
+		input  string
+		want   int
+		pretty string
+	}{
+		{"1 + 2 == 3", 1, "((1+2)==3)"},
+		{"total > 100 && qty >= 3", 1, "((total>100)&&(qty>=3))"},
+		{"qty < 2 || qty != 3 && true", 0, "((qty<2)||((qty!=3)&&true))"},
+		{"!(qty <= 3) || false", 0, "((!(qty<=3))||false)"},
+		{"!!(qty > 0)", 1, "(!(!(qty>0)))"},
+		{"(1 < 2) == (2 < 3)", 1, "((1<2)==(2<3))"},
+		// a discount with thresholds
+		{"total - if total >= 100 then total / 10 else if total >= 50 then 5 else 0", 108,
+			"(total-(if (total>=100) then (total/10) else (if (total>=50) then 5 else 0)))"},
+		{"(if qty > 2 then 1 else 0) * 7", 7, "((if (qty>2) then 1 else 0)*7)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			exp, err := Parse(tt.input)
+			if err != nil {
+				t.Fatalf("parse(%q) returned error: %v", tt.input, err)
+			}
+			if got := exp.Pretty(); got != tt.pretty {
+				t.Errorf("parse(%q).Pretty() = %q, want %q", tt.input, got, tt.pretty)
+			}
+			if got := exp.Eval(env); got != tt.want {
+				t.Errorf("eval(parse(%q)) = %d, want %d", tt.input, got, tt.want)
+			}
+			prog, err := vm.Compile(exp)
+			if err != nil {
+				t.Fatalf("compile(%q) returned error: %v", tt.input, err)
+			}
+			if result, err := prog.Eval(env); err != nil || result != vm.Value(tt.want) {
+				t.Errorf("run(compile(parse(%q))) = %d, %v, want %d", tt.input, result, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseInt(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int
+	}{
+		{"0", 0},
+		{"42", 42},
+		{"1_000_000", 1000000},
+		{"0x2A", 42},
+		{"0XFF_FF", 65535},
+		{"0b1010", 10},
+		{"0o17", 15},
+		{"010", 10},
+		{"-42", -42},
+		{"-9223372036854775808", math.MinInt},
+		{"-0x8000000000000000", math.MinInt},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseInt(tt.input)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseInt(%q) = %d, %v, want %d", tt.input, got, err, tt.want)
+		}
+	}
+
+	for _, input := range []string{"12ab", "1__0", "1_", "0x", "0x_1", "0b102", "99999999999999999999", "9223372036854775808", "--1", "-"} {
+		if _, err := ParseInt(input); err == nil {
+			t.Errorf("ParseInt(%q) returned no error", input)
+		}
+	}
+}
+
+func TestParseFunctions(t *testing.T) {
+	env := ast.Env{"x": 10}
+	tests := []struct {
+		input  string
+		want   int
+		pretty string
+	}{
+		{"fn f(n) = if n < 2 then n else f(n-1) + f(n-2) in f(x)", 55,
+			"(fn f(n) = (if (n<2) then n else (f((n-1))+f((n-2)))) in f(x))"},
+		{"fn add(a, b) = a + b in add(1, 2) * add(x, -x)", 0, "(fn add(a, b) = (a+b) in (add(1, 2)*add(x, (-x))))"},
+		{"fn seven() = 7 in seven() + 1", 8, "(fn seven() = 7 in (seven()+1))"},
+		{"fn inc(a) = a + 1 in fn twice(a) = inc(inc(a)) in twice(x)", 12,
+			"(fn inc(a) = (a+1) in (fn twice(a) = inc(inc(a)) in twice(x)))"},
+		// the function body sees the variables of the environment
+		{"fn scale(a) = a * x in scale(3)", 30, "(fn scale(a) = (a*x) in scale(3))"},
+		// and the enclosing lets and parameters
+		{"let rate = 2 in fn f(y) = y * rate in f(3)", 6, "(let rate = 2 in (fn f(y) = (y*rate) in f(3)))"},
+		{"fn f(a) = (fn g(b) = a + b in g(1)) in f(x)", 11, "(fn f(a) = (fn g(b) = (a+b) in g(1)) in f(x))"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			exp, err := Parse(tt.input)
+			if err != nil {
+				t.Fatalf("parse(%q) returned error: %v", tt.input, err)
+			}
+			if got := exp.Pretty(); got != tt.pretty {
+				t.Errorf("parse(%q).Pretty() = %q, want %q", tt.input, got, tt.pretty)
+			}
+			if got := exp.Eval(env); got != tt.want {
 				t.Errorf("eval(parse(%q)) = %d, want %d", tt.input, got, tt.want)
 			}
+			prog, err := vm.Compile(exp)
+			if err != nil {
+				t.Fatalf("compile(%q) returned error: %v", tt.input, err)
+			}
+			if result, err := prog.Eval(env); err != nil || result != vm.Value(tt.want) {
+				t.Errorf("run(compile(parse(%q))) = %d, %v, want %d", tt.input, result, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLambdas(t *testing.T) {
+	env := ast.Env{"x": 10}
+	tests := []struct {
+		input  string
+		want   int
+		pretty string
+	}{
+		{"(\\a -> a + 1)(x)", 11, "(\\a -> (a+1))(x)"},
+		{"(\\ -> 7)() * 2", 14, "((\\ -> 7)()*2)"},
+		{"let add = \\a b -> a + b in add(x, 1)", 11, "(let add = (\\a b -> (a+b)) in add(x, 1))"},
+		// the body of a lambda extends as far as possible
+		{"(\\a -> a * 2 + 1)(x)", 21, "(\\a -> ((a*2)+1))(x)"},
+		{"fn adder(n) = \\a -> a + n in adder(3)(x)", 13, "(fn adder(n) = (\\a -> (a+n)) in adder(3)(x))"},
+		{"(\\a -> \\b -> a - b)(x)(1)", 9, "(\\a -> (\\b -> (a-b)))(x)(1)"},
+		{"fn twice(f, a) = f(f(a)) in twice(\\a -> a * 3, x)", 90, "(fn twice(f, a) = f(f(a)) in twice((\\a -> (a*3)), x))"},
+		{"fn fold(f, acc, n) = if n == 0 then acc else fold(f, f(acc, n), n - 1) in fold(\\acc n -> acc + n, 0, x)", 55,
+			"(fn fold(f, acc, n) = (if (n==0) then acc else fold(f, f(acc, n), (n-1))) in fold((\\acc n -> (acc+n)), 0, x))"},
+		{"let y = 4 in fn g(a) = (\\b -> b + y)(a) in g(1)", 5, "(let y = 4 in (fn g(a) = (\\b -> (b+y))(a) in g(1)))"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			exp, err := Parse(tt.input)
+			if err != nil {
+				t.Fatalf("parse(%q) returned error: %v", tt.input, err)
+			}
+			if got := exp.Pretty(); got != tt.pretty {
+				t.Errorf("parse(%q).Pretty() = %q, want %q", tt.input, got, tt.pretty)
+			}
+			if got, err := ast.Evaluate(exp, env); err != nil || got != tt.want {
+				t.Errorf("eval(parse(%q)) = %d, %v, want %d", tt.input, got, err, tt.want)
+			}
+			prog, err := vm.Compile(exp)
+			if err != nil {
+				t.Fatalf("compile(%q) returned error: %v", tt.input, err)
+			}
+			if result, err := prog.Eval(env); err != nil || result != vm.Value(tt.want) {
+				t.Errorf("run(compile(parse(%q))) = %d, %v, want %d", tt.input, result, err, tt.want)
+			}
+		})
+	}
+}
+
+// strings are only passed to native functions, so they are checked
+// against the signatures of the natives of the vm
+func TestParseStrings(t *testing.T) {
+	natives := vm.NewNatives()
+	rates := map[string]int{"EUR": 108, "say \"hi\"": 1}
+	if err := natives.RegisterGoFunc("lookupRate", func(cur string) int { return rates[cur] }); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		input  string
+		want   int
+		pretty string
+	}{
+		{`lookupRate("EUR") * 2`, 216, `(lookupRate("EUR")*2)`},
+		{`lookupRate("say \"hi\"") + lookupRate("")`, 1, `(lookupRate("say \"hi\"")+lookupRate(""))`},
+		{`let c = "EUR" in lookupRate(c)`, 108, `(let c = "EUR" in lookupRate(c))`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			exp, err := Parse(tt.input)
+			if err != nil {
+				t.Fatalf("parse(%q) returned error: %v", tt.input, err)
+			}
+			if got := exp.Pretty(); got != tt.pretty {
+				t.Errorf("parse(%q).Pretty() = %q, want %q", tt.input, got, tt.pretty)
+			}
+			prog, err := vm.CompileWith(exp, natives)
+			if err != nil {
+				t.Fatalf("compile(%q) returned error: %v", tt.input, err)
+			}
+			if result, err := prog.Run(); err != nil || result != vm.Value(tt.want) {
+				t.Errorf("run(compile(parse(%q))) = %d, %v, want %d", tt.input, result, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []string{"1 +", "(1 + 2", "*", "12ab + 1", "0x", "1 -", "- * 2", "price qty", "x(1",
+		"let", "let 1 = 2 in 3", "let x 2 in x", "let x = 2 x", "let x = 2 in", "in", "let in = 1 in 2",
+		"if 1 then 2", "if 1 else 2", "if then 1 else 2", "1 & 2", "1 =< 2", "true = 1",
+		"f(1 2)", "f(,)", "fn (x) = x in 1", "fn f x = x in 1", "fn f(1) = 1 in 2", "fn f(x y) = x in 1", "fn f(x) x in 1", "fn f(x) = x", "fn = 1",
+		"\\", "\\a", "\\a, b -> a", "\\1 -> 1", "\\a -> ", "\\a => a", "f(1)(", "(1)(2,)", "9223372036854775808", "-9223372036854775809", "-(9223372036854775808)",
+		`f("a)`, `f("\q")`, "f(\"a\nb\")"}
+
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			if _, err := Parse(input); err == nil {
+				t.Errorf("parse(%q) returned no error", input)
+			}
 		})
 	}
 }
@@ -0,0 +1,376 @@
+// Package pratt implements a Pratt (top-down operator precedence) parser
+// which turns arithmetic expressions into an ast.Exp.
+package pratt
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/lennart01/learning_go/ast"
+	"github.com/lennart01/learning_go/lexer"
+	"github.com/lennart01/learning_go/parser"
+)
+
+// precedence of the unary minus and not, they bind tighter than all binary operators
+const prefixPrecedence = 6
+
+// precedences of the binary operators
+var precedences = map[lexer.Kind]int{
+	lexer.OR:       1,
+	lexer.AND:      2,
+	lexer.EQ:       3,
+	lexer.NEQ:      3,
+	lexer.LT:       3,
+	lexer.LE:       3,
+	lexer.GT:       3,
+	lexer.GE:       3,
+	lexer.PLUS:     4,
+	lexer.MINUS:    4,
+	lexer.MULTIPLY: 5,
+	lexer.DIVIDE:   5,
+	lexer.MODULO:   5,
+}
+
+// constructors for the binary operators
+var binaryOps = map[lexer.Kind]func(left, right ast.Exp) ast.Exp{
+	lexer.PLUS:     func(left, right ast.Exp) ast.Exp { return ast.PlusExp{Left: left, Right: right} },
+	lexer.MINUS:    func(left, right ast.Exp) ast.Exp { return ast.SubExp{Left: left, Right: right} },
+	lexer.MULTIPLY: func(left, right ast.Exp) ast.Exp { return ast.MultExp{Left: left, Right: right} },
+	lexer.DIVIDE:   func(left, right ast.Exp) ast.Exp { return ast.DivExp{Left: left, Right: right} },
+	lexer.MODULO:   func(left, right ast.Exp) ast.Exp { return ast.ModExp{Left: left, Right: right} },
+	lexer.EQ:       func(left, right ast.Exp) ast.Exp { return ast.EqExp{Left: left, Right: right} },
+	lexer.NEQ:      func(left, right ast.Exp) ast.Exp { return ast.NeqExp{Left: left, Right: right} },
+	lexer.LT:       func(left, right ast.Exp) ast.Exp { return ast.LtExp{Left: left, Right: right} },
+	lexer.LE:       func(left, right ast.Exp) ast.Exp { return ast.LeExp{Left: left, Right: right} },
+	lexer.GT:       func(left, right ast.Exp) ast.Exp { return ast.GtExp{Left: left, Right: right} },
+	lexer.GE:       func(left, right ast.Exp) ast.Exp { return ast.GeExp{Left: left, Right: right} },
+	lexer.AND:      func(left, right ast.Exp) ast.Exp { return ast.AndExp{Left: left, Right: right} },
+	lexer.OR:       func(left, right ast.Exp) ast.Exp { return ast.OrExp{Left: left, Right: right} },
+}
+
+// Parser represents a parser for the input string
+type Parser struct {
+	input  string
+	tokens []lexer.Token // tokens of the input, the last one is always EOF
+	pos    int
+	err    *parser.ParseError // first error encountered while parsing
+}
+
+// Parse parses the given input string and returns the resulting expression
+func Parse(input string) (ast.Exp, error) {
+	return NewParser(input).Parse()
+}
+
+// NewParser creates a new parser for the given input string
+func NewParser(input string) *Parser {
+	tokens := lexer.Scan(input)
+	return &Parser{input: input, tokens: tokens, pos: 0}
+}
+
+// Parse parses the input string and returns the resulting expression
+func (p *Parser) Parse() (ast.Exp, error) {
+	expr := p.parseExpression(0)
+	// the whole input has to be consumed
+	if p.err == nil && p.tokens[p.pos].Kind != lexer.EOF {
+		p.fail(parser.Expected("")...)
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return expr, nil
+}
+
+// parseExpression parses an expression with the given precedence
+// only operators with at least this precedence are consumed
+func (p *Parser) parseExpression(precedence int) ast.Exp {
+	left := p.parseAtom()
+
+	for p.err == nil {
+		token := p.tokens[p.pos]
+
+		opPrecedence, ok := precedences[token.Kind]
+		if !ok || opPrecedence < precedence {
+			break
+		}
+
+		p.pos++
+		// the right operand only takes operators with a higher precedence,
+		// this makes all binary operators left associative
+		right := p.parseExpression(opPrecedence + 1)
+		left = binaryOps[token.Kind](left, right)
+	}
+
+	return left
+}
+
+// parseAtom parses an atomic expression, a number, a string, a boolean, a variable,
+// a call, a negated expression, a let, an if, a function definition,
+// a lambda or an expression in parentheses
+// a call or an expression in parentheses may be followed by applications
+func (p *Parser) parseAtom() ast.Exp {
+	token := p.tokens[p.pos]
+
+	switch token.Kind {
+	case lexer.NUMBER:
+		value, err := parser.ParseInt(token.Lexeme)
+		if err != nil {
+			if p.err == nil {
+				p.err = parser.NewNumberError(p.input, token)
+			}
+			return nil
+		}
+		p.pos++
+		return ast.IntExp{Val: value}
+	case lexer.STRING:
+		value, err := strconv.Unquote(token.Lexeme)
+		if err != nil {
+			return p.failString(token)
+		}
+		p.pos++
+		return ast.StringExp{Val: value}
+	case lexer.TRUE, lexer.FALSE:
+		p.pos++
+		return ast.BoolExp{Val: token.Kind == lexer.TRUE}
+	case lexer.IDENT:
+		p.pos++
+		if p.tokens[p.pos].Kind == lexer.LPAREN {
+			p.pos++
+			args := p.parseArgs()
+			if p.err != nil {
+				return nil
+			}
+			return p.parseApps(ast.CallExp{Name: token.Lexeme, Args: args})
+		}
+		return ast.VarExp{Name: token.Lexeme}
+	case lexer.MINUS:
+		p.pos++
+		if num := p.tokens[p.pos]; num.Kind == lexer.NUMBER && parser.MinIntLiteral(num.Lexeme) {
+			p.pos++
+			return ast.IntExp{Val: math.MinInt}
+		}
+		expr := p.parseExpression(prefixPrecedence)
+		if p.err != nil {
+			return nil
+		}
+		return ast.NegExp{Exp: expr}
+	case lexer.NOT:
+		p.pos++
+		expr := p.parseExpression(prefixPrecedence)
+		if p.err != nil {
+			return nil
+		}
+		return ast.NotExp{Exp: expr}
+	case lexer.LPAREN:
+		p.pos++
+		expr := p.parseExpression(0)
+		if p.err != nil {
+			return nil
+		}
+		if p.tokens[p.pos].Kind == lexer.RPAREN {
+			p.pos++
+			return p.parseApps(expr)
+		} else {
+			return p.fail(parser.Expected(")")...)
+		}
+	case lexer.LET:
+		p.pos++
+		return p.parseLet()
+	case lexer.IF:
+		p.pos++
+		return p.parseIf()
+	case lexer.FN:
+		p.pos++
+		return p.parseFn()
+	case lexer.LAMBDA:
+		p.pos++
+		return p.parseLambda()
+	default:
+		if parser.UnterminatedString(token) {
+			return p.failString(token)
+		}
+		return p.fail(parser.Operands()...)
+	}
+}
+
+// parseLet parses the rest of let name = value in body after the keyword let
+// the body has the lowest precedence, so it extends as far as possible
+func (p *Parser) parseLet() ast.Exp {
+	name := p.tokens[p.pos]
+	if name.Kind != lexer.IDENT {
+		return p.fail("identifier")
+	}
+	p.pos++
+	if p.tokens[p.pos].Kind != lexer.ASSIGN {
+		return p.fail("'='")
+	}
+	p.pos++
+	value := p.parseExpression(0)
+	if p.err != nil {
+		return nil
+	}
+	if p.tokens[p.pos].Kind != lexer.IN {
+		return p.fail(parser.Expected("in")...)
+	}
+	p.pos++
+	body := p.parseExpression(0)
+	if p.err != nil {
+		return nil
+	}
+	return ast.LetExp{Name: name.Lexeme, Value: value, Body: body}
+}
+
+// parseIf parses the rest of if cond then a else b after the keyword if
+// like the body of a let, the else branch extends as far as possible
+func (p *Parser) parseIf() ast.Exp {
+	cond := p.parseExpression(0)
+	if p.err != nil {
+		return nil
+	}
+	if p.tokens[p.pos].Kind != lexer.THEN {
+		return p.fail(parser.Expected("then")...)
+	}
+	p.pos++
+	then := p.parseExpression(0)
+	if p.err != nil {
+		return nil
+	}
+	if p.tokens[p.pos].Kind != lexer.ELSE {
+		return p.fail(parser.Expected("else")...)
+	}
+	p.pos++
+	els := p.parseExpression(0)
+	if p.err != nil {
+		return nil
+	}
+	return ast.IfExp{Cond: cond, Then: then, Else: els}
+}
+
+// parseArgs parses the arguments of a call or an application after
+// the opening parenthesis
+func (p *Parser) parseArgs() []ast.Exp {
+	args := []ast.Exp{}
+	if p.tokens[p.pos].Kind == lexer.RPAREN {
+		p.pos++
+		return args
+	}
+	for {
+		arg := p.parseExpression(0)
+		if p.err != nil {
+			return nil
+		}
+		args = append(args, arg)
+		switch p.tokens[p.pos].Kind {
+		case lexer.COMMA:
+			p.pos++
+		case lexer.RPAREN:
+			p.pos++
+			return args
+		default:
+			p.fail(append(parser.Expected(","), "')'")...)
+			return nil
+		}
+	}
+}
+
+// parseApps parses the applications which follow fn, e.g. the (2) of f(1)(2)
+func (p *Parser) parseApps(fn ast.Exp) ast.Exp {
+	for p.tokens[p.pos].Kind == lexer.LPAREN {
+		p.pos++
+		args := p.parseArgs()
+		if p.err != nil {
+			return nil
+		}
+		fn = ast.AppExp{Fn: fn, Args: args}
+	}
+	return fn
+}
+
+// parseLambda parses the rest of the lambda \a b -> body after the backslash
+// like the body of a let, the body extends as far as possible
+func (p *Parser) parseLambda() ast.Exp {
+	params := []string{}
+	for p.tokens[p.pos].Kind != lexer.ARROW {
+		param := p.tokens[p.pos]
+		if param.Kind != lexer.IDENT {
+			return p.fail("identifier", "'->'")
+		}
+		p.pos++
+		params = append(params, param.Lexeme)
+	}
+	p.pos++
+	body := p.parseExpression(0)
+	if p.err != nil {
+		return nil
+	}
+	return ast.LambdaExp{Params: params, Body: body}
+}
+
+// parseFn parses the rest of fn name(a, b) = body in exp after the keyword fn
+// like the body of a let, exp extends as far as possible
+func (p *Parser) parseFn() ast.Exp {
+	name := p.tokens[p.pos]
+	if name.Kind != lexer.IDENT {
+		return p.fail("identifier")
+	}
+	p.pos++
+	if p.tokens[p.pos].Kind != lexer.LPAREN {
+		return p.fail("'('")
+	}
+	p.pos++
+	params := []string{}
+	if p.tokens[p.pos].Kind == lexer.RPAREN {
+		p.pos++
+	} else {
+		for {
+			param := p.tokens[p.pos]
+			if param.Kind != lexer.IDENT {
+				return p.fail("identifier")
+			}
+			p.pos++
+			params = append(params, param.Lexeme)
+			kind := p.tokens[p.pos].Kind
+			if kind != lexer.COMMA && kind != lexer.RPAREN {
+				return p.fail("','", "')'")
+			}
+			p.pos++
+			if kind == lexer.RPAREN {
+				break
+			}
+		}
+	}
+	if p.tokens[p.pos].Kind != lexer.ASSIGN {
+		return p.fail("'='")
+	}
+	p.pos++
+	body := p.parseExpression(0)
+	if p.err != nil {
+		return nil
+	}
+	if p.tokens[p.pos].Kind != lexer.IN {
+		return p.fail(parser.Expected("in")...)
+	}
+	p.pos++
+	in := p.parseExpression(0)
+	if p.err != nil {
+		return nil
+	}
+	return ast.FuncExp{Name: name.Lexeme, Params: params, Body: body, In: in}
+}
+
+// fail records a parse error for the current token and returns a nil
+// expression, only the first error is kept
+func (p *Parser) fail(expected ...string) ast.Exp {
+	if p.err == nil {
+		p.err = parser.NewTokenError(p.input, p.tokens[p.pos], expected...)
+	}
+	return nil
+}
+
+// failString records a parse error for an invalid string literal and
+// returns a nil expression, only the first error is kept
+func (p *Parser) failString(token lexer.Token) ast.Exp {
+	if p.err == nil {
+		p.err = parser.NewStringError(p.input, token)
+	}
+	return nil
+}
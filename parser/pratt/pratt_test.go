@@ -0,0 +1,244 @@
+package pratt
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/lennart01/learning_go/ast"
+	"github.com/lennart01/learning_go/parser"
+)
+
+func TestParser(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int
+	}{
+		{"1 + 2", 3},
+		{"1 - 2", -1},
+		{"2 * 3", 6},
+		{"4 / 2", 2},
+		{"(1 + 2) * 3", 9},
+		{"2 * (1 + 1 + 1) * 2 + 1", 13},
+		{"2 * (1 + 1 + 1) * (2 + 1) - 1 / 2", 18},
+		{"10 * 0x10 + 1", 161},
+		{"1 - 2 - 3", -4},
+		{"8 / 4 / 2", 1},
+		{"7 % 3 * 2", 2},
+		{"-2 * 3", -6},
+		{"2 - -3", 5},
+		{"-(1 + 2) % 2", -1},
+		{"-9223372036854775808 + 1", math.MinInt + 1},
+		{"-0x8000000000000000 * 1", math.MinInt},
+	}
+
+	for _, test := range tests {
+		expr, err := Parse(test.input)
+		if err != nil {
+			t.Fatalf("parse(%q) returned error: %v", test.input, err)
+		}
+		got := expr.Eval()
+		if got != test.want {
+			t.Errorf("parse(%q).Eval() = %v, want %v", test.input, got, test.want)
+		}
+	}
+}
+func TestParseVariables(t *testing.T) {
+	env := ast.Env{"price": 3, "qty": 4}
+	tests := []struct {
+		input string
+		want  int
+	}{
+		{"price * qty", 12},
+		{"price * qty - price", 9},
+		{"-price + (qty % 3)", -2},
+	}
+
+	for _, test := range tests {
+		expr, err := Parse(test.input)
+		if err != nil {
+			t.Fatalf("parse(%q) returned error: %v", test.input, err)
+		}
+		// both parsers produce the same ast
+		want, _ := parser.Parse(test.input)
+		if expr.Pretty() != want.Pretty() {
+			t.Errorf("parse(%q) = %s, want %s", test.input, expr.Pretty(), want.Pretty())
+		}
+		if got := expr.Eval(env); got != test.want {
+			t.Errorf("parse(%q).Eval(env) = %v, want %v", test.input, got, test.want)
+		}
+	}
+}
+
+func TestParseLet(t *testing.T) {
+	env := ast.Env{"x": 10, "price": 3}
+	tests := []struct {
+		input string
+		want  int
+	}{
+		{"let x = 1 + 2 in x * x", 9},
+		{"let y = 2 in y + 1 * y", 4},
+		{"1 + let y = 2 in y * 3", 7},
+		{"(let y = 2 in y) * 3", 6},
+		{"-let y = 2 in y + 1", -3},
+		{"let x = x + 1 in x", 11},
+		{"let a = price * 2 in let b = a + 1 in a * b - x", 32},
+		{"let x = let x = 2 in x * x in x + x", 8},
+	}
+
+	for _, test := range tests {
+		expr, err := Parse(test.input)
+		if err != nil {
+			t.Fatalf("parse(%q) returned error: %v", test.input, err)
+		}
+		// both parsers produce the same ast
+		want, _ := parser.Parse(test.input)
+		if expr.Pretty() != want.Pretty() {
+			t.Errorf("parse(%q) = %s, want %s", test.input, expr.Pretty(), want.Pretty())
+		}
+		if got := expr.Eval(env); got != test.want {
+			t.Errorf("parse(%q).Eval(env) = %v, want %v", test.input, got, test.want)
+		}
+	}
+}
+
+func TestParseConditionals(t *testing.T) {
+	env := ast.Env{"x": 3, "y": 5}
+	tests := []struct {
+		input string
+		want  int
+	}{
+		{"1 + 2 == 3", 1},
+		{"x < y && y < 10 || false", 1},
+		{"!(x == 3) || x >= y", 0},
+		{"!(x > 0)", 0},
+		{"1 < 2 == true", 1},
+		{"x > 1 && x < 3 || y != 5", 0},
+		{"if x > 2 then x * 10 else 0", 30},
+		{"1 + if x < 0 then 1 else 2 * 3", 7},
+		{"if true then if false then 1 else 2 else 3", 2},
+		{"let d = if y >= 5 then 1 else 0 in y - d", 4},
+		{"fn f(n) = if n < 2 then n else f(n-1) + f(n-2) in f(y)", 5},
+		{"fn add(a, b) = a + b in add(1, 2) * -add(x, y)", -24},
+		{"fn seven() = 7 in seven() - x", 4},
+		{"(\\a -> a * y)(x) + 1", 16},
+		{"let sub = \\a b -> a - b in sub(y, x)", 2},
+		{"fn adder(n) = \\a -> a + n in adder(x)(y)", 8},
+		{"(\\ -> \\a -> a)()(x) * -1", -3},
+	}
+
+	for _, test := range tests {
+		expr, err := Parse(test.input)
+		if err != nil {
+			t.Fatalf("parse(%q) returned error: %v", test.input, err)
+		}
+		// both parsers produce the same ast
+		want, _ := parser.Parse(test.input)
+		if expr.Pretty() != want.Pretty() {
+			t.Errorf("parse(%q) = %s, want %s", test.input, expr.Pretty(), want.Pretty())
+		}
+		if got := expr.Eval(env); got != test.want {
+			t.Errorf("parse(%q).Eval(env) = %v, want %v", test.input, got, test.want)
+		}
+	}
+}
+
+func TestParseExpression(t *testing.T) {
+	tests := []struct {
+		input      string
+		precedence int
+		want       ast.Exp
+	}{
+		{"1 + 2", 0, ast.PlusExp{Left: ast.IntExp{Val: 1}, Right: ast.IntExp{Val: 2}}},
+		{"1 + 2 * 3", 0, ast.PlusExp{Left: ast.IntExp{Val: 1}, Right: ast.MultExp{Left: ast.IntExp{Val: 2}, Right: ast.IntExp{Val: 3}}}},
+		{"1 * 2 + 3", 4, ast.PlusExp{Left: ast.MultExp{Left: ast.IntExp{Val: 1}, Right: ast.IntExp{Val: 2}}, Right: ast.IntExp{Val: 3}}},
+		{"1 * 2 + 3", 5, ast.MultExp{Left: ast.IntExp{Val: 1}, Right: ast.IntExp{Val: 2}}},
+		{"1 - 2 - 3", 0, ast.SubExp{Left: ast.SubExp{Left: ast.IntExp{Val: 1}, Right: ast.IntExp{Val: 2}}, Right: ast.IntExp{Val: 3}}},
+		{"-1 * 2", 0, ast.MultExp{Left: ast.NegExp{Exp: ast.IntExp{Val: 1}}, Right: ast.IntExp{Val: 2}}},
+		{"1 < 2 && true", 0, ast.AndExp{Left: ast.LtExp{Left: ast.IntExp{Val: 1}, Right: ast.IntExp{Val: 2}}, Right: ast.BoolExp{Val: true}}},
+		{"1 < 2 && true", 3, ast.LtExp{Left: ast.IntExp{Val: 1}, Right: ast.IntExp{Val: 2}}},
+	}
+
+	for _, test := range tests {
+		parser := NewParser(test.input)
+		got := parser.parseExpression(test.precedence)
+		if !expressionEqual(got, test.want) {
+			t.Errorf("parseExpression(%q, %d) = %v, want %v", test.input, test.precedence, got, test.want)
+		}
+	}
+}
+
+// strings are only passed to native functions, which Eval does not call,
+// so the parsed expressions are compared without evaluating them
+func TestParseStrings(t *testing.T) {
+	tests := []struct {
+		input string
+		want  ast.Exp
+	}{
+		{`rate("EUR") * 2`, ast.MultExp{Left: ast.CallExp{Name: "rate", Args: []ast.Exp{ast.StringExp{Val: "EUR"}}}, Right: ast.IntExp{Val: 2}}},
+		{`rate("a\"b", "")`, ast.CallExp{Name: "rate", Args: []ast.Exp{ast.StringExp{Val: `a"b`}, ast.StringExp{Val: ""}}}},
+	}
+
+	for _, test := range tests {
+		got, err := Parse(test.input)
+		if err != nil {
+			t.Fatalf("parse(%q) returned error: %v", test.input, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parse(%q) = %s, want %s", test.input, got.Pretty(), test.want.Pretty())
+		}
+	}
+}
+
+// check if two expressions are equal
+func expressionEqual(a, b ast.Exp) bool {
+	if a == nil && b == nil {
+		return true
+	}
+	if a == nil || b == nil {
+		return false
+	}
+	if a.Pretty() != b.Pretty() || a.Eval() != b.Eval() {
+		return false
+	}
+	return true
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		input  string
+		pretty string
+	}{
+		{"(1 + 2", "(1 + 2\n      ^ expected '+', '-', '*', '/', '%', '==', '!=', '<', '<=', '>', '>=', '&&', '||' or ')'"},
+		{"1 + * 2", "1 + * 2\n    ^ expected number, string, identifier, 'true', 'false', '(', '-', '!', 'let', 'if', 'fn' or '\\'"},
+		{"1 2", "1 2\n  ^ expected '+', '-', '*', '/', '%', '==', '!=', '<', '<=', '>', '>=', '&&', '||' or end of input"},
+		{"", "\n^ expected number, string, identifier, 'true', 'false', '(', '-', '!', 'let', 'if', 'fn' or '\\'"},
+		{"1 + $", "1 + $\n    ^ expected number, string, identifier, 'true', 'false', '(', '-', '!', 'let', 'if', 'fn' or '\\'"},
+		{"1.5", "1.5\n^ invalid number literal \"1.5\""},
+		{"-9223372036854775809", "-9223372036854775809\n ^ invalid number literal \"9223372036854775809\""},
+		{`rate("\q")`, "rate(\"\\q\")\n     ^ invalid string literal \"\\q\""},
+		{`rate("EUR)`, "rate(\"EUR)\n     ^ unterminated string literal \"EUR)"},
+		{"let 1 = 2 in 3", "let 1 = 2 in 3\n    ^ expected identifier"},
+		{"let x 2 in x", "let x 2 in x\n      ^ expected '='"},
+		{"let x = 2 x", "let x = 2 x\n          ^ expected '+', '-', '*', '/', '%', '==', '!=', '<', '<=', '>', '>=', '&&', '||' or 'in'"},
+		{"if 1 else 2", "if 1 else 2\n     ^ expected '+', '-', '*', '/', '%', '==', '!=', '<', '<=', '>', '>=', '&&', '||' or 'then'"},
+		{"if 1 then 2", "if 1 then 2\n           ^ expected '+', '-', '*', '/', '%', '==', '!=', '<', '<=', '>', '>=', '&&', '||' or 'else'"},
+		{"1 & 2", "1 & 2\n  ^ expected '+', '-', '*', '/', '%', '==', '!=', '<', '<=', '>', '>=', '&&', '||' or end of input"},
+		{"let x = 2 in", "let x = 2 in\n            ^ expected number, string, identifier, 'true', 'false', '(', '-', '!', 'let', 'if', 'fn' or '\\'"},
+		{"\\a, b -> a", "\\a, b -> a\n  ^ expected identifier or '->'"},
+		{"f(1)(2", "f(1)(2\n      ^ expected '+', '-', '*', '/', '%', '==', '!=', '<', '<=', '>', '>=', '&&', '||', ',' or ')'"},
+	}
+
+	for _, test := range tests {
+		_, err := Parse(test.input)
+		var perr *parser.ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("parse(%q) error = %v, want a *parser.ParseError", test.input, err)
+			continue
+		}
+		if got := perr.Pretty(); got != test.pretty {
+			t.Errorf("parse(%q) error = %q, want %q", test.input, got, test.pretty)
+		}
+	}
+}
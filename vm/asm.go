@@ -0,0 +1,343 @@
+package vm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// mnemonics of the opcodes in the assembly format
+var mnemonics = map[OpCode]string{
+	PUSH:          "push",
+	PLUS:          "add",
+	MULTIPLY:      "mul",
+	SUB:           "sub",
+	DIV:           "div",
+	MOD:           "mod",
+	NEG:           "neg",
+	LOAD:          "load",
+	LOAD_SLOT:     "load_slot",
+	STORE_LOCAL:   "store_local",
+	LOAD_LOCAL:    "load_local",
+	EQ:            "eq",
+	NE:            "ne",
+	LT:            "lt",
+	LE:            "le",
+	GT:            "gt",
+	GE:            "ge",
+	NOT:           "not",
+	JUMP:          "jump",
+	JUMP_IF_FALSE: "jump_if_false",
+	FUNC:          "func",
+	CALL:          "call",
+	RET:           "ret",
+	MAKE_CLOSURE:  "make_closure",
+	LOAD_UPVAL:    "load_upval",
+	CALL_CLOSURE:  "call_closure",
+	TAILCALL:      "tailcall",
+	CALL_NATIVE:   "call_native",
+	PUSH_STR:      "push_str",
+}
+
+// opcodes by their mnemonic
+var opcodes = func() map[string]OpCode {
+	ops := make(map[string]OpCode, len(mnemonics))
+	for op, name := range mnemonics {
+		ops[name] = op
+	}
+	return ops
+}()
+
+// directive for instructions with an opcode which has no mnemonic,
+// e.g. ".code 42 0", so that every []Code can be disassembled
+const rawDirective = ".code"
+
+// AsmError is returned by Assemble for invalid assembly
+type AsmError struct {
+	Line int    // line of the error, starting at 1
+	Msg  string // description of the error
+}
+
+func (e *AsmError) Error() string {
+	return fmt.Sprintf("vm: asm line %d: %s", e.Line, e.Msg)
+}
+
+// Assemble reads a program in the assembly format and returns its code
+//
+// every line contains at most one instruction, e.g. "push 1", "load x" or "add",
+// everything after a ';' is a comment, and a name followed by a ':'
+// at the start of a line defines a label, e.g. "start: push 1"
+// the target of a jump, call or closure is a label or the index of an
+// instruction, e.g. "jump start", "jump_if_false 4" or "call fib" after
+// "fib: func fib 1", a lambda has the number of its captured values as
+// a third operand, e.g. "add: func lambda 1 1" and "make_closure add",
+// a native function is called by its name and the number of arguments,
+// e.g. "call_native max 2", and a string is quoted like in Go, e.g.
+// "push_str "EUR""
+func Assemble(r io.Reader) ([]Code, error) {
+	code := []Code{}
+	labels := map[string]int{} // line on which each label was defined
+	pcs := map[string]int{}    // index of the instruction after each label
+	uses := map[int]int{}      // line of every jump to a label by its pc
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := asmFields(scanner.Text())
+		// a label may be followed by an instruction on the same line
+		if len(fields) > 0 && strings.HasSuffix(fields[0], ":") {
+			label := strings.TrimSuffix(fields[0], ":")
+			if !isIdentifier(label) {
+				return nil, &AsmError{line, fmt.Sprintf("invalid label %q", label)}
+			}
+			if prev, ok := labels[label]; ok {
+				return nil, &AsmError{line, fmt.Sprintf("label %q already defined on line %d", label, prev)}
+			}
+			labels[label] = line
+			pcs[label] = len(code)
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		c, err := assembleInstruction(fields)
+		if err != nil {
+			return nil, &AsmError{line, err.Error()}
+		}
+		if hasTarget(c.Op) && c.name != "" {
+			uses[len(code)] = line
+		}
+		code = append(code, c)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	// labels may be used before they are defined, so the targets
+	// are resolved once all labels are known
+	for pc := range code {
+		c := &code[pc]
+		if !hasTarget(c.Op) || c.name == "" {
+			continue
+		}
+		target, ok := pcs[c.name]
+		if !ok {
+			return nil, &AsmError{uses[pc], fmt.Sprintf("undefined label %q", c.name)}
+		}
+		c.val, c.name = target, ""
+	}
+	return code, nil
+}
+
+// assembles a single instruction from its fields
+func assembleInstruction(fields []string) (Code, error) {
+	name, args := fields[0], fields[1:]
+	if name == rawDirective {
+		if len(args) != 2 {
+			return Code{}, fmt.Errorf("%s expects an opcode and a value", rawDirective)
+		}
+		op, err := parseAsmInt(args[0])
+		if err != nil {
+			return Code{}, err
+		}
+		val, err := parseAsmInt(args[1])
+		if err != nil {
+			return Code{}, err
+		}
+		return Code{Op: OpCode(op), val: val}, nil
+	}
+	op, ok := opcodes[strings.ToLower(name)]
+	if !ok {
+		return Code{}, fmt.Errorf("unknown instruction %q", name)
+	}
+	switch op {
+	case FUNC:
+		if len(args) != 2 && len(args) != 3 {
+			return Code{}, fmt.Errorf("%s expects a name and the number of parameters", mnemonics[op])
+		}
+		if !isIdentifier(args[0]) {
+			return Code{}, fmt.Errorf("invalid function %q", args[0])
+		}
+		params, err := parseAsmInt(args[1])
+		if err != nil {
+			return Code{}, err
+		}
+		upvals := 0
+		if len(args) == 3 {
+			if upvals, err = parseAsmInt(args[2]); err != nil {
+				return Code{}, err
+			}
+		}
+		return NewLambdaCode(args[0], params, upvals), nil
+	case PUSH_STR:
+		if len(args) != 1 {
+			return Code{}, fmt.Errorf("%s expects a quoted string", mnemonics[op])
+		}
+		str, err := strconv.Unquote(args[0])
+		if err != nil || !strings.HasPrefix(args[0], `"`) {
+			return Code{}, fmt.Errorf("invalid string %s", args[0])
+		}
+		return NewPushStrCode(str), nil
+	case CALL_NATIVE:
+		if len(args) != 2 {
+			return Code{}, fmt.Errorf("%s expects a name and the number of arguments", mnemonics[op])
+		}
+		if !isIdentifier(args[0]) {
+			return Code{}, fmt.Errorf("invalid function %q", args[0])
+		}
+		n, err := parseAsmInt(args[1])
+		if err != nil {
+			return Code{}, err
+		}
+		return NewCallNativeCode(args[0], n), nil
+	case PUSH, LOAD, LOAD_SLOT, STORE_LOCAL, LOAD_LOCAL, JUMP, JUMP_IF_FALSE, CALL, MAKE_CLOSURE, LOAD_UPVAL, CALL_CLOSURE, TAILCALL:
+		if len(args) != 1 {
+			return Code{}, fmt.Errorf("%s expects one operand", mnemonics[op])
+		}
+	default:
+		if len(args) != 0 {
+			return Code{}, fmt.Errorf("%s expects no operand", mnemonics[op])
+		}
+		return Code{Op: op}, nil
+	}
+	if op == LOAD {
+		if !isIdentifier(args[0]) {
+			return Code{}, fmt.Errorf("invalid variable %q", args[0])
+		}
+		return NewLoadCode(args[0]), nil
+	}
+	if hasTarget(op) && isIdentifier(args[0]) {
+		// the label is resolved by Assemble
+		return Code{Op: op, name: args[0]}, nil
+	}
+	val, err := parseAsmInt(args[0])
+	if err != nil {
+		return Code{}, err
+	}
+	return Code{Op: op, val: val}, nil
+}
+
+// splits a line into its fields, which are separated by white space,
+// a quoted string is a single field and everything after a ';' outside
+// of a string is a comment
+func asmFields(line string) []string {
+	var fields []string
+	start, quoted := -1, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quoted && c == '\\':
+			i++
+		case quoted:
+			quoted = c != '"'
+		case c == ';':
+			line = line[:i]
+		case c == ' ' || c == '\t' || c == '\r':
+			if start >= 0 {
+				fields = append(fields, line[start:i])
+				start = -1
+			}
+		default:
+			if start < 0 {
+				start = i
+			}
+			quoted = c == '"'
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, line[start:])
+	}
+	return fields
+}
+
+// parses an integer operand, the prefixes 0x, 0b and 0o are supported
+func parseAsmInt(s string) (int, error) {
+	val, err := strconv.ParseInt(s, 0, strconv.IntSize)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return int(val), nil
+}
+
+// returns true if s is a valid label or variable name
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the instruction in the assembly format, e.g. "push 1"
+func (c Code) String() string {
+	name, ok := mnemonics[c.Op]
+	switch {
+	case c.Op == FUNC && c.upvals != 0:
+		return fmt.Sprintf("%s %s %d %d", name, c.name, c.val, c.upvals)
+	case c.Op == FUNC, c.Op == CALL_NATIVE:
+		return fmt.Sprintf("%s %s %d", name, c.name, c.val)
+	case c.Op == PUSH_STR:
+		return name + " " + strconv.Quote(c.name)
+	case !ok || !hasIntOperand(c.Op) && c.val != 0:
+		return fmt.Sprintf("%s %d %d", rawDirective, int(c.Op), c.val)
+	case hasIntOperand(c.Op):
+		return fmt.Sprintf("%s %d", name, c.val)
+	case c.Op == LOAD:
+		return name + " " + c.name
+	default:
+		return name
+	}
+}
+
+// returns true if the instructions with the opcode have an integer operand
+func hasIntOperand(op OpCode) bool {
+	return op == PUSH || op == LOAD_SLOT || op == STORE_LOCAL || op == LOAD_LOCAL ||
+		op == LOAD_UPVAL || op == CALL_CLOSURE || hasTarget(op)
+}
+
+// returns true if the opcode is a jump
+func isJump(op OpCode) bool {
+	return op == JUMP || op == JUMP_IF_FALSE
+}
+
+// returns true if the operand of the opcode is the index of an instruction
+func hasTarget(op OpCode) bool {
+	return isJump(op) || op == CALL || op == TAILCALL || op == MAKE_CLOSURE
+}
+
+// Disassemble returns the code in the assembly format, one instruction
+// per line, Assemble(strings.NewReader(Disassemble(code))) returns code again
+// every target of a jump, call or closure gets a label L<pc> on its own
+// line, e.g. "L4:"
+func Disassemble(code []Code) string {
+	// only the targets in range can be labeled
+	inRange := func(c Code) bool {
+		return hasTarget(c.Op) && c.val >= 0 && c.val <= len(code)
+	}
+	labeled := make([]bool, len(code)+1)
+	for _, c := range code {
+		if inRange(c) {
+			labeled[c.val] = true
+		}
+	}
+	var sb strings.Builder
+	for pc, c := range code {
+		if labeled[pc] {
+			fmt.Fprintf(&sb, "L%d:\n", pc)
+		}
+		if inRange(c) {
+			fmt.Fprintf(&sb, "%s L%d\n", mnemonics[c.Op], c.val)
+			continue
+		}
+		sb.WriteString(c.String() + "\n")
+	}
+	if labeled[len(code)] {
+		fmt.Fprintf(&sb, "L%d:\n", len(code))
+	}
+	return sb.String()
+}
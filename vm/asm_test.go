@@ -0,0 +1,240 @@
+package vm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAssemble(t *testing.T) {
+	src := `
+; a comment
+start: push 1 ; push one
+	PUSH 0x10
+add
+
+end:
+	mul
+`
+	code, err := Assemble(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("Assemble returned error: %v", err)
+	}
+	want := []Code{NewPushCode(1), NewPushCode(16), NewPlusCode(), NewMultiplyCode()}
+	if !reflect.DeepEqual(code, want) {
+		t.Errorf("Assemble = %v, want %v", code, want)
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	tests := []struct {
+		src     string
+		message string
+	}{
+		{"push 1\nfoo", `vm: asm line 2: unknown instruction "foo"`},
+		{"push", "vm: asm line 1: push expects one operand"},
+		{"push 1 2", "vm: asm line 1: push expects one operand"},
+		{"push x", `vm: asm line 1: invalid number "x"`},
+		{"push 1\n\nadd 2", "vm: asm line 3: add expects no operand"},
+		{"a: push 1\na: push 2", `vm: asm line 2: label "a" already defined on line 1`},
+		{"1a: push 1", `vm: asm line 1: invalid label "1a"`},
+		{".code 1", "vm: asm line 1: .code expects an opcode and a value"},
+		{"load 1x", `vm: asm line 1: invalid variable "1x"`},
+		{"load", "vm: asm line 1: load expects one operand"},
+		{"load_slot x", `vm: asm line 1: invalid number "x"`},
+		{"store_local", "vm: asm line 1: store_local expects one operand"},
+		{"push 1\njump nowhere", `vm: asm line 2: undefined label "nowhere"`},
+		{"jump", "vm: asm line 1: jump expects one operand"},
+		{"jump_if_false 1x", `vm: asm line 1: invalid number "1x"`},
+		{"func f", "vm: asm line 1: func expects a name and the number of parameters"},
+		{"func 1f 0", `vm: asm line 1: invalid function "1f"`},
+		{"func f x", `vm: asm line 1: invalid number "x"`},
+		{"call", "vm: asm line 1: call expects one operand"},
+		{"push 1\ncall f", `vm: asm line 2: undefined label "f"`},
+		{"ret 1", "vm: asm line 1: ret expects no operand"},
+		{"func f 1 2 3", "vm: asm line 1: func expects a name and the number of parameters"},
+		{"func f 1 x", `vm: asm line 1: invalid number "x"`},
+		{"make_closure", "vm: asm line 1: make_closure expects one operand"},
+		{"push 1\nmake_closure f", `vm: asm line 2: undefined label "f"`},
+		{"load_upval x", `vm: asm line 1: invalid number "x"`},
+		{"call_closure", "vm: asm line 1: call_closure expects one operand"},
+		{"tailcall", "vm: asm line 1: tailcall expects one operand"},
+		{"push 1\ntailcall f", `vm: asm line 2: undefined label "f"`},
+		{"call_native max", "vm: asm line 1: call_native expects a name and the number of arguments"},
+		{"call_native 1max 0", `vm: asm line 1: invalid function "1max"`},
+		{"call_native max x", `vm: asm line 1: invalid number "x"`},
+		{"push_str", "vm: asm line 1: push_str expects a quoted string"},
+		{"push_str EUR", "vm: asm line 1: invalid string EUR"},
+		{`push_str "EUR`, `vm: asm line 1: invalid string "EUR`},
+		{`push_str "a" "b"`, "vm: asm line 1: push_str expects a quoted string"},
+		{"push_str `EUR`", "vm: asm line 1: invalid string `EUR`"},
+	}
+
+	for _, tt := range tests {
+		_, err := Assemble(strings.NewReader(tt.src))
+		var asmErr *AsmError
+		if !errors.As(err, &asmErr) {
+			t.Errorf("Assemble(%q) error = %v, want an *AsmError", tt.src, err)
+			continue
+		}
+		if err.Error() != tt.message {
+			t.Errorf("Assemble(%q) error = %q, want %q", tt.src, err.Error(), tt.message)
+		}
+	}
+}
+
+func TestAssembleLabels(t *testing.T) {
+	// labels may be used before and after they are defined,
+	// a label at the end of the code is the end of the program
+	src := `
+	load x
+	jump_if_false else
+	push 1
+	jump end
+else:	push 2
+	jump 7
+end:
+	neg
+`
+	code, err := Assemble(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("Assemble returned error: %v", err)
+	}
+	want := []Code{
+		NewLoadCode("x"), NewJumpIfFalseCode(4), NewPushCode(1), NewJumpCode(6),
+		NewPushCode(2), NewJumpCode(7), NewNegCode(),
+	}
+	if !reflect.DeepEqual(code, want) {
+		t.Errorf("Assemble = %v, want %v", code, want)
+	}
+
+	// calls use labels like jumps
+	src = `
+	push 2
+	call double
+	ret
+double: func double 1
+	load_local 0
+	push 2
+	mul
+	ret
+`
+	code, err = Assemble(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("Assemble returned error: %v", err)
+	}
+	want = []Code{
+		NewPushCode(2), NewCallCode(3), NewRetCode(),
+		NewFuncCode("double", 1), NewLoadLocalCode(0), NewPushCode(2), NewMultiplyCode(), NewRetCode(),
+	}
+	if !reflect.DeepEqual(code, want) {
+		t.Errorf("Assemble = %v, want %v", code, want)
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	code := []Code{NewPushCode(-1), NewPushCode(2), NewSubCode(), NewNegCode(), NewLoadCode("x"), NewLoadSlotCode(3), NewStoreLocalCode(1), NewLoadLocalCode(1), {Op: 42, val: 7}}
+	want := "push -1\npush 2\nsub\nneg\nload x\nload_slot 3\nstore_local 1\nload_local 1\n.code 42 7\n"
+	got := Disassemble(code)
+	if got != want {
+		t.Errorf("Disassemble = %q, want %q", got, want)
+	}
+	// the disassembly can be assembled into the same code
+	assembled, err := Assemble(strings.NewReader(got))
+	if err != nil {
+		t.Fatalf("Assemble returned error: %v", err)
+	}
+	if !reflect.DeepEqual(assembled, code) {
+		t.Errorf("Assemble(Disassemble(code)) = %v, want %v", assembled, code)
+	}
+
+	// the jump targets become labels, targets out of range stay numbers
+	code = []Code{NewLoadCode("x"), NewJumpIfFalseCode(4), NewPushCode(1), NewJumpCode(5), NewPushCode(2), NewJumpCode(9)}
+	want = "load x\njump_if_false L4\npush 1\njump L5\nL4:\npush 2\nL5:\njump 9\n"
+	if got := Disassemble(code); got != want {
+		t.Errorf("Disassemble = %q, want %q", got, want)
+	}
+	code = code[:5]
+	want = "load x\njump_if_false L4\npush 1\njump L5\nL4:\npush 2\nL5:\n"
+	got = Disassemble(code)
+	if got != want {
+		t.Errorf("Disassemble = %q, want %q", got, want)
+	}
+	if assembled, err := Assemble(strings.NewReader(got)); err != nil || !reflect.DeepEqual(assembled, code) {
+		t.Errorf("Assemble(Disassemble(code)) = %v, %v, want %v", assembled, err, code)
+	}
+
+	// the functions are labeled by their index
+	code = []Code{NewPushCode(2), NewCallCode(3), NewRetCode(), NewFuncCode("f", 1), NewLoadLocalCode(0), NewRetCode()}
+	want = "push 2\ncall L3\nret\nL3:\nfunc f 1\nload_local 0\nret\n"
+	got = Disassemble(code)
+	if got != want {
+		t.Errorf("Disassemble = %q, want %q", got, want)
+	}
+	if assembled, err := Assemble(strings.NewReader(got)); err != nil || !reflect.DeepEqual(assembled, code) {
+		t.Errorf("Assemble(Disassemble(code)) = %v, %v, want %v", assembled, err, code)
+	}
+
+	// the lambdas are labeled like functions, the captured values follow the parameters
+	code = []Code{NewPushCode(2), NewMakeClosureCode(4), NewCallClosureCode(0), NewRetCode(), NewLambdaCode("lambda", 0, 1), NewLoadUpvalCode(0), NewRetCode()}
+	want = "push 2\nmake_closure L4\ncall_closure 0\nret\nL4:\nfunc lambda 0 1\nload_upval 0\nret\n"
+	got = Disassemble(code)
+	if got != want {
+		t.Errorf("Disassemble = %q, want %q", got, want)
+	}
+	if assembled, err := Assemble(strings.NewReader(got)); err != nil || !reflect.DeepEqual(assembled, code) {
+		t.Errorf("Assemble(Disassemble(code)) = %v, %v, want %v", assembled, err, code)
+	}
+}
+
+// runs the programs in testdata/*.asm, every file contains the expected
+// result in a comment of the form "; want: 42"
+func TestAsmFixtures(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.asm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no fixtures found")
+	}
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			src, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, ok := fixtureWant(string(src))
+			if !ok {
+				t.Fatalf("%s has no \"; want:\" comment", file)
+			}
+			code, err := Assemble(strings.NewReader(string(src)))
+			if err != nil {
+				t.Fatalf("Assemble returned error: %v", err)
+			}
+			result, err := NewVM(code).Run()
+			if err != nil || result != want {
+				t.Errorf("Run() = %d, %v, want %d", result, err, want)
+			}
+			roundTrip, err := Assemble(strings.NewReader(Disassemble(code)))
+			if err != nil || !reflect.DeepEqual(roundTrip, code) {
+				t.Errorf("Assemble(Disassemble(code)) = %v, %v, want %v", roundTrip, err, code)
+			}
+		})
+	}
+}
+
+// returns the value of the "; want: <value>" comment of a fixture
+func fixtureWant(src string) (Value, bool) {
+	for _, line := range strings.Split(src, "\n") {
+		if rest, ok := strings.CutPrefix(strings.TrimSpace(line), "; want:"); ok {
+			val, err := strconv.Atoi(strings.TrimSpace(rest))
+			return Value(val), err == nil
+		}
+	}
+	return 0, false
+}
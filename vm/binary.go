@@ -0,0 +1,314 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+)
+
+// layout of a binary program file:
+//
+//	magic     4 bytes "GOVM"
+//	version   1 byte
+//	constants uvarint count, followed by the varint encoded values
+//	names     uvarint count, followed by the names of the variables and
+//	          functions and the strings, every name is its uvarint length
+//	          followed by its bytes
+//	vars      uvarint count, followed by the uvarint index into the names
+//	          of the variable of every slot
+//	code      uvarint count, followed by the instructions, every
+//	          instruction is its uvarint opcode followed by its operand,
+//	          the operand of PUSH is the uvarint index into the constants,
+//	          of LOAD and PUSH_STR the uvarint index into the names,
+//	          of LOAD_SLOT the uvarint slot, of STORE_LOCAL and
+//	          LOAD_LOCAL the uvarint local, of JUMP, JUMP_IF_FALSE,
+//	          CALL, TAILCALL and MAKE_CLOSURE the uvarint target, of LOAD_UPVAL
+//	          the uvarint captured value, of CALL_CLOSURE the uvarint
+//	          number of arguments, FUNC has three operands,
+//	          the uvarint index into the names, the uvarint
+//	          number of parameters and of captured values, and
+//	          CALL_NATIVE two, the uvarint index into the names and
+//	          the uvarint number of arguments
+//	checksum  4 bytes little endian CRC32 (IEEE) of everything before it
+const (
+	binaryMagic   = "GOVM"
+	binaryVersion = 1
+)
+
+// ErrInvalidProgram is wrapped by all errors of UnmarshalBinary
+var ErrInvalidProgram = errors.New("vm: invalid program file")
+
+// MarshalBinary encodes the program in the binary program format
+// implements encoding.BinaryMarshaler
+func (p *Program) MarshalBinary() ([]byte, error) {
+	// collect the distinct values of all PUSH instructions and the
+	// distinct names of all LOAD, FUNC, CALL_NATIVE and PUSH_STR instructions
+	var constants []int
+	var names []string
+	index := map[int]int{}
+	nameIndex := map[string]int{}
+	addName := func(name string) {
+		if _, ok := nameIndex[name]; !ok {
+			nameIndex[name] = len(names)
+			names = append(names, name)
+		}
+	}
+	for _, name := range p.vars {
+		addName(name)
+	}
+	for _, c := range p.code {
+		switch c.Op {
+		case PUSH:
+			if _, ok := index[c.val]; !ok {
+				index[c.val] = len(constants)
+				constants = append(constants, c.val)
+			}
+		case LOAD, FUNC, CALL_NATIVE, PUSH_STR:
+			addName(c.name)
+		}
+	}
+
+	buf := []byte(binaryMagic)
+	buf = append(buf, binaryVersion)
+	buf = binary.AppendUvarint(buf, uint64(len(constants)))
+	for _, val := range constants {
+		buf = binary.AppendVarint(buf, int64(val))
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(names)))
+	for _, name := range names {
+		buf = binary.AppendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(p.vars)))
+	for _, name := range p.vars {
+		buf = binary.AppendUvarint(buf, uint64(nameIndex[name]))
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(p.code)))
+	for _, c := range p.code {
+		if _, ok := mnemonics[c.Op]; !ok {
+			return nil, fmt.Errorf("vm: can not encode unknown opcode %d", int(c.Op))
+		}
+		buf = binary.AppendUvarint(buf, uint64(c.Op))
+		switch c.Op {
+		case PUSH:
+			buf = binary.AppendUvarint(buf, uint64(index[c.val]))
+		case LOAD, PUSH_STR:
+			buf = binary.AppendUvarint(buf, uint64(nameIndex[c.name]))
+		case FUNC:
+			buf = binary.AppendUvarint(buf, uint64(nameIndex[c.name]))
+			buf = binary.AppendUvarint(buf, uint64(c.val))
+			buf = binary.AppendUvarint(buf, uint64(c.upvals))
+		case CALL_NATIVE:
+			buf = binary.AppendUvarint(buf, uint64(nameIndex[c.name]))
+			buf = binary.AppendUvarint(buf, uint64(c.val))
+		case LOAD_SLOT, STORE_LOCAL, LOAD_LOCAL, JUMP, JUMP_IF_FALSE, CALL, TAILCALL, MAKE_CLOSURE, LOAD_UPVAL, CALL_CLOSURE:
+			buf = binary.AppendUvarint(buf, uint64(c.val))
+		}
+	}
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf)), nil
+}
+
+// UnmarshalBinary decodes a program in the binary program format
+// truncated, tampered or otherwise invalid data is rejected with an error
+// wrapping ErrInvalidProgram, it must only be called on a new Program
+// the program calls no native functions, see UnmarshalBinaryWith
+// implements encoding.BinaryUnmarshaler
+func (p *Program) UnmarshalBinary(data []byte) error {
+	return p.UnmarshalBinaryWith(data, nil)
+}
+
+// UnmarshalBinaryWith is like UnmarshalBinary, the CALL_NATIVE
+// instructions call the native functions of natives, which may be nil
+func (p *Program) UnmarshalBinaryWith(data []byte, natives *Natives) error {
+	if len(data) < len(binaryMagic)+1+4 {
+		return invalidProgram("truncated file of %d bytes", len(data))
+	}
+	if string(data[:len(binaryMagic)]) != binaryMagic {
+		return invalidProgram("bad magic bytes %q", data[:len(binaryMagic)])
+	}
+	version := data[len(binaryMagic)]
+	if version != binaryVersion {
+		return invalidProgram("unsupported format version %d", version)
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return invalidProgram("checksum mismatch")
+	}
+
+	r := bytes.NewReader(body[len(binaryMagic)+1:])
+	count, err := readCount(r, "constants")
+	if err != nil {
+		return err
+	}
+	constants := make([]int, count)
+	for i := range constants {
+		val, err := binary.ReadVarint(r)
+		if err != nil {
+			return invalidProgram("truncated constant %d", i)
+		}
+		constants[i] = int(val)
+	}
+
+	count, err = readCount(r, "names")
+	if err != nil {
+		return err
+	}
+	names := make([]string, count)
+	for i := range names {
+		length, err := binary.ReadUvarint(r)
+		if err != nil || length > uint64(r.Len()) {
+			return invalidProgram("truncated name %d", i)
+		}
+		name := make([]byte, length)
+		r.Read(name)
+		names[i] = string(name)
+	}
+
+	count, err = readCount(r, "vars")
+	if err != nil {
+		return err
+	}
+	vars := make([]string, count)
+	for i := range vars {
+		index, err := binary.ReadUvarint(r)
+		if err != nil {
+			return invalidProgram("truncated var %d", i)
+		}
+		if index >= uint64(len(names)) {
+			return invalidProgram("name index %d of var %d out of range", index, i)
+		}
+		vars[i] = names[index]
+	}
+
+	count, err = readCount(r, "instructions")
+	if err != nil {
+		return err
+	}
+	code := make([]Code, count)
+	for pc := range code {
+		op, err := binary.ReadUvarint(r)
+		if err != nil {
+			return invalidProgram("truncated instruction at pc %d", pc)
+		}
+		if _, ok := mnemonics[OpCode(op)]; !ok {
+			return invalidProgram("unknown opcode %d at pc %d", op, pc)
+		}
+		code[pc].Op = OpCode(op)
+		if !hasOperand(code[pc].Op) {
+			continue
+		}
+		operand, err := binary.ReadUvarint(r)
+		if err != nil {
+			return invalidProgram("truncated operand at pc %d", pc)
+		}
+		switch code[pc].Op {
+		case PUSH:
+			if operand >= uint64(len(constants)) {
+				return invalidProgram("constant index %d out of range at pc %d", operand, pc)
+			}
+			code[pc].val = constants[operand]
+		case LOAD, PUSH_STR:
+			if operand >= uint64(len(names)) {
+				return invalidProgram("name index %d out of range at pc %d", operand, pc)
+			}
+			code[pc].name = names[operand]
+		case LOAD_SLOT:
+			if operand > math.MaxInt32 {
+				return invalidProgram("slot %d out of range at pc %d", operand, pc)
+			}
+			code[pc].val = int(operand)
+		case STORE_LOCAL, LOAD_LOCAL:
+			if operand > math.MaxInt32 {
+				return invalidProgram("local %d out of range at pc %d", operand, pc)
+			}
+			code[pc].val = int(operand)
+		case JUMP, JUMP_IF_FALSE, CALL, TAILCALL, MAKE_CLOSURE:
+			if operand > math.MaxInt32 {
+				return invalidProgram("jump target %d out of range at pc %d", operand, pc)
+			}
+			code[pc].val = int(operand)
+		case LOAD_UPVAL:
+			if operand > math.MaxInt32 {
+				return invalidProgram("captured value %d out of range at pc %d", operand, pc)
+			}
+			code[pc].val = int(operand)
+		case CALL_CLOSURE:
+			if operand > math.MaxInt32 {
+				return invalidProgram("%d arguments out of range at pc %d", operand, pc)
+			}
+			code[pc].val = int(operand)
+		case FUNC:
+			if operand >= uint64(len(names)) {
+				return invalidProgram("name index %d out of range at pc %d", operand, pc)
+			}
+			params, err := binary.ReadUvarint(r)
+			if err != nil {
+				return invalidProgram("truncated operand at pc %d", pc)
+			}
+			if params > math.MaxInt32 {
+				return invalidProgram("%d parameters out of range at pc %d", params, pc)
+			}
+			code[pc].name, code[pc].val = names[operand], int(params)
+			upvals, err := binary.ReadUvarint(r)
+			if err != nil {
+				return invalidProgram("truncated operand at pc %d", pc)
+			}
+			if upvals > math.MaxInt32 {
+				return invalidProgram("%d captured values out of range at pc %d", upvals, pc)
+			}
+			code[pc].upvals = int(upvals)
+		case CALL_NATIVE:
+			if operand >= uint64(len(names)) {
+				return invalidProgram("name index %d out of range at pc %d", operand, pc)
+			}
+			args, err := binary.ReadUvarint(r)
+			if err != nil {
+				return invalidProgram("truncated operand at pc %d", pc)
+			}
+			if args > math.MaxInt32 {
+				return invalidProgram("%d arguments out of range at pc %d", args, pc)
+			}
+			code[pc].name, code[pc].val = names[operand], int(args)
+		}
+	}
+	if r.Len() != 0 {
+		return invalidProgram("%d unexpected bytes after the code", r.Len())
+	}
+
+	// the code of an untrusted file is verified once before it can be run
+	prog := newProgram(code, vars, natives)
+	if prog.err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidProgram, prog.err)
+	}
+	*p = *prog
+	return nil
+}
+
+// returns true if the instructions with the opcode have an operand,
+// FUNC has a second and a third one, CALL_NATIVE a second one
+func hasOperand(op OpCode) bool {
+	return op == LOAD || op == PUSH_STR || op == FUNC || op == CALL_NATIVE || hasIntOperand(op)
+}
+
+// reads the number of elements of a section of the file, the number is
+// checked against the remaining size so that corrupt counts can not
+// cause huge allocations
+func readCount(r *bytes.Reader, section string) (int, error) {
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, invalidProgram("truncated number of %s", section)
+	}
+	// every element takes at least one byte
+	if count > uint64(r.Len()) {
+		return 0, invalidProgram("%d %s do not fit into the remaining %d bytes", count, section, r.Len())
+	}
+	return int(count), nil
+}
+
+// returns an error wrapping ErrInvalidProgram
+func invalidProgram(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidProgram, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,149 @@
+package vm
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lennart01/learning_go/ast"
+)
+
+// Program implements the binary marshaling interfaces of the standard library
+var (
+	_ encoding.BinaryMarshaler   = (*Program)(nil)
+	_ encoding.BinaryUnmarshaler = (*Program)(nil)
+)
+
+func TestMarshalBinary(t *testing.T) {
+	progs := []*Program{
+		LoadAst(benchExp).Program,
+		LoadAst(deepSum(2 * smallStack)).Program,
+		NewVM([]Code{NewPushCode(-1 << 40), NewPushCode(7), NewPushCode(-1 << 40), NewModCode(), NewNegCode(), NewPlusCode()}).Program,
+		NewVM([]Code{NewLoadCode("price"), NewLoadCode("qty"), NewMultiplyCode(), NewLoadSlotCode(300), NewLoadCode("price"), NewSubCode(), NewPlusCode()}).Program,
+		newProgram([]Code{NewLoadSlotCode(0), NewLoadCode("b"), NewLoadSlotCode(1), NewMultiplyCode(), NewPlusCode()}, []string{"a", "b"}, nil),
+		LoadAst(ast.LetExp{Name: "x", Value: ast.IntExp{Val: 3}, Body: ast.LetExp{Name: "y", Value: ast.VarExp{Name: "x"}, Body: ast.VarExp{Name: "y"}}}).Program,
+		LoadAst(ast.IfExp{
+			Cond: ast.AndExp{Left: ast.LtExp{Left: ast.IntExp{Val: 1}, Right: ast.IntExp{Val: 2}}, Right: ast.NotExp{Exp: ast.BoolExp{Val: false}}},
+			Then: ast.IntExp{Val: 10},
+			Else: ast.IntExp{Val: 3},
+		}).Program,
+		LoadAst(fibExp(ast.IntExp{Val: 12})).Program,
+		LoadAst(foldExp(ast.VarExp{Name: "f"})).Program,
+		LoadAst(countExp(ast.VarExp{Name: "n"})).Program,
+	}
+
+	for _, prog := range progs {
+		data, err := prog.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary returned error: %v", err)
+		}
+		var decoded Program
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("UnmarshalBinary returned error: %v", err)
+		}
+		if !reflect.DeepEqual(decoded.code, prog.code) || decoded.maxStack != prog.maxStack ||
+			decoded.slots != prog.slots || decoded.locals != prog.locals || !reflect.DeepEqual(decoded.Vars(), prog.Vars()) ||
+			!reflect.DeepEqual(decoded.funcLocals, prog.funcLocals) {
+			t.Errorf("UnmarshalBinary(MarshalBinary(p)) = %v, want %v", decoded, *prog)
+		}
+		want, wantErr := prog.Run()
+		got, err := decoded.Run()
+		if got != want || err != wantErr {
+			t.Errorf("decoded Run() = %d, %v, want %d, %v", got, err, want, wantErr)
+		}
+	}
+}
+
+func TestMarshalBinaryConstantPool(t *testing.T) {
+	// the same value is only stored once
+	prog := NewVM([]Code{NewPushCode(1000), NewPushCode(1000), NewPlusCode()}).Program
+	data, err := prog.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// magic, version, 1 constant of 2 bytes, no names and vars, 3 instructions of 2+2+1 bytes, checksum
+	if want := 4 + 1 + 1 + 2 + 1 + 1 + 1 + 5 + 4; len(data) != want {
+		t.Errorf("len(MarshalBinary) = %d, want %d", len(data), want)
+	}
+
+	if _, err := NewVM([]Code{{Op: 42}}).MarshalBinary(); err == nil {
+		t.Errorf("Expected an error for an unknown opcode")
+	}
+}
+
+func TestUnmarshalBinaryErrors(t *testing.T) {
+	valid, err := LoadAst(benchExp).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// changes a copy of the valid file
+	modify := func(f func(data []byte) []byte) []byte {
+		return f(append([]byte(nil), valid...))
+	}
+	// builds a file with a valid header and checksum around the given body
+	withBody := func(body []byte) []byte {
+		prog := append([]byte(binaryMagic), binaryVersion)
+		prog = append(prog, body...)
+		return appendChecksum(prog)
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		message string
+	}{
+		{"empty", nil, "truncated file of 0 bytes"},
+		{"magic", modify(func(d []byte) []byte { d[0] = 'X'; return d }), `bad magic bytes "XOVM"`},
+		{"version", modify(func(d []byte) []byte { d[4] = 9; return d }), "unsupported format version 9"},
+		{"truncated", valid[:len(valid)-1], "checksum mismatch"},
+		{"tampered", modify(func(d []byte) []byte { d[6] ^= 1; return d }), "checksum mismatch"},
+		{"constant count", withBody([]byte{100}), "100 constants do not fit into the remaining 0 bytes"},
+		{"truncated constant", withBody([]byte{1, 0x80}), "truncated constant 0"},
+		{"code count", withBody([]byte{0, 0, 0}), "truncated number of instructions"},
+		{"unknown opcode", withBody([]byte{0, 0, 0, 1, 42}), "unknown opcode 42 at pc 0"},
+		{"constant index", withBody([]byte{1, 2, 0, 0, 1, byte(PUSH), 3}), "constant index 3 out of range at pc 0"},
+		{"truncated operand", withBody([]byte{0, 0, 0, 1, byte(PUSH)}), "truncated operand at pc 0"},
+		{"unverifiable code", withBody([]byte{0, 0, 0, 1, byte(NEG)}), "vm: stack underflow at pc 0 (NEG)"},
+		{"name count", withBody([]byte{0, 5, 1}), "5 names do not fit into the remaining 1 bytes"},
+		{"truncated name", withBody([]byte{0, 1, 5, 'x'}), "truncated name 0"},
+		{"name index", withBody([]byte{0, 1, 1, 'x', 0, 1, byte(LOAD), 1}), "name index 1 out of range at pc 0"},
+		{"slot", withBody([]byte{0, 0, 0, 1, byte(LOAD_SLOT), 0xff, 0xff, 0xff, 0xff, 0x0f}), "slot 4294967295 out of range at pc 0"},
+		{"var count", withBody([]byte{0, 0, 3}), "3 vars do not fit into the remaining 0 bytes"},
+		{"var index", withBody([]byte{0, 0, 1, 0}), "name index 0 of var 0 out of range"},
+		{"local", withBody([]byte{0, 0, 0, 1, byte(LOAD_LOCAL), 0xff, 0xff, 0xff, 0xff, 0x0f}), "local 4294967295 out of range at pc 0"},
+		{"jump", withBody([]byte{0, 0, 0, 1, byte(JUMP), 0xff, 0xff, 0xff, 0xff, 0x0f}), "jump target 4294967295 out of range at pc 0"},
+		{"jump target", withBody([]byte{0, 0, 0, 1, byte(JUMP), 2}), "vm: jump target 2 out of range at pc 0"},
+		{"function name", withBody([]byte{0, 0, 0, 1, byte(FUNC), 0, 0}), "name index 0 out of range at pc 0"},
+		{"truncated parameters", withBody([]byte{0, 1, 1, 'f', 0, 1, byte(FUNC), 0}), "truncated operand at pc 0"},
+		{"parameters", withBody([]byte{0, 1, 1, 'f', 0, 1, byte(FUNC), 0, 0xff, 0xff, 0xff, 0xff, 0x0f}), "4294967295 parameters out of range at pc 0"},
+		{"truncated captured values", withBody([]byte{0, 1, 1, 'f', 0, 1, byte(FUNC), 0, 0}), "truncated operand at pc 0"},
+		{"captured values", withBody([]byte{0, 1, 1, 'f', 0, 1, byte(FUNC), 0, 0, 0xff, 0xff, 0xff, 0xff, 0x0f}), "4294967295 captured values out of range at pc 0"},
+		{"upval", withBody([]byte{0, 0, 0, 1, byte(LOAD_UPVAL), 0xff, 0xff, 0xff, 0xff, 0x0f}), "captured value 4294967295 out of range at pc 0"},
+		{"arguments", withBody([]byte{0, 0, 0, 1, byte(CALL_CLOSURE), 0xff, 0xff, 0xff, 0xff, 0x0f}), "4294967295 arguments out of range at pc 0"},
+		{"call of no function", withBody([]byte{1, 2, 0, 0, 3, byte(PUSH), 0, byte(CALL), 0, byte(RET)}), "vm: call target 0 at pc 1 is not a function"},
+		{"unnamed slot", withBody([]byte{0, 1, 1, 'x', 1, 0, 1, byte(LOAD_SLOT), 1}), "vm: program reads 2 slots but only 1 have a name"},
+		{"trailing bytes", withBody([]byte{0, 0, 0, 1, byte(NEG), 0}), "1 unexpected bytes after the code"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var prog Program
+			err := prog.UnmarshalBinary(tt.data)
+			if !errors.Is(err, ErrInvalidProgram) {
+				t.Fatalf("UnmarshalBinary error = %v, want ErrInvalidProgram", err)
+			}
+			if !strings.HasSuffix(err.Error(), ": "+tt.message) {
+				t.Errorf("UnmarshalBinary error = %q, want %q", err.Error(), tt.message)
+			}
+		})
+	}
+}
+
+// appends the checksum to a program file
+func appendChecksum(data []byte) []byte {
+	return binary.LittleEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+}
@@ -0,0 +1,204 @@
+package vm
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/lennart01/learning_go/ast"
+)
+
+// functions see the lets and parameters around their definition, like
+// lambdas, but they are called by CALL without a closure: the locals of
+// the enclosing frames which a function uses are passed to it as extra
+// arguments after its parameters, so a function is compiled like a
+// lambda lifted to the top level, e.g.
+// let rate = 2 in fn f(y) = y * rate in f(3)
+// calls f(3, rate)
+//
+// a call passes the values which the function captures in its own frame,
+// so before compiling, the lets, parameters and functions are renamed to
+// unique names, a let between the definition and the call can not hide
+// a captured variable then
+
+// separates the name of a local or function from the number which makes
+// it unique, it can not appear in an identifier
+const uniqueSep = "@"
+
+// returns the name of a local or function before it was renamed
+func original(name string) string {
+	if i := strings.Index(name, uniqueSep); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// returns true if the name is a renamed let, parameter or function,
+// variables of the host keep their names
+func isLocal(name string) bool {
+	return strings.Contains(name, uniqueSep)
+}
+
+// returns a copy of the ast in which the lets, parameters and functions
+// have unique names, and collects the renamed functions
+func (comp *compiler) rename(exp ast.Exp) ast.Exp {
+	r := renamer{defs: map[string]ast.FuncExp{}}
+	exp = r.rename(exp)
+	comp.defs, comp.lifted = r.defs, map[string][]string{}
+	return exp
+}
+
+// renames the lets, parameters and functions of an ast to unique names
+type renamer struct {
+	count int
+	vars  [][2]string // original and unique names of the variables in scope, the innermost last
+	funcs [][2]string // original and unique names of the functions in scope, the innermost last
+	defs  map[string]ast.FuncExp
+}
+
+// returns a new unique name for the name
+func (r *renamer) unique(name string) string {
+	r.count++
+	return name + uniqueSep + strconv.Itoa(r.count)
+}
+
+// returns the unique name of the innermost binding of the name,
+// the name itself if there is none
+func find(scope [][2]string, name string) (string, bool) {
+	for i := len(scope) - 1; i >= 0; i-- {
+		if scope[i][0] == name {
+			return scope[i][1], true
+		}
+	}
+	return name, false
+}
+
+// returns a copy of exp in which the bindings and their uses are renamed,
+// the variables of the host and the calls of native functions keep their
+// names, the renamed function definitions are collected in defs
+func (r *renamer) rename(exp ast.Exp) ast.Exp {
+	switch exp := exp.(type) {
+	case ast.VarExp:
+		name, _ := find(r.vars, exp.Name)
+		return ast.VarExp{Name: name}
+	case ast.LetExp:
+		value := r.rename(exp.Value)
+		name := r.unique(exp.Name)
+		r.vars = append(r.vars, [2]string{exp.Name, name})
+		body := r.rename(exp.Body)
+		r.vars = r.vars[:len(r.vars)-1]
+		return ast.LetExp{Name: name, Value: value, Body: body}
+	case ast.FuncExp:
+		name := r.unique(exp.Name)
+		r.funcs = append(r.funcs, [2]string{exp.Name, name})
+		params, body := r.renameBody(exp.Params, exp.Body)
+		def := ast.FuncExp{Name: name, Params: params, Body: body}
+		r.defs[name] = def
+		def.In = r.rename(exp.In)
+		r.funcs = r.funcs[:len(r.funcs)-1]
+		return def
+	case ast.LambdaExp:
+		params, body := r.renameBody(exp.Params, exp.Body)
+		return ast.LambdaExp{Params: params, Body: body}
+	case ast.CallExp:
+		// like in the ast, a function hides a variable of the same name
+		name, ok := find(r.funcs, exp.Name)
+		if !ok {
+			name, _ = find(r.vars, exp.Name)
+		}
+		return ast.CallExp{Name: name, Args: r.renameAll(exp.Args)}
+	case ast.AppExp:
+		return ast.AppExp{Fn: r.rename(exp.Fn), Args: r.renameAll(exp.Args)}
+	case ast.PlusExp:
+		return ast.PlusExp{Left: r.rename(exp.Left), Right: r.rename(exp.Right)}
+	case ast.SubExp:
+		return ast.SubExp{Left: r.rename(exp.Left), Right: r.rename(exp.Right)}
+	case ast.MultExp:
+		return ast.MultExp{Left: r.rename(exp.Left), Right: r.rename(exp.Right)}
+	case ast.DivExp:
+		return ast.DivExp{Left: r.rename(exp.Left), Right: r.rename(exp.Right)}
+	case ast.ModExp:
+		return ast.ModExp{Left: r.rename(exp.Left), Right: r.rename(exp.Right)}
+	case ast.NegExp:
+		return ast.NegExp{Exp: r.rename(exp.Exp)}
+	case ast.EqExp:
+		return ast.EqExp{Left: r.rename(exp.Left), Right: r.rename(exp.Right)}
+	case ast.NeqExp:
+		return ast.NeqExp{Left: r.rename(exp.Left), Right: r.rename(exp.Right)}
+	case ast.LtExp:
+		return ast.LtExp{Left: r.rename(exp.Left), Right: r.rename(exp.Right)}
+	case ast.LeExp:
+		return ast.LeExp{Left: r.rename(exp.Left), Right: r.rename(exp.Right)}
+	case ast.GtExp:
+		return ast.GtExp{Left: r.rename(exp.Left), Right: r.rename(exp.Right)}
+	case ast.GeExp:
+		return ast.GeExp{Left: r.rename(exp.Left), Right: r.rename(exp.Right)}
+	case ast.AndExp:
+		return ast.AndExp{Left: r.rename(exp.Left), Right: r.rename(exp.Right)}
+	case ast.OrExp:
+		return ast.OrExp{Left: r.rename(exp.Left), Right: r.rename(exp.Right)}
+	case ast.NotExp:
+		return ast.NotExp{Exp: r.rename(exp.Exp)}
+	case ast.IfExp:
+		return ast.IfExp{Cond: r.rename(exp.Cond), Then: r.rename(exp.Then), Else: r.rename(exp.Else)}
+	}
+	// literals and expressions which the vm does not support
+	return exp
+}
+
+// renames the parameters and the body of a function or lambda
+func (r *renamer) renameBody(params []string, body ast.Exp) ([]string, ast.Exp) {
+	renamed := make([]string, len(params))
+	for i, param := range params {
+		renamed[i] = r.unique(param)
+		r.vars = append(r.vars, [2]string{param, renamed[i]})
+	}
+	body = r.rename(body)
+	r.vars = r.vars[:len(r.vars)-len(params)]
+	return renamed, body
+}
+
+// renames every expression of a list
+func (r *renamer) renameAll(exps []ast.Exp) []ast.Exp {
+	renamed := make([]ast.Exp, len(exps))
+	for i, exp := range exps {
+		renamed[i] = r.rename(exp)
+	}
+	return renamed
+}
+
+// returns the renamed locals of the enclosing frames which the function
+// with the unique name captures: the ones its body uses and the ones
+// captured by the functions defined outside of it which it calls,
+// as it has to pass them on
+// a function only depends on functions defined around it, so the
+// recursion ends
+func (comp *compiler) captured(name string) []string {
+	if names, ok := comp.lifted[name]; ok {
+		return names
+	}
+	def := comp.defs[name]
+	names := []string{}
+	add := func(name string) {
+		for _, n := range names {
+			if n == name {
+				return
+			}
+		}
+		names = append(names, name)
+	}
+	// the parameters are not free, and a function is free if it is
+	// called but not defined in the body
+	for _, free := range ast.FreeVars(ast.LambdaExp{Params: def.Params, Body: def.Body}) {
+		if _, ok := comp.defs[free]; ok {
+			if free != name {
+				for _, n := range comp.captured(free) {
+					add(n)
+				}
+			}
+		} else if isLocal(free) {
+			add(free)
+		}
+	}
+	comp.lifted[name] = names
+	return names
+}
@@ -0,0 +1,161 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/lennart01/learning_go/ast"
+)
+
+// Tracer is notified about every instruction a traced run executes
+type Tracer interface {
+	// OnStep is called before the instruction c at index pc is executed,
+	// stack holds the values on the stack with the top value last,
+	// it must not be modified
+	OnStep(pc int, c Code, stack []Value)
+}
+
+// TableTracer prints a table with the pc, the instruction and the stack
+// before every instruction, e.g.
+//
+//	pc  instruction  stack
+//	0   push 1       []
+//	1   push 2       [1]
+//	2   add          [1 2]
+type TableTracer struct {
+	w      io.Writer
+	header bool // true once the header has been printed
+}
+
+// creates a new tracer which prints the table to w
+func NewTableTracer(w io.Writer) *TableTracer {
+	return &TableTracer{w: w}
+}
+
+// OnStep prints a row of the table
+func (t *TableTracer) OnStep(pc int, c Code, stack []Value) {
+	if !t.header {
+		fmt.Fprintf(t.w, "%-3s %-12s %s\n", "pc", "instruction", "stack")
+		t.header = true
+	}
+	fmt.Fprintf(t.w, "%-3d %-12s %v\n", pc, c, stack)
+}
+
+// Debugger runs a program step by step
+// it stops at breakpoints and allows to inspect the stack in between
+type Debugger struct {
+	prog        *Program
+	env         ast.Env
+	slots       []Value
+	m           machine
+	stack       []Value
+	breakpoints map[int]bool
+	done        bool  // true once the program finished or failed
+	result      Value // result of the program once it is done
+	err         error // error of the program once it is done
+}
+
+// creates a new debugger which is about to execute the first instruction
+func NewDebugger(prog *Program) *Debugger {
+	d := &Debugger{prog: prog, breakpoints: map[int]bool{}}
+	d.Reset()
+	return d
+}
+
+// Reset starts the program again from the first instruction
+// breakpoints are kept
+func (d *Debugger) Reset() {
+	d.stack = d.prog.frame(make([]Value, 0, d.prog.maxStack))
+	d.done, d.result, d.err = false, 0, nil
+	d.m = d.prog.bind(d.env, d.slots)
+	d.prog.load(&d.m)
+	// an invalid program can not be executed at all
+	if d.prog.err != nil {
+		d.done, d.err = true, d.prog.err
+	} else if len(d.prog.code) == 0 {
+		d.finish()
+	}
+}
+
+// Bind sets the variables of LOAD and the slots of LOAD_SLOT,
+// like for a VM the named slots of a compiled program are taken from env
+// if slots is nil, and starts the program again from the first instruction
+func (d *Debugger) Bind(env ast.Env, slots []Value) {
+	d.env, d.slots = env, slots
+	d.Reset()
+}
+
+// SetBreakpoint makes Continue stop before the instruction at pc
+func (d *Debugger) SetBreakpoint(pc int) {
+	d.breakpoints[pc] = true
+}
+
+// ClearBreakpoint removes the breakpoint at pc
+func (d *Debugger) ClearBreakpoint(pc int) {
+	delete(d.breakpoints, pc)
+}
+
+// Step executes the next instruction
+// returns true once the program is done
+func (d *Debugger) Step() bool {
+	if d.done {
+		return true
+	}
+	stack, err := d.m.step(d.stack)
+	d.stack = stack
+	if err != nil {
+		d.done, d.err = true, d.m.trace(err, stack)
+		return true
+	}
+	if d.m.pc >= len(d.m.code) {
+		d.finish()
+	}
+	return d.done
+}
+
+// Continue executes instructions until the next instruction has a
+// breakpoint or the program is done, at least one instruction is executed
+// returns true once the program is done
+func (d *Debugger) Continue() bool {
+	for !d.Step() {
+		if d.breakpoints[d.m.pc] {
+			return false
+		}
+	}
+	return true
+}
+
+// PC returns the index of the next instruction
+func (d *Debugger) PC() int {
+	return d.m.pc
+}
+
+// Next returns the next instruction, false if the program is done
+func (d *Debugger) Next() (Code, bool) {
+	if d.done {
+		return Code{}, false
+	}
+	return d.m.code[d.m.pc], true
+}
+
+// Stack returns a copy of the values on the stack with the top value last
+func (d *Debugger) Stack() []Value {
+	return append([]Value(nil), d.stack...)
+}
+
+// Done returns true once the program finished or failed
+func (d *Debugger) Done() bool {
+	return d.done
+}
+
+// Result returns the result of the program once it is done
+// it is the same result Run returns
+func (d *Debugger) Result() (Value, error) {
+	return d.result, d.err
+}
+
+// marks the program as finished and stores its result
+func (d *Debugger) finish() {
+	d.done = true
+	d.result, d.err = d.m.result(d.stack)
+}
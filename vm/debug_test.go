@@ -0,0 +1,188 @@
+package vm
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lennart01/learning_go/ast"
+)
+
+// records every step of a traced run
+type recordingTracer struct {
+	pcs    []int
+	codes  []Code
+	stacks [][]Value
+}
+
+func (r *recordingTracer) OnStep(pc int, c Code, stack []Value) {
+	r.pcs = append(r.pcs, pc)
+	r.codes = append(r.codes, c)
+	r.stacks = append(r.stacks, append([]Value{}, stack...))
+}
+
+func TestTracer(t *testing.T) {
+	code := []Code{NewPushCode(1), NewPushCode(2), NewPlusCode(), NewNegCode()}
+	rec := &recordingTracer{}
+	vm := NewVM(code)
+	vm.Tracer = rec
+	result, err := vm.Run()
+	if err != nil || result != -3 {
+		t.Fatalf("Run = %d, %v, want -3, nil", result, err)
+	}
+	if want := []int{0, 1, 2, 3}; !reflect.DeepEqual(rec.pcs, want) {
+		t.Errorf("pcs = %v, want %v", rec.pcs, want)
+	}
+	if !reflect.DeepEqual(rec.codes, code) {
+		t.Errorf("codes = %v, want %v", rec.codes, code)
+	}
+	want := [][]Value{{}, {1}, {1, 2}, {3}}
+	if !reflect.DeepEqual(rec.stacks, want) {
+		t.Errorf("stacks = %v, want %v", rec.stacks, want)
+	}
+}
+
+func TestTracerError(t *testing.T) {
+	code := []Code{NewPushCode(1), NewPushCode(0), NewDivCode()}
+	rec := &recordingTracer{}
+	_, err := NewVM(code).RunTrace(rec)
+	if !errors.Is(err, ErrDivisionByZero{2, DIV}) {
+		t.Errorf("RunTrace error = %v, want division by zero at pc 2", err)
+	}
+	// the failing instruction is reported before it is executed
+	if want := []int{0, 1, 2}; !reflect.DeepEqual(rec.pcs, want) {
+		t.Errorf("pcs = %v, want %v", rec.pcs, want)
+	}
+}
+
+func TestTableTracer(t *testing.T) {
+	var sb strings.Builder
+	vm := NewVM([]Code{NewPushCode(1), NewPushCode(2), NewPlusCode()})
+	vm.Tracer = NewTableTracer(&sb)
+	if _, err := vm.Run(); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	want := "" +
+		"pc  instruction  stack\n" +
+		"0   push 1       []\n" +
+		"1   push 2       [1]\n" +
+		"2   add          [1 2]\n"
+	if sb.String() != want {
+		t.Errorf("table =\n%s\nwant\n%s", sb.String(), want)
+	}
+}
+
+func TestDebugger(t *testing.T) {
+	// (1+2)*3-4/2
+	prog, err := Compile(benchExp)
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	d := NewDebugger(prog)
+	if c, ok := d.Next(); !ok || c != NewPushCode(1) {
+		t.Fatalf("Next = %v, %v, want push 1, true", c, ok)
+	}
+
+	// single steps
+	d.Step()
+	d.Step()
+	if d.PC() != 2 {
+		t.Errorf("PC = %d, want 2", d.PC())
+	}
+	if want := []Value{1, 2}; !reflect.DeepEqual(d.Stack(), want) {
+		t.Errorf("Stack = %v, want %v", d.Stack(), want)
+	}
+
+	// the returned stack is a copy
+	d.Stack()[0] = 100
+	if d.Stack()[0] != 1 {
+		t.Errorf("modifying the result of Stack changed the debugger")
+	}
+
+	// continue to a breakpoint
+	d.SetBreakpoint(4)
+	if d.Continue() {
+		t.Fatalf("Continue finished the program instead of stopping at the breakpoint")
+	}
+	if d.PC() != 4 {
+		t.Errorf("PC = %d, want 4", d.PC())
+	}
+	if want := []Value{3, 3}; !reflect.DeepEqual(d.Stack(), want) {
+		t.Errorf("Stack = %v, want %v", d.Stack(), want)
+	}
+
+	// continue to the end, the breakpoint at the current pc is not hit again
+	d.ClearBreakpoint(4)
+	if !d.Continue() || !d.Done() {
+		t.Fatalf("Continue did not finish the program")
+	}
+	if _, ok := d.Next(); ok {
+		t.Errorf("Next returned an instruction after the program is done")
+	}
+	want, _ := prog.Run()
+	if result, err := d.Result(); err != nil || result != want {
+		t.Errorf("Result = %d, %v, want %d, nil", result, err, want)
+	}
+
+	// reset keeps the breakpoints
+	d.SetBreakpoint(3)
+	d.Reset()
+	if d.Done() || d.PC() != 0 || len(d.Stack()) != 0 {
+		t.Fatalf("Reset did not restart the program")
+	}
+	d.Continue()
+	if d.PC() != 3 {
+		t.Errorf("PC after Reset and Continue = %d, want 3", d.PC())
+	}
+}
+
+func TestDebuggerErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		code []Code
+		err  error
+	}{
+		{"division by zero", []Code{NewPushCode(1), NewPushCode(0), NewModCode()}, ErrDivisionByZero{2, MOD}},
+		{"underflow", []Code{NewPlusCode()}, ErrStackUnderflow{0, PLUS}},
+		{"empty", []Code{}, ErrEmptyProgram},
+		// the error of a function is wrapped in a TraceError
+		{"division in a function", []Code{
+			NewPushCode(0), NewCallCode(3), NewRetCode(),
+			NewFuncCode("f", 1), NewPushCode(1), NewLoadLocalCode(0), NewDivCode(), NewRetCode(),
+		}, ErrDivisionByZero{6, DIV}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDebugger(NewVM(tt.code).Program)
+			d.Continue()
+			if !d.Done() {
+				t.Fatalf("Continue did not finish the program")
+			}
+			if _, err := d.Result(); !errors.Is(err, tt.err) {
+				t.Errorf("Result error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestDebuggerBind(t *testing.T) {
+	d := NewDebugger(NewVM([]Code{NewLoadCode("x"), NewLoadSlotCode(0), NewSubCode()}).Program)
+	d.Continue()
+	if _, err := d.Result(); err != (ast.UnboundVariableError{Name: "x"}) {
+		t.Errorf("Result error = %v, want unbound variable x", err)
+	}
+	d.Bind(ast.Env{"x": 5}, []Value{2})
+	if d.Done() {
+		t.Fatalf("Bind did not restart the program")
+	}
+	d.Step()
+	d.Step()
+	if want := []Value{5, 2}; !reflect.DeepEqual(d.Stack(), want) {
+		t.Errorf("Stack = %v, want %v", d.Stack(), want)
+	}
+	d.Continue()
+	if result, err := d.Result(); err != nil || result != 3 {
+		t.Errorf("Result = %d, %v, want 3, nil", result, err)
+	}
+}
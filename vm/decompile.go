@@ -0,0 +1,551 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/lennart01/learning_go/ast"
+)
+
+// Decompile rebuilds the expression which was compiled into the code
+// the code is executed symbolically: instead of values the stack holds
+// the expressions which compute them
+// LOAD_SLOT i becomes the variable $i, the names of the slots are unknown
+// STORE_LOCAL starts a let with the names %0, %1, ... in the order of the
+// lets, its body is the expression which ends up in the place of the value
+// JUMP_IF_FALSE starts an if expression, the jumps must have the shape
+// the compiler produces for if, && and ||
+// the main code and every function, which must end with RET, are
+// decompiled on their own, the parameters are named like the lets,
+// the functions are defined around the main code, the ones a function
+// calls outside of it
+// TAILCALL is decompiled like the CALL it replaced, the compiler keeps
+// the jumps and RET after it, CALL_NATIVE becomes a call of the native
+// function and PUSH_STR a string literal
+// a lambda becomes a lambda expression in the place of its MAKE_CLOSURE,
+// its parameters and lets continue the numbering of the enclosing frame
+// and LOAD_UPVAL becomes the captured variable or number
+// PUSH 1 and PUSH 0 become true and false where a bool is expected,
+// e.g. in a condition or next to a comparison
+// returns the verification error if the code is not well-formed
+func Decompile(code []Code) (ast.Exp, error) {
+	return decompile(code, nil)
+}
+
+// Decompile rebuilds the expression which was compiled into the program,
+// the slots are replaced by the names of their variables
+func (p *Program) Decompile() (ast.Exp, error) {
+	return decompile(p.code, p.vars)
+}
+
+// a let whose body is being decompiled
+type openLet struct {
+	index int    // index of the body on the stack, the let ends when it is consumed
+	local int    // local of the let
+	name  string // unique name of the let
+	value ast.Exp
+}
+
+// state of the symbolic execution of the code
+type decompiler struct {
+	code  []Code
+	vars  []string // names of the slots
+	funcs []string // names of the functions by the index of their FUNC instruction
+	// end of the code of every lambda by the index of its FUNC instruction
+	lambdas map[int]int
+	// lambdas whose bodies are being decompiled, shared with the
+	// decompilers of the bodies
+	open   map[int]bool
+	upvals []ast.Exp // the values captured by the lambda being decompiled
+	stack  []ast.Exp
+	lets   []openLet
+	count  int // number of lets so far
+	// name of the let which stored the current value of a local
+	bound map[int]string
+	// while a branch is decompiled, the values below base and the lets
+	// below floor belong to the code before the branch
+	base, floor int
+	jump        int // pc of the jump which starts the branch
+}
+
+// decompiles the code, vars are the names of the slots
+func decompile(code []Code, vars []string) (ast.Exp, error) {
+	if err := Verify(code); err != nil {
+		return nil, err
+	}
+	// every function ends before the next one, the main code
+	// before the first function
+	var entries []int
+	for pc, c := range code {
+		if c.Op == FUNC {
+			entries = append(entries, pc)
+		}
+	}
+	end := func(i int) int {
+		if i < len(entries) {
+			return entries[i]
+		}
+		return len(code)
+	}
+	// the targets of closures are lambdas, the other functions
+	// are defined by name
+	ends := make(map[int]int, len(entries))
+	for i, entry := range entries {
+		ends[entry] = end(i + 1)
+	}
+	lambdas := map[int]int{}
+	for _, c := range code {
+		if c.Op == MAKE_CLOSURE {
+			lambdas[c.val] = ends[c.val]
+		}
+	}
+	var named []int
+	for pc, c := range code {
+		if (c.Op == CALL || c.Op == TAILCALL) && lambdas[c.val] > 0 {
+			return nil, fmt.Errorf("vm: can not decompile the call of a lambda at pc %d", pc)
+		}
+		if c.Op == FUNC && lambdas[pc] == 0 {
+			named = append(named, pc)
+		}
+	}
+	funcs := funcNames(code, named)
+	frame := func() *decompiler {
+		return &decompiler{code: code, vars: vars, funcs: funcs, lambdas: lambdas, open: map[int]bool{}}
+	}
+	exp, err := frame().frame(0, end(0), 0)
+	if err != nil {
+		return nil, err
+	}
+	defs := make([]ast.FuncExp, len(named))
+	for i, entry := range named {
+		body, err := frame().frame(entry+1, ends[entry], code[entry].val)
+		if err != nil {
+			return nil, err
+		}
+		defs[i] = ast.FuncExp{Name: funcs[entry], Params: paramNames(0, code[entry].val), Body: body}
+	}
+	order, err := definitionOrder(code, named, ends)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(order) - 1; i >= 0; i-- {
+		def := defs[order[i]]
+		def.In = exp
+		exp = def
+	}
+	return exp, nil
+}
+
+// returns the names of params parameters, numbered from first on
+func paramNames(first, params int) []string {
+	names := make([]string, params)
+	for i := range names {
+		names[i] = fmt.Sprintf("%%%d", first+i)
+	}
+	return names
+}
+
+// decompiles the main code or a function from up to but excluding to,
+// the first params locals are the parameters, which are named like the
+// next lets, RET at the end is dropped
+func (d *decompiler) frame(from, to, params int) (ast.Exp, error) {
+	d.stack, d.bound = []ast.Exp{}, map[int]string{}
+	for i, name := range paramNames(d.count, params) {
+		d.bound[i] = name
+	}
+	d.count += params
+	if d.code[to-1].Op == RET {
+		to--
+	}
+	if err := d.block(from, to); err != nil {
+		return nil, err
+	}
+	if len(d.stack) != 1 {
+		return nil, fmt.Errorf("vm: can not decompile the code from pc %d to %d", from, to)
+	}
+	d.closeLets(0, -1, len(d.lets))
+	return d.stack[0], nil
+}
+
+// returns the names of the functions by the index of their FUNC
+// instruction, a name which is used by an earlier function gets the
+// suffix %<pc>, so that calls refer to the right definition
+func funcNames(code []Code, entries []int) []string {
+	names := make([]string, len(code))
+	used := map[string]bool{}
+	for _, entry := range entries {
+		name := code[entry].name
+		if used[name] {
+			name = fmt.Sprintf("%s%%%d", name, entry)
+		}
+		used[name] = true
+		names[entry] = name
+	}
+	return names
+}
+
+// returns the order of the definitions of the functions, by their index
+// in entries and from the outermost, a function is defined inside the
+// functions it calls, also in the lambdas it creates, so that they are
+// in scope of its body, ends are the ends of the code of the functions
+// returns an error for functions which call each other
+func definitionOrder(code []Code, entries []int, ends map[int]int) ([]int, error) {
+	index := make(map[int]int, len(entries))
+	for i, entry := range entries {
+		index[entry] = i
+	}
+	// 0 unvisited, 1 being visited, 2 ordered
+	state := make([]int, len(entries))
+	order := make([]int, 0, len(entries))
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case 1:
+			return fmt.Errorf("vm: can not decompile the recursion through the function %q", code[entries[i]].name)
+		case 2:
+			return nil
+		}
+		state[i] = 1
+		scanned := map[int]bool{}
+		var scan func(entry int) error
+		scan = func(entry int) error {
+			for pc := entry + 1; pc < ends[entry]; pc++ {
+				c := code[pc]
+				switch {
+				case (c.Op == CALL || c.Op == TAILCALL) && c.val != entries[i]:
+					if err := visit(index[c.val]); err != nil {
+						return err
+					}
+				case c.Op == MAKE_CLOSURE && !scanned[c.val]:
+					scanned[c.val] = true
+					if err := scan(c.val); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+		if err := scan(entries[i]); err != nil {
+			return err
+		}
+		state[i] = 2
+		order = append(order, i)
+		return nil
+	}
+	for i := range entries {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// wraps the values which are consumed, except the one at keep, into
+// at most max lets which end with them, the innermost let first
+func (d *decompiler) closeLets(from, keep, max int) {
+	for ; max > 0 && len(d.lets) > d.floor; max-- {
+		let := d.lets[len(d.lets)-1]
+		if let.index < from || let.index == keep {
+			return
+		}
+		d.lets = d.lets[:len(d.lets)-1]
+		d.stack[let.index] = ast.LetExp{Name: let.name, Value: let.value, Body: d.stack[let.index]}
+		if d.bound[let.local] == let.name {
+			delete(d.bound, let.local)
+		}
+	}
+}
+
+// returns the error for jumps which do not have the shape of an if
+func (d *decompiler) unstructured(pc int) error {
+	return fmt.Errorf("vm: can not decompile the jump at pc %d", pc)
+}
+
+// executes the instructions from up to but excluding to
+func (d *decompiler) block(from, to int) error {
+	for pc := from; pc < to; pc++ {
+		c := d.code[pc]
+		if c.Op == TAILCALL {
+			c.Op = CALL
+		}
+		n := len(d.stack)
+		pop, push := c.stackEffect(d.code)
+		if n-pop < d.base {
+			// a branch uses a value of the code before the if
+			return d.unstructured(d.jump)
+		}
+		switch c.Op {
+		case JUMP_IF_FALSE:
+			// the condition is replaced by the if, so it keeps its lets
+			end, err := d.branch(pc, to)
+			if err != nil {
+				return err
+			}
+			pc = end - 1
+			continue
+		case JUMP:
+			// the jumps of an if are consumed by branch
+			return d.unstructured(pc)
+		case RET:
+			// only the RET at the end of a function can be decompiled
+			return fmt.Errorf("vm: can not decompile the return at pc %d", pc)
+		case STORE_LOCAL:
+			// the value may be the body of open lets: lets inside the value
+			// end with it, they are found by the local which is overwritten,
+			// the outer lets are still open and contain the new let
+			for i := len(d.lets) - 1; i >= d.floor && d.lets[i].index == n-1; i-- {
+				if d.lets[i].local == c.val {
+					d.closeLets(n-1, -1, len(d.lets)-i)
+					break
+				}
+			}
+		default:
+			// an operand which is replaced by the result keeps its lets
+			keep := -1
+			if push == 1 {
+				keep = n - pop
+			}
+			d.closeLets(n-pop, keep, len(d.lets))
+		}
+		if err := d.exec(pc, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// executes an instruction which is not a jump
+func (d *decompiler) exec(pc int, c Code) error {
+	n := len(d.stack)
+	switch c.Op {
+	case PUSH:
+		d.stack = append(d.stack, ast.IntExp{Val: c.val})
+	case PUSH_STR:
+		d.stack = append(d.stack, ast.StringExp{Val: c.name})
+	case LOAD:
+		d.stack = append(d.stack, ast.VarExp{Name: c.name})
+	case LOAD_SLOT:
+		name := fmt.Sprintf("$%d", c.val)
+		if c.val < len(d.vars) {
+			name = d.vars[c.val]
+		}
+		d.stack = append(d.stack, ast.VarExp{Name: name})
+	case STORE_LOCAL:
+		name := fmt.Sprintf("%%%d", d.count)
+		d.count++
+		d.lets = append(d.lets, openLet{index: n - 1, local: c.val, name: name, value: d.stack[n-1]})
+		d.bound[c.val] = name
+		d.stack = d.stack[:n-1]
+	case LOAD_LOCAL:
+		name, ok := d.bound[c.val]
+		if !ok {
+			return fmt.Errorf("vm: local %d is read outside of a let at pc %d", c.val, pc)
+		}
+		d.stack = append(d.stack, ast.VarExp{Name: name})
+	case NEG:
+		d.stack[n-1] = ast.NegExp{Exp: d.stack[n-1]}
+	case NOT:
+		d.stack[n-1] = ast.NotExp{Exp: asBool(d.stack[n-1])}
+	case CALL:
+		params := d.code[c.val].val
+		args := append([]ast.Exp{}, d.stack[n-params:]...)
+		d.stack = append(d.stack[:n-params], ast.CallExp{Name: d.funcs[c.val], Args: args})
+	case MAKE_CLOSURE:
+		return d.lambda(pc, c)
+	case LOAD_UPVAL:
+		d.stack = append(d.stack, d.upvals[c.val])
+	case CALL_CLOSURE:
+		args := append([]ast.Exp{}, d.stack[n-c.val:]...)
+		d.stack = append(d.stack[:n-c.val-1], ast.AppExp{Fn: d.stack[n-c.val-1], Args: args})
+	case CALL_NATIVE:
+		args := append([]ast.Exp{}, d.stack[n-c.val:]...)
+		d.stack = append(d.stack[:n-c.val], ast.CallExp{Name: c.name, Args: args})
+	default:
+		left, right := d.stack[n-2], d.stack[n-1]
+		d.stack = d.stack[:n-1]
+		switch c.Op {
+		case PLUS:
+			d.stack[n-2] = ast.PlusExp{Left: left, Right: right}
+		case MULTIPLY:
+			d.stack[n-2] = ast.MultExp{Left: left, Right: right}
+		case SUB:
+			d.stack[n-2] = ast.SubExp{Left: left, Right: right}
+		case DIV:
+			d.stack[n-2] = ast.DivExp{Left: left, Right: right}
+		case MOD:
+			d.stack[n-2] = ast.ModExp{Left: left, Right: right}
+		case EQ:
+			left, right = sameKind(left, right)
+			d.stack[n-2] = ast.EqExp{Left: left, Right: right}
+		case NE:
+			left, right = sameKind(left, right)
+			d.stack[n-2] = ast.NeqExp{Left: left, Right: right}
+		case LT:
+			d.stack[n-2] = ast.LtExp{Left: left, Right: right}
+		case LE:
+			d.stack[n-2] = ast.LeExp{Left: left, Right: right}
+		case GT:
+			d.stack[n-2] = ast.GtExp{Left: left, Right: right}
+		case GE:
+			d.stack[n-2] = ast.GeExp{Left: left, Right: right}
+		}
+	}
+	return nil
+}
+
+// replaces the captured values on the stack by the lambda of the
+// MAKE_CLOSURE c at pc, its body is decompiled with the captured values
+// in place of LOAD_UPVAL, so they must be variables or numbers
+func (d *decompiler) lambda(pc int, c Code) error {
+	fn := d.code[c.val]
+	n := len(d.stack)
+	upvals := append([]ast.Exp{}, d.stack[n-fn.upvals:]...)
+	for _, upval := range upvals {
+		switch upval.(type) {
+		case ast.VarExp, ast.IntExp:
+		default:
+			return fmt.Errorf("vm: can not decompile the captured value %s at pc %d", upval.Pretty(), pc)
+		}
+	}
+	if d.open[c.val] {
+		return fmt.Errorf("vm: can not decompile the closure at pc %d inside of its own lambda", pc)
+	}
+	d.open[c.val] = true
+	defer delete(d.open, c.val)
+	inner := &decompiler{code: d.code, vars: d.vars, funcs: d.funcs, lambdas: d.lambdas, open: d.open, upvals: upvals, count: d.count}
+	body, err := inner.frame(c.val+1, d.lambdas[c.val], fn.val)
+	if err != nil {
+		return err
+	}
+	params := paramNames(d.count, fn.val)
+	// the names of the lets of the body stay unique
+	d.count = inner.count
+	d.stack = append(d.stack[:n-fn.upvals], ast.LambdaExp{Params: params, Body: body})
+	return nil
+}
+
+// decompiles the if which starts with the JUMP_IF_FALSE at pc and
+// ends at or before to, the code must have the shape
+//
+//	jump_if_false else; then...; jump end; else: else...; end:
+//
+// returns the index of the instruction after the if
+func (d *decompiler) branch(pc, to int) (int, error) {
+	target := d.code[pc].val
+	if target <= pc+1 || target > to || d.code[target-1].Op != JUMP {
+		return 0, d.unstructured(pc)
+	}
+	end := d.code[target-1].val
+	if end < target || end > to {
+		return 0, d.unstructured(pc)
+	}
+	n := len(d.stack)
+	cond := d.stack[n-1]
+	d.stack = d.stack[:n-1]
+
+	bound := make(map[int]string, len(d.bound))
+	for local, name := range d.bound {
+		bound[local] = name
+	}
+	then, err := d.branchValue(pc, pc+1, target-1)
+	if err != nil {
+		return 0, err
+	}
+	d.bound = bound
+	els, err := d.branchValue(pc, target, end)
+	if err != nil {
+		return 0, err
+	}
+	// after the if a local which a branch stored has an unknown value
+	for _, c := range d.code[pc+1 : end] {
+		if c.Op == STORE_LOCAL {
+			delete(bound, c.val)
+		}
+	}
+	d.bound = bound
+	d.stack = append(d.stack, ifExp(cond, then, els))
+	return end, nil
+}
+
+// decompiles the code of a branch, which must push exactly one value
+// the lets which start in the branch end with it
+func (d *decompiler) branchValue(jump, from, to int) (ast.Exp, error) {
+	base, floor, outer := d.base, d.floor, d.jump
+	d.base, d.floor, d.jump = len(d.stack), len(d.lets), jump
+	defer func() { d.base, d.floor, d.jump = base, floor, outer }()
+	if err := d.block(from, to); err != nil {
+		return nil, err
+	}
+	if len(d.stack) != d.base+1 {
+		return nil, d.unstructured(jump)
+	}
+	d.closeLets(d.base, -1, len(d.lets))
+	val := d.stack[d.base]
+	d.stack = d.stack[:d.base]
+	return val, nil
+}
+
+// returns the expression of an if, the shapes the compiler uses
+// for && and || become the logical operators again
+func ifExp(cond, then, els ast.Exp) ast.Exp {
+	cond = asBool(cond)
+	if b, ok := doubleNot(then); ok && els == (ast.IntExp{Val: 0}) {
+		return ast.AndExp{Left: cond, Right: b}
+	}
+	if b, ok := doubleNot(els); ok && then == (ast.IntExp{Val: 1}) {
+		return ast.OrExp{Left: cond, Right: b}
+	}
+	then, els = sameKind(then, els)
+	return ast.IfExp{Cond: cond, Then: then, Else: els}
+}
+
+// bools are pushed as 1 and 0, which are decompiled into numbers,
+// but where the expression needs a bool they become true and false
+
+// returns true if the expression is a bool, as far as its shape tells
+func isBool(exp ast.Exp) bool {
+	switch exp := exp.(type) {
+	case ast.BoolExp, ast.EqExp, ast.NeqExp, ast.LtExp, ast.LeExp, ast.GtExp, ast.GeExp,
+		ast.NotExp, ast.AndExp, ast.OrExp:
+		return true
+	case ast.IfExp:
+		return isBool(exp.Then) || isBool(exp.Else)
+	case ast.LetExp:
+		return isBool(exp.Body)
+	}
+	return false
+}
+
+// returns the expression with the numbers 1 and 0 which are its value
+// replaced by true and false
+func asBool(exp ast.Exp) ast.Exp {
+	switch e := exp.(type) {
+	case ast.IntExp:
+		if e.Val == 0 || e.Val == 1 {
+			return ast.BoolExp{Val: e.Val == 1}
+		}
+	case ast.IfExp:
+		return ast.IfExp{Cond: e.Cond, Then: asBool(e.Then), Else: asBool(e.Else)}
+	case ast.LetExp:
+		return ast.LetExp{Name: e.Name, Value: e.Value, Body: asBool(e.Body)}
+	}
+	return exp
+}
+
+// returns both expressions as bools if one of them is a bool,
+// e.g. the branches of an if or the operands of ==
+func sameKind(a, b ast.Exp) (ast.Exp, ast.Exp) {
+	if isBool(a) || isBool(b) {
+		return asBool(a), asBool(b)
+	}
+	return a, b
+}
+
+// returns b if exp is !!b
+func doubleNot(exp ast.Exp) (ast.Exp, bool) {
+	if not, ok := exp.(ast.NotExp); ok {
+		if inner, ok := not.Exp.(ast.NotExp); ok {
+			return inner.Exp, true
+		}
+	}
+	return nil, false
+}
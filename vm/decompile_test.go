@@ -0,0 +1,324 @@
+package vm
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lennart01/learning_go/ast"
+)
+
+func TestDecompile(t *testing.T) {
+	tests := []ast.Exp{
+		ast.IntExp{Val: 1},
+		// (1+2)*(3+4) can not be shown by tracking a single previous value
+		ast.MultExp{
+			Left:  ast.PlusExp{Left: ast.IntExp{Val: 1}, Right: ast.IntExp{Val: 2}},
+			Right: ast.PlusExp{Left: ast.IntExp{Val: 3}, Right: ast.IntExp{Val: 4}},
+		},
+		ast.SubExp{Left: ast.IntExp{Val: 1}, Right: ast.SubExp{Left: ast.IntExp{Val: 2}, Right: ast.IntExp{Val: 3}}},
+		ast.NegExp{Exp: ast.ModExp{Left: ast.IntExp{Val: -7}, Right: ast.DivExp{Left: ast.IntExp{Val: 4}, Right: ast.IntExp{Val: 2}}}},
+		benchExp,
+		deepSum(50),
+		ast.MultExp{Left: ast.VarExp{Name: "price"}, Right: ast.NegExp{Exp: ast.VarExp{Name: "qty"}}},
+	}
+
+	for _, exp := range tests {
+		t.Run(exp.Pretty(), func(t *testing.T) {
+			prog, err := Compile(exp)
+			if err != nil {
+				t.Fatalf("Compile returned error: %v", err)
+			}
+			got, err := prog.Decompile()
+			if err != nil {
+				t.Fatalf("Decompile returned error: %v", err)
+			}
+			if !reflect.DeepEqual(got, exp) {
+				t.Errorf("Decompile(Compile(%s)) = %s", exp.Pretty(), got.Pretty())
+			}
+		})
+	}
+}
+
+func TestDecompileVariables(t *testing.T) {
+	// the names of the slots are not part of the code
+	got, err := Decompile([]Code{NewLoadSlotCode(0), NewLoadCode("x"), NewPlusCode()})
+	if err != nil {
+		t.Fatalf("Decompile returned error: %v", err)
+	}
+	if got.Pretty() != "($0+x)" {
+		t.Errorf("Decompile = %s, want ($0+x)", got.Pretty())
+	}
+}
+
+func TestDecompileInvalid(t *testing.T) {
+	code := []Code{NewPushCode(1), NewPushCode(2), NewPlusCode(), NewMultiplyCode()}
+	if _, err := Decompile(code); err != (ErrStackUnderflow{3, MULTIPLY}) {
+		t.Errorf("Decompile() error = %v, want %v", err, ErrStackUnderflow{3, MULTIPLY})
+	}
+}
+
+func TestDecompileLet(t *testing.T) {
+	x, y := ast.VarExp{Name: "x"}, ast.VarExp{Name: "y"}
+	tests := []struct {
+		exp  ast.Exp
+		want string
+	}{
+		{ast.LetExp{Name: "x", Value: ast.IntExp{Val: 3}, Body: ast.MultExp{Left: x, Right: x}}, "(let %0 = 3 in (%0*%0))"},
+		{ast.PlusExp{Left: ast.LetExp{Name: "x", Value: ast.IntExp{Val: 3}, Body: x}, Right: ast.VarExp{Name: "z"}}, "(let %0 = 3 in (%0+z))"},
+		{ast.PlusExp{Left: ast.IntExp{Val: 1}, Right: ast.LetExp{Name: "x", Value: ast.IntExp{Val: 3}, Body: ast.NegExp{Exp: x}}}, "(1+(let %0 = 3 in (-%0)))"},
+		{ast.LetExp{Name: "x", Value: ast.LetExp{Name: "y", Value: ast.IntExp{Val: 2}, Body: y}, Body: ast.LetExp{Name: "y", Value: x, Body: ast.SubExp{Left: y, Right: x}}},
+			"(let %1 = (let %0 = 2 in %0) in (let %2 = %1 in (%2-%1)))"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.exp.Pretty(), func(t *testing.T) {
+			prog, err := Compile(tt.exp)
+			if err != nil {
+				t.Fatalf("Compile returned error: %v", err)
+			}
+			got, err := prog.Decompile()
+			if err != nil {
+				t.Fatalf("Decompile returned error: %v", err)
+			}
+			if got.Pretty() != tt.want {
+				t.Errorf("Decompile(Compile(%s)) = %s, want %s", tt.exp.Pretty(), got.Pretty(), tt.want)
+			}
+			env := ast.Env{"z": 5}
+			if got, want := got.Eval(env), tt.exp.Eval(env); got != want {
+				t.Errorf("decompiled expression evaluates to %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestDecompileLocalOutsideOfLet(t *testing.T) {
+	// the inner let overwrites local 0, the outer let can not be used afterwards
+	code := []Code{
+		NewPushCode(1), NewStoreLocalCode(0),
+		NewPushCode(5), NewPushCode(2), NewStoreLocalCode(0), NewLoadLocalCode(0), NewPlusCode(),
+		NewLoadLocalCode(0), NewPlusCode(),
+	}
+	want := "vm: local 0 is read outside of a let at pc 7"
+	if _, err := Decompile(code); err == nil || err.Error() != want {
+		t.Errorf("Decompile() error = %v, want %s", err, want)
+	}
+	if _, err := Decompile([]Code{NewLoadLocalCode(0)}); err == nil {
+		t.Errorf("Decompile() of a load without a store returned no error")
+	}
+}
+
+func TestDecompileConditionals(t *testing.T) {
+	x, y := ast.VarExp{Name: "x"}, ast.VarExp{Name: "y"}
+	tests := []struct {
+		exp  ast.Exp
+		want string
+	}{
+		{ast.IfExp{Cond: ast.LtExp{Left: x, Right: y}, Then: x, Else: ast.NegExp{Exp: y}}, "(if (x<y) then x else (-y))"},
+		// the shapes of && and || are recognized, where a bool is
+		// expected 1 and 0 become true and false
+		{ast.AndExp{Left: ast.EqExp{Left: x, Right: ast.IntExp{Val: 1}}, Right: ast.NotExp{Exp: ast.LtExp{Left: y, Right: x}}}, "((x==1)&&(!(y<x)))"},
+		{ast.OrExp{Left: ast.BoolExp{Val: false}, Right: ast.GeExp{Left: x, Right: y}}, "(false||(x>=y))"},
+		{ast.NotExp{Exp: ast.BoolExp{Val: true}}, "(!true)"},
+		{ast.IfExp{Cond: ast.LtExp{Left: x, Right: y}, Then: ast.BoolExp{Val: true}, Else: ast.EqExp{Left: x, Right: y}}, "(if (x<y) then true else (x==y))"},
+		{ast.EqExp{Left: ast.BoolExp{Val: false}, Right: ast.LtExp{Left: x, Right: y}}, "(false==(x<y))"},
+		{ast.PlusExp{Left: ast.IntExp{Val: 1}, Right: ast.IfExp{Cond: ast.LtExp{Left: x, Right: y}, Then: ast.IfExp{Cond: ast.BoolExp{Val: true}, Then: ast.IntExp{Val: 2}, Else: ast.IntExp{Val: 3}}, Else: ast.IntExp{Val: 4}}},
+			"(1+(if (x<y) then (if true then 2 else 3) else 4))"},
+		// a let in a branch ends with the branch, a let around the if contains it
+		{ast.LetExp{Name: "a", Value: x, Body: ast.IfExp{
+			Cond: ast.GtExp{Left: ast.VarExp{Name: "a"}, Right: y},
+			Then: ast.LetExp{Name: "b", Value: y, Body: ast.MultExp{Left: ast.VarExp{Name: "b"}, Right: ast.VarExp{Name: "a"}}},
+			Else: ast.VarExp{Name: "a"},
+		}}, "(let %0 = x in (if (%0>y) then (let %1 = y in (%1*%0)) else %0))"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.exp.Pretty(), func(t *testing.T) {
+			prog, err := Compile(tt.exp)
+			if err != nil {
+				t.Fatalf("Compile returned error: %v", err)
+			}
+			got, err := prog.Decompile()
+			if err != nil {
+				t.Fatalf("Decompile returned error: %v", err)
+			}
+			if got.Pretty() != tt.want {
+				t.Errorf("Decompile(Compile(%s)) = %s, want %s", tt.exp.Pretty(), got.Pretty(), tt.want)
+			}
+		})
+	}
+}
+
+func TestDecompileUnstructuredJumps(t *testing.T) {
+	tests := []struct {
+		name string
+		code []Code
+		want string
+	}{
+		{"jump over code", []Code{NewPushCode(1), NewJumpCode(3), NewNegCode()}, "vm: can not decompile the jump at pc 1"},
+		{"no else", []Code{NewPushCode(1), NewLoadCode("x"), NewJumpIfFalseCode(4), NewNegCode()}, "vm: can not decompile the jump at pc 2"},
+		// the branches change a value which was pushed before the if
+		{"branch uses outer value", []Code{
+			NewPushCode(1), NewLoadCode("x"), NewJumpIfFalseCode(5), NewNegCode(), NewJumpCode(5),
+		}, "vm: can not decompile the jump at pc 2"},
+		{"loop", []Code{NewPushCode(1), NewLoadCode("x"), NewJumpIfFalseCode(4), NewJumpCode(1)}, "vm: can not decompile the jump at pc 2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Verify(tt.code); err != nil {
+				t.Fatalf("Verify() = %v, the code must be valid", err)
+			}
+			if _, err := Decompile(tt.code); err == nil || err.Error() != tt.want {
+				t.Errorf("Decompile() error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecompileRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 2000; i++ {
+		exp := randomExp(r, 6, r.Intn(2) == 0)
+		prog, err := Compile(exp)
+		if err != nil {
+			t.Fatalf("Compile returned error: %v", err)
+		}
+		got, err := prog.Decompile()
+		if err != nil {
+			t.Fatalf("Decompile(Compile(%s)) returned error: %v", exp.Pretty(), err)
+		}
+		want, wantErr := ast.Evaluate(exp)
+		if val, err := ast.Evaluate(got); val != want || (err == nil) != (wantErr == nil) {
+			t.Fatalf("Decompile(Compile(%s)) = %s evaluates to %d, %v, want %d, %v",
+				exp.Pretty(), got.Pretty(), val, err, want, wantErr)
+		}
+	}
+}
+
+func TestDecompileFunctions(t *testing.T) {
+	x, a := ast.VarExp{Name: "x"}, ast.VarExp{Name: "a"}
+	inc := ast.FuncExp{Name: "inc", Params: []string{"a"}, Body: ast.PlusExp{Left: a, Right: ast.IntExp{Val: 1}},
+		In: ast.FuncExp{Name: "twice", Params: []string{"a"},
+			Body: ast.CallExp{Name: "inc", Args: []ast.Exp{ast.CallExp{Name: "inc", Args: []ast.Exp{a}}}},
+			In:   ast.CallExp{Name: "twice", Args: []ast.Exp{x}}}}
+	tests := []struct {
+		exp  ast.Exp
+		want string
+	}{
+		{fibExp(x), "(fn fib(%0) = (if (%0<2) then %0 else (fib((%0-1))+fib((%0-2)))) in fib(x))"},
+		{inc, "(fn inc(%0) = (%0+1) in (fn twice(%0) = inc(inc(%0)) in twice(x)))"},
+		// the hidden function is renamed by the pc of its FUNC instruction
+		{ast.FuncExp{Name: "f", Params: []string{"a"}, Body: a, In: ast.FuncExp{Name: "f", Params: []string{"a"},
+			Body: ast.NegExp{Exp: a}, In: ast.CallExp{Name: "f", Args: []ast.Exp{x}}}},
+			"(fn f(%0) = %0 in (fn f%6(%0) = (-%0) in f%6(x)))"},
+		// the tail call is decompiled like a call
+		{countExp(x), "(fn count(%0, %1) = (if (%0==0) then %1 else count((%0-1), (%1+%0))) in count(x, 0))"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.exp.Pretty(), func(t *testing.T) {
+			prog, err := Compile(tt.exp)
+			if err != nil {
+				t.Fatalf("Compile returned error: %v", err)
+			}
+			got, err := prog.Decompile()
+			if err != nil {
+				t.Fatalf("Decompile returned error: %v", err)
+			}
+			if got.Pretty() != tt.want {
+				t.Errorf("Decompile(Compile(%s)) = %s, want %s", tt.exp.Pretty(), got.Pretty(), tt.want)
+			}
+			env := ast.Env{"x": 10}
+			if got, want := got.Eval(env), tt.exp.Eval(env); got != want {
+				t.Errorf("decompiled expression evaluates to %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestDecompileClosures(t *testing.T) {
+	x, a, y := ast.VarExp{Name: "x"}, ast.VarExp{Name: "a"}, ast.VarExp{Name: "y"}
+	tests := []struct {
+		exp  ast.Exp
+		want string
+	}{
+		{ast.AppExp{Fn: ast.LambdaExp{Params: []string{"a"}, Body: ast.PlusExp{Left: a, Right: x}}, Args: []ast.Exp{ast.IntExp{Val: 1}}}, "(\\%0 -> (%0+x))(1)"},
+		// the lambda continues the numbering of the lets, the captured
+		// let is loaded by its name
+		{ast.LetExp{Name: "y", Value: ast.IntExp{Val: 5}, Body: ast.LetExp{Name: "f", Value: ast.LambdaExp{Params: []string{"a"},
+			Body: ast.LetExp{Name: "b", Value: ast.MultExp{Left: a, Right: y}, Body: ast.VarExp{Name: "b"}}},
+			Body: ast.CallExp{Name: "f", Args: []ast.Exp{x}}}},
+			"(let %0 = 5 in (let %3 = (\\%1 -> (let %2 = (%1*%0) in %2)) in %3(x)))"},
+		// a nested lambda captures a value the outer lambda captured
+		{ast.LetExp{Name: "y", Value: ast.IntExp{Val: 2}, Body: ast.AppExp{Fn: ast.AppExp{
+			Fn:   ast.LambdaExp{Params: []string{"a"}, Body: ast.LambdaExp{Body: ast.SubExp{Left: a, Right: y}}},
+			Args: []ast.Exp{x}}}},
+			"(let %0 = 2 in (\\%1 -> (\\ -> (%1-%0)))(x)())"},
+		// the function is defined around the one which calls it in a lambda
+		{ast.FuncExp{Name: "inc", Params: []string{"a"}, Body: ast.PlusExp{Left: a, Right: ast.IntExp{Val: 1}},
+			In: ast.FuncExp{Name: "make", Params: []string{"a"},
+				Body: ast.LambdaExp{Body: ast.CallExp{Name: "inc", Args: []ast.Exp{a}}},
+				In:   ast.AppExp{Fn: ast.CallExp{Name: "make", Args: []ast.Exp{x}}}}},
+			"(fn inc(%0) = (%0+1) in (fn make(%0) = (\\ -> inc(%0)) in make(x)()))"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.exp.Pretty(), func(t *testing.T) {
+			prog, err := Compile(tt.exp)
+			if err != nil {
+				t.Fatalf("Compile returned error: %v", err)
+			}
+			got, err := prog.Decompile()
+			if err != nil {
+				t.Fatalf("Decompile returned error: %v", err)
+			}
+			if got.Pretty() != tt.want {
+				t.Errorf("Decompile(Compile(%s)) = %s, want %s", tt.exp.Pretty(), got.Pretty(), tt.want)
+			}
+			// the decompiled expression compiles to the same code
+			again, err := Compile(got)
+			if err != nil {
+				t.Fatalf("Compile(Decompile()) returned error: %v", err)
+			}
+			if !reflect.DeepEqual(again.Code(), prog.Code()) {
+				t.Errorf("Compile(Decompile()) = %v, want %v", again.Code(), prog.Code())
+			}
+		})
+	}
+}
+
+func TestDecompileFunctionErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"mutual recursion", "push 1\ncall f\nret\nf: func f 1\nload_local 0\ncall g\nret\ng: func g 1\nload_local 0\ncall f\nret",
+			`vm: can not decompile the recursion through the function "f"`},
+		// the code after the first return is never run
+		{"early return", "push 1\nret\npush 2\nret", "vm: can not decompile the return at pc 1"},
+		{"computed capture", "push 1\npush 2\nadd\nmake_closure f\ncall_closure 0\nret\nf: func lambda 0 1\nload_upval 0\nret",
+			"vm: can not decompile the captured value (1+2) at pc 3"},
+		{"call of a lambda", "make_closure f\ncall f\nadd\nret\nf: func lambda 0\npush 1\nret",
+			"vm: can not decompile the call of a lambda at pc 1"},
+		{"closure in its lambda", "make_closure f\ncall_closure 0\nret\nf: func lambda 0\nmake_closure f\nret",
+			"vm: can not decompile the closure at pc 4 inside of its own lambda"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := Assemble(strings.NewReader(tt.src))
+			if err != nil {
+				t.Fatalf("Assemble returned error: %v", err)
+			}
+			if err := Verify(code); err != nil {
+				t.Fatalf("Verify() = %v, the code must be valid", err)
+			}
+			if _, err := Decompile(code); err == nil || err.Error() != tt.want {
+				t.Errorf("Decompile() error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lennart01/learning_go/ast"
+)
+
+// ErrEmptyProgram is returned when a program without any code is run
+var ErrEmptyProgram = errors.New("vm: empty program")
+
+// ErrEmptyStack is returned when the stack is empty after the program ran,
+// so there is no result
+var ErrEmptyStack = errors.New("vm: empty stack at the end of the program")
+
+// ErrStackUnderflow is returned when an instruction needs more values than
+// there are on the stack
+type ErrStackUnderflow struct {
+	Pc int    // index of the instruction in the code
+	Op OpCode // the opcode of the instruction
+}
+
+func (e ErrStackUnderflow) Error() string {
+	return fmt.Sprintf("vm: stack underflow at pc %d (%s)", e.Pc, e.Op)
+}
+
+// ErrDivisionByZero is returned when DIV or MOD is executed with zero as
+// the right operand
+type ErrDivisionByZero struct {
+	Pc int    // index of the instruction in the code
+	Op OpCode // the opcode of the instruction
+}
+
+func (e ErrDivisionByZero) Error() string {
+	return fmt.Sprintf("vm: division by zero at pc %d (%s)", e.Pc, e.Op)
+}
+
+// ErrUnknownOpCode is returned when an instruction has an opcode the vm
+// does not know
+type ErrUnknownOpCode struct {
+	Pc int    // index of the instruction in the code
+	Op OpCode // the unknown opcode
+}
+
+func (e ErrUnknownOpCode) Error() string {
+	return fmt.Sprintf("vm: unknown opcode %d at pc %d", int(e.Op), e.Pc)
+}
+
+// ErrSlotOutOfRange is returned when LOAD_SLOT reads a slot which was
+// not passed to the run
+type ErrSlotOutOfRange struct {
+	Pc   int // index of the instruction in the code
+	Slot int // the slot which does not exist
+}
+
+func (e ErrSlotOutOfRange) Error() string {
+	return fmt.Sprintf("vm: slot %d out of range at pc %d", e.Slot, e.Pc)
+}
+
+// ErrStackOverflow is returned by RunContext when an instruction would
+// put more values on the stack than RunOptions.MaxStack allows
+type ErrStackOverflow struct {
+	Pc int    // index of the instruction in the code
+	Op OpCode // the opcode of the instruction
+}
+
+func (e ErrStackOverflow) Error() string {
+	return fmt.Sprintf("vm: stack overflow at pc %d (%s)", e.Pc, e.Op)
+}
+
+// ErrBudgetExceeded is wrapped by the errors of RunContext when a run
+// executes more instructions or uses more memory than its options allow
+var ErrBudgetExceeded = errors.New("vm: budget exceeded")
+
+// ErrCallDepth is returned when a CALL would exceed the maximum number
+// of nested calls of a run, see DefaultMaxCallDepth
+type ErrCallDepth struct {
+	Pc    int // index of the CALL instruction in the code
+	Depth int // number of active calls
+}
+
+func (e ErrCallDepth) Error() string {
+	return fmt.Sprintf("vm: maximum call depth of %d exceeded at pc %d", e.Depth, e.Pc)
+}
+
+// Is makes errors.Is(err, ast.ErrCallDepth) true, so that the errors of
+// the vm and of ast.Evaluate can be checked in the same way
+func (e ErrCallDepth) Is(target error) bool {
+	return target == ast.ErrCallDepth
+}
+
+// name of the frame of the main code in a TraceError
+const mainFrame = "<main>"
+
+// Frame is a function which was active when a run failed
+type Frame struct {
+	Func string // name of the function, "<main>" for the main code
+	Pc   int    // index of the failed instruction in the innermost frame, of the CALL in the others
+}
+
+// TraceError is returned when an instruction fails inside a function,
+// it wraps the error of the instruction, e.g. ErrDivisionByZero,
+// so that errors.As still finds it
+type TraceError struct {
+	Err    error
+	Frames []Frame // the active functions, the innermost first and the main code last
+}
+
+// only this many innermost frames are listed by Error,
+// e.g. for a runaway recursion which exceeded the maximum call depth
+const maxTraceFrames = 10
+
+func (e TraceError) Error() string {
+	var sb strings.Builder
+	sb.WriteString(e.Err.Error())
+	for i, f := range e.Frames {
+		switch {
+		case i == 0:
+			sb.WriteString(" in ")
+		case i < maxTraceFrames || i == len(e.Frames)-1:
+			sb.WriteString(", called from ")
+		case i == maxTraceFrames:
+			fmt.Fprintf(&sb, ", ... %d more calls", len(e.Frames)-maxTraceFrames-1)
+			continue
+		default:
+			continue
+		}
+		fmt.Fprintf(&sb, "%s at pc %d", f.Func, f.Pc)
+	}
+	return sb.String()
+}
+
+func (e TraceError) Unwrap() error {
+	return e.Err
+}
+
+// NativeError is returned when a native function fails, it wraps the
+// error of the function, e.g. an argument which does not fit into the
+// parameter of a function registered by Natives.RegisterGoFunc
+type NativeError struct {
+	Name string // name of the native function
+	Pc   int    // index of the CALL_NATIVE instruction in the code
+	Err  error
+}
+
+func (e NativeError) Error() string {
+	return fmt.Sprintf("vm: native function %q failed at pc %d: %v", e.Name, e.Pc, e.Err)
+}
+
+func (e NativeError) Unwrap() error {
+	return e.Err
+}
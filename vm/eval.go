@@ -0,0 +1,67 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/lennart01/learning_go/ast"
+)
+
+// ErrSlotCount is returned by EvalSlots when the number of values does
+// not match the number of slots of the program
+type ErrSlotCount struct {
+	Want int // number of slots of the program
+	Got  int // number of values passed to EvalSlots
+}
+
+func (e ErrSlotCount) Error() string {
+	return fmt.Sprintf("vm: program has %d slots, got %d values", e.Want, e.Got)
+}
+
+// Vars returns the names of the variables of a compiled program,
+// the i-th name is the variable of slot i
+func (p *Program) Vars() []string {
+	return append([]string(nil), p.vars...)
+}
+
+// Eval runs the program with the variables of env, the variables are
+// looked up once before the program runs
+// returns an ast.UnboundVariableError if the run loads a variable
+// which env does not bind
+//
+// programs are compiled once and can be evaluated many times,
+// EvalSlots avoids the map lookups of Eval
+func (p *Program) Eval(env ast.Env) (Value, error) {
+	return p.RunEnv(env)
+}
+
+// EvalSlots runs the program, slots holds the value of every variable
+// in the order of Vars
+// returns ErrSlotCount if the number of values does not match
+func (p *Program) EvalSlots(slots []Value) (Value, error) {
+	if len(slots) != p.slots {
+		return 0, ErrSlotCount{p.slots, len(slots)}
+	}
+	return p.run(machine{slots: slots})
+}
+
+// returns a machine with the inputs of a run
+// if slots is nil, the named slots are looked up in env, the slots
+// which env does not bind are only an error once they are loaded
+func (p *Program) bind(env ast.Env, slots []Value) machine {
+	var unbound []string
+	if slots == nil && len(p.vars) > 0 {
+		slots = make([]Value, len(p.vars))
+		for i, name := range p.vars {
+			val, ok := env[name]
+			if !ok {
+				if unbound == nil {
+					unbound = make([]string, len(p.vars))
+				}
+				unbound[i] = name
+				continue
+			}
+			slots[i] = Value(val)
+		}
+	}
+	return machine{env: env, slots: slots, unbound: unbound}
+}
@@ -0,0 +1,112 @@
+package vm
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/lennart01/learning_go/ast"
+)
+
+// a*b + c
+var formulaExp = ast.PlusExp{
+	Left:  ast.MultExp{Left: ast.VarExp{Name: "a"}, Right: ast.VarExp{Name: "b"}},
+	Right: ast.VarExp{Name: "c"},
+}
+
+func TestEval(t *testing.T) {
+	prog, err := Compile(formulaExp)
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(prog.Vars(), want) {
+		t.Errorf("Vars = %v, want %v", prog.Vars(), want)
+	}
+	tests := []struct {
+		env  ast.Env
+		want Value
+	}{
+		{ast.Env{"a": 2, "b": 3, "c": 4}, 10},
+		{ast.Env{"a": -1, "b": 5, "c": 0}, -5},
+		{ast.Env{"a": 0, "b": 0, "c": 7, "unused": 1}, 7},
+	}
+	for _, test := range tests {
+		got, err := prog.Eval(test.env)
+		if err != nil || got != test.want {
+			t.Errorf("Eval(%v) = %d, %v, want %d", test.env, got, err, test.want)
+		}
+		slots := []Value{Value(test.env["a"]), Value(test.env["b"]), Value(test.env["c"])}
+		got, err = prog.EvalSlots(slots)
+		if err != nil || got != test.want {
+			t.Errorf("EvalSlots(%v) = %d, %v, want %d", slots, got, err, test.want)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	prog, err := Compile(formulaExp)
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	_, err = prog.Eval(ast.Env{"a": 1, "c": 2})
+	if want := (ast.UnboundVariableError{Name: "b"}); err != want {
+		t.Errorf("Eval error = %v, want %v", err, want)
+	}
+	_, err = prog.EvalSlots([]Value{1, 2})
+	var count ErrSlotCount
+	if !errors.As(err, &count) || count != (ErrSlotCount{Want: 3, Got: 2}) {
+		t.Errorf("EvalSlots error = %v, want %v", err, ErrSlotCount{Want: 3, Got: 2})
+	}
+	// a program without variables has no slots
+	prog, _ = Compile(ast.IntExp{Val: 1})
+	if got, err := prog.EvalSlots(nil); err != nil || got != 1 {
+		t.Errorf("EvalSlots(nil) = %d, %v, want 1", got, err)
+	}
+}
+
+func TestEvalUntakenBranch(t *testing.T) {
+	// if a > 0 then b else c
+	prog, err := Compile(ast.IfExp{
+		Cond: ast.GtExp{Left: ast.VarExp{Name: "a"}, Right: ast.IntExp{Val: 0}},
+		Then: ast.VarExp{Name: "b"},
+		Else: ast.VarExp{Name: "c"},
+	})
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	// a variable is only needed if its branch is taken
+	if got, err := prog.Eval(ast.Env{"a": 1, "b": 2}); err != nil || got != 2 {
+		t.Errorf("Eval = %d, %v, want 2", got, err)
+	}
+	if got, err := prog.Eval(ast.Env{"a": 0, "c": 3}); err != nil || got != 3 {
+		t.Errorf("Eval = %d, %v, want 3", got, err)
+	}
+	_, err = prog.Eval(ast.Env{"a": 0, "b": 2})
+	if want := (ast.UnboundVariableError{Name: "c"}); err != want {
+		t.Errorf("Eval error = %v, want %v", err, want)
+	}
+}
+
+func TestEvalSlotsDoesNotAllocate(t *testing.T) {
+	prog, _ := Compile(formulaExp)
+	slots := []Value{2, 3, 4}
+	if allocs := testing.AllocsPerRun(100, func() { prog.EvalSlots(slots) }); allocs != 0 {
+		t.Errorf("EvalSlots allocates %v times per run, want 0", allocs)
+	}
+}
+
+func BenchmarkEval(b *testing.B) {
+	prog, _ := Compile(formulaExp)
+	env := ast.Env{"a": 2, "b": 3, "c": 4}
+	for i := 0; i < b.N; i++ {
+		prog.Eval(env)
+	}
+}
+
+func BenchmarkEvalSlots(b *testing.B) {
+	prog, _ := Compile(formulaExp)
+	slots := []Value{2, 3, 4}
+	for i := 0; i < b.N; i++ {
+		prog.EvalSlots(slots)
+	}
+}
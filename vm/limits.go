@@ -0,0 +1,141 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"unsafe"
+)
+
+// RunOptions limits the resources a single run of a program may use,
+// a zero field means that the resource is not limited
+type RunOptions struct {
+	MaxSteps  int // maximum number of executed instructions ("gas")
+	MaxStack  int // maximum number of values on the stack, including the locals
+	MaxMemory int // maximum number of bytes used by the values on the stack and by the closures
+	// maximum number of nested calls, a zero does not remove
+	// this limit but uses DefaultMaxCallDepth
+	MaxCallDepth int
+}
+
+// the context is checked for cancellation every this many instructions,
+// so that checking it does not slow down the dispatch loop
+const cancelInterval = 1024
+
+// size of a value on the stack in bytes
+const valueSize = int(unsafe.Sizeof(Value(0)))
+
+// Runs the program like Run, but stops with an error as soon as
+// the run exceeds one of the limits of the options or the context is done
+//
+// the errors are ErrStackOverflow{pc, op} if the stack grows beyond
+// MaxStack, an error wrapping ErrBudgetExceeded if more than MaxSteps
+// instructions are executed or the stack needs more than MaxMemory bytes,
+// and ctx.Err(), e.g. context.Canceled, if the context is done
+func (p *Program) RunContext(ctx context.Context, opts RunOptions) (Value, error) {
+	return p.runContext(ctx, opts, p.bind(nil, nil), nil)
+}
+
+// Runs the program of the vm like RunContext with the variables of the vm
+// if the vm has a tracer, every instruction is reported to it
+func (vm VM) RunContext(ctx context.Context, opts RunOptions) (Value, error) {
+	m := vm.bind(vm.Env, vm.Slots)
+	m.maxCalls = vm.MaxCallDepth
+	return vm.Program.runContext(ctx, opts, m, vm.Tracer)
+}
+
+func (p *Program) runContext(ctx context.Context, opts RunOptions, m machine, t Tracer) (Value, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	lim := newLimits(opts)
+	if opts.MaxCallDepth > 0 {
+		m.maxCalls = opts.MaxCallDepth
+	}
+	p.load(&m)
+	if t != nil {
+		// the tracer may keep the stack, so it is not taken from the pool
+		return m.runLimited(ctx, p.frame(make([]Value, 0, p.maxStack)), lim, t)
+	}
+	stack := stackPool.Get().(*[]Value)
+	if cap(*stack) < p.maxStack {
+		*stack = make([]Value, 0, p.maxStack)
+	}
+	result, err := m.runLimited(ctx, p.frame((*stack)[:0]), lim, nil)
+	stackPool.Put(stack)
+	return result, err
+}
+
+// limits of a run with the unlimited resources set to the maximum
+type limits struct {
+	RunOptions
+	depth  int // maximum number of values on the stack, by MaxStack and MaxMemory
+	memory int // maximum number of values on the stack and in the closures, by MaxMemory
+}
+
+func newLimits(opts RunOptions) limits {
+	lim := limits{RunOptions: opts, depth: math.MaxInt, memory: math.MaxInt}
+	if opts.MaxMemory > 0 {
+		lim.memory = opts.MaxMemory / valueSize
+	}
+	if opts.MaxSteps <= 0 {
+		lim.MaxSteps = math.MaxInt
+	}
+	if opts.MaxStack > 0 && opts.MaxStack < lim.depth {
+		lim.depth = opts.MaxStack
+	}
+	if opts.MaxMemory > 0 && opts.MaxMemory/valueSize < lim.depth {
+		lim.depth = opts.MaxMemory / valueSize
+	}
+	return lim
+}
+
+// returns the error for an instruction which made the stack deeper
+// than the limits allow
+func (lim limits) overflow(pc int, c Code, depth int) error {
+	if lim.MaxStack > 0 && depth > lim.MaxStack {
+		return ErrStackOverflow{pc, c.Op}
+	}
+	return fmt.Errorf("%w: memory limit of %d bytes at pc %d (%s)", ErrBudgetExceeded, lim.MaxMemory, pc, c.Op)
+}
+
+// runs the remaining instructions like run, but checks the limits
+// after every instruction and the context every cancelInterval instructions
+// t may be nil
+func (m *machine) runLimited(ctx context.Context, stack []Value, lim limits, t Tracer) (Value, error) {
+	var err error
+	// the channel is nil if the context can never be done
+	done := ctx.Done()
+	for steps := 0; m.pc < len(m.code); steps++ {
+		if steps == lim.MaxSteps {
+			return 0, m.trace(fmt.Errorf("%w: instruction limit of %d at pc %d", ErrBudgetExceeded, lim.MaxSteps, m.pc), stack)
+		}
+		if done != nil && steps%cancelInterval == 0 {
+			select {
+			case <-done:
+				return 0, ctx.Err()
+			default:
+			}
+		}
+		pc, c := m.pc, m.code[m.pc]
+		if t != nil {
+			t.OnStep(pc, c, stack)
+		}
+		if stack, err = m.step(stack); err != nil {
+			return 0, m.trace(err, stack)
+		}
+		// the closures made before count towards every later stack
+		if len(stack) > lim.depth || lim.MaxMemory > 0 && len(stack)+m.heap.size() > lim.memory {
+			// the trace starts at the failed instruction,
+			// or in the called function after a call
+			if c.Op != CALL && c.Op != CALL_CLOSURE && c.Op != TAILCALL {
+				m.pc = pc
+			}
+			return 0, m.trace(lim.overflow(pc, c, len(stack)), stack)
+		}
+	}
+	return m.result(stack)
+}
@@ -0,0 +1,118 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRunContext(t *testing.T) {
+	// (1+2)*3-4/2 executes 9 instructions with at most 3 values on the stack
+	prog, err := Compile(benchExp)
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	tests := []struct {
+		name string
+		opts RunOptions
+		want Value
+		err  error
+	}{
+		{"unlimited", RunOptions{}, 7, nil},
+		{"enough", RunOptions{MaxSteps: 9, MaxStack: 3, MaxMemory: 3 * valueSize}, 7, nil},
+		{"steps", RunOptions{MaxSteps: 8}, 0, ErrBudgetExceeded},
+		{"stack", RunOptions{MaxStack: 2}, 0, ErrStackOverflow{6, PUSH}},
+		{"memory", RunOptions{MaxMemory: 3*valueSize - 1}, 0, ErrBudgetExceeded},
+		{"stack and memory", RunOptions{MaxStack: 1, MaxMemory: valueSize}, 0, ErrStackOverflow{1, PUSH}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := prog.RunContext(context.Background(), tt.opts)
+			if !errors.Is(err, tt.err) || err == nil && tt.err != nil {
+				t.Fatalf("RunContext error = %v, want %v", err, tt.err)
+			}
+			if result != tt.want {
+				t.Errorf("RunContext = %d, want %d", result, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunContextErrors(t *testing.T) {
+	// errors of the program are returned before the limits are checked
+	_, err := NewVM([]Code{NewPlusCode()}).RunContext(context.Background(), RunOptions{MaxSteps: 1})
+	if !errors.Is(err, ErrStackUnderflow{0, PLUS}) {
+		t.Errorf("RunContext error = %v, want stack underflow", err)
+	}
+	_, err = NewVM([]Code{NewPushCode(1), NewPushCode(0), NewDivCode()}).RunContext(context.Background(), RunOptions{MaxSteps: 3})
+	if !errors.Is(err, ErrDivisionByZero{2, DIV}) {
+		t.Errorf("RunContext error = %v, want division by zero", err)
+	}
+}
+
+func TestRunContextCancel(t *testing.T) {
+	prog, err := Compile(deepSum(5000))
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := prog.RunContext(ctx, RunOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("RunContext error = %v, want context.Canceled", err)
+	}
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if _, err := prog.RunContext(ctx, RunOptions{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("RunContext error = %v, want context.DeadlineExceeded", err)
+	}
+
+	// a context which is not done does not change the result
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	want, _ := prog.Run()
+	if result, err := prog.RunContext(ctx, RunOptions{}); err != nil || result != want {
+		t.Errorf("RunContext = %d, %v, want %d, nil", result, err, want)
+	}
+}
+
+func TestRunContextTracer(t *testing.T) {
+	rec := &recordingTracer{}
+	vm := NewVM([]Code{NewPushCode(1), NewPushCode(2), NewPlusCode()})
+	vm.Tracer = rec
+	_, err := vm.RunContext(context.Background(), RunOptions{MaxSteps: 2})
+	if !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("RunContext error = %v, want ErrBudgetExceeded", err)
+	}
+	if len(rec.pcs) != 2 {
+		t.Errorf("tracer saw %d steps, want 2", len(rec.pcs))
+	}
+}
+
+func TestRunContextDoesNotAllocate(t *testing.T) {
+	prog, err := Compile(benchExp)
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	ctx := context.Background()
+	opts := RunOptions{MaxSteps: 100, MaxStack: 10}
+	prog.RunContext(ctx, opts) // fill the pool
+	if allocs := testing.AllocsPerRun(100, func() { prog.RunContext(ctx, opts) }); allocs != 0 {
+		t.Errorf("RunContext allocates %v times per run, want 0", allocs)
+	}
+}
+
+func BenchmarkProgramRunContext(b *testing.B) {
+	prog, err := Compile(benchExp)
+	if err != nil {
+		b.Fatalf("Compile returned error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := RunOptions{MaxSteps: 1000, MaxStack: 100}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		prog.RunContext(ctx, opts)
+	}
+}
@@ -0,0 +1,349 @@
+package vm
+
+import (
+	"strconv"
+
+	"github.com/lennart01/learning_go/ast"
+)
+
+// machine is the state of a single run of a program
+// every run has its own machine, the program itself is never modified
+//
+// the stack is not part of the machine but passed to and returned by
+// its methods, so a stack in a local array of the caller stays there
+// instead of escaping to the heap
+type machine struct {
+	code  []Code  // the verified code of the program
+	pc    int     // index of the next instruction
+	env   ast.Env // variables of LOAD
+	slots []Value // values of LOAD_SLOT
+	// names of the slots which env does not bind, "" for a bound slot,
+	// nil if all slots are bound
+	unbound []string
+
+	// the frame of a call is on the stack: the arguments, the other
+	// locals of the function and the saved registers of the caller,
+	// the pc to return to, fp, fn and cl, followed by the values the
+	// function computes
+	fp         int       // index of the first local of the active frame on the stack
+	fn         int       // index of the FUNC instruction of the active function, -1 for the main code
+	cl         int       // handle of the active closure, -1 if the active function is no lambda
+	calls      int       // number of active calls
+	maxCalls   int       // maximum number of active calls
+	funcLocals []int     // number of locals of every function by the index of its FUNC instruction
+	natives    []*native // native function of every CALL_NATIVE instruction by its index
+	strIndex   []int     // index of the string of every PUSH_STR instruction by its index
+	// the strings of the program which the values of PUSH_STR index,
+	// a pointer so that passing them to a native function does not
+	// move the slots of every run to the heap
+	strings *[]string
+
+	// the closures of the run, nil until the first MAKE_CLOSURE, so that
+	// runs without lambdas do not allocate
+	heap *heap
+	// the buffer for the arguments of native functions, nil until the
+	// first CALL_NATIVE
+	args *nativeArgs
+}
+
+// the arguments of native functions, passing the stack itself would
+// move every stack to the heap, so the arguments are copied into a
+// buffer which is reused by all calls of a run
+type nativeArgs struct {
+	buf []Value
+}
+
+// calls the native function with a copy of the arguments
+func (m *machine) callNative(f *native, args []Value) (Value, error) {
+	if m.args == nil {
+		m.args = &nativeArgs{}
+	}
+	m.args.buf = append(m.args.buf[:0], args...)
+	return f.fn(*m.strings, m.args.buf)
+}
+
+// a closure is a lambda with the values it captured
+type closure struct {
+	fn    int // index of the FUNC instruction of the lambda
+	first int // index of the first captured value in the upvals of the heap
+}
+
+// the closures created by a run, a closure value on the stack is the
+// handle of the closure, its index in closures
+type heap struct {
+	closures []closure
+	upvals   []Value // the captured values of all closures
+}
+
+// returns the number of values the heap holds, a closure counts as two
+func (h *heap) size() int {
+	if h == nil {
+		return 0
+	}
+	return 2*len(h.closures) + len(h.upvals)
+}
+
+// runs the remaining instructions and returns the result
+// no memory is allocated if the capacity of the stack is at least the
+// maximum stack depth of the code
+func (m *machine) run(stack []Value) (Value, error) {
+	var err error
+	for m.pc < len(m.code) {
+		if stack, err = m.step(stack); err != nil {
+			return 0, m.trace(err, stack)
+		}
+	}
+	return m.result(stack)
+}
+
+// runs the remaining instructions and reports every instruction
+// to the tracer before it is executed
+func (m *machine) runTraced(stack []Value, t Tracer) (Value, error) {
+	var err error
+	for m.pc < len(m.code) {
+		t.OnStep(m.pc, m.code[m.pc], stack)
+		if stack, err = m.step(stack); err != nil {
+			return 0, m.trace(err, stack)
+		}
+	}
+	return m.result(stack)
+}
+
+// returns the result of a finished run, the top value of the stack
+func (m *machine) result(stack []Value) (Value, error) {
+	if len(m.code) == 0 {
+		return 0, ErrEmptyProgram
+	}
+	// if the stack is empty, there is no result
+	if len(stack) == 0 {
+		return 0, ErrEmptyStack
+	}
+	return stack[len(stack)-1], nil
+}
+
+// returns the error of the instruction at pc with the active calls,
+// which are found by the registers saved on the stack
+// errors of the main code are returned unchanged
+func (m *machine) trace(err error, stack []Value) error {
+	if m.calls == 0 {
+		return err
+	}
+	frames := make([]Frame, 0, m.calls+1)
+	pc, fp, fn := m.pc, m.fp, m.fn
+	for fn >= 0 {
+		frames = append(frames, Frame{Func: m.code[fn].name, Pc: pc})
+		saved := fp + m.funcLocals[fn]
+		// the caller is at its CALL or CALL_CLOSURE
+		pc, fp, fn = int(stack[saved])-1, int(stack[saved+1]), int(stack[saved+2])
+	}
+	frames = append(frames, Frame{Func: mainFrame, Pc: pc})
+	return TraceError{Err: err, Frames: frames}
+}
+
+// returns 1 for true and 0 for false
+func boolValue(b bool) Value {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// executes the instruction at pc and returns the new stack
+// the code has been verified, so the stack never underflows and
+// the instructions do not check the number of values on the stack
+func (m *machine) step(stack []Value) ([]Value, error) {
+	c := m.code[m.pc]
+	// n is the number of values on the stack
+	n := len(stack)
+	// switch case on the opcode
+	switch c.Op {
+	// push the value onto the stack
+	case PUSH:
+		stack = append(stack, Value(c.val))
+	case PUSH_STR:
+		// the string was interned when the program was created
+		stack = append(stack, Value(m.strIndex[m.pc]))
+	case PLUS:
+		// replace the top two values by their sum
+		stack[n-2] += stack[n-1]
+		stack = stack[:n-1]
+	case MULTIPLY:
+		// replace the top two values by their product
+		stack[n-2] *= stack[n-1]
+		stack = stack[:n-1]
+	case SUB:
+		// the top value is the right operand
+		stack[n-2] -= stack[n-1]
+		stack = stack[:n-1]
+	case DIV:
+		if stack[n-1] == 0 {
+			return stack, ErrDivisionByZero{m.pc, c.Op}
+		}
+		stack[n-2] /= stack[n-1]
+		stack = stack[:n-1]
+	case MOD:
+		if stack[n-1] == 0 {
+			return stack, ErrDivisionByZero{m.pc, c.Op}
+		}
+		stack[n-2] %= stack[n-1]
+		stack = stack[:n-1]
+	case NEG:
+		// negate the top value
+		stack[n-1] = -stack[n-1]
+	case LOAD:
+		val, ok := m.env[c.name]
+		if !ok {
+			return stack, ast.UnboundVariableError{Name: c.name}
+		}
+		stack = append(stack, Value(val))
+	case LOAD_SLOT:
+		// the slot is never negative, this is checked by the verifier
+		if c.val >= len(m.slots) {
+			return stack, ErrSlotOutOfRange{m.pc, c.val}
+		}
+		// a variable only needs a value if it is loaded, e.g. not
+		// if it is in a branch which is not taken
+		if m.unbound != nil && m.unbound[c.val] != "" {
+			return stack, ast.UnboundVariableError{Name: m.unbound[c.val]}
+		}
+		stack = append(stack, m.slots[c.val])
+	case STORE_LOCAL:
+		// the locals are the bottom values of the frame
+		stack[m.fp+c.val] = stack[n-1]
+		stack = stack[:n-1]
+	case LOAD_LOCAL:
+		stack = append(stack, stack[m.fp+c.val])
+	case EQ:
+		stack[n-2] = boolValue(stack[n-2] == stack[n-1])
+		stack = stack[:n-1]
+	case NE:
+		stack[n-2] = boolValue(stack[n-2] != stack[n-1])
+		stack = stack[:n-1]
+	case LT:
+		stack[n-2] = boolValue(stack[n-2] < stack[n-1])
+		stack = stack[:n-1]
+	case LE:
+		stack[n-2] = boolValue(stack[n-2] <= stack[n-1])
+		stack = stack[:n-1]
+	case GT:
+		stack[n-2] = boolValue(stack[n-2] > stack[n-1])
+		stack = stack[:n-1]
+	case GE:
+		stack[n-2] = boolValue(stack[n-2] >= stack[n-1])
+		stack = stack[:n-1]
+	case NOT:
+		stack[n-1] = boolValue(stack[n-1] == 0)
+	case JUMP:
+		// the target is in range, this is checked by the verifier
+		m.pc = c.val
+		return stack, nil
+	case JUMP_IF_FALSE:
+		cond := stack[n-1]
+		stack = stack[:n-1]
+		if cond == 0 {
+			m.pc = c.val
+			return stack, nil
+		}
+	case CALL:
+		// the target is a FUNC instruction without captured values,
+		// this is checked by the verifier
+		return m.enter(stack, c.val, -1)
+	case TAILCALL:
+		// the target is a FUNC instruction without captured values and
+		// only a function makes tail calls, with exactly the arguments
+		// on its stack, this is checked by the verifier
+		return m.reenter(stack, c.val), nil
+	case MAKE_CLOSURE:
+		// the target is the FUNC instruction of a lambda, the captured
+		// values on top of the stack are moved to the heap
+		if m.heap == nil {
+			m.heap = &heap{}
+		}
+		upvals := m.code[c.val].upvals
+		m.heap.closures = append(m.heap.closures, closure{fn: c.val, first: len(m.heap.upvals)})
+		m.heap.upvals = append(m.heap.upvals, stack[n-upvals:]...)
+		stack = append(stack[:n-upvals], Value(len(m.heap.closures)-1))
+	case LOAD_UPVAL:
+		// only a lambda loads captured values, it is always called
+		// through a closure, this is checked by the verifier
+		stack = append(stack, m.heap.upvals[m.heap.closures[m.cl].first+c.val])
+	case CALL_CLOSURE:
+		args := c.val
+		handle := stack[n-args-1]
+		if m.heap == nil || handle < 0 || int(handle) >= len(m.heap.closures) {
+			return stack, ast.NotAFunctionError{Exp: strconv.Itoa(int(handle))}
+		}
+		fn := m.heap.closures[handle].fn
+		if params := m.code[fn].val; args != params {
+			return stack, ast.ArityError{Name: m.code[fn].name, Want: params, Got: args}
+		}
+		// the arguments replace the closure, so that the frame
+		// looks like the frame of a CALL
+		copy(stack[n-args-1:], stack[n-args:])
+		return m.enter(stack[:n-1], fn, int(handle))
+	case CALL_NATIVE:
+		// the function was looked up when the program was created
+		f := m.natives[m.pc]
+		result, err := m.callNative(f, stack[n-c.val:])
+		if err != nil {
+			return stack, NativeError{Name: f.name, Pc: m.pc, Err: err}
+		}
+		stack = append(stack[:n-c.val], result)
+	case RET:
+		if m.calls == 0 {
+			// the main code ends the program
+			m.pc = len(m.code)
+			return stack, nil
+		}
+		saved := m.fp + m.funcLocals[m.fn]
+		fp := m.fp
+		m.pc, m.fp = int(stack[saved]), int(stack[saved+1])
+		m.fn, m.cl = int(stack[saved+2]), int(stack[saved+3])
+		m.calls--
+		// the frame is replaced by the result
+		stack[fp] = stack[n-1]
+		return stack[:fp+1], nil
+	default:
+		return stack, ErrUnknownOpCode{m.pc, c.Op}
+	}
+	m.pc++
+	return stack, nil
+}
+
+// calls the function whose FUNC instruction is at fn, the arguments
+// are on top of the stack, cl is the handle of the called closure
+func (m *machine) enter(stack []Value, fn, cl int) ([]Value, error) {
+	if m.calls >= m.maxCalls {
+		return stack, ErrCallDepth{m.pc, m.calls}
+	}
+	// the arguments on top of the stack are the first locals
+	// of the new frame, the other locals start as zero
+	n, params := len(stack), m.code[fn].val
+	for i := params; i < m.funcLocals[fn]; i++ {
+		stack = append(stack, 0)
+	}
+	stack = append(stack, Value(m.pc+1), Value(m.fp), Value(m.fn), Value(m.cl))
+	m.fp, m.fn, m.cl = n-params, fn, cl
+	m.calls++
+	m.pc = fn + 1
+	return stack, nil
+}
+
+// calls the function whose FUNC instruction is at fn in the frame of
+// the active function, the arguments on top of the stack replace its
+// locals and the saved registers of its caller are kept, so that fn
+// returns to this caller and the number of active calls stays the same
+func (m *machine) reenter(stack []Value, fn int) []Value {
+	n, params := len(stack), m.code[fn].val
+	saved := m.fp + m.funcLocals[m.fn]
+	// the arguments may overwrite the saved registers
+	pc, fp, caller, cl := stack[saved], stack[saved+1], stack[saved+2], stack[saved+3]
+	stack = stack[:m.fp+copy(stack[m.fp:], stack[n-params:])]
+	for i := params; i < m.funcLocals[fn]; i++ {
+		stack = append(stack, 0)
+	}
+	stack = append(stack, pc, fp, caller, cl)
+	m.fn, m.cl = fn, -1
+	m.pc = fn + 1
+	return stack
+}
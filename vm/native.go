@@ -0,0 +1,304 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+
+	"github.com/lennart01/learning_go/ast"
+)
+
+// NativeFunc is a function of the host which expressions can call like
+// a function they define, e.g. max(a, b, c)
+// args are the values of the arguments, they are only valid during the
+// call and must not be kept, a returned error stops the run
+type NativeFunc func(args ...Value) (Value, error)
+
+// a registered native function
+type native struct {
+	name string
+	// number of parameters, the minimum number of arguments of a
+	// variadic function
+	params   int
+	variadic bool
+	sig      ast.Signature // the kinds of the parameters and the result for ast.Check
+	// calls the function, a string argument is the index of the
+	// string in strs, the strings of the program
+	fn func(strs []string, args []Value) (Value, error)
+}
+
+// Natives is a registry of native functions by their name, which is
+// passed to CompileWith, NewVMWith and UnmarshalBinaryWith
+// a program looks up its native functions once when it is created, so
+// registering or unregistering a function afterwards does not change it
+// a nil *Natives has no functions, a Natives is safe for concurrent use
+type Natives struct {
+	mu    sync.RWMutex
+	funcs map[string]*native
+}
+
+// creates an empty registry of native functions
+func NewNatives() *Natives {
+	return &Natives{funcs: map[string]*native{}}
+}
+
+// RegisterFunc registers a native function under the name, so that
+// programs created afterwards can call it with any number of ints,
+// e.g.
+//
+//	natives.RegisterFunc("max", func(args ...vm.Value) (vm.Value, error) { ... })
+//
+// a function of the expression with the same name and a variable which
+// holds a closure hide the native function, a function which is already
+// registered under the name is replaced
+// returns an error if the name is not an identifier
+func (n *Natives) RegisterFunc(name string, fn NativeFunc) error {
+	if fn == nil {
+		return fmt.Errorf("vm: native function %q is nil", name)
+	}
+	sig := ast.Signature{Params: []ast.Kind{ast.Int}, Variadic: true, Result: ast.Int}
+	call := func(_ []string, args []Value) (Value, error) {
+		return fn(args...)
+	}
+	return n.register(&native{name: name, variadic: true, sig: sig, fn: call})
+}
+
+// RegisterGoFunc registers an ordinary Go function as a native function,
+// e.g. func(a, b int) int or func(currency string) (int64, error)
+// the parameters and the result may be integers of any size or bools,
+// a bool is 1 for true and 0 for false, the parameters may be strings
+// as well, which take string literals, e.g. lookupRate("EUR"), the
+// result may be followed by an error, a variadic function takes any
+// number of further arguments
+// calls with the wrong number or kinds of arguments are rejected by Compile,
+// an argument which does not fit into its parameter stops the run
+// returns an error if the function has another type or the name can
+// not be registered
+func (n *Natives) RegisterGoFunc(name string, fn any) error {
+	f := reflect.ValueOf(fn)
+	if f.Kind() != reflect.Func || f.IsNil() {
+		return fmt.Errorf("vm: native function %q is %T, not a function", name, fn)
+	}
+	t := f.Type()
+	params := make([]reflect.Type, t.NumIn())
+	sig := ast.Signature{Params: make([]ast.Kind, len(params)), Variadic: t.IsVariadic()}
+	for i := range params {
+		params[i] = t.In(i)
+		if t.IsVariadic() && i == len(params)-1 {
+			params[i] = params[i].Elem()
+		}
+		if !isNativeType(params[i]) && params[i].Kind() != reflect.String {
+			return fmt.Errorf("vm: parameter %d of the native function %q has the unsupported type %s", i+1, name, params[i])
+		}
+		sig.Params[i] = kindOf(params[i])
+	}
+	errorType := reflect.TypeOf((*error)(nil)).Elem()
+	if t.NumOut() == 0 || t.NumOut() > 2 || t.NumOut() == 2 && t.Out(1) != errorType {
+		return fmt.Errorf("vm: native function %q must return a value or a value and an error", name)
+	}
+	if !isNativeType(t.Out(0)) {
+		return fmt.Errorf("vm: the result of the native function %q has the unsupported type %s", name, t.Out(0))
+	}
+	sig.Result = kindOf(t.Out(0))
+	call := func(strs []string, args []Value) (Value, error) {
+		in := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			// the arguments of a variadic function share its last parameter
+			typ := params[len(params)-1]
+			if i < len(params) {
+				typ = params[i]
+			}
+			val, err := toGo(arg, typ, strs)
+			if err != nil {
+				return 0, fmt.Errorf("argument %d: %w", i+1, err)
+			}
+			in[i] = val
+		}
+		out := f.Call(in)
+		if len(out) == 2 && !out[1].IsNil() {
+			return 0, out[1].Interface().(error)
+		}
+		return fromGo(out[0])
+	}
+	fixed := len(params)
+	if t.IsVariadic() {
+		fixed--
+	}
+	return n.register(&native{name: name, params: fixed, variadic: t.IsVariadic(), sig: sig, fn: call})
+}
+
+// Unregister removes the native function with the name, programs
+// which were created before keep calling it
+// returns false if no function is registered under the name
+func (n *Natives) Unregister(name string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.funcs[name]; !ok {
+		return false
+	}
+	delete(n.funcs, name)
+	return true
+}
+
+// adds a native function to the registry, replacing the function of
+// the same name
+func (n *Natives) register(f *native) error {
+	if !isIdentifier(f.name) {
+		return fmt.Errorf("vm: invalid name %q of a native function", f.name)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.funcs[f.name] = f
+	return nil
+}
+
+// returns the native function with the name
+func (n *Natives) lookup(name string) (*native, bool) {
+	if n == nil {
+		return nil, false
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	f, ok := n.funcs[name]
+	return f, ok
+}
+
+// returns the signature of the native function with the name for ast.Check
+func (n *Natives) signature(name string) (ast.Signature, bool) {
+	f, ok := n.lookup(name)
+	if !ok {
+		return ast.Signature{}, false
+	}
+	return f.sig, true
+}
+
+// returns an error if the function can not be called with args arguments
+func (f *native) checkArity(args int) error {
+	if f.variadic && args < f.params {
+		return fmt.Errorf("vm: native function %q expects at least %d arguments, got %d", f.name, f.params, args)
+	}
+	if !f.variadic && args != f.params {
+		return fmt.Errorf("vm: %w", ast.ArityError{Name: f.name, Want: f.params, Got: args})
+	}
+	return nil
+}
+
+// returns the native function of every CALL_NATIVE instruction by its
+// index, nil if the code calls none
+// returns an error wrapping ast.UndefinedFunctionError if a function is
+// not registered in natives
+func resolveNatives(code []Code, natives *Natives) ([]*native, error) {
+	var funcs []*native
+	for pc, c := range code {
+		if c.Op != CALL_NATIVE {
+			continue
+		}
+		f, ok := natives.lookup(c.name)
+		if !ok {
+			return nil, fmt.Errorf("vm: %w at pc %d", ast.UndefinedFunctionError{Name: c.name}, pc)
+		}
+		if err := f.checkArity(c.val); err != nil {
+			return nil, fmt.Errorf("%w at pc %d", err, pc)
+		}
+		if funcs == nil {
+			funcs = make([]*native, len(code))
+		}
+		funcs[pc] = f
+	}
+	return funcs, nil
+}
+
+// returns the distinct strings of the PUSH_STR instructions and the
+// index of the string of every PUSH_STR instruction by its index,
+// both are nil if the code pushes no strings
+func internStrings(code []Code) (strs []string, index []int) {
+	seen := map[string]int{}
+	for pc, c := range code {
+		if c.Op != PUSH_STR {
+			continue
+		}
+		i, ok := seen[c.name]
+		if !ok {
+			i = len(strs)
+			seen[c.name] = i
+			strs = append(strs, c.name)
+		}
+		if index == nil {
+			index = make([]int, len(code))
+		}
+		index[pc] = i
+	}
+	return strs, index
+}
+
+// returns true if values of the type can be passed to and returned
+// from a native function, strings can only be passed
+func isNativeType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Bool:
+		return true
+	}
+	return false
+}
+
+// returns the kind of the values of a type which isNativeType accepts
+// or of a string
+func kindOf(t reflect.Type) ast.Kind {
+	switch t.Kind() {
+	case reflect.Bool:
+		return ast.Bool
+	case reflect.String:
+		return ast.String
+	}
+	return ast.Int
+}
+
+// converts a value into the type of a parameter, a string is looked
+// up in strs
+func toGo(v Value, t reflect.Type, strs []string) (reflect.Value, error) {
+	val := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.String:
+		if v < 0 || int(v) >= len(strs) {
+			return val, fmt.Errorf("%d is not a string", v)
+		}
+		val.SetString(strs[v])
+	case reflect.Bool:
+		if v != 0 && v != 1 {
+			return val, fmt.Errorf("%d is not a bool", v)
+		}
+		val.SetBool(v == 1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v < 0 || val.OverflowUint(uint64(v)) {
+			return val, fmt.Errorf("%d overflows %s", v, t)
+		}
+		val.SetUint(uint64(v))
+	default:
+		if val.OverflowInt(int64(v)) {
+			return val, fmt.Errorf("%d overflows %s", v, t)
+		}
+		val.SetInt(int64(v))
+	}
+	return val, nil
+}
+
+// converts the result of a native function into a value
+func fromGo(val reflect.Value) (Value, error) {
+	switch val.Kind() {
+	case reflect.Bool:
+		return boolValue(val.Bool()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if val.Uint() > math.MaxInt {
+			return 0, fmt.Errorf("result %d overflows Value", val.Uint())
+		}
+		return Value(val.Uint()), nil
+	default:
+		if val.Int() < math.MinInt || val.Int() > math.MaxInt {
+			return 0, fmt.Errorf("result %d overflows Value", val.Int())
+		}
+		return Value(val.Int()), nil
+	}
+}
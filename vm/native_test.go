@@ -0,0 +1,462 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lennart01/learning_go/ast"
+)
+
+// returns a new registry with the native functions of the tests
+func testNatives(t *testing.T) *Natives {
+	t.Helper()
+	natives := NewNatives()
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("registering a native function failed: %v", err)
+		}
+	}
+	must(natives.RegisterFunc("max", func(args ...Value) (Value, error) {
+		if len(args) == 0 {
+			return 0, errors.New("max of no values")
+		}
+		m := args[0]
+		for _, arg := range args[1:] {
+			if arg > m {
+				m = arg
+			}
+		}
+		return m, nil
+	}))
+	// rounds v to a multiple of 10^digits
+	must(natives.RegisterGoFunc("round", func(v int64, digits uint8) (int64, error) {
+		if digits > 18 {
+			return 0, fmt.Errorf("%d digits are too many", digits)
+		}
+		p := int64(1)
+		for i := uint8(0); i < digits; i++ {
+			p *= 10
+		}
+		return (v + p/2) / p * p, nil
+	}))
+	must(natives.RegisterGoFunc("pick", func(cond bool, a, b int) int {
+		if cond {
+			return a
+		}
+		return b
+	}))
+	must(natives.RegisterGoFunc("even", func(v int) bool { return v%2 == 0 }))
+	must(natives.RegisterGoFunc("first", func(v int16, rest ...int32) int { return int(v) }))
+	must(natives.RegisterGoFunc("big", func() uint64 { return 1 << 63 }))
+	// the exchange rate of a currency in cents
+	must(natives.RegisterGoFunc("lookupRate", func(currency string) (int, error) {
+		rates := map[string]int{"EUR": 108, "USD": 100}
+		rate, ok := rates[currency]
+		if !ok {
+			return 0, fmt.Errorf("unknown currency %q", currency)
+		}
+		return rate, nil
+	}))
+	return natives
+}
+
+func call(name string, args ...ast.Exp) ast.CallExp {
+	return ast.CallExp{Name: name, Args: args}
+}
+
+func TestNativeFunctions(t *testing.T) {
+	natives := testNatives(t)
+	x, a := ast.VarExp{Name: "x"}, ast.VarExp{Name: "a"}
+	tests := []struct {
+		exp  ast.Exp
+		want Value
+	}{
+		{call("max", x, ast.IntExp{Val: 3}, ast.IntExp{Val: 7}), 10},
+		{call("max", ast.IntExp{Val: 3}), 3},
+		{call("round", ast.IntExp{Val: 1249}, ast.IntExp{Val: 2}), 1200},
+		{call("pick", ast.LtExp{Left: x, Right: ast.IntExp{Val: 5}}, ast.IntExp{Val: 1}, ast.IntExp{Val: 2}), 2},
+		{ast.IfExp{Cond: ast.AndExp{Left: call("even", x), Right: ast.NotExp{Exp: call("even", ast.IntExp{Val: 3})}}, Then: x, Else: a}, 10},
+		{call("even", x), 1},
+		{call("first", ast.IntExp{Val: 4}), 4},
+		{call("first", x, ast.IntExp{Val: 1}, ast.IntExp{Val: 2}), 10},
+		// the arguments are evaluated before the call, a native function
+		// may be called from a function and a lambda
+		{ast.FuncExp{Name: "f", Params: []string{"a"}, Body: call("max", a, call("round", a, ast.IntExp{Val: 1})),
+			In: call("f", ast.IntExp{Val: 15})}, 20},
+		{ast.AppExp{Fn: ast.LambdaExp{Params: []string{"a"}, Body: call("max", a, x)}, Args: []ast.Exp{ast.IntExp{Val: 11}}}, 11},
+		// a function of the expression and a variable holding a closure
+		// hide the native function
+		{ast.FuncExp{Name: "max", Params: []string{"a"}, Body: ast.NegExp{Exp: a}, In: call("max", x)}, -10},
+		{ast.LetExp{Name: "max", Value: ast.LambdaExp{Params: []string{"a"}, Body: a}, Body: call("max", ast.IntExp{Val: 1})}, 1},
+		// strings are only passed to native functions, but they may be
+		// bound to variables and captured on the way
+		{ast.MultExp{Left: call("lookupRate", ast.StringExp{Val: "EUR"}), Right: x}, 1080},
+		{ast.LetExp{Name: "c", Value: ast.StringExp{Val: "USD"}, Body: call("lookupRate", ast.VarExp{Name: "c"})}, 100},
+		{ast.LetExp{Name: "c", Value: ast.StringExp{Val: "EUR"},
+			Body: ast.AppExp{Fn: ast.LambdaExp{Params: []string{"a"}, Body: ast.PlusExp{Left: a, Right: call("lookupRate", ast.VarExp{Name: "c"})}},
+				Args: []ast.Exp{call("lookupRate", ast.StringExp{Val: "USD"})}}}, 208},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.exp.Pretty(), func(t *testing.T) {
+			prog, err := CompileWith(tt.exp, natives)
+			if err != nil {
+				t.Fatalf("CompileWith returned error: %v", err)
+			}
+			if got, err := prog.Eval(ast.Env{"x": 10}); err != nil || got != tt.want {
+				t.Errorf("Eval = %d, %v, want %d", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNativeCode(t *testing.T) {
+	natives := testNatives(t)
+	prog, err := CompileWith(ast.PlusExp{Left: call("max", ast.VarExp{Name: "x"}, ast.IntExp{Val: 2}), Right: ast.IntExp{Val: 1}}, natives)
+	if err != nil {
+		t.Fatalf("CompileWith returned error: %v", err)
+	}
+	want := []Code{NewLoadSlotCode(0), NewPushCode(2), NewCallNativeCode("max", 2), NewPushCode(1), NewPlusCode()}
+	if !reflect.DeepEqual(prog.Code(), want) {
+		t.Errorf("CompileWith =\n%s\nwant\n%s", Disassemble(prog.Code()), Disassemble(want))
+	}
+	if got, want := Disassemble(prog.Code()), "load_slot 0\npush 2\ncall_native max 2\npush 1\nadd\n"; got != want {
+		t.Errorf("Disassemble = %q, want %q", got, want)
+	}
+	code, err := Assemble(strings.NewReader(Disassemble(prog.Code())))
+	if err != nil || !reflect.DeepEqual(code, want) {
+		t.Errorf("Assemble(Disassemble(code)) = %v, %v, want %v", code, err, want)
+	}
+
+	// the optimizer keeps the call, even with constant arguments
+	prog, err = CompileWith(call("max", ast.IntExp{Val: 1}, ast.PlusExp{Left: ast.IntExp{Val: 2}, Right: ast.IntExp{Val: 0}}), natives)
+	if err != nil {
+		t.Fatalf("CompileWith returned error: %v", err)
+	}
+	want = []Code{NewPushCode(1), NewPushCode(2), NewCallNativeCode("max", 2)}
+	if got := Optimize(prog.Code()); !reflect.DeepEqual(got, want) {
+		t.Errorf("Optimize = %v, want %v", got, want)
+	}
+
+	decompiled, err := prog.Decompile()
+	if err != nil {
+		t.Fatalf("Decompile returned error: %v", err)
+	}
+	if got, want := decompiled.Pretty(), "max(1, (2+0))"; got != want {
+		t.Errorf("Decompile = %s, want %s", got, want)
+	}
+}
+
+func TestNativeStrings(t *testing.T) {
+	natives := testNatives(t)
+	eur := call("lookupRate", ast.StringExp{Val: "EUR"})
+	prog, err := CompileWith(ast.PlusExp{Left: eur, Right: ast.SubExp{Left: call("lookupRate", ast.StringExp{Val: "USD"}), Right: eur}}, natives)
+	if err != nil {
+		t.Fatalf("CompileWith returned error: %v", err)
+	}
+	if got, err := prog.Run(); err != nil || got != 100 {
+		t.Errorf("Run = %d, %v, want 100", got, err)
+	}
+	// equal strings are interned once
+	if want := []string{"EUR", "USD"}; !reflect.DeepEqual(prog.strings, want) {
+		t.Errorf("strings = %q, want %q", prog.strings, want)
+	}
+
+	want := "push_str \"EUR\"\ncall_native lookupRate 1\npush_str \"USD\"\ncall_native lookupRate 1\n" +
+		"push_str \"EUR\"\ncall_native lookupRate 1\nsub\nadd\n"
+	if got := Disassemble(prog.Code()); got != want {
+		t.Errorf("Disassemble = %q, want %q", got, want)
+	}
+	code, err := Assemble(strings.NewReader(Disassemble(prog.Code())))
+	if err != nil || !reflect.DeepEqual(code, prog.Code()) {
+		t.Errorf("Assemble(Disassemble(code)) = %v, %v, want %v", code, err, prog.Code())
+	}
+	// a string may contain white space, quotes and semicolons
+	code, err = Assemble(strings.NewReader(`push_str "a \"b\"; c"  ; comment`))
+	if want := []Code{NewPushStrCode(`a "b"; c`)}; err != nil || !reflect.DeepEqual(code, want) {
+		t.Errorf("Assemble = %v, %v, want %v", code, err, want)
+	}
+
+	data, err := prog.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary returned error: %v", err)
+	}
+	var decoded Program
+	if err := decoded.UnmarshalBinaryWith(data, natives); err != nil {
+		t.Fatalf("UnmarshalBinaryWith returned error: %v", err)
+	}
+	if !reflect.DeepEqual(decoded.Code(), prog.Code()) {
+		t.Errorf("UnmarshalBinary(MarshalBinary(p)).Code() = %v, want %v", decoded.Code(), prog.Code())
+	}
+	if got, err := decoded.Run(); err != nil || got != 100 {
+		t.Errorf("decoded Run = %d, %v, want 100", got, err)
+	}
+
+	decompiled, err := prog.Decompile()
+	if err != nil {
+		t.Fatalf("Decompile returned error: %v", err)
+	}
+	if got, want := decompiled.Pretty(), `(lookupRate("EUR")+(lookupRate("USD")-lookupRate("EUR")))`; got != want {
+		t.Errorf("Decompile = %s, want %s", got, want)
+	}
+}
+
+func TestNativeBinary(t *testing.T) {
+	natives := testNatives(t)
+	prog, err := CompileWith(call("round", call("max", ast.VarExp{Name: "x"}, ast.IntExp{Val: 2}), ast.IntExp{Val: 1}), natives)
+	if err != nil {
+		t.Fatalf("CompileWith returned error: %v", err)
+	}
+	data, err := prog.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary returned error: %v", err)
+	}
+	var decoded Program
+	if err := decoded.UnmarshalBinaryWith(data, natives); err != nil {
+		t.Fatalf("UnmarshalBinaryWith returned error: %v", err)
+	}
+	if !reflect.DeepEqual(decoded.Code(), prog.Code()) {
+		t.Errorf("UnmarshalBinary(MarshalBinary(p)).Code() = %v, want %v", decoded.Code(), prog.Code())
+	}
+	if got, err := decoded.Eval(ast.Env{"x": 17}); err != nil || got != 20 {
+		t.Errorf("decoded Eval = %d, %v, want 20", got, err)
+	}
+
+	// the native functions are looked up when the file is loaded
+	data, err = NewVMWith([]Code{NewPushCode(1), NewCallNativeCode("max", 1)}, natives).MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary returned error: %v", err)
+	}
+	data = []byte(strings.Replace(string(data[:len(data)-4]), "max", "nax", 1))
+	err = decoded.UnmarshalBinaryWith(appendChecksum(data), natives)
+	if !errors.Is(err, ErrInvalidProgram) || !strings.Contains(err.Error(), `undefined function "nax" at pc 1`) {
+		t.Errorf("UnmarshalBinaryWith error = %v, want an ErrInvalidProgram naming nax", err)
+	}
+}
+
+func TestNativeErrors(t *testing.T) {
+	natives := testNatives(t)
+	x := ast.VarExp{Name: "x"}
+	tests := []struct {
+		exp     ast.Exp
+		name    string
+		message string
+	}{
+		{call("max"), "max", `vm: native function "max" failed at pc 0: max of no values`},
+		{call("round", x, ast.IntExp{Val: 20}), "round", `vm: native function "round" failed at pc 2: 20 digits are too many`},
+		{call("round", x, ast.IntExp{Val: -1}), "round", `vm: native function "round" failed at pc 2: argument 2: -1 overflows uint8`},
+		{call("first", ast.IntExp{Val: 1 << 20}), "first", `vm: native function "first" failed at pc 1: argument 1: 1048576 overflows int16`},
+		{call("first", ast.IntExp{Val: 1}, ast.IntExp{Val: 2}, ast.IntExp{Val: 1 << 40}), "first",
+			`vm: native function "first" failed at pc 3: argument 3: 1099511627776 overflows int32`},
+		{call("big"), "big", `vm: native function "big" failed at pc 0: result 9223372036854775808 overflows Value`},
+		{call("lookupRate", ast.StringExp{Val: "GBP"}), "lookupRate", `vm: native function "lookupRate" failed at pc 1: unknown currency "GBP"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.exp.Pretty(), func(t *testing.T) {
+			prog, err := CompileWith(tt.exp, natives)
+			if err != nil {
+				t.Fatalf("CompileWith returned error: %v", err)
+			}
+			_, err = prog.Eval(ast.Env{"x": 10})
+			var nativeErr NativeError
+			if !errors.As(err, &nativeErr) || nativeErr.Name != tt.name {
+				t.Fatalf("Eval error = %v, want a NativeError of %s", err, tt.name)
+			}
+			if err.Error() != tt.message {
+				t.Errorf("Eval error = %q, want %q", err.Error(), tt.message)
+			}
+		})
+	}
+
+	// hand written code is not checked, so a bool argument may be no bool
+	_, err := NewVMWith([]Code{NewPushCode(10), NewPushCode(1), NewPushCode(2), NewCallNativeCode("pick", 3)}, natives).Run()
+	if want := `vm: native function "pick" failed at pc 3: argument 1: 10 is not a bool`; err == nil || err.Error() != want {
+		t.Errorf("Run error = %v, want %q", err, want)
+	}
+	// nor is a string argument
+	_, err = NewVMWith([]Code{NewPushCode(5), NewCallNativeCode("lookupRate", 1)}, natives).Run()
+	if want := `vm: native function "lookupRate" failed at pc 1: argument 1: 5 is not a string`; err == nil || err.Error() != want {
+		t.Errorf("Run error = %v, want %q", err, want)
+	}
+
+	// the error of a native function called by a function has a trace
+	prog, err := CompileWith(ast.FuncExp{Name: "f", Params: []string{"a"}, Body: call("max"), In: ast.NegExp{Exp: call("f", x)}}, natives)
+	if err != nil {
+		t.Fatalf("CompileWith returned error: %v", err)
+	}
+	_, err = prog.Eval(ast.Env{"x": 1})
+	var traceErr TraceError
+	var nativeErr NativeError
+	if !errors.As(err, &traceErr) || !errors.As(err, &nativeErr) || len(traceErr.Frames) != 2 || traceErr.Frames[0].Func != "f" {
+		t.Errorf("Eval error = %#v, want a NativeError with a trace through f", err)
+	}
+}
+
+func TestCompileNativeErrors(t *testing.T) {
+	natives := testNatives(t)
+	tests := []struct {
+		exp     ast.Exp
+		target  any
+		message string
+	}{
+		{call("round", ast.IntExp{Val: 1}), &ast.ArityError{}, `vm: function "round" expects 2 arguments, got 1`},
+		{call("even", ast.IntExp{Val: 1}, ast.IntExp{Val: 2}), &ast.ArityError{}, `vm: function "even" expects 1 arguments, got 2`},
+		{call("first"), nil, `vm: native function "first" expects at least 1 arguments, got 0`},
+		{call("nosuch", ast.IntExp{Val: 1}), &ast.UndefinedFunctionError{}, `vm: undefined function "nosuch"`},
+		// the kinds of the parameters and the result are checked
+		{call("pick", ast.IntExp{Val: 1}, ast.IntExp{Val: 1}, ast.IntExp{Val: 2}), &ast.TypeError{}, `vm: 1 has the type int, want bool`},
+		{ast.PlusExp{Left: call("even", ast.IntExp{Val: 1}), Right: ast.IntExp{Val: 1}}, &ast.TypeError{}, `vm: even(1) has the type bool, want int`},
+		{call("max", ast.BoolExp{Val: true}), &ast.TypeError{}, `vm: true has the type bool, want int`},
+		{call("lookupRate", ast.IntExp{Val: 1}), &ast.TypeError{}, `vm: 1 has the type int, want string`},
+		{call("max", ast.StringExp{Val: "EUR"}), &ast.TypeError{}, `vm: "EUR" has the type string, want int`},
+	}
+
+	for _, tt := range tests {
+		_, err := CompileWith(tt.exp, natives)
+		if err == nil {
+			t.Errorf("CompileWith(%s) succeeded, want an error", tt.exp.Pretty())
+			continue
+		}
+		if tt.target != nil && !errors.As(err, tt.target) {
+			t.Errorf("CompileWith(%s) error = %v, want a %T", tt.exp.Pretty(), err, tt.target)
+		}
+		if err.Error() != tt.message {
+			t.Errorf("CompileWith(%s) error = %q, want %q", tt.exp.Pretty(), err.Error(), tt.message)
+		}
+	}
+
+	// code which calls a function with the wrong number of arguments
+	// can not be run
+	_, err := NewVMWith([]Code{NewPushCode(1), NewCallNativeCode("round", 1)}, natives).Run()
+	var arity ast.ArityError
+	if !errors.As(err, &arity) || err.Error() != `vm: function "round" expects 2 arguments, got 1 at pc 1` {
+		t.Errorf("Run error = %v, want an ast.ArityError at pc 1", err)
+	}
+	_, err = NewVMWith([]Code{NewCallNativeCode("nosuch", 0)}, natives).Run()
+	var undefined ast.UndefinedFunctionError
+	if !errors.As(err, &undefined) || err.Error() != `vm: undefined function "nosuch" at pc 0` {
+		t.Errorf("Run error = %v, want an ast.UndefinedFunctionError at pc 0", err)
+	}
+}
+
+func TestRegisterErrors(t *testing.T) {
+	natives := NewNatives()
+	tests := []struct {
+		name    string
+		err     error
+		message string
+	}{
+		{"invalid name", natives.RegisterFunc("1max", func(args ...Value) (Value, error) { return 0, nil }), `vm: invalid name "1max" of a native function`},
+		{"nil", natives.RegisterFunc("nothing", nil), `vm: native function "nothing" is nil`},
+		{"no function", natives.RegisterGoFunc("seven", 7), `vm: native function "seven" is int, not a function`},
+		{"nil function", natives.RegisterGoFunc("nothing", (func() int)(nil)), `vm: native function "nothing" is func() int, not a function`},
+		{"parameter", natives.RegisterGoFunc("length", func(v []int) int { return len(v) }), `vm: parameter 1 of the native function "length" has the unsupported type []int`},
+		{"variadic parameter", natives.RegisterGoFunc("sum", func(v ...float64) int { return 0 }), `vm: parameter 1 of the native function "sum" has the unsupported type float64`},
+		{"no result", natives.RegisterGoFunc("log", func(v int) {}), `vm: native function "log" must return a value or a value and an error`},
+		{"second result", natives.RegisterGoFunc("div", func(a, b int) (int, int) { return a / b, a % b }), `vm: native function "div" must return a value or a value and an error`},
+		{"result", natives.RegisterGoFunc("half", func(v int) float64 { return float64(v) / 2 }), `vm: the result of the native function "half" has the unsupported type float64`},
+		{"string result", natives.RegisterGoFunc("name", func(v int) string { return "" }), `vm: the result of the native function "name" has the unsupported type string`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.err == nil || tt.err.Error() != tt.message {
+				t.Errorf("error = %v, want %q", tt.err, tt.message)
+			}
+		})
+	}
+	// a rejected function is not registered
+	if _, err := CompileWith(call("length", ast.IntExp{Val: 1}), natives); err == nil {
+		t.Errorf("CompileWith succeeded, want an undefined function")
+	}
+}
+
+func TestNativesRegistry(t *testing.T) {
+	natives := NewNatives()
+	if err := natives.RegisterGoFunc("twice", func(v int) int { return 2 * v }); err != nil {
+		t.Fatalf("RegisterGoFunc returned error: %v", err)
+	}
+	exp := call("twice", ast.IntExp{Val: 3})
+	old, err := CompileWith(exp, natives)
+	if err != nil {
+		t.Fatalf("CompileWith returned error: %v", err)
+	}
+
+	// registering the name again replaces the function, also its type,
+	// programs created before keep the old function
+	if err := natives.RegisterGoFunc("twice", func(v int) bool { return v > 0 }); err != nil {
+		t.Fatalf("RegisterGoFunc returned error: %v", err)
+	}
+	if got, err := old.Run(); got != 6 || err != nil {
+		t.Errorf("old Run() = %d, %v, want 6, nil", got, err)
+	}
+	if _, err := CompileWith(ast.PlusExp{Left: exp, Right: ast.IntExp{Val: 1}}, natives); !errors.As(err, new(ast.TypeError)) {
+		t.Errorf("CompileWith error = %v, want an ast.TypeError", err)
+	}
+	if err := natives.RegisterFunc("twice", func(args ...Value) (Value, error) { return 3 * args[0], nil }); err != nil {
+		t.Fatalf("RegisterFunc returned error: %v", err)
+	}
+	if got, err := NewVMWith([]Code{NewPushCode(3), NewCallNativeCode("twice", 1)}, natives).Run(); got != 9 || err != nil {
+		t.Errorf("Run() = %d, %v, want 9, nil", got, err)
+	}
+
+	// an unregistered function can not be called by new programs
+	if !natives.Unregister("twice") {
+		t.Errorf("Unregister(twice) = false, want true")
+	}
+	if natives.Unregister("twice") {
+		t.Errorf("Unregister(twice) twice = true, want false")
+	}
+	var undefined ast.UndefinedFunctionError
+	if _, err := CompileWith(exp, natives); !errors.As(err, &undefined) {
+		t.Errorf("CompileWith error = %v, want an ast.UndefinedFunctionError", err)
+	}
+	if got, err := old.Run(); got != 6 || err != nil {
+		t.Errorf("old Run() = %d, %v, want 6, nil", got, err)
+	}
+
+	// the functions of a registry are only visible to its programs
+	if _, err := CompileWith(call("max", ast.IntExp{Val: 1}), NewNatives()); !errors.As(err, &undefined) {
+		t.Errorf("CompileWith error = %v, want an ast.UndefinedFunctionError", err)
+	}
+	if _, err := Compile(call("max", ast.IntExp{Val: 1})); !errors.As(err, &undefined) {
+		t.Errorf("Compile error = %v, want an ast.UndefinedFunctionError", err)
+	}
+	if _, ok := testNatives(t).lookup("twice"); ok {
+		t.Errorf("twice is registered in another registry")
+	}
+}
+
+func TestConcurrentNativeCalls(t *testing.T) {
+	natives := testNatives(t)
+	prog, err := CompileWith(ast.FuncExp{Name: "f", Params: []string{"a"},
+		Body: call("max", ast.VarExp{Name: "a"}, call("round", ast.VarExp{Name: "x"}, ast.IntExp{Val: 1})),
+		In:   call("f", ast.VarExp{Name: "x"})}, natives)
+	if err != nil {
+		t.Fatalf("CompileWith returned error: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for x := 0; x < 100; x++ {
+				want := Value((x + 5) / 10 * 10)
+				if want < Value(x) {
+					want = Value(x)
+				}
+				if got, err := prog.EvalSlots([]Value{Value(x)}); err != nil || got != want {
+					t.Errorf("EvalSlots(%d) = %d, %v, want %d", x, got, err, want)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
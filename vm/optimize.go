@@ -0,0 +1,254 @@
+package vm
+
+// Pass is a single optimization of the code, the passes of Optimize
+// can be chosen individually with OptimizeWith
+//
+// a pass must not change the result of the code and must not make
+// the code longer, it returns the code unchanged if it does not apply
+//
+// the code of a pass is a basic block: it contains no jumps, nothing
+// jumps into it, and it may pop values which were pushed before it
+// the block of a function starts with its FUNC instruction, a pass
+// must keep the FUNC, CALL, TAILCALL and MAKE_CLOSURE instructions,
+// a CALL_NATIVE may have side effects and must be kept as well
+type Pass struct {
+	Name string              // name of the pass, e.g. for command line flags
+	Run  func([]Code) []Code // returns the optimized copy of the code
+}
+
+var (
+	// ConstantFolding computes arithmetic and comparisons on constants
+	// at compile time, e.g. "push 1; push 2; add" becomes "push 3" and
+	// "push 1; add; push 2; add" becomes "push 3; add"
+	ConstantFolding = Pass{"constant-folding", foldConstants}
+	// AlgebraicIdentities removes operations which do not change a value,
+	// e.g. "push 0; add", "push 1; mul" or "neg; neg", and
+	// turns "neg; add" into "sub"
+	AlgebraicIdentities = Pass{"algebraic-identities", applyIdentities}
+	// StrengthReduction replaces operations by cheaper ones,
+	// e.g. "push -1; mul" and "push -1; div" become "neg"
+	StrengthReduction = Pass{"strength-reduction", reduceStrength}
+)
+
+// DefaultPasses are the passes used by Optimize
+var DefaultPasses = []Pass{ConstantFolding, AlgebraicIdentities, StrengthReduction}
+
+// Optimize returns optimized code with the same result as code,
+// it uses all DefaultPasses
+func Optimize(code []Code) []Code {
+	return OptimizeWith(code, DefaultPasses...)
+}
+
+// OptimizeWith returns code optimized by the passes, the passes are
+// applied in order until none of them can shorten the code any further
+// the code is not modified, invalid code is returned unchanged so that
+// running it returns the same error
+func OptimizeWith(code []Code, passes ...Pass) []Code {
+	code = append([]Code(nil), code...)
+	if Verify(code) != nil {
+		return code
+	}
+	for {
+		// every pass only ever shortens the code, so the code
+		// did not change if it has the same length
+		n := len(code)
+		code = optimizeBlocks(code, passes)
+		if len(code) == n {
+			return code
+		}
+	}
+}
+
+// applies the passes once to every basic block of the code
+// the blocks start at the first instruction, at every jump target,
+// after every jump, RET and TAILCALL and at every function, the jumps are kept
+// and their targets and the targets of the calls and closures are moved
+// to the new start of the block
+func optimizeBlocks(code []Code, passes []Pass) []Code {
+	leader := make([]bool, len(code)+1)
+	leader[0], leader[len(code)] = true, true
+	for pc, c := range code {
+		switch {
+		case isJump(c.Op):
+			leader[c.val], leader[pc+1] = true, true
+		case c.Op == RET || c.Op == TAILCALL:
+			leader[pc+1] = true
+		case c.Op == FUNC:
+			leader[pc] = true
+		}
+	}
+	out := make([]Code, 0, len(code))
+	start := make([]int, len(code)+1) // new index of every leader
+	var jumps []int                   // indices of the jumps in out
+	for pc := 0; pc < len(code); {
+		end := pc + 1
+		for !leader[end] {
+			end++
+		}
+		start[pc] = len(out)
+		block := code[pc:end]
+		last := block[len(block)-1]
+		if isJump(last.Op) {
+			block = block[:len(block)-1]
+		}
+		for _, pass := range passes {
+			block = pass.Run(block)
+		}
+		out = append(out, block...)
+		if isJump(last.Op) {
+			jumps = append(jumps, len(out))
+			out = append(out, last)
+		}
+		pc = end
+	}
+	start[len(code)] = len(out)
+	for _, i := range jumps {
+		out[i].val = start[out[i].val]
+	}
+	// the passes never remove a call or closure, a FUNC starts a block
+	for i, c := range out {
+		if c.Op == CALL || c.Op == TAILCALL || c.Op == MAKE_CLOSURE {
+			out[i].val = start[c.val]
+		}
+	}
+	return out
+}
+
+// runs a peephole optimization: every instruction is appended to the
+// optimized code and reduce is called with the optimized code, until
+// it returns false, so that the results of a reduction can be reduced again
+func peephole(code []Code, reduce func(out []Code) ([]Code, bool)) []Code {
+	out := make([]Code, 0, len(code))
+	for _, c := range code {
+		out = append(out, c)
+		for reduced := true; reduced; {
+			out, reduced = reduce(out)
+		}
+	}
+	return out
+}
+
+// returns true if the last instructions of code are PUSH instructions
+// followed by the opcodes ops, e.g. endsWith(code, 1, PLUS) matches "push x; add"
+func endsWith(code []Code, pushes int, ops ...OpCode) bool {
+	n := pushes + len(ops)
+	if len(code) < n {
+		return false
+	}
+	tail := code[len(code)-n:]
+	for i := 0; i < pushes; i++ {
+		if tail[i].Op != PUSH {
+			return false
+		}
+	}
+	for i, op := range ops {
+		if tail[pushes+i].Op != op {
+			return false
+		}
+	}
+	return true
+}
+
+func foldConstants(code []Code) []Code {
+	return peephole(code, func(out []Code) ([]Code, bool) {
+		n := len(out)
+		switch {
+		case endsWith(out, 1, NEG):
+			// push a; neg
+			out[n-2].val = -out[n-2].val
+			return out[:n-1], true
+		case endsWith(out, 1, NOT):
+			// push a; not
+			out[n-2].val = int(boolValue(out[n-2].val == 0))
+			return out[:n-1], true
+		case n >= 3 && out[n-3].Op == PUSH && out[n-2].Op == PUSH:
+			// push a; push b; op
+			val, ok := fold(out[n-1].Op, out[n-3].val, out[n-2].val)
+			if !ok {
+				return out, false
+			}
+			out[n-3].val = val
+			return out[:n-2], true
+		case n >= 4 && out[n-4].Op == PUSH && out[n-2].Op == PUSH &&
+			out[n-3].Op == out[n-1].Op && (out[n-1].Op == PLUS || out[n-1].Op == MULTIPLY):
+			// push a; add; push b; add is x+a+b, which is x+(a+b),
+			// the same holds for mul, also if the operations overflow
+			out[n-4].val, _ = fold(out[n-1].Op, out[n-4].val, out[n-2].val)
+			return out[:n-2], true
+		}
+		return out, false
+	})
+}
+
+// computes the binary operation op on constants,
+// returns false if op is not a binary operation or would fail at runtime
+func fold(op OpCode, left, right int) (int, bool) {
+	switch op {
+	case PLUS:
+		return left + right, true
+	case MULTIPLY:
+		return left * right, true
+	case SUB:
+		return left - right, true
+	case DIV:
+		// a division by zero is kept, so that it fails at runtime
+		if right == 0 {
+			return 0, false
+		}
+		return left / right, true
+	case MOD:
+		if right == 0 {
+			return 0, false
+		}
+		return left % right, true
+	case EQ:
+		return int(boolValue(left == right)), true
+	case NE:
+		return int(boolValue(left != right)), true
+	case LT:
+		return int(boolValue(left < right)), true
+	case LE:
+		return int(boolValue(left <= right)), true
+	case GT:
+		return int(boolValue(left > right)), true
+	case GE:
+		return int(boolValue(left >= right)), true
+	}
+	return 0, false
+}
+
+func applyIdentities(code []Code) []Code {
+	return peephole(code, func(out []Code) ([]Code, bool) {
+		n := len(out)
+		switch {
+		case endsWith(out, 1, PLUS) && out[n-2].val == 0,
+			endsWith(out, 1, SUB) && out[n-2].val == 0,
+			endsWith(out, 1, MULTIPLY) && out[n-2].val == 1,
+			endsWith(out, 1, DIV) && out[n-2].val == 1,
+			endsWith(out, 0, NEG, NEG):
+			// x+0, x-0, x*1, x/1 and -(-x) are x
+			return out[:n-2], true
+		case endsWith(out, 0, NEG, PLUS):
+			// x+(-y) is x-y
+			out[n-2] = NewSubCode()
+			return out[:n-1], true
+		case endsWith(out, 0, NEG, SUB):
+			// x-(-y) is x+y
+			out[n-2] = NewPlusCode()
+			return out[:n-1], true
+		}
+		return out, false
+	})
+}
+
+func reduceStrength(code []Code) []Code {
+	return peephole(code, func(out []Code) ([]Code, bool) {
+		n := len(out)
+		if (endsWith(out, 1, MULTIPLY) || endsWith(out, 1, DIV)) && out[n-2].val == -1 {
+			// x*-1 and x/-1 are -x, also for the smallest int
+			out[n-2] = NewNegCode()
+			return out[:n-1], true
+		}
+		return out, false
+	})
+}
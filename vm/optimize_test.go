@@ -0,0 +1,236 @@
+package vm
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lennart01/learning_go/ast"
+)
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		name   string
+		passes []Pass
+		src    string
+		want   string
+	}{
+		{"fold", []Pass{ConstantFolding}, "push 1\npush 2\nadd\npush 3\nmul", "push 9"},
+		{"fold neg", []Pass{ConstantFolding}, "push 4\nneg", "push -4"},
+		{"fold comparison", []Pass{ConstantFolding}, "push 1\npush 2\nlt\npush 3\npush 3\nne\nsub", "push 1"},
+		{"fold not", []Pass{ConstantFolding}, "push 7\nnot\nnot", "push 1"},
+		{"fold keeps division by zero", []Pass{ConstantFolding}, "push 1\npush 0\ndiv", "push 1\npush 0\ndiv"},
+		{"fold nested", []Pass{ConstantFolding}, "push 1\npush 2\npush 3\nmul\nadd\npush 4\nadd", "push 11"},
+		{"reassociate", []Pass{ConstantFolding}, "push 5\npush 0\ndiv\npush 2\nadd\npush 3\nadd", "push 5\npush 0\ndiv\npush 5\nadd"},
+		{"reassociate mul", []Pass{ConstantFolding}, "push 5\npush 0\ndiv\npush 2\nmul\npush 3\nmul", "push 5\npush 0\ndiv\npush 6\nmul"},
+		{"add zero", []Pass{AlgebraicIdentities}, "push 5\npush 0\nadd", "push 5"},
+		{"sub zero", []Pass{AlgebraicIdentities}, "push 5\npush 0\nsub", "push 5"},
+		{"mul one", []Pass{AlgebraicIdentities}, "push 5\npush 1\nmul", "push 5"},
+		{"div one", []Pass{AlgebraicIdentities}, "push 5\npush 1\ndiv", "push 5"},
+		{"double neg", []Pass{AlgebraicIdentities}, "push 5\nneg\nneg", "push 5"},
+		{"add neg", []Pass{AlgebraicIdentities}, "push 5\npush 2\nneg\nadd", "push 5\npush 2\nsub"},
+		{"sub neg", []Pass{AlgebraicIdentities}, "push 5\npush 2\nneg\nsub", "push 5\npush 2\nadd"},
+		{"identities cascade", []Pass{AlgebraicIdentities}, "push 5\npush 0\nadd\npush 1\nmul\nneg\nneg", "push 5"},
+		{"mul minus one", []Pass{StrengthReduction}, "push 5\npush -1\nmul", "push 5\nneg"},
+		{"div minus one", []Pass{StrengthReduction}, "push 5\npush -1\ndiv", "push 5\nneg"},
+		{"no passes", nil, "push 5\npush 0\nadd", "push 5\npush 0\nadd"},
+		{"all", DefaultPasses, "push 1\npush 0\ndiv\npush 0\nadd\npush 2\npush 3\nmul\nmul", "push 1\npush 0\ndiv\npush 6\nmul"},
+		{"invalid code is kept", DefaultPasses, "push 0\nadd", "push 0\nadd"},
+		// the blocks are optimized separately and the targets move with them
+		{"blocks", DefaultPasses,
+			"load x\njump_if_false else\npush 1\npush 2\nadd\njump end\nelse: push 3\nneg\nend: push 0\nadd",
+			"load x\njump_if_false else\npush 3\njump end\nelse: push -3\nend:"},
+		// push 1 and add are in different blocks
+		{"no folding across jumps", DefaultPasses,
+			"push 5\npush 1\npush 0\njump_if_false skip\nskip: add",
+			"push 5\npush 1\npush 0\njump_if_false skip\nskip: add"},
+		// the body of a function is a block of its own, the calls move with it
+		{"functions", DefaultPasses,
+			"push 1\npush 2\nadd\ncall f\nret\nf: func f 1\nload_local 0\npush 0\nadd\nret",
+			"push 3\ncall f\nret\nf: func f 1\nload_local 0\nret"},
+		// a tail call ends its block like a return
+		{"tail calls", DefaultPasses,
+			"push 1\npush 2\nadd\ncall f\nret\nf: func f 1\nload_local 0\npush 0\nadd\ntailcall f\npush 1\nneg",
+			"push 3\ncall f\nret\nf: func f 1\nload_local 0\ntailcall f\npush -1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := Assemble(strings.NewReader(tt.src))
+			if err != nil {
+				t.Fatalf("Assemble returned error: %v", err)
+			}
+			want, err := Assemble(strings.NewReader(tt.want))
+			if err != nil {
+				t.Fatalf("Assemble returned error: %v", err)
+			}
+			orig := append([]Code(nil), code...)
+			got := OptimizeWith(code, tt.passes...)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("OptimizeWith =\n%s\nwant\n%s", Disassemble(got), Disassemble(want))
+			}
+			if !reflect.DeepEqual(code, orig) {
+				t.Errorf("OptimizeWith modified its input")
+			}
+		})
+	}
+}
+
+func TestOptimizeCompiled(t *testing.T) {
+	// (x+0)*1 with x = 2*3 is folded into a single push
+	exp := ast.MultExp{
+		Left:  ast.PlusExp{Left: ast.MultExp{Left: ast.IntExp{Val: 2}, Right: ast.IntExp{Val: 3}}, Right: ast.IntExp{Val: 0}},
+		Right: ast.IntExp{Val: 1},
+	}
+	prog, err := Compile(exp)
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	if got, want := Optimize(prog.Code()), []Code{NewPushCode(6)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Optimize = %v, want %v", got, want)
+	}
+}
+
+func TestOptimizeFunctions(t *testing.T) {
+	prog, err := Compile(fibExp(ast.IntExp{Val: 10}))
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	optimized := Optimize(prog.Code())
+	if err := Verify(optimized); err != nil {
+		t.Fatalf("Verify(Optimize(fib)) = %v", err)
+	}
+	if got, err := NewVM(optimized).Run(); err != nil || got != 55 {
+		t.Errorf("Optimize(fib) runs to %d, %v, want 55", got, err)
+	}
+}
+
+func TestOptimizeClosures(t *testing.T) {
+	// (\a -> a * (2 + 3))(x + 0)
+	a := ast.VarExp{Name: "a"}
+	prog, err := Compile(ast.AppExp{
+		Fn:   ast.LambdaExp{Params: []string{"a"}, Body: ast.MultExp{Left: a, Right: ast.PlusExp{Left: ast.IntExp{Val: 2}, Right: ast.IntExp{Val: 3}}}},
+		Args: []ast.Exp{ast.PlusExp{Left: ast.VarExp{Name: "x"}, Right: ast.IntExp{Val: 0}}},
+	})
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	// the code before the lambda gets shorter, so the closure is moved
+	want := []Code{
+		NewMakeClosureCode(4), NewLoadSlotCode(0), NewCallClosureCode(1), NewRetCode(),
+		NewLambdaCode("lambda", 1, 0), NewLoadLocalCode(0), NewPushCode(5), NewMultiplyCode(), NewRetCode(),
+	}
+	optimized := Optimize(prog.Code())
+	if !reflect.DeepEqual(optimized, want) {
+		t.Errorf("Optimize = %v, want %v", optimized, want)
+	}
+	if got, err := newProgram(optimized, prog.vars, nil).Eval(ast.Env{"x": 4}); err != nil || got != 20 {
+		t.Errorf("Optimize runs to %d, %v, want 20", got, err)
+	}
+}
+
+// constants of the random programs, small values make the
+// identities and divisions by zero likely
+var randomConstants = []int{0, 1, -1, 2, 3, -7, math.MaxInt, math.MinInt}
+
+// returns a random expression with at most depth levels, a bool if
+// boolean is true, otherwise an int
+func randomExp(r *rand.Rand, depth int, boolean bool) ast.Exp {
+	if depth == 0 || r.Intn(4) == 0 {
+		switch {
+		case boolean:
+			return ast.BoolExp{Val: r.Intn(2) == 0}
+		case r.Intn(4) == 0:
+			return ast.VarExp{Name: "a"}
+		}
+		return ast.IntExp{Val: randomConstants[r.Intn(len(randomConstants))]}
+	}
+	if boolean {
+		op := r.Intn(6)
+		// the operands of the comparisons are ints
+		left, right := randomExp(r, depth-1, op > 1), randomExp(r, depth-1, op > 1)
+		switch op {
+		case 0:
+			return ast.LtExp{Left: left, Right: right}
+		case 1:
+			return ast.EqExp{Left: left, Right: right}
+		case 2:
+			return ast.AndExp{Left: left, Right: right}
+		case 3:
+			return ast.OrExp{Left: left, Right: right}
+		case 4:
+			return ast.NotExp{Exp: left}
+		default:
+			return ast.EqExp{Left: left, Right: right}
+		}
+	}
+	left, right := randomExp(r, depth-1, false), randomExp(r, depth-1, false)
+	switch r.Intn(8) {
+	case 0:
+		return ast.PlusExp{Left: left, Right: right}
+	case 1:
+		return ast.MultExp{Left: left, Right: right}
+	case 2:
+		return ast.SubExp{Left: left, Right: right}
+	case 3:
+		return ast.DivExp{Left: left, Right: right}
+	case 4:
+		return ast.ModExp{Left: left, Right: right}
+	case 5:
+		return ast.LetExp{Name: "a", Value: left, Body: right}
+	case 6:
+		return ast.IfExp{Cond: randomExp(r, depth-1, true), Then: left, Else: right}
+	default:
+		return ast.NegExp{Exp: left}
+	}
+}
+
+// returns a random expression in which the variable is always bound
+func randomClosedExp(r *rand.Rand, depth int) ast.Exp {
+	return ast.LetExp{Name: "a", Value: ast.IntExp{Val: randomConstants[r.Intn(len(randomConstants))]}, Body: randomExp(r, depth, r.Intn(2) == 0)}
+}
+
+func TestOptimizeRandom(t *testing.T) {
+	passes := map[string][]Pass{
+		"default":              DefaultPasses,
+		"constant-folding":     {ConstantFolding},
+		"algebraic-identities": {AlgebraicIdentities},
+		"strength-reduction":   {StrengthReduction},
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		exp := randomClosedExp(r, 6)
+		prog, err := Compile(exp)
+		if err != nil {
+			t.Fatalf("Compile returned error: %v", err)
+		}
+		code := prog.Code()
+		want, wantErr := prog.Run()
+		if val, err := ast.Evaluate(exp); Value(val) != want || (err == nil) != (wantErr == nil) {
+			t.Fatalf("Compile(%s) runs to %d, %v, want %d, %v", exp.Pretty(), want, wantErr, val, err)
+		}
+		for name, p := range passes {
+			optimized := OptimizeWith(code, p...)
+			if len(optimized) > len(code) {
+				t.Errorf("%s made the code longer:\n%s", name, Disassemble(code))
+			}
+			got, err := NewVM(optimized).Run()
+			// the pc of a division by zero may change
+			var divErr ErrDivisionByZero
+			if errors.As(wantErr, &divErr) != errors.As(err, &divErr) || got != want {
+				t.Fatalf("%s changed the result from %d, %v to %d, %v\ncode:\n%s\noptimized:\n%s",
+					name, want, wantErr, got, err, Disassemble(code), Disassemble(optimized))
+			}
+		}
+	}
+}
+
+func BenchmarkOptimizedRun(b *testing.B) {
+	prog := NewVM(Optimize(LoadAst(benchExp).Code()))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		prog.Run()
+	}
+}
@@ -0,0 +1,53 @@
+package vm
+
+// Optional type is used to represent a value that may or may not exist
+// it is the Go version of the Optional<T> template of the c++ source
+type Optional[T any] struct {
+	val    T    // the value, only valid if exists is true
+	exists bool // true if the value exists
+}
+
+// helper functions for Optional
+// returns true if the value exists
+func (o Optional[T]) IsJust() bool {
+	return o.exists
+}
+
+// returns the value if it exists
+// if it does not exist panic
+func (o Optional[T]) Value() T {
+	if !o.exists {
+		panic("Value does not exist")
+	}
+	return o.val
+}
+
+// returns the value and true if it exists,
+// otherwise the zero value and false
+func (o Optional[T]) Get() (T, bool) {
+	return o.val, o.exists
+}
+
+// creates a new Optional with the value
+func Just[T any](val T) Optional[T] {
+	return Optional[T]{val, true}
+}
+
+// creates a new Optional with no value
+func Nothing[T any]() Optional[T] {
+	return Optional[T]{}
+}
+
+// creates an Optional from the result of a function returning a value and
+// an error, e.g. ToOptional(prog.Run()), the error is discarded
+func ToOptional[T any](val T, err error) Optional[T] {
+	if err != nil {
+		return Nothing[T]()
+	}
+	return Just(val)
+}
+
+// returns true if the value does not exist
+func (o Optional[T]) IsNothing() bool {
+	return !o.exists
+}
@@ -0,0 +1,14 @@
+; the absolute value of -7, the label end is the end of the program
+; want: 7
+push -7
+store_local 0
+load_local 0
+push 0
+lt
+jump_if_false positive
+load_local 0
+neg
+jump end
+positive:
+load_local 0
+end:
@@ -0,0 +1,19 @@
+; a closure which captured the argument of the function that made it
+; want: 13
+push 3
+call adder
+push 10
+call_closure 1
+ret
+
+; fn adder(n) = \a -> a + n
+adder: func adder 1
+load_local 0
+make_closure add
+ret
+
+add: func lambda 1 1
+load_local 0
+load_upval 0
+add
+ret
@@ -0,0 +1,12 @@
+; (1 + 2) * 3 - 4 / 2
+; want: 7
+start:
+push 1
+push 2
+add          ; 3
+push 3
+mul          ; 9
+push 4
+push 2
+div
+sub
@@ -0,0 +1,24 @@
+; a countdown which sums the numbers from 100000 down to 1, the
+; recursive call is a tail call, so it runs in a single frame
+; want: 5000050000
+push 100000
+push 0
+call count
+ret
+
+; fn count(n, acc) = if n == 0 then acc else count(n - 1, acc + n)
+count: func count 2
+load_local 0
+push 0
+eq
+jump_if_false recurse
+load_local 1
+ret
+recurse:
+load_local 0
+push 1
+sub
+load_local 1
+load_local 0
+add
+tailcall count
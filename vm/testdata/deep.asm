@@ -0,0 +1,11 @@
+; 1 + (2 + (3 + (4 + 5)))
+; want: 15
+push 1
+push 2
+push 3
+push 4
+push 5
+add
+add
+add
+add
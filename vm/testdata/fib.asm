@@ -0,0 +1,25 @@
+; fib(10) with a recursive function, the main code ends with ret
+; want: 55
+push 10
+call fib
+ret
+
+; fn fib(n) = if n < 2 then n else fib(n-1) + fib(n-2)
+fib: func fib 1
+load_local 0
+push 2
+lt
+jump_if_false recurse
+load_local 0
+ret
+recurse:
+load_local 0
+push 1
+sub
+call fib
+load_local 0
+push 2
+sub
+call fib
+add
+ret
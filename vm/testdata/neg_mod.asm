@@ -0,0 +1,8 @@
+; -(0x11 % 0b101) * 10
+; want: -20
+push 0x11
+push 0b101
+mod
+neg
+push 10
+mul
@@ -0,0 +1,170 @@
+package vm
+
+import (
+	"fmt"
+)
+
+// ErrStackDepth is returned when a program ends with more than one value
+// on the stack, a program must leave exactly its result on the stack
+type ErrStackDepth struct {
+	Depth int // number of values on the stack at the end of the program
+}
+
+func (e ErrStackDepth) Error() string {
+	return fmt.Sprintf("vm: program ends with %d values on the stack instead of 1", e.Depth)
+}
+
+// Verify checks that the code can be run without a stack underflow,
+// contains only known opcodes and leaves exactly one value on the stack
+// the main code starts at the first instruction and every function
+// after its FUNC instruction, a function must return exactly one value
+// a lambda, a function with captured values, can only be called through
+// a closure and only a lambda can load captured values
+// only a function can make a tail call, with exactly the arguments on
+// its stack
+// the errors are the same the vm would return at runtime,
+// e.g. ErrStackUnderflow{pc, op}, ErrUnknownOpCode{pc, op} or ErrEmptyProgram
+func Verify(code []Code) error {
+	_, err := verify(code)
+	return err
+}
+
+// layout of verified code
+type layout struct {
+	maxStack int // maximum number of values on the stack of a frame, without its locals
+	// index of the FUNC instruction of the function every instruction
+	// belongs to, -1 for the main code and unreachable instructions
+	owner []int
+}
+
+// verifies the code and returns its layout
+//
+// the stack depth before every instruction is simulated, every instruction
+// is visited once with the depth of its predecessor, an instruction which
+// can be reached with different depths would make the code invalid
+// the frame of a function starts with an empty stack, its parameters
+// are locals
+func verify(code []Code) (layout, error) {
+	if len(code) == 0 {
+		return layout{}, ErrEmptyProgram
+	}
+	// depth before each instruction, -1 if it has not been reached yet
+	depths := make([]int, len(code))
+	owner := make([]int, len(code))
+	for pc := range depths {
+		depths[pc], owner[pc] = -1, -1
+	}
+	depths[0] = 0
+	work := []int{0}
+	for pc, c := range code {
+		if c.Op != FUNC {
+			continue
+		}
+		if c.val < 0 {
+			return layout{}, fmt.Errorf("vm: negative number of parameters %d at pc %d", c.val, pc)
+		}
+		if c.upvals < 0 {
+			return layout{}, fmt.Errorf("vm: negative number of captured values %d at pc %d", c.upvals, pc)
+		}
+		if pc+1 == len(code) {
+			return layout{}, fmt.Errorf("vm: function %q does not return", c.name)
+		}
+		depths[pc+1], owner[pc+1] = 0, pc
+		work = append(work, pc+1)
+	}
+	deepest := 0
+	for len(work) > 0 {
+		pc := work[len(work)-1]
+		work = work[:len(work)-1]
+		c := code[pc]
+		if _, ok := mnemonics[c.Op]; !ok {
+			return layout{}, ErrUnknownOpCode{pc, c.Op}
+		}
+		if c.Op == FUNC {
+			return layout{}, fmt.Errorf("vm: pc %d runs into the function %q", pc, c.name)
+		}
+		if c.Op == LOAD_SLOT && c.val < 0 {
+			return layout{}, fmt.Errorf("vm: negative slot %d at pc %d", c.val, pc)
+		}
+		if (c.Op == STORE_LOCAL || c.Op == LOAD_LOCAL) && c.val < 0 {
+			return layout{}, fmt.Errorf("vm: negative local %d at pc %d", c.val, pc)
+		}
+		if (c.Op == JUMP || c.Op == JUMP_IF_FALSE) && (c.val < 0 || c.val > len(code)) {
+			return layout{}, fmt.Errorf("vm: jump target %d out of range at pc %d", c.val, pc)
+		}
+		if (c.Op == CALL || c.Op == TAILCALL || c.Op == MAKE_CLOSURE) && (c.val < 0 || c.val >= len(code) || code[c.val].Op != FUNC) {
+			return layout{}, fmt.Errorf("vm: call target %d at pc %d is not a function", c.val, pc)
+		}
+		// a lambda needs the values of its closure
+		if (c.Op == CALL || c.Op == TAILCALL) && code[c.val].upvals > 0 {
+			return layout{}, fmt.Errorf("vm: pc %d calls the lambda %q without a closure", pc, code[c.val].name)
+		}
+		// the main code has no frame which a tail call could reuse
+		if c.Op == TAILCALL && owner[pc] < 0 {
+			return layout{}, fmt.Errorf("vm: tail call at pc %d outside of a function", pc)
+		}
+		if c.Op == LOAD_UPVAL && (owner[pc] < 0 || c.val < 0 || c.val >= code[owner[pc]].upvals) {
+			return layout{}, fmt.Errorf("vm: captured value %d out of range at pc %d", c.val, pc)
+		}
+		if (c.Op == CALL_CLOSURE || c.Op == CALL_NATIVE) && c.val < 0 {
+			return layout{}, fmt.Errorf("vm: negative number of arguments %d at pc %d", c.val, pc)
+		}
+		pop, push := c.stackEffect(code)
+		if depths[pc] < pop {
+			return layout{}, ErrStackUnderflow{pc, c.Op}
+		}
+		if c.Op == RET && depths[pc] != 1 {
+			if owner[pc] >= 0 {
+				return layout{}, fmt.Errorf("vm: function %q returns with %d values on the stack at pc %d", code[owner[pc]].name, depths[pc], pc)
+			}
+			return layout{}, ErrStackDepth{depths[pc]}
+		}
+		if c.Op == TAILCALL && depths[pc] != pop {
+			return layout{}, fmt.Errorf("vm: function %q makes a tail call with %d values on the stack instead of %d at pc %d", code[owner[pc]].name, depths[pc], pop, pc)
+		}
+		depth := depths[pc] - pop + push
+		if depth > deepest {
+			deepest = depth
+		}
+		for _, next := range successors(code, pc) {
+			if next == len(code) {
+				// the program ends after this instruction
+				if owner[pc] >= 0 {
+					return layout{}, fmt.Errorf("vm: function %q does not return", code[owner[pc]].name)
+				}
+				if depth == 0 {
+					return layout{}, ErrEmptyStack
+				}
+				if depth != 1 {
+					return layout{}, ErrStackDepth{depth}
+				}
+				continue
+			}
+			if depths[next] == -1 {
+				depths[next], owner[next] = depth, owner[pc]
+				work = append(work, next)
+			} else if owner[next] != owner[pc] {
+				return layout{}, fmt.Errorf("vm: pc %d belongs to more than one function", next)
+			} else if depths[next] != depth {
+				return layout{}, fmt.Errorf("vm: pc %d is reached with %d and %d values on the stack", next, depths[next], depth)
+			}
+		}
+	}
+	return layout{maxStack: deepest, owner: owner}, nil
+}
+
+// returns the instructions which can be executed after the instruction at pc,
+// len(code) stands for the end of the program
+// a CALL continues after it once the function returned, RET and TAILCALL,
+// which returns from the function it is in, have no successor
+func successors(code []Code, pc int) []int {
+	switch c := code[pc]; c.Op {
+	case JUMP:
+		return []int{c.val}
+	case JUMP_IF_FALSE:
+		return []int{pc + 1, c.val}
+	case RET, TAILCALL:
+		return nil
+	}
+	return []int{pc + 1}
+}
@@ -0,0 +1,131 @@
+package vm
+
+import (
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name string
+		code []Code
+		want error
+	}{
+		{"valid", []Code{NewPushCode(1), NewPushCode(2), NewPlusCode(), NewNegCode()}, nil},
+		{"empty", []Code{}, ErrEmptyProgram},
+		{"underflow", []Code{NewPushCode(1), NewPushCode(2), NewPlusCode(), NewMultiplyCode()}, ErrStackUnderflow{3, MULTIPLY}},
+		{"neg underflow", []Code{NewNegCode(), NewPushCode(1)}, ErrStackUnderflow{0, NEG}},
+		{"unknown opcode", []Code{NewPushCode(1), {Op: -1}}, ErrUnknownOpCode{1, -1}},
+		{"two values", []Code{NewPushCode(1), NewPushCode(2)}, ErrStackDepth{2}},
+		{"loads", []Code{NewLoadCode("x"), NewLoadSlotCode(0), NewPlusCode()}, nil},
+		{"three values", []Code{NewPushCode(1), NewPushCode(2), NewPushCode(3), NewSubCode(), NewPushCode(4)}, ErrStackDepth{3}},
+		{"branches", []Code{NewLoadCode("x"), NewJumpIfFalseCode(4), NewPushCode(1), NewJumpCode(5), NewPushCode(2)}, nil},
+		{"jump to the end", []Code{NewPushCode(1), NewJumpCode(2), NewNegCode()}, nil},
+		// the condition is popped, so the else branch underflows
+		{"condition underflow", []Code{NewPushCode(1), NewJumpIfFalseCode(3), NewPushCode(2), NewNegCode()}, ErrStackUnderflow{3, NEG}},
+		{"branch leaves two values", []Code{NewPushCode(0), NewPushCode(0), NewJumpIfFalseCode(4), NewPushCode(1)}, ErrStackDepth{2}},
+		// push 1; call f; ret; f: func f 1; load_local 0; ret
+		{"function", []Code{NewPushCode(1), NewCallCode(3), NewRetCode(), NewFuncCode("f", 1), NewLoadLocalCode(0), NewRetCode()}, nil},
+		// the frame of a function starts empty, the argument is a local
+		{"function underflow", []Code{NewPushCode(1), NewCallCode(3), NewRetCode(), NewFuncCode("f", 1), NewNegCode(), NewRetCode()}, ErrStackUnderflow{4, NEG}},
+		{"main returns two values", []Code{NewPushCode(1), NewPushCode(2), NewRetCode()}, ErrStackDepth{2}},
+		{"call underflow", []Code{NewCallCode(2), NewRetCode(), NewFuncCode("f", 1), NewPushCode(1), NewRetCode()}, ErrStackUnderflow{0, CALL}},
+		// push 1; make_closure f; push 2; call_closure 1; ret; f: func lambda 1 1; load_upval 0; ret
+		{"closure", []Code{NewPushCode(1), NewMakeClosureCode(5), NewPushCode(2), NewCallClosureCode(1), NewRetCode(),
+			NewLambdaCode("lambda", 1, 1), NewLoadUpvalCode(0), NewRetCode()}, nil},
+		{"closure underflow", []Code{NewMakeClosureCode(3), NewCallClosureCode(0), NewRetCode(),
+			NewLambdaCode("lambda", 0, 1), NewLoadUpvalCode(0), NewRetCode()}, ErrStackUnderflow{0, MAKE_CLOSURE}},
+		{"call_closure underflow", []Code{NewPushCode(1), NewCallClosureCode(1), NewRetCode()}, ErrStackUnderflow{1, CALL_CLOSURE}},
+		// push 1; call f; ret; f: func f 1; load_local 0; tailcall g; g: func g 1; load_local 0; ret
+		{"tail call", []Code{NewPushCode(1), NewCallCode(3), NewRetCode(), NewFuncCode("f", 1), NewLoadLocalCode(0), NewTailCallCode(6),
+			NewFuncCode("g", 1), NewLoadLocalCode(0), NewRetCode()}, nil},
+		{"call_native", []Code{NewPushCode(1), NewPushCode(2), NewCallNativeCode("max", 2)}, nil},
+		{"call_native underflow", []Code{NewPushCode(1), NewCallNativeCode("max", 2)}, ErrStackUnderflow{1, CALL_NATIVE}},
+		{"tail call underflow", []Code{NewPushCode(1), NewCallCode(3), NewRetCode(), NewFuncCode("f", 1), NewTailCallCode(3)}, ErrStackUnderflow{4, TAILCALL}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Verify(tt.code); err != tt.want {
+				t.Errorf("Verify() = %v, want %v", err, tt.want)
+			}
+			// the vm returns the same error without running the code
+			if _, err := NewVM(tt.code).Run(); tt.want != nil && err != tt.want {
+				t.Errorf("Run() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyMaxStack(t *testing.T) {
+	// every compiled program is valid
+	prog, err := Compile(deepSum(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(prog.Code()); err != nil {
+		t.Errorf("Verify(Compile(deepSum(100))) = %v, want nil", err)
+	}
+	if prog.maxStack != 100 {
+		t.Errorf("maxStack = %d, want 100", prog.maxStack)
+	}
+}
+
+func TestVerifyErrorMessage(t *testing.T) {
+	err := Verify([]Code{NewPushCode(1), NewPushCode(2)})
+	if want := "vm: program ends with 2 values on the stack instead of 1"; err == nil || err.Error() != want {
+		t.Errorf("Verify() = %v, want %q", err, want)
+	}
+	err = Verify([]Code{NewLoadSlotCode(-1)})
+	if want := "vm: negative slot -1 at pc 0"; err == nil || err.Error() != want {
+		t.Errorf("Verify() = %v, want %q", err, want)
+	}
+	err = Verify([]Code{NewPushCode(1), NewStoreLocalCode(-2), NewPushCode(2)})
+	if want := "vm: negative local -2 at pc 1"; err == nil || err.Error() != want {
+		t.Errorf("Verify() = %v, want %q", err, want)
+	}
+	err = Verify([]Code{NewPushCode(1), NewJumpCode(-1)})
+	if want := "vm: jump target -1 out of range at pc 1"; err == nil || err.Error() != want {
+		t.Errorf("Verify() = %v, want %q", err, want)
+	}
+	// the then branch pushes one value more than the else branch
+	err = Verify([]Code{NewLoadCode("x"), NewJumpIfFalseCode(5), NewPushCode(1), NewPushCode(2), NewJumpCode(6), NewPushCode(3), NewNegCode()})
+	if want := "vm: pc 6 is reached with 1 and 2 values on the stack"; err == nil || err.Error() != want {
+		t.Errorf("Verify() = %v, want %q", err, want)
+	}
+
+	// functions
+	tests := []struct {
+		code []Code
+		want string
+	}{
+		{[]Code{NewPushCode(1), NewCallCode(0)}, "vm: call target 0 at pc 1 is not a function"},
+		{[]Code{NewPushCode(1), NewCallCode(7)}, "vm: call target 7 at pc 1 is not a function"},
+		{[]Code{NewPushCode(1), NewFuncCode("f", 0), NewPushCode(2), NewRetCode()}, `vm: pc 1 runs into the function "f"`},
+		{[]Code{NewPushCode(1), NewRetCode(), NewFuncCode("f", 0), NewPushCode(2)}, `vm: function "f" does not return`},
+		{[]Code{NewPushCode(1), NewRetCode(), NewFuncCode("f", 0)}, `vm: function "f" does not return`},
+		{[]Code{NewPushCode(1), NewRetCode(), NewFuncCode("f", 0), NewPushCode(2), NewPushCode(3), NewRetCode()}, `vm: function "f" returns with 2 values on the stack at pc 5`},
+		{[]Code{NewPushCode(1), NewRetCode(), NewFuncCode("f", -1), NewPushCode(2), NewRetCode()}, "vm: negative number of parameters -1 at pc 2"},
+		{[]Code{NewPushCode(1), NewRetCode(), NewLambdaCode("lambda", 0, -1), NewPushCode(2), NewRetCode()}, "vm: negative number of captured values -1 at pc 2"},
+		{[]Code{NewMakeClosureCode(1), NewPushCode(1)}, "vm: call target 1 at pc 0 is not a function"},
+		{[]Code{NewPushCode(1), NewCallCode(3), NewRetCode(), NewLambdaCode("lambda", 1, 1), NewLoadUpvalCode(0), NewRetCode()},
+			`vm: pc 1 calls the lambda "lambda" without a closure`},
+		{[]Code{NewLoadUpvalCode(0)}, "vm: captured value 0 out of range at pc 0"},
+		{[]Code{NewPushCode(1), NewMakeClosureCode(4), NewCallClosureCode(0), NewRetCode(), NewLambdaCode("lambda", 0, 1), NewLoadUpvalCode(1), NewRetCode()},
+			"vm: captured value 1 out of range at pc 5"},
+		{[]Code{NewPushCode(1), NewCallClosureCode(-1)}, "vm: negative number of arguments -1 at pc 1"},
+		{[]Code{NewPushCode(1), NewCallNativeCode("max", -1)}, "vm: negative number of arguments -1 at pc 1"},
+		{[]Code{NewPushCode(1), NewTailCallCode(0)}, "vm: call target 0 at pc 1 is not a function"},
+		{[]Code{NewPushCode(1), NewTailCallCode(2), NewFuncCode("f", 1), NewLoadLocalCode(0), NewRetCode()}, "vm: tail call at pc 1 outside of a function"},
+		{[]Code{NewPushCode(1), NewCallCode(3), NewRetCode(), NewFuncCode("f", 1), NewLoadLocalCode(0), NewPushCode(2), NewTailCallCode(3)},
+			`vm: function "f" makes a tail call with 2 values on the stack instead of 1 at pc 6`},
+		{[]Code{NewPushCode(1), NewCallCode(3), NewRetCode(), NewFuncCode("f", 0), NewPushCode(2), NewTailCallCode(6), NewLambdaCode("lambda", 1, 1), NewLoadUpvalCode(0), NewRetCode()},
+			`vm: pc 5 calls the lambda "lambda" without a closure`},
+		// the main code jumps into the function
+		{[]Code{NewPushCode(1), NewJumpCode(4), NewRetCode(), NewFuncCode("f", 0), NewPushCode(2), NewRetCode()}, "vm: pc 4 belongs to more than one function"},
+	}
+	for _, tt := range tests {
+		if err := Verify(tt.code); err == nil || err.Error() != tt.want {
+			t.Errorf("Verify(%v) = %v, want %q", tt.code, err, tt.want)
+		}
+	}
+}
@@ -1,47 +1,16 @@
-package main
+// Package vm implements a small stack based virtual machine which executes
+// code compiled from an ast.Exp.
+package vm
 
 import (
-	"container/list"
-	"strconv"
+	"fmt"
+	"sync"
 
 	"github.com/lennart01/learning_go/ast"
 )
 
-// Optional type is used to represent a value that may or may not exist
-type Optional struct {
-	val    interface{} // can be any type
-	exists bool        // true if the value exists
-}
-
-// helper functions for Optional
-// returns true if the value exists
-func (o Optional) IsJust() bool {
-	return o.exists
-}
-
-// returns the value if it exists
-// if it does not exist panic
-func (o Optional) Value() interface{} {
-	if !o.exists {
-		panic("Value does not exist")
-	}
-	return o.val
-}
-
-// creates a new Optional with the value
-func Just(val interface{}) Optional {
-	return Optional{val, true}
-}
-
-// creates a new Optional with no value
-func Nothing() Optional {
-	return Optional{nil, false}
-}
-
-// returns true if the value does not exist
-func (o Optional) IsNothing() bool {
-	return !o.exists
-}
+// Value is the type of the values on the stack and of the result of a program
+type Value int
 
 // type defines a new type similar to typedef in c++
 type OpCode int
@@ -51,201 +20,876 @@ const (
 	PUSH OpCode = iota
 	PLUS
 	MULTIPLY
+	SUB           // subtracts the top value from the value below it
+	DIV           // divides the value below the top by the top value
+	MOD           // remainder of dividing the value below the top by the top value
+	NEG           // negates the top value
+	LOAD          // pushes the value of a variable of the environment
+	LOAD_SLOT     // pushes the value of a slot
+	STORE_LOCAL   // pops the top value and stores it in a local
+	LOAD_LOCAL    // pushes the value of a local
+	EQ            // replaces the top two values by 1 if they are equal, otherwise by 0
+	NE            // replaces the top two values by 1 if they differ, otherwise by 0
+	LT            // replaces the top two values by 1 if the lower one is less than the top value
+	LE            // replaces the top two values by 1 if the lower one is less than or equal to the top value
+	GT            // replaces the top two values by 1 if the lower one is greater than the top value
+	GE            // replaces the top two values by 1 if the lower one is greater than or equal to the top value
+	NOT           // replaces the top value by 1 if it is 0, otherwise by 0
+	JUMP          // continues at the target
+	JUMP_IF_FALSE // pops the top value and continues at the target if it is 0
+	FUNC          // starts a function, it is never executed
+	CALL          // calls the function starting at the target with the arguments on top of the stack
+	RET           // returns the top value from a function, in the main code it ends the program
+	MAKE_CLOSURE  // pops the captured values of the lambda starting at the target and pushes its closure
+	LOAD_UPVAL    // pushes a captured value of the active closure
+	CALL_CLOSURE  // calls the closure below the arguments on top of the stack
+	TAILCALL      // calls the function starting at the target in the frame of the active function
+	CALL_NATIVE   // calls a native function with the arguments on top of the stack
+	PUSH_STR      // pushes a string, which only native functions take
 )
 
+// names of the opcodes
+var opNames = [...]string{
+	PUSH:          "PUSH",
+	PLUS:          "PLUS",
+	MULTIPLY:      "MULTIPLY",
+	SUB:           "SUB",
+	DIV:           "DIV",
+	MOD:           "MOD",
+	NEG:           "NEG",
+	LOAD:          "LOAD",
+	LOAD_SLOT:     "LOAD_SLOT",
+	STORE_LOCAL:   "STORE_LOCAL",
+	LOAD_LOCAL:    "LOAD_LOCAL",
+	EQ:            "EQ",
+	NE:            "NE",
+	LT:            "LT",
+	LE:            "LE",
+	GT:            "GT",
+	GE:            "GE",
+	NOT:           "NOT",
+	JUMP:          "JUMP",
+	JUMP_IF_FALSE: "JUMP_IF_FALSE",
+	FUNC:          "FUNC",
+	CALL:          "CALL",
+	RET:           "RET",
+	MAKE_CLOSURE:  "MAKE_CLOSURE",
+	LOAD_UPVAL:    "LOAD_UPVAL",
+	CALL_CLOSURE:  "CALL_CLOSURE",
+	TAILCALL:      "TAILCALL",
+	CALL_NATIVE:   "CALL_NATIVE",
+	PUSH_STR:      "PUSH_STR",
+}
+
+// returns the name of the opcode
+func (op OpCode) String() string {
+	if op < 0 || int(op) >= len(opNames) {
+		return fmt.Sprintf("OpCode(%d)", int(op))
+	}
+	return opNames[op]
+}
+
 // define a struct to represent a code
 type Code struct {
-	Op  OpCode
-	val int
+	Op   OpCode
+	val  int    // value of PUSH, slot of LOAD_SLOT, local of STORE_LOCAL and LOAD_LOCAL, target of a jump, call or MAKE_CLOSURE, parameters of FUNC, captured value of LOAD_UPVAL, arguments of CALL_CLOSURE and CALL_NATIVE
+	name string // variable of LOAD, function of FUNC and CALL_NATIVE, string of PUSH_STR
+	// captured values of a FUNC which starts a lambda
+	upvals int
 }
 
 // helper functions for Code
 // these functions are used to push a code onto the stack
 func NewPushCode(val int) Code {
-	return Code{PUSH, val}
+	return Code{Op: PUSH, val: val}
 }
 func NewPlusCode() Code {
-	return Code{PLUS, 0}
+	return Code{Op: PLUS}
 }
 func NewMultiplyCode() Code {
-	return Code{MULTIPLY, 0}
+	return Code{Op: MULTIPLY}
+}
+func NewSubCode() Code {
+	return Code{Op: SUB}
+}
+func NewDivCode() Code {
+	return Code{Op: DIV}
+}
+func NewModCode() Code {
+	return Code{Op: MOD}
+}
+func NewNegCode() Code {
+	return Code{Op: NEG}
+}
+
+func NewLoadCode(name string) Code {
+	return Code{Op: LOAD, name: name}
+}
+func NewLoadSlotCode(slot int) Code {
+	return Code{Op: LOAD_SLOT, val: slot}
+}
+func NewStoreLocalCode(local int) Code {
+	return Code{Op: STORE_LOCAL, val: local}
+}
+func NewLoadLocalCode(local int) Code {
+	return Code{Op: LOAD_LOCAL, val: local}
+}
+func NewEqCode() Code {
+	return Code{Op: EQ}
+}
+func NewNeCode() Code {
+	return Code{Op: NE}
+}
+func NewLtCode() Code {
+	return Code{Op: LT}
+}
+func NewLeCode() Code {
+	return Code{Op: LE}
+}
+func NewGtCode() Code {
+	return Code{Op: GT}
+}
+func NewGeCode() Code {
+	return Code{Op: GE}
+}
+func NewNotCode() Code {
+	return Code{Op: NOT}
+}
+
+// the target of a jump is the index of the next instruction,
+// len(code) ends the program
+func NewJumpCode(target int) Code {
+	return Code{Op: JUMP, val: target}
+}
+func NewJumpIfFalseCode(target int) Code {
+	return Code{Op: JUMP_IF_FALSE, val: target}
+}
+
+// the parameters of a function are its first locals
+func NewFuncCode(name string, params int) Code {
+	return Code{Op: FUNC, val: params, name: name}
+}
+
+// the function of a lambda is only called through its closures,
+// the captured values are loaded by LOAD_UPVAL
+func NewLambdaCode(name string, params, upvals int) Code {
+	return Code{Op: FUNC, val: params, name: name, upvals: upvals}
+}
+
+// the target of a call is the index of the FUNC instruction
+func NewCallCode(target int) Code {
+	return Code{Op: CALL, val: target}
+}
+func NewRetCode() Code {
+	return Code{Op: RET}
+}
+
+// a tail call returns the result of the called function
+// from the active function, like a CALL followed by RET
+func NewTailCallCode(target int) Code {
+	return Code{Op: TAILCALL, val: target}
+}
+
+// the target of MAKE_CLOSURE is the index of the FUNC instruction of a lambda
+func NewMakeClosureCode(target int) Code {
+	return Code{Op: MAKE_CLOSURE, val: target}
+}
+func NewLoadUpvalCode(index int) Code {
+	return Code{Op: LOAD_UPVAL, val: index}
+}
+
+// the closure is below the arguments on the stack
+func NewCallClosureCode(args int) Code {
+	return Code{Op: CALL_CLOSURE, val: args}
+}
+
+// the native function is looked up by its name once when the program
+// is created, see NewVMWith
+func NewCallNativeCode(name string, args int) Code {
+	return Code{Op: CALL_NATIVE, val: args, name: name}
+}
+
+// a string is only passed to native functions, the value on the stack
+// is the index of the string in the strings of the program
+func NewPushStrCode(s string) Code {
+	return Code{Op: PUSH_STR, name: s}
+}
+
+// returns the value of a PUSH code, the slot of a LOAD_SLOT code,
+// the local of a STORE_LOCAL or LOAD_LOCAL code, the target of a jump,
+// call or MAKE_CLOSURE, the number of parameters of a FUNC code,
+// the captured value of a LOAD_UPVAL code or the number of arguments
+// of a CALL_CLOSURE or CALL_NATIVE code
+func (c Code) Val() int {
+	return c.val
+}
+
+// returns the number of captured values of a FUNC code of a lambda
+func (c Code) Upvals() int {
+	return c.upvals
+}
+
+// returns the variable of a LOAD code, the function of a FUNC or
+// CALL_NATIVE code or the string of a PUSH_STR code
+func (c Code) Name() string {
+	return c.name
+}
+
+// Program is a compiled expression which can be run by the vm
+// a program is never modified after it has been compiled,
+// so it can be shared and run by many goroutines at the same time
+type Program struct {
+	code     []Code
+	maxStack int      // maximum number of values on the stack while running
+	slots    int      // number of slots read by LOAD_SLOT instructions
+	locals   int      // number of locals of the main code, they are the bottom values of the stack
+	vars     []string // names of the slots, empty if the slots have no names
+	err      error    // result of verifying the code, returned by every run
+	// number of locals of every function by the index of its FUNC
+	// instruction, nil if the code has no functions
+	funcLocals []int
+	// native function of every CALL_NATIVE instruction by its index,
+	// nil if the code calls none
+	natives []*native
+	// the distinct strings of the PUSH_STR instructions and the index of
+	// the string of every PUSH_STR instruction by its index, nil if the
+	// code pushes none
+	strings  []string
+	strIndex []int
+}
+
+// DefaultMaxCallDepth is the maximum number of nested calls of a run
+// if the vm or the options of the run do not set another one
+const DefaultMaxCallDepth = 10000
+
+// programs which need at most this many values on the stack
+// keep their stack in a local array while running
+const smallStack = 32
+
+// stacks of programs which need more than smallStack values,
+// a pool is safe for concurrent use and avoids allocating a stack per run
+var stackPool = sync.Pool{
+	New: func() any {
+		stack := make([]Value, 0, 2*smallStack)
+		return &stack
+	},
+}
+
+// Check checks the ast like ast.Check without native functions
+// Compile checks the ast, so a compiled program never adds a closure
+// or applies an int, and both fail like ast.Evaluate
+func Check(exp ast.Exp) error {
+	return CheckWith(exp, nil)
+}
+
+// CheckWith checks the ast like ast.Check, calls of names without a
+// definition call the native functions of natives, which may be nil
+func CheckWith(exp ast.Exp, natives *Natives) error {
+	if err := ast.Check(exp, natives.signature); err != nil {
+		return fmt.Errorf("vm: %w", err)
+	}
+	return nil
+}
+
+// Compile transforms an ast into a program which calls no native functions
+// every variable is assigned a slot, the slots are numbered in the order
+// in which the variables first appear in the ast, see Vars
+// returns an error if the ast contains an expression the vm does not support
+func Compile(exp ast.Exp) (*Program, error) {
+	return CompileWith(exp, nil)
+}
+
+// CompileWith is like Compile, calls of names without a definition call
+// the native functions of natives, which may be nil
+func CompileWith(exp ast.Exp, natives *Natives) (*Program, error) {
+	if err := CheckWith(exp, natives); err != nil {
+		return nil, err
+	}
+	comp := compiler{natives: natives}
+	if err := comp.transformAst(comp.rename(exp)); err != nil {
+		return nil, err
+	}
+	if err := comp.transformFuncs(); err != nil {
+		return nil, err
+	}
+	prog := newProgram(comp.code, comp.vars, natives)
+	if prog.err != nil {
+		return nil, prog.err
+	}
+	return prog, nil
+}
+
+// creates a program for the code, vars are the names of the slots
+// the code is verified once so that runs do not need to check the stack,
+// the native functions are looked up in natives once and the strings
+// are interned
+func newProgram(code []Code, vars []string, natives *Natives) *Program {
+	lay, err := verify(code)
+	prog := &Program{code: code, maxStack: lay.maxStack, vars: vars, err: err}
+	for _, c := range code {
+		if c.Op == LOAD_SLOT && c.val >= prog.slots {
+			prog.slots = c.val + 1
+		}
+	}
+	if err == nil {
+		prog.locals, prog.funcLocals = countLocals(code, lay.owner)
+		prog.natives, prog.err = resolveNatives(code, natives)
+		prog.strings, prog.strIndex = internStrings(code)
+	}
+	prog.maxStack += prog.locals
+	if prog.err == nil && len(vars) > 0 && prog.slots > len(vars) {
+		prog.err = fmt.Errorf("vm: program reads %d slots but only %d have a name", prog.slots, len(vars))
+	}
+	return prog
+}
+
+// returns the number of locals of the main code and of every function,
+// the parameters are the first locals of a function
+// owner is the index of the FUNC instruction every instruction belongs to
+func countLocals(code []Code, owner []int) (locals int, funcLocals []int) {
+	for pc, c := range code {
+		if c.Op == FUNC {
+			if funcLocals == nil {
+				funcLocals = make([]int, len(code))
+			}
+			funcLocals[pc] = c.val
+		}
+	}
+	for pc, c := range code {
+		if c.Op != STORE_LOCAL && c.Op != LOAD_LOCAL {
+			continue
+		}
+		if fn := owner[pc]; fn >= 0 {
+			if c.val >= funcLocals[fn] {
+				funcLocals[fn] = c.val + 1
+			}
+		} else if c.val >= locals {
+			locals = c.val + 1
+		}
+	}
+	return locals, funcLocals
+}
+
+// returns a copy of the code of the program
+func (p *Program) Code() []Code {
+	return append([]Code(nil), p.code...)
+}
+
+// Runs the program
+// returns the top value of the stack after the last instruction,
+// or an error if the program can not be executed
+// every run uses its own stack, so no memory is allocated and
+// concurrent runs of the same program do not interfere
+func (p *Program) Run() (Value, error) {
+	return p.RunEnv(nil)
+}
+
+// Runs the program like Run, LOAD instructions and the named slots of a
+// compiled program push the variables of env
+// returns an ast.UnboundVariableError if the run loads a variable
+// which env does not bind
+func (p *Program) RunEnv(env ast.Env) (Value, error) {
+	return p.run(p.bind(env, nil))
+}
+
+// Runs the program like Run, LOAD_SLOT i pushes slots[i]
+// returns ErrSlotOutOfRange if there is no such slot
+func (p *Program) RunSlots(slots []Value) (Value, error) {
+	return p.run(machine{slots: slots})
+}
+
+// runs the program on a machine which only has its inputs set
+func (p *Program) run(m machine) (Value, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	p.load(&m)
+	if p.maxStack <= smallStack {
+		var buf [smallStack]Value
+		return m.run(p.frame(buf[:0]))
+	}
+	stack := stackPool.Get().(*[]Value)
+	if cap(*stack) < p.maxStack {
+		*stack = make([]Value, 0, p.maxStack)
+	}
+	result, err := m.run(p.frame((*stack)[:0]))
+	stackPool.Put(stack)
+	return result, err
+}
+
+// Runs the program and reports every instruction to the tracer
+// before it is executed
+func (p *Program) RunTrace(t Tracer) (Value, error) {
+	return p.runTrace(p.bind(nil, nil), t)
+}
+
+func (p *Program) runTrace(m machine, t Tracer) (Value, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	p.load(&m)
+	// the tracer may keep the stack, so it is not taken from the pool
+	return m.runTraced(p.frame(make([]Value, 0, p.maxStack)), t)
+}
+
+// prepares the machine to run the code of the program
+func (p *Program) load(m *machine) {
+	m.code, m.funcLocals, m.natives = p.code, p.funcLocals, p.natives
+	m.strings, m.strIndex = &p.strings, p.strIndex
+	m.fn, m.cl = -1, -1
+	if m.maxCalls <= 0 {
+		m.maxCalls = DefaultMaxCallDepth
+	}
+}
+
+// returns the empty stack with the locals of the program set to zero,
+// the locals are the bottom values of the stack
+func (p *Program) frame(stack []Value) []Value {
+	for i := 0; i < p.locals; i++ {
+		stack = append(stack, 0)
+	}
+	return stack
 }
 
 // define a struct to represent a virtual machine
+// the vm runs a program, copies of a vm share the same program
 type VM struct {
-	code  []Code     // holds the program code
-	stack *list.List // holds the stack
+	*Program
+	Tracer Tracer  // if not nil, Run reports every instruction to the tracer
+	Env    ast.Env // variables of LOAD instructions
+	Slots  []Value // values of LOAD_SLOT instructions
+	// maximum number of nested calls, DefaultMaxCallDepth if zero
+	MaxCallDepth int
+}
+
+// the state of the compiler of an ast, see CompileWith
+type compiler struct {
+	code   []Code
+	vars   []string     // names of the slots in the order of their first use
+	scope  []string     // names of the locals of the enclosing lets and the parameters
+	upvals []string     // names of the values captured by the lambda being compiled
+	funcs  []int        // functions which can be called by their index in the queue, the innermost last
+	queue  []queuedFunc // functions whose bodies are compiled after the main code
+	// renamed function definitions by their unique names and the locals
+	// of the enclosing frames they capture, see captured
+	defs   map[string]ast.FuncExp
+	lifted map[string][]string
+	// index of every CALL and MAKE_CLOSURE, its target is the index
+	// in the queue until the bodies are compiled
+	calls []int
+	// native functions which calls of names without a definition call
+	natives *Natives
+}
+
+// a function whose body is compiled after the main code
+type queuedFunc struct {
+	def      ast.FuncExp
+	funcs    []int    // functions the body can call, including the function itself
+	captured []string // locals of the frames around a function which are passed after the arguments
+	upvals   []string // variables of the frame around a lambda which it captures
+	entry    int      // index of the FUNC instruction once the body is compiled
 }
 
 // Creates a new vm
+// the code is verified once, if it is invalid every run returns the error
 func NewVM(code []Code) VM {
-	return VM{code, list.New()} // initialize the stack as an empty list
+	return NewVMWith(code, nil)
+}
+
+// Creates a new vm whose CALL_NATIVE instructions call the native
+// functions of natives, which may be nil
+func NewVMWith(code []Code, natives *Natives) VM {
+	return VM{Program: newProgram(code, nil, natives)}
 }
 
-func (vm *VM) transformAst(ast_exp ast.Exp) {
+// Runs the program of the vm with the variables of the vm
+// if the vm has a tracer, every instruction is reported to it
+func (vm VM) Run() (Value, error) {
+	m := vm.bind(vm.Env, vm.Slots)
+	m.maxCalls = vm.MaxCallDepth
+	if vm.Tracer != nil {
+		return vm.Program.runTrace(m, vm.Tracer)
+	}
+	return vm.Program.run(m)
+}
+
+// returns the number of values an instruction pops from and pushes onto the stack
+// a CALL or TAILCALL pops the parameters of the FUNC instruction in the code
+// at its target, a MAKE_CLOSURE its captured values
+func (c Code) stackEffect(code []Code) (pop int, push int) {
+	switch c.Op {
+	case PUSH, PUSH_STR, LOAD, LOAD_SLOT, LOAD_LOCAL:
+		return 0, 1
+	case NEG, NOT:
+		return 1, 1
+	case STORE_LOCAL, JUMP_IF_FALSE, RET:
+		return 1, 0
+	case JUMP, FUNC:
+		return 0, 0
+	case CALL:
+		return code[c.val].val, 1
+	case TAILCALL:
+		return code[c.val].val, 0
+	case MAKE_CLOSURE:
+		return code[c.val].upvals, 1
+	case LOAD_UPVAL:
+		return 0, 1
+	case CALL_CLOSURE:
+		return c.val + 1, 1
+	case CALL_NATIVE:
+		return c.val, 1
+	default:
+		return 2, 1
+	}
+}
+
+func (comp *compiler) transformAst(ast_exp ast.Exp) error {
 	// switch case on the type of the ast
 	switch ast_exp := ast_exp.(type) {
 	// if the ast is an int expression
 	case ast.IntExp:
 		// push the value onto the stack
-		vm.code = append(vm.code, NewPushCode(ast_exp.Eval()))
+		comp.code = append(comp.code, NewPushCode(ast_exp.Val))
+		return nil
 	// if the ast is a plus expression
 	case ast.PlusExp:
 		// parse the left and right expressions
-		vm.transformAst(ast_exp.Left)
-		vm.transformAst(ast_exp.Right)
+		if err := comp.transformBinary(ast_exp.Left, ast_exp.Right); err != nil {
+			return err
+		}
 		// push a plus code onto the stack
-		vm.code = append(vm.code, NewPlusCode())
+		comp.code = append(comp.code, NewPlusCode())
+		return nil
 	// if the ast is a mult expression
 	case ast.MultExp:
 		// parse the left and right expressions
-		vm.transformAst(ast_exp.Left)
-		vm.transformAst(ast_exp.Right)
+		if err := comp.transformBinary(ast_exp.Left, ast_exp.Right); err != nil {
+			return err
+		}
 		// push a multiply code onto the stack
-		vm.code = append(vm.code, NewMultiplyCode())
+		comp.code = append(comp.code, NewMultiplyCode())
+		return nil
+	case ast.SubExp:
+		if err := comp.transformBinary(ast_exp.Left, ast_exp.Right); err != nil {
+			return err
+		}
+		comp.code = append(comp.code, NewSubCode())
+		return nil
+	case ast.DivExp:
+		if err := comp.transformBinary(ast_exp.Left, ast_exp.Right); err != nil {
+			return err
+		}
+		comp.code = append(comp.code, NewDivCode())
+		return nil
+	case ast.ModExp:
+		if err := comp.transformBinary(ast_exp.Left, ast_exp.Right); err != nil {
+			return err
+		}
+		comp.code = append(comp.code, NewModCode())
+		return nil
+	case ast.NegExp:
+		if err := comp.transformAst(ast_exp.Exp); err != nil {
+			return err
+		}
+		comp.code = append(comp.code, NewNegCode())
+		return nil
+	case ast.VarExp:
+		return comp.variable(ast_exp.Name)
+	case ast.BoolExp:
+		comp.code = append(comp.code, NewPushCode(int(boolValue(ast_exp.Val))))
+		return nil
+	case ast.StringExp:
+		comp.code = append(comp.code, NewPushStrCode(ast_exp.Val))
+		return nil
+	case ast.EqExp:
+		return comp.transformOp(NewEqCode(), ast_exp.Left, ast_exp.Right)
+	case ast.NeqExp:
+		return comp.transformOp(NewNeCode(), ast_exp.Left, ast_exp.Right)
+	case ast.LtExp:
+		return comp.transformOp(NewLtCode(), ast_exp.Left, ast_exp.Right)
+	case ast.LeExp:
+		return comp.transformOp(NewLeCode(), ast_exp.Left, ast_exp.Right)
+	case ast.GtExp:
+		return comp.transformOp(NewGtCode(), ast_exp.Left, ast_exp.Right)
+	case ast.GeExp:
+		return comp.transformOp(NewGeCode(), ast_exp.Left, ast_exp.Right)
+	case ast.NotExp:
+		return comp.transformOp(NewNotCode(), ast_exp.Exp)
+	case ast.AndExp:
+		// a && b is if a then !!b else false, !! turns b into 1 or 0
+		return comp.transformAst(ast.IfExp{
+			Cond: ast_exp.Left,
+			Then: ast.NotExp{Exp: ast.NotExp{Exp: ast_exp.Right}},
+			Else: ast.BoolExp{Val: false},
+		})
+	case ast.OrExp:
+		// a || b is if a then true else !!b
+		return comp.transformAst(ast.IfExp{
+			Cond: ast_exp.Left,
+			Then: ast.BoolExp{Val: true},
+			Else: ast.NotExp{Exp: ast.NotExp{Exp: ast_exp.Right}},
+		})
+	case ast.IfExp:
+		// cond; jump_if_false else; then; jump end; else: else; end:
+		if err := comp.transformAst(ast_exp.Cond); err != nil {
+			return err
+		}
+		jumpElse := len(comp.code)
+		comp.code = append(comp.code, NewJumpIfFalseCode(0))
+		if err := comp.transformAst(ast_exp.Then); err != nil {
+			return err
+		}
+		jumpEnd := len(comp.code)
+		comp.code = append(comp.code, NewJumpCode(0))
+		comp.code[jumpElse].val = len(comp.code)
+		if err := comp.transformAst(ast_exp.Else); err != nil {
+			return err
+		}
+		comp.code[jumpEnd].val = len(comp.code)
+		return nil
+	case ast.LetExp:
+		// the value is computed once and stored in the local of the let,
+		// the name is not in scope while the value is computed
+		if err := comp.transformAst(ast_exp.Value); err != nil {
+			return err
+		}
+		// lets which are not nested share their locals
+		comp.code = append(comp.code, NewStoreLocalCode(len(comp.scope)))
+		comp.scope = append(comp.scope, ast_exp.Name)
+		err := comp.transformAst(ast_exp.Body)
+		comp.scope = comp.scope[:len(comp.scope)-1]
+		return err
+	case ast.FuncExp:
+		// the body is compiled after the main code, it can call the
+		// function itself and the functions around the definition
+		index := len(comp.queue)
+		comp.queue = append(comp.queue, queuedFunc{
+			def:      ast_exp,
+			funcs:    append(append([]int(nil), comp.funcs...), index),
+			captured: comp.captured(ast_exp.Name),
+		})
+		comp.funcs = append(comp.funcs, index)
+		err := comp.transformAst(ast_exp.In)
+		comp.funcs = comp.funcs[:len(comp.funcs)-1]
+		return err
+	case ast.LambdaExp:
+		// the body is compiled after the main code like the body of a
+		// function, the closure gets a copy of the variables of the frame
+		// which the body uses and which the functions it calls capture,
+		// the other variables are slots
+		var upvals []string
+		capture := func(name string) error {
+			for _, upval := range upvals {
+				if upval == name {
+					return nil
+				}
+			}
+			upvals = append(upvals, name)
+			return comp.variable(name)
+		}
+		for _, name := range ast.FreeVars(ast_exp) {
+			if _, ok := comp.defs[name]; ok {
+				for _, captured := range comp.captured(name) {
+					if err := capture(captured); err != nil {
+						return err
+					}
+				}
+			} else if comp.captures(name) {
+				if err := capture(name); err != nil {
+					return err
+				}
+			}
+		}
+		comp.queue = append(comp.queue, queuedFunc{
+			def:    ast.FuncExp{Name: ast.LambdaName, Params: ast_exp.Params, Body: ast_exp.Body},
+			funcs:  append([]int(nil), comp.funcs...),
+			upvals: upvals,
+		})
+		comp.calls = append(comp.calls, len(comp.code))
+		comp.code = append(comp.code, NewMakeClosureCode(len(comp.queue)-1))
+		return nil
+	case ast.AppExp:
+		// fn; args...; call_closure n
+		if err := comp.transformAst(ast_exp.Fn); err != nil {
+			return err
+		}
+		return comp.transformOp(NewCallClosureCode(len(ast_exp.Args)), ast_exp.Args...)
+	case ast.CallExp:
+		index, ok := comp.function(ast_exp.Name)
+		if !ok {
+			// without a function of the name the call applies the
+			// closure in the variable
+			if comp.captures(ast_exp.Name) {
+				return comp.transformAst(ast.AppExp{Fn: ast.VarExp{Name: ast_exp.Name}, Args: ast_exp.Args})
+			}
+			// otherwise it calls the native function of the name
+			if f, ok := comp.natives.lookup(ast_exp.Name); ok {
+				if err := f.checkArity(len(ast_exp.Args)); err != nil {
+					return err
+				}
+				return comp.transformOp(NewCallNativeCode(ast_exp.Name, len(ast_exp.Args)), ast_exp.Args...)
+			}
+			return fmt.Errorf("vm: %w", ast.UndefinedFunctionError{Name: ast_exp.Name})
+		}
+		f := comp.queue[index]
+		if params := len(f.def.Params); len(ast_exp.Args) != params {
+			return fmt.Errorf("vm: %w", ast.ArityError{Name: original(ast_exp.Name), Want: params, Got: len(ast_exp.Args)})
+		}
+		// the arguments become the first locals of the frame of the call,
+		// followed by the captured locals
+		for _, arg := range ast_exp.Args {
+			if err := comp.transformAst(arg); err != nil {
+				return err
+			}
+		}
+		for _, name := range f.captured {
+			if err := comp.variable(name); err != nil {
+				return err
+			}
+		}
+		comp.calls = append(comp.calls, len(comp.code))
+		comp.code = append(comp.code, NewCallCode(index))
+		return nil
+	default:
+		return fmt.Errorf("vm: unsupported expression %T", ast_exp)
 	}
 }
 
-// loads an ast into the vm
-func LoadAst(ast ast.Exp) VM {
-	// create a new vm
-	vm := NewVM([]Code{})
-	// parse the ast into code
-	vm.transformAst(ast)
-	return vm
+// returns the slot of a variable, a new slot is added for a new variable
+func (comp *compiler) slot(name string) int {
+	for i, v := range comp.vars {
+		if v == name {
+			return i
+		}
+	}
+	comp.vars = append(comp.vars, name)
+	return len(comp.vars) - 1
 }
 
-// Runs the program
-func (vm VM) Run() Optional {
-	// always start with an empty stack
-	vm.stack.Init()
-
-	// loop through the code
-	// "_" ignores the index
-	for _, code := range vm.code {
-		// switch case on the opcode
-		switch code.Op {
-		// push the value onto the stack
-		case PUSH:
-			vm.stack.PushBack(code.val)
-		case PLUS:
-			// pop the top two values
-			// if the stack is empty, return Nothing
-			// otherwise, push the sum of the two values onto the stack
-			if vm.stack.Len() < 2 {
-				return Nothing()
-			}
-			val1 := vm.stack.Remove(vm.stack.Back()).(int)
-			val2 := vm.stack.Remove(vm.stack.Back()).(int)
-			vm.stack.PushBack(val1 + val2)
-		case MULTIPLY:
-			// pop the top two values
-			// if the stack is empty, return Nothing
-			// otherwise, push the product of the two values onto the stack
-			if vm.stack.Len() < 2 {
-				return Nothing()
-			}
-			val1 := vm.stack.Remove(vm.stack.Back()).(int)
-			val2 := vm.stack.Remove(vm.stack.Back()).(int)
-			vm.stack.PushBack(val1 * val2)
-		}
-	}
-	// if the stack is empty, return Nothing
-	if vm.stack.Len() == 0 {
-		return Nothing()
-	}
-	// otherwise, return the top value
-	return Just(vm.stack.Back().Value.(int))
-}
-
-// prints the result of the vm
-func showVMResult(result Optional) {
-	if result.IsJust() {
-		println(result.Value().(int))
-	} else {
-		println("Nothing")
-	}
-
-}
-
-// prints the calculation
-func showCalculation(vm VM) {
-	stack_list := list.New()
-	prev_value := ""
-	// loop through the code
-	// "_" ignores the index
-	for _, code := range vm.code {
-		// switch case on the opcode
-		switch code.Op {
-		case PUSH:
-			// push the value onto the stack_list
-			stack_list.PushBack(code.val)
-		case PLUS:
-			// pop the top two values and set the prev_value to the calculation
-			if prev_value == "" {
-				element1 := stack_list.Back()
-				element2 := stack_list.Back().Prev()
-				val1 := strconv.Itoa(stack_list.Remove(element1).(int))
-				val2 := strconv.Itoa(stack_list.Remove(element2).(int))
-				prev_value = "(" + val1 + " + " + val2 + ")"
-				// append the new calculation to the prev_value
-			} else if prev_value != "" {
-				element2 := stack_list.Back()
-				val2 := strconv.Itoa(stack_list.Remove(element2).(int))
-				val1 := prev_value
-				prev_value = "(" + val1 + " + " + val2 + ")"
-			}
-		// pop the top two values and set the prev_value to the calculation
-		case MULTIPLY:
-			if prev_value == "" {
-				element1 := stack_list.Back()
-				element2 := stack_list.Back().Prev()
-				val1 := strconv.Itoa(stack_list.Remove(element1).(int))
-				val2 := strconv.Itoa(stack_list.Remove(element2).(int))
-				prev_value = "(" + val1 + " * " + val2 + ")"
-				// append the new calculation to the prev_value
-			} else if prev_value != "" {
-				element2 := stack_list.Back()
-				val2 := strconv.Itoa(stack_list.Remove(element2).(int))
-				val1 := prev_value
-				prev_value = "(" + val1 + " * " + val2 + ")"
-			}
+// pushes the value of a variable: a let-bound variable or parameter is
+// a local, the innermost let wins, a variable which the lambda being
+// compiled captured is loaded from its closure, every other one is a slot
+func (comp *compiler) variable(name string) error {
+	for i := len(comp.scope) - 1; i >= 0; i-- {
+		if comp.scope[i] == name {
+			comp.code = append(comp.code, NewLoadLocalCode(i))
+			return nil
+		}
+	}
+	for i, upval := range comp.upvals {
+		if upval == name {
+			comp.code = append(comp.code, NewLoadUpvalCode(i))
+			return nil
+		}
+	}
+	// the name is resolved to a slot once, so that runs do not
+	// need to look up the variable in a map
+	comp.code = append(comp.code, NewLoadSlotCode(comp.slot(name)))
+	return nil
+}
+
+// returns true if the variable is a local of the frame being compiled or
+// captured by its lambda, so that a lambda defined in the frame captures it
+func (comp *compiler) captures(name string) bool {
+	for _, local := range comp.scope {
+		if local == name {
+			return true
+		}
+	}
+	for _, upval := range comp.upvals {
+		if upval == name {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the index in the queue of the innermost function with the name
+func (comp *compiler) function(name string) (int, bool) {
+	for i := len(comp.funcs) - 1; i >= 0; i-- {
+		if comp.queue[comp.funcs[i]].def.Name == name {
+			return comp.funcs[i], true
 		}
 	}
-	// print the calculation
-	print("The VM runs the following calculation: \n")
-	print(prev_value)
-	println()
-}
-
-// test the vm
-func main() {
-	// create a new vm with the code
-	vm := NewVM([]Code{
-		NewPushCode(1),
-		NewPushCode(2),
-		NewPlusCode(),
-		NewPushCode(3),
-		NewMultiplyCode(),
-	})
-	// print the calculation
-	showCalculation(vm)
-	// run the vm
-	result := vm.Run()
-	// print the result
-	showVMResult(result)
-
-	// create an ast
-	int_exp1 := ast.IntExp{Val: 1}
-	int_exp2 := ast.IntExp{Val: 2}
-	plus_exp := ast.PlusExp{Left: int_exp1, Right: int_exp2}
-	mult_exp := ast.MultExp{Left: plus_exp, Right: int_exp2}
-	// load the ast into the vm
-	vm2 := LoadAst(mult_exp)
-	// print the calculation
-	showCalculation(vm2)
-	// run the vm
-	result2 := vm2.Run()
-	// print the result
-	showVMResult(result2)
+	return 0, false
+}
+
+// compiles the bodies of the functions and lambdas after the main code,
+// which then ends with RET, and sets the targets of the calls and closures
+// compiling a body may queue the functions which are defined in it
+func (comp *compiler) transformFuncs() error {
+	if len(comp.queue) == 0 {
+		return nil
+	}
+	comp.code = append(comp.code, NewRetCode())
+	for i := 0; i < len(comp.queue); i++ {
+		f := comp.queue[i]
+		comp.queue[i].entry = len(comp.code)
+		comp.scope = append(append([]string(nil), f.def.Params...), f.captured...)
+		comp.code = append(comp.code, NewLambdaCode(original(f.def.Name), len(comp.scope), len(f.upvals)))
+		comp.upvals = f.upvals
+		comp.funcs = append([]int(nil), f.funcs...)
+		if err := comp.transformAst(f.def.Body); err != nil {
+			return err
+		}
+		comp.code = append(comp.code, NewRetCode())
+	}
+	for _, pc := range comp.calls {
+		comp.code[pc].val = comp.queue[comp.code[pc].val].entry
+	}
+	// the main code ends before the first function
+	tailCalls(comp.code, comp.queue[0].entry)
+	return nil
+}
+
+// replaces the calls in tail position of the functions from the index
+// first on by TAILCALL, so that a recursion in tail position runs in
+// constant stack depth
+// a call is in tail position if RET follows it, directly or after
+// jumps, e.g. in a branch of an if which ends the function, the jumps
+// and RET after a tail call are kept but no longer reached
+// the main code has no frame to reuse, its calls are kept
+func tailCalls(code []Code, first int) {
+	for pc := first; pc < len(code); pc++ {
+		if code[pc].Op != CALL {
+			continue
+		}
+		next := pc + 1
+		for next < len(code) && code[next].Op == JUMP {
+			next = code[next].val
+		}
+		if next < len(code) && code[next].Op == RET {
+			code[pc].Op = TAILCALL
+		}
+	}
+}
+
+// transforms the operands of a binary expression
+func (comp *compiler) transformBinary(left, right ast.Exp) error {
+	if err := comp.transformAst(left); err != nil {
+		return err
+	}
+	return comp.transformAst(right)
+}
+
+// transforms the operands followed by the instruction c
+func (comp *compiler) transformOp(c Code, operands ...ast.Exp) error {
+	for _, operand := range operands {
+		if err := comp.transformAst(operand); err != nil {
+			return err
+		}
+	}
+	comp.code = append(comp.code, c)
+	return nil
+}
+
+// loads an ast into the vm
+// panics if the ast can not be compiled, use Compile to handle the error
+func LoadAst(ast ast.Exp) VM {
+	// parse the ast into code
+	prog, err := Compile(ast)
+	if err != nil {
+		panic(err)
+	}
+	return VM{Program: prog}
 }
@@ -1,6 +1,12 @@
-package main
+package vm
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/lennart01/learning_go/ast"
@@ -15,9 +21,9 @@ func TestVM(t *testing.T) {
 		NewPushCode(3),
 		NewMultiplyCode(),
 	})
-	result1 := vm1.Run()
-	if result1.Value().(int) != 9 {
-		t.Errorf("Test case 1 failed: expected 9, but got %d", result1.Value().(int))
+	result1, err := vm1.Run()
+	if err != nil || result1 != 9 {
+		t.Errorf("Test case 1 failed: expected 9, but got %d, %v", result1, err)
 	}
 
 	// test case 2
@@ -28,9 +34,9 @@ func TestVM(t *testing.T) {
 		NewPushCode(3),
 		NewPlusCode(),
 	})
-	result2 := vm2.Run()
-	if result2.Value().(int) != 5 {
-		t.Errorf("Test case 2 failed: expected 5, but got %d", result2.Value().(int))
+	result2, err := vm2.Run()
+	if err != nil || result2 != 5 {
+		t.Errorf("Test case 2 failed: expected 5, but got %d, %v", result2, err)
 	}
 
 	// test case 3
@@ -40,9 +46,9 @@ func TestVM(t *testing.T) {
 		NewPlusCode(),
 		NewMultiplyCode(),
 	})
-	result3 := vm3.Run()
-	if !result3.IsNothing() {
-		t.Errorf("Test case 3 failed: expected Nothing, but got %d", result3.Value().(int))
+	result3, err := vm3.Run()
+	if err != (ErrStackUnderflow{3, MULTIPLY}) {
+		t.Errorf("Test case 3 failed: expected stack underflow at pc 3, but got %d, %v", result3, err)
 	}
 	// test case 4 (with ast)
 	int_exp1 := ast.IntExp{Val: 1}
@@ -51,9 +57,9 @@ func TestVM(t *testing.T) {
 	plus_exp := ast.PlusExp{Left: int_exp1, Right: int_exp2}
 	mult_exp := ast.MultExp{Left: plus_exp, Right: int_exp3}
 	vm4 := LoadAst(mult_exp)
-	vm4_result := vm4.Run()
-	if vm4_result.Value().(int) != 9 {
-		t.Errorf("Test case 4 failed: expected 9, but got %d", vm4_result.Value().(int))
+	vm4_result, err := vm4.Run()
+	if err != nil || vm4_result != 9 {
+		t.Errorf("Test case 4 failed: expected 9, but got %d, %v", vm4_result, err)
 	}
 
 }
@@ -82,3 +88,1086 @@ func TestLoadAst(t *testing.T) {
 		}
 	}
 }
+
+func TestCompile(t *testing.T) {
+	prog, err := Compile(ast.MultExp{Left: ast.PlusExp{Left: ast.IntExp{Val: 1}, Right: ast.IntExp{Val: 2}}, Right: ast.IntExp{Val: 3}})
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	result, err := prog.Run()
+	if err != nil || result != 9 {
+		t.Errorf("Expected 9, but got %d, %v", result, err)
+	}
+
+	// a nil expression can not be compiled
+	if _, err := Compile(nil); err == nil {
+		t.Errorf("Expected an error for a nil expression")
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	tests := []struct {
+		name string
+		exp  ast.Exp
+		want int
+	}{
+		{"sub", ast.SubExp{Left: ast.IntExp{Val: 1}, Right: ast.IntExp{Val: 3}}, -2},
+		{"div", ast.DivExp{Left: ast.IntExp{Val: 7}, Right: ast.IntExp{Val: 2}}, 3},
+		{"mod", ast.ModExp{Left: ast.IntExp{Val: -7}, Right: ast.IntExp{Val: 3}}, -1},
+		{"neg", ast.NegExp{Exp: ast.SubExp{Left: ast.IntExp{Val: 1}, Right: ast.IntExp{Val: 4}}}, 3},
+		{"nested", ast.SubExp{Left: ast.IntExp{Val: 10}, Right: ast.DivExp{Left: ast.IntExp{Val: 9}, Right: ast.NegExp{Exp: ast.IntExp{Val: 3}}}}, 13},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := Compile(tt.exp)
+			if err != nil {
+				t.Fatalf("Compile(%s) returned error: %v", tt.exp.Pretty(), err)
+			}
+			result, err := prog.Run()
+			if err != nil || result != Value(tt.want) {
+				t.Errorf("Run(%s) = %d, %v, want %d", tt.exp.Pretty(), result, err, tt.want)
+			}
+			if got := tt.exp.Eval(); got != tt.want {
+				t.Errorf("Eval(%s) = %d, want %d", tt.exp.Pretty(), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDivisionByZero(t *testing.T) {
+	for _, code := range []Code{NewDivCode(), NewModCode()} {
+		vm := NewVM([]Code{NewPushCode(1), NewPushCode(0), code})
+		result, err := vm.Run()
+		if err != (ErrDivisionByZero{2, code.Op}) {
+			t.Errorf("Expected division by zero at pc 2, but got %d, %v", result, err)
+		}
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    []Code
+		want    error
+		message string
+	}{
+		{"empty program", []Code{}, ErrEmptyProgram, "vm: empty program"},
+		{"underflow", []Code{NewPushCode(1), NewPlusCode()}, ErrStackUnderflow{1, PLUS}, "vm: stack underflow at pc 1 (PLUS)"},
+		{"neg underflow", []Code{NewNegCode()}, ErrStackUnderflow{0, NEG}, "vm: stack underflow at pc 0 (NEG)"},
+		{"division by zero", []Code{NewPushCode(1), NewPushCode(0), NewModCode()}, ErrDivisionByZero{2, MOD}, "vm: division by zero at pc 2 (MOD)"},
+		{"unknown opcode", []Code{NewPushCode(1), {Op: 42}}, ErrUnknownOpCode{1, 42}, "vm: unknown opcode 42 at pc 1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewVM(tt.code).Run()
+			if err != tt.want {
+				t.Fatalf("Run() error = %v, want %v", err, tt.want)
+			}
+			if err.Error() != tt.message {
+				t.Errorf("Run() error message = %q, want %q", err.Error(), tt.message)
+			}
+		})
+	}
+}
+
+func TestVariables(t *testing.T) {
+	// price * qty - discount
+	exp := ast.SubExp{
+		Left:  ast.MultExp{Left: ast.VarExp{Name: "price"}, Right: ast.VarExp{Name: "qty"}},
+		Right: ast.VarExp{Name: "discount"},
+	}
+	prog, err := Compile(exp)
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	// the variables are resolved to slots
+	want := []Code{NewLoadSlotCode(0), NewLoadSlotCode(1), NewMultiplyCode(), NewLoadSlotCode(2), NewSubCode()}
+	if !reflect.DeepEqual(prog.Code(), want) {
+		t.Errorf("Compile = %v, want %v", prog.Code(), want)
+	}
+	if vars := []string{"price", "qty", "discount"}; !reflect.DeepEqual(prog.Vars(), vars) {
+		t.Errorf("Vars = %v, want %v", prog.Vars(), vars)
+	}
+
+	env := ast.Env{"price": 3, "qty": 4, "discount": 2}
+	if result, err := prog.RunEnv(env); err != nil || result != 10 {
+		t.Errorf("RunEnv = %d, %v, want 10, nil", result, err)
+	}
+	if result, err := (VM{Program: prog, Env: env}).Run(); err != nil || result != 10 {
+		t.Errorf("VM.Run = %d, %v, want 10, nil", result, err)
+	}
+	// the result is the same as the one of the ast
+	if result, _ := prog.RunEnv(env); int(result) != exp.Eval(env) {
+		t.Errorf("RunEnv = %d, Eval = %d", result, exp.Eval(env))
+	}
+
+	_, err = prog.RunEnv(ast.Env{"price": 3})
+	if want := (ast.UnboundVariableError{Name: "qty"}); err != want {
+		t.Errorf("RunEnv error = %v, want %v", err, want)
+	}
+	if _, err := prog.Run(); err != (ast.UnboundVariableError{Name: "price"}) {
+		t.Errorf("Run error = %v, want unbound variable price", err)
+	}
+}
+
+func TestSlots(t *testing.T) {
+	// $0 * $1 - $0
+	code := []Code{NewLoadSlotCode(0), NewLoadSlotCode(1), NewMultiplyCode(), NewLoadSlotCode(0), NewSubCode()}
+	prog := NewVM(code)
+	if result, err := prog.RunSlots([]Value{3, 4}); err != nil || result != 9 {
+		t.Errorf("RunSlots = %d, %v, want 9, nil", result, err)
+	}
+	prog.Slots = []Value{5, 2}
+	if result, err := prog.Run(); err != nil || result != 5 {
+		t.Errorf("VM.Run = %d, %v, want 5, nil", result, err)
+	}
+	_, err := prog.RunSlots([]Value{3})
+	if want := (ErrSlotOutOfRange{1, 1}); err != want {
+		t.Errorf("RunSlots error = %v, want %v", err, want)
+	}
+	if want := "vm: slot 1 out of range at pc 1"; err.Error() != want {
+		t.Errorf("RunSlots error message = %q, want %q", err.Error(), want)
+	}
+}
+
+func TestLet(t *testing.T) {
+	x := ast.VarExp{Name: "x"}
+	tests := []struct {
+		name   string
+		exp    ast.Exp
+		env    ast.Env
+		want   Value
+		locals int
+	}{
+		{"square", ast.LetExp{Name: "x", Value: ast.PlusExp{Left: ast.IntExp{Val: 1}, Right: ast.IntExp{Val: 2}}, Body: ast.MultExp{Left: x, Right: x}}, nil, 9, 1},
+		// the let shadows the variable of the environment only in its body
+		{"shadow", ast.PlusExp{Left: x, Right: ast.LetExp{Name: "x", Value: ast.IntExp{Val: 2}, Body: x}}, ast.Env{"x": 10}, 12, 1},
+		{"own value", ast.LetExp{Name: "x", Value: ast.PlusExp{Left: x, Right: ast.IntExp{Val: 1}}, Body: x}, ast.Env{"x": 10}, 11, 1},
+		// lets which are not nested share their local
+		{"siblings", ast.SubExp{
+			Left:  ast.LetExp{Name: "a", Value: ast.IntExp{Val: 5}, Body: ast.VarExp{Name: "a"}},
+			Right: ast.LetExp{Name: "b", Value: ast.IntExp{Val: 2}, Body: ast.VarExp{Name: "b"}},
+		}, nil, 3, 1},
+		{"nested", ast.LetExp{Name: "x", Value: ast.IntExp{Val: 2}, Body: ast.LetExp{Name: "y", Value: ast.MultExp{Left: x, Right: x}, Body: ast.SubExp{Left: ast.VarExp{Name: "y"}, Right: x}}}, nil, 2, 2},
+		{"inner shadow", ast.LetExp{Name: "x", Value: ast.IntExp{Val: 1}, Body: ast.PlusExp{Left: ast.LetExp{Name: "x", Value: ast.IntExp{Val: 2}, Body: x}, Right: x}}, nil, 3, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := Compile(tt.exp)
+			if err != nil {
+				t.Fatalf("Compile returned error: %v", err)
+			}
+			if prog.locals != tt.locals {
+				t.Errorf("Compile(%s) has %d locals, want %d", tt.exp.Pretty(), prog.locals, tt.locals)
+			}
+			if got, err := prog.Eval(tt.env); err != nil || got != tt.want {
+				t.Errorf("Eval = %d, %v, want %d", got, err, tt.want)
+			}
+			if got := tt.exp.Eval(tt.env); Value(got) != tt.want {
+				t.Errorf("ast Eval = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLetComputesValueOnce(t *testing.T) {
+	// let x = 1 + 2 in x * x
+	exp := ast.LetExp{
+		Name:  "x",
+		Value: ast.PlusExp{Left: ast.IntExp{Val: 1}, Right: ast.IntExp{Val: 2}},
+		Body:  ast.MultExp{Left: ast.VarExp{Name: "x"}, Right: ast.VarExp{Name: "x"}},
+	}
+	prog, err := Compile(exp)
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	want := []Code{
+		NewPushCode(1), NewPushCode(2), NewPlusCode(), NewStoreLocalCode(0),
+		NewLoadLocalCode(0), NewLoadLocalCode(0), NewMultiplyCode(),
+	}
+	if !reflect.DeepEqual(prog.Code(), want) {
+		t.Errorf("Compile = %v, want %v", prog.Code(), want)
+	}
+	if len(prog.Vars()) != 0 {
+		t.Errorf("Vars = %v, want none", prog.Vars())
+	}
+	// the local is the bottom value of the stack
+	if prog.maxStack != 3 {
+		t.Errorf("maxStack = %d, want 3", prog.maxStack)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { prog.Run() }); allocs != 0 {
+		t.Errorf("Run allocates %v times per run, want 0", allocs)
+	}
+}
+
+func TestConditionals(t *testing.T) {
+	x, one, two := ast.VarExp{Name: "x"}, ast.IntExp{Val: 1}, ast.IntExp{Val: 2}
+	tests := []struct {
+		exp  ast.Exp
+		want Value
+	}{
+		{ast.BoolExp{Val: true}, 1},
+		{ast.EqExp{Left: x, Right: two}, 0},
+		{ast.NeqExp{Left: x, Right: two}, 1},
+		{ast.LtExp{Left: x, Right: two}, 0},
+		{ast.LeExp{Left: x, Right: ast.IntExp{Val: 3}}, 1},
+		{ast.GtExp{Left: x, Right: two}, 1},
+		{ast.GeExp{Left: x, Right: ast.IntExp{Val: 4}}, 0},
+		{ast.NotExp{Exp: ast.GtExp{Left: x, Right: two}}, 0},
+		{ast.NotExp{Exp: ast.BoolExp{Val: false}}, 1},
+		// a bool is 1 for true and 0 for false
+		{ast.AndExp{Left: ast.GtExp{Left: x, Right: two}, Right: ast.BoolExp{Val: true}}, 1},
+		{ast.AndExp{Left: ast.GtExp{Left: x, Right: two}, Right: ast.BoolExp{Val: false}}, 0},
+		{ast.OrExp{Left: ast.BoolExp{Val: false}, Right: ast.NeqExp{Left: x, Right: two}}, 1},
+		{ast.OrExp{Left: ast.BoolExp{Val: false}, Right: ast.BoolExp{Val: false}}, 0},
+		{ast.EqExp{Left: ast.LtExp{Left: x, Right: two}, Right: ast.BoolExp{Val: false}}, 1},
+		{ast.IfExp{Cond: ast.GtExp{Left: x, Right: two}, Then: x, Else: two}, 3},
+		{ast.IfExp{Cond: ast.LtExp{Left: x, Right: two}, Then: x, Else: two}, 2},
+		// if x > 2 then (if x > 5 then 1 else 2) else 3
+		{ast.IfExp{
+			Cond: ast.GtExp{Left: x, Right: two},
+			Then: ast.IfExp{Cond: ast.GtExp{Left: x, Right: ast.IntExp{Val: 5}}, Then: one, Else: two},
+			Else: ast.IntExp{Val: 3},
+		}, 2},
+		// the if is an operand like any other expression
+		{ast.PlusExp{Left: one, Right: ast.IfExp{Cond: ast.GtExp{Left: x, Right: one}, Then: ast.LetExp{Name: "y", Value: two, Body: ast.VarExp{Name: "y"}}, Else: one}}, 3},
+	}
+
+	env := ast.Env{"x": 3}
+	for _, tt := range tests {
+		t.Run(tt.exp.Pretty(), func(t *testing.T) {
+			prog, err := Compile(tt.exp)
+			if err != nil {
+				t.Fatalf("Compile returned error: %v", err)
+			}
+			if got, err := prog.Eval(env); err != nil || got != tt.want {
+				t.Errorf("Eval = %d, %v, want %d", got, err, tt.want)
+			}
+			if got := tt.exp.Eval(env); Value(got) != tt.want {
+				t.Errorf("ast Eval = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIfCode(t *testing.T) {
+	// if x == 1 then 1 else 2
+	exp := ast.IfExp{Cond: ast.EqExp{Left: ast.VarExp{Name: "x"}, Right: ast.IntExp{Val: 1}}, Then: ast.IntExp{Val: 1}, Else: ast.IntExp{Val: 2}}
+	prog, err := Compile(exp)
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	want := []Code{
+		NewLoadSlotCode(0), NewPushCode(1), NewEqCode(), NewJumpIfFalseCode(6),
+		NewPushCode(1), NewJumpCode(7),
+		NewPushCode(2),
+	}
+	if !reflect.DeepEqual(prog.Code(), want) {
+		t.Errorf("Compile = %v, want %v", prog.Code(), want)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { prog.EvalSlots([]Value{1}) }); allocs != 0 {
+		t.Errorf("EvalSlots allocates %v times per run, want 0", allocs)
+	}
+}
+
+func TestShortCircuit(t *testing.T) {
+	// the right operand and the branch which is not taken are not run,
+	// so the division by zero does not fail
+	fail := ast.DivExp{Left: ast.IntExp{Val: 1}, Right: ast.IntExp{Val: 0}}
+	failBool := ast.EqExp{Left: fail, Right: ast.IntExp{Val: 0}}
+	tests := []struct {
+		exp  ast.Exp
+		want Value
+	}{
+		{ast.AndExp{Left: ast.BoolExp{Val: false}, Right: failBool}, 0},
+		{ast.OrExp{Left: ast.BoolExp{Val: true}, Right: failBool}, 1},
+		{ast.IfExp{Cond: ast.BoolExp{Val: true}, Then: ast.IntExp{Val: 5}, Else: fail}, 5},
+		{ast.IfExp{Cond: ast.BoolExp{Val: false}, Then: fail, Else: ast.IntExp{Val: 6}}, 6},
+	}
+	for _, tt := range tests {
+		prog, err := Compile(tt.exp)
+		if err != nil {
+			t.Fatalf("Compile returned error: %v", err)
+		}
+		if got, err := prog.Run(); err != nil || got != tt.want {
+			t.Errorf("Run(%s) = %d, %v, want %d", tt.exp.Pretty(), got, err, tt.want)
+		}
+	}
+	prog, _ := Compile(ast.AndExp{Left: ast.BoolExp{Val: true}, Right: failBool})
+	if _, err := prog.Run(); err != (ErrDivisionByZero{4, DIV}) {
+		t.Errorf("Run error = %v, want %v", err, ErrDivisionByZero{4, DIV})
+	}
+}
+
+// fn fib(n) = if n < 2 then n else fib(n-1) + fib(n-2) in fib(arg)
+func fibExp(arg ast.Exp) ast.Exp {
+	n := ast.VarExp{Name: "n"}
+	call := func(k int) ast.Exp {
+		return ast.CallExp{Name: "fib", Args: []ast.Exp{ast.SubExp{Left: n, Right: ast.IntExp{Val: k}}}}
+	}
+	return ast.FuncExp{
+		Name:   "fib",
+		Params: []string{"n"},
+		Body:   ast.IfExp{Cond: ast.LtExp{Left: n, Right: ast.IntExp{Val: 2}}, Then: n, Else: ast.PlusExp{Left: call(1), Right: call(2)}},
+		In:     ast.CallExp{Name: "fib", Args: []ast.Exp{arg}},
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	x, a, b := ast.VarExp{Name: "x"}, ast.VarExp{Name: "a"}, ast.VarExp{Name: "b"}
+	call := func(name string, args ...ast.Exp) ast.Exp { return ast.CallExp{Name: name, Args: args} }
+	tests := []struct {
+		exp  ast.Exp
+		want Value
+	}{
+		{fibExp(x), 55},
+		{fibExp(ast.IntExp{Val: 20}), 6765},
+		{ast.FuncExp{Name: "sub", Params: []string{"a", "b"}, Body: ast.SubExp{Left: a, Right: b}, In: call("sub", x, ast.IntExp{Val: 3})}, 7},
+		{ast.FuncExp{Name: "one", Body: ast.IntExp{Val: 1}, In: ast.PlusExp{Left: call("one"), Right: call("one")}}, 2},
+		// the body loads the variables of the program
+		{ast.FuncExp{Name: "addX", Params: []string{"a"}, Body: ast.PlusExp{Left: a, Right: x}, In: call("addX", ast.IntExp{Val: 1})}, 11},
+		// the lets of a body are locals of its frame
+		{ast.FuncExp{
+			Name:   "square",
+			Params: []string{"a"},
+			Body:   ast.LetExp{Name: "b", Value: ast.MultExp{Left: a, Right: a}, Body: b},
+			In:     ast.LetExp{Name: "a", Value: ast.IntExp{Val: 3}, Body: ast.PlusExp{Left: call("square", a), Right: a}},
+		}, 12},
+		// the inner definition hides the outer function
+		{ast.FuncExp{Name: "f", Params: []string{"a"}, Body: ast.IntExp{Val: 1},
+			In: ast.FuncExp{Name: "f", Params: []string{"a"}, Body: ast.PlusExp{Left: a, Right: ast.IntExp{Val: 1}}, In: call("f", ast.IntExp{Val: 5})}}, 6},
+		// a body calls the functions around it and the ones defined in it
+		{ast.FuncExp{Name: "inc", Params: []string{"a"}, Body: ast.PlusExp{Left: a, Right: ast.IntExp{Val: 1}},
+			In: ast.FuncExp{Name: "twice", Params: []string{"a"}, Body: call("inc", call("inc", a)), In: call("twice", x)}}, 12},
+		{ast.FuncExp{Name: "outer", Params: []string{"a"},
+			Body: ast.FuncExp{Name: "inner", Params: []string{"b"}, Body: ast.MultExp{Left: b, Right: b}, In: call("inner", ast.PlusExp{Left: a, Right: ast.IntExp{Val: 1}})},
+			In:   call("outer", x)}, 121},
+	}
+
+	env := ast.Env{"x": 10}
+	for _, tt := range tests {
+		t.Run(tt.exp.Pretty(), func(t *testing.T) {
+			prog, err := Compile(tt.exp)
+			if err != nil {
+				t.Fatalf("Compile returned error: %v", err)
+			}
+			if got, err := prog.Eval(env); err != nil || got != tt.want {
+				t.Errorf("Eval = %d, %v, want %d", got, err, tt.want)
+			}
+			if got, err := ast.Evaluate(tt.exp, env); err != nil || Value(got) != tt.want {
+				t.Errorf("ast Evaluate = %d, %v, want %d", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFunctionCode(t *testing.T) {
+	// fn double(a) = a * 2 in double(3) + 1
+	a := ast.VarExp{Name: "a"}
+	exp := ast.FuncExp{
+		Name:   "double",
+		Params: []string{"a"},
+		Body:   ast.MultExp{Left: a, Right: ast.IntExp{Val: 2}},
+		In:     ast.PlusExp{Left: ast.CallExp{Name: "double", Args: []ast.Exp{ast.IntExp{Val: 3}}}, Right: ast.IntExp{Val: 1}},
+	}
+	prog, err := Compile(exp)
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	want := []Code{
+		NewPushCode(3), NewCallCode(5), NewPushCode(1), NewPlusCode(), NewRetCode(),
+		NewFuncCode("double", 1), NewLoadLocalCode(0), NewPushCode(2), NewMultiplyCode(), NewRetCode(),
+	}
+	if !reflect.DeepEqual(prog.Code(), want) {
+		t.Errorf("Compile = %v, want %v", prog.Code(), want)
+	}
+	if got, err := prog.Run(); err != nil || got != 7 {
+		t.Errorf("Run = %d, %v, want 7", got, err)
+	}
+	// the frames are on the stack, so calls do not allocate either
+	if allocs := testing.AllocsPerRun(100, func() { prog.Run() }); allocs != 0 {
+		t.Errorf("Run allocates %v times per run, want 0", allocs)
+	}
+}
+
+func TestCompileFunctionErrors(t *testing.T) {
+	a := ast.VarExp{Name: "a"}
+	tests := []struct {
+		exp  ast.Exp
+		want string
+	}{
+		{ast.CallExp{Name: "f"}, `vm: undefined function "f"`},
+		// a function is not in scope of the expressions around its definition
+		{ast.PlusExp{Left: ast.FuncExp{Name: "f", Body: ast.IntExp{Val: 1}, In: ast.IntExp{Val: 2}}, Right: ast.CallExp{Name: "f"}}, `vm: undefined function "f"`},
+		{ast.FuncExp{Name: "f", Params: []string{"a"}, Body: a, In: ast.CallExp{Name: "f"}}, `vm: function "f" expects 1 arguments, got 0`},
+		{ast.FuncExp{Name: "f", Body: ast.CallExp{Name: "g"}, In: ast.CallExp{Name: "f"}}, `vm: undefined function "g"`},
+	}
+
+	for _, tt := range tests {
+		if _, err := Compile(tt.exp); err == nil || err.Error() != tt.want {
+			t.Errorf("Compile(%s) error = %v, want %q", tt.exp.Pretty(), err, tt.want)
+		}
+	}
+	_, err := Compile(ast.CallExp{Name: "f"})
+	if !errors.Is(err, ast.UndefinedFunctionError{Name: "f"}) {
+		t.Errorf("Compile error = %v, want to wrap ast.UndefinedFunctionError", err)
+	}
+}
+
+func TestCompileCapturedLocals(t *testing.T) {
+	a, b, n, y := ast.VarExp{Name: "a"}, ast.VarExp{Name: "b"}, ast.VarExp{Name: "n"}, ast.VarExp{Name: "y"}
+	call := func(name string, args ...ast.Exp) ast.Exp { return ast.CallExp{Name: name, Args: args} }
+	let := func(name string, val int, body ast.Exp) ast.Exp {
+		return ast.LetExp{Name: name, Value: ast.IntExp{Val: val}, Body: body}
+	}
+	tests := []ast.Exp{
+		// let rate = 2 in fn f(y) = y * rate in f(3)
+		let("rate", 2, ast.FuncExp{Name: "f", Params: []string{"y"}, Body: ast.MultExp{Left: y, Right: ast.VarExp{Name: "rate"}}, In: call("f", ast.IntExp{Val: 3})}),
+		// let y = 4 in fn g(a) = (\b -> b + y)(a) in g(1)
+		let("y", 4, ast.FuncExp{Name: "g", Params: []string{"a"},
+			Body: ast.AppExp{Fn: ast.LambdaExp{Params: []string{"b"}, Body: ast.PlusExp{Left: b, Right: y}}, Args: []ast.Exp{a}}, In: call("g", ast.IntExp{Val: 1})}),
+		// a let between the definition and the call does not hide the captured a
+		let("a", 1, ast.FuncExp{Name: "f", Body: a, In: let("a", 2, ast.PlusExp{Left: call("f"), Right: a})}),
+		// f passes a of the let on to h, although its parameter hides it
+		let("a", 1, ast.FuncExp{Name: "h", Body: a,
+			In: ast.FuncExp{Name: "f", Params: []string{"a"}, Body: ast.PlusExp{Left: call("h"), Right: a}, In: call("f", ast.IntExp{Val: 5})}}),
+		// a recursive function passes the captured values to itself
+		let("k", 3, ast.FuncExp{Name: "sum", Params: []string{"n"},
+			Body: ast.IfExp{Cond: ast.EqExp{Left: n, Right: ast.IntExp{Val: 0}}, Then: ast.IntExp{Val: 0},
+				Else: ast.PlusExp{Left: ast.VarExp{Name: "k"}, Right: call("sum", ast.SubExp{Left: n, Right: ast.IntExp{Val: 1}})}},
+			In: call("sum", ast.IntExp{Val: 4})}),
+		// a function in a lambda captures the parameter of the lambda
+		ast.AppExp{Fn: ast.LambdaExp{Params: []string{"a"}, Body: ast.FuncExp{Name: "g", Body: a, In: call("g")}}, Args: []ast.Exp{ast.IntExp{Val: 7}}},
+		// a lambda captures the values of the functions it calls
+		let("a", 10, ast.FuncExp{Name: "h", Params: []string{"n"}, Body: ast.PlusExp{Left: n, Right: a},
+			In: ast.FuncExp{Name: "f", Params: []string{"b"}, Body: ast.AppExp{Fn: ast.LambdaExp{Params: []string{"n"}, Body: call("h", n)}, Args: []ast.Exp{b}},
+				In: call("f", ast.IntExp{Val: 1})}}),
+		// a function defined in h calls h
+		let("a", 1, ast.FuncExp{Name: "h", Params: []string{"n"},
+			Body: ast.IfExp{Cond: ast.EqExp{Left: n, Right: ast.IntExp{Val: 0}}, Then: a,
+				Else: ast.FuncExp{Name: "g", Params: []string{"b"}, Body: call("h", b), In: call("g", ast.SubExp{Left: n, Right: ast.IntExp{Val: 1}})}},
+			In: call("h", ast.IntExp{Val: 3})}),
+	}
+
+	for _, exp := range tests {
+		want, err := ast.Evaluate(exp)
+		if err != nil {
+			t.Fatalf("Evaluate(%s) returned error: %v", exp.Pretty(), err)
+		}
+		prog, err := Compile(exp)
+		if err != nil {
+			t.Errorf("Compile(%s) returned error: %v", exp.Pretty(), err)
+			continue
+		}
+		if got, err := prog.Run(); err != nil || got != Value(want) {
+			t.Errorf("Run(%s) = %d, %v, want %d like the ast", exp.Pretty(), got, err, want)
+		}
+	}
+
+	// the captured value is passed after the arguments
+	prog, err := Compile(tests[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Code{
+		NewPushCode(2), NewStoreLocalCode(0), NewPushCode(3), NewLoadLocalCode(0), NewCallCode(6), NewRetCode(),
+		NewFuncCode("f", 2), NewLoadLocalCode(0), NewLoadLocalCode(1), NewMultiplyCode(), NewRetCode(),
+	}
+	if !reflect.DeepEqual(prog.Code(), want) {
+		t.Errorf("Compile = %v, want %v", prog.Code(), want)
+	}
+}
+
+func TestCallDepth(t *testing.T) {
+	// fn loop(a) = 1 + loop(a + 1) in loop(0), the call is not in tail position
+	a := ast.VarExp{Name: "a"}
+	loop := ast.FuncExp{
+		Name:   "loop",
+		Params: []string{"a"},
+		Body:   ast.PlusExp{Left: ast.IntExp{Val: 1}, Right: ast.CallExp{Name: "loop", Args: []ast.Exp{ast.PlusExp{Left: a, Right: ast.IntExp{Val: 1}}}}},
+		In:     ast.CallExp{Name: "loop", Args: []ast.Exp{ast.IntExp{Val: 0}}},
+	}
+	prog, err := Compile(loop)
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	_, err = prog.Run()
+	var depth ErrCallDepth
+	if !errors.As(err, &depth) || depth.Depth != DefaultMaxCallDepth {
+		t.Fatalf("Run error = %v, want ErrCallDepth with depth %d", err, DefaultMaxCallDepth)
+	}
+	// the same error as the one of the ast
+	if !errors.Is(err, ast.ErrCallDepth) {
+		t.Errorf("errors.Is(%v, ast.ErrCallDepth) = false", err)
+	}
+
+	// the limit can be set per vm and per run
+	v := VM{Program: prog, MaxCallDepth: 10}
+	if _, err := v.Run(); !errors.As(err, &depth) || depth.Depth != 10 {
+		t.Errorf("Run error = %v, want ErrCallDepth with depth 10", err)
+	}
+	if _, err := prog.RunContext(context.Background(), RunOptions{MaxCallDepth: 20}); !errors.As(err, &depth) || depth.Depth != 20 {
+		t.Errorf("RunContext error = %v, want ErrCallDepth with depth 20", err)
+	}
+
+	// fib(15) needs 15 nested calls
+	fib, err := Compile(fibExp(ast.IntExp{Val: 15}))
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	if got, err := (VM{Program: fib, MaxCallDepth: 15}).Run(); err != nil || got != 610 {
+		t.Errorf("Run = %d, %v, want 610", got, err)
+	}
+	if _, err := (VM{Program: fib, MaxCallDepth: 14}).Run(); !errors.As(err, &depth) {
+		t.Errorf("Run error = %v, want ErrCallDepth", err)
+	}
+}
+
+func TestTraceError(t *testing.T) {
+	// fn div(a) = 10 / a in fn f(a) = div(a - 1) in 1 + f(x)
+	a := ast.VarExp{Name: "a"}
+	exp := ast.FuncExp{
+		Name:   "div",
+		Params: []string{"a"},
+		Body:   ast.DivExp{Left: ast.IntExp{Val: 10}, Right: a},
+		In: ast.FuncExp{
+			Name:   "f",
+			Params: []string{"a"},
+			// the negation keeps the call out of tail position, so f stays in the trace
+			Body: ast.NegExp{Exp: ast.CallExp{Name: "div", Args: []ast.Exp{ast.SubExp{Left: a, Right: ast.IntExp{Val: 1}}}}},
+			In:   ast.PlusExp{Left: ast.IntExp{Val: 1}, Right: ast.CallExp{Name: "f", Args: []ast.Exp{ast.VarExp{Name: "x"}}}},
+		},
+	}
+	prog, err := Compile(exp)
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	if got, err := prog.Eval(ast.Env{"x": 3}); err != nil || got != -4 {
+		t.Errorf("Eval = %d, %v, want -4", got, err)
+	}
+
+	// push 1; load_slot 0; call f; add; ret
+	// div: func div 1; push 10; load_local 0; div; ret
+	// f: func f 1; load_local 0; push 1; sub; call div; neg; ret
+	_, err = prog.Eval(ast.Env{"x": 1})
+	want := TraceError{
+		Err:    ErrDivisionByZero{8, DIV},
+		Frames: []Frame{{"div", 8}, {"f", 14}, {"<main>", 2}},
+	}
+	if !reflect.DeepEqual(err, want) {
+		t.Fatalf("Eval error = %#v, want %#v", err, want)
+	}
+	if msg := "vm: division by zero at pc 8 (DIV) in div at pc 8, called from f at pc 14, called from <main> at pc 2"; err.Error() != msg {
+		t.Errorf("Error() = %q, want %q", err.Error(), msg)
+	}
+	// the error of the instruction is wrapped
+	var div ErrDivisionByZero
+	if !errors.As(err, &div) || div.Pc != 8 {
+		t.Errorf("errors.As(%v) = %v, want ErrDivisionByZero at pc 8", err, div)
+	}
+	// the trace of a runaway recursion is shortened
+	many := make([]Frame, 100)
+	for i := range many {
+		many[i] = Frame{"loop", 3}
+	}
+	many[99] = Frame{"<main>", 1}
+	msg := TraceError{Err: ErrCallDepth{3, 99}, Frames: many}.Error()
+	if want := ", ... 89 more calls, called from <main> at pc 1"; !strings.HasSuffix(msg, want) || strings.Count(msg, "loop") != 10 {
+		t.Errorf("Error() = %q, want 10 frames of loop and the suffix %q", msg, want)
+	}
+}
+
+// fn count(n, acc) = if n == 0 then acc else count(n - 1, acc + n) in count(arg, 0)
+func countExp(arg ast.Exp) ast.Exp {
+	n, acc := ast.VarExp{Name: "n"}, ast.VarExp{Name: "acc"}
+	return ast.FuncExp{
+		Name:   "count",
+		Params: []string{"n", "acc"},
+		Body: ast.IfExp{
+			Cond: ast.EqExp{Left: n, Right: ast.IntExp{Val: 0}},
+			Then: acc,
+			Else: ast.CallExp{Name: "count", Args: []ast.Exp{ast.SubExp{Left: n, Right: ast.IntExp{Val: 1}}, ast.PlusExp{Left: acc, Right: n}}},
+		},
+		In: ast.CallExp{Name: "count", Args: []ast.Exp{arg, ast.IntExp{Val: 0}}},
+	}
+}
+
+func TestTailCallCode(t *testing.T) {
+	prog, err := Compile(countExp(ast.VarExp{Name: "x"}))
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	// the call of the main code is not in tail position, the recursive
+	// call is, the jump and return after it are no longer reached
+	want := []Code{
+		NewLoadSlotCode(0), NewPushCode(0), NewCallCode(4), NewRetCode(),
+		NewFuncCode("count", 2), NewLoadLocalCode(0), NewPushCode(0), NewEqCode(), NewJumpIfFalseCode(11), NewLoadLocalCode(1), NewJumpCode(18),
+		NewLoadLocalCode(0), NewPushCode(1), NewSubCode(), NewLoadLocalCode(1), NewLoadLocalCode(0), NewPlusCode(), NewTailCallCode(4), NewRetCode(),
+	}
+	if !reflect.DeepEqual(prog.Code(), want) {
+		t.Errorf("Compile =\n%s\nwant\n%s", Disassemble(prog.Code()), Disassemble(want))
+	}
+}
+
+func TestTailCalls(t *testing.T) {
+	// a countdown from 10,000,000 runs in the frame of the first call,
+	// so it needs neither more calls nor more stack: the frame has the
+	// two arguments and the saved registers and count pushes at most
+	// three values
+	prog, err := Compile(countExp(ast.VarExp{Name: "x"}))
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	v := VM{Program: prog, Slots: []Value{10_000_000}}
+	got, err := v.RunContext(context.Background(), RunOptions{MaxStack: 9, MaxCallDepth: 1})
+	if err != nil || got != 50_000_005_000_000 {
+		t.Fatalf("RunContext = %d, %v, want 50000005000000", got, err)
+	}
+
+	a, b, f := ast.VarExp{Name: "a"}, ast.VarExp{Name: "b"}, ast.CallExp{Name: "f", Args: []ast.Exp{ast.VarExp{Name: "x"}}}
+	tests := []struct {
+		name string
+		exp  ast.Exp
+		want Value
+	}{
+		// a lambda calls a function in tail position, the frame of the
+		// closure becomes the frame of the function
+		{"from a lambda", ast.AppExp{Fn: ast.LambdaExp{Params: []string{"a"}, Body: countExp(a)}, Args: []ast.Exp{ast.VarExp{Name: "x"}}}, 15},
+		// fn g(a) = let b = a * 2 in b + 1 in fn f(a) = g(a + 1) in f(x)
+		{"more locals", ast.FuncExp{
+			Name: "g", Params: []string{"a"}, Body: ast.LetExp{Name: "b", Value: ast.MultExp{Left: a, Right: ast.IntExp{Val: 2}}, Body: ast.PlusExp{Left: b, Right: ast.IntExp{Val: 1}}},
+			In: ast.FuncExp{Name: "f", Params: []string{"a"}, Body: ast.CallExp{Name: "g", Args: []ast.Exp{ast.PlusExp{Left: a, Right: ast.IntExp{Val: 1}}}}, In: f},
+		}, 13},
+		// fn g(a, b) = a - b in fn f(a) = let b = 1 in g(b, a) in f(x)
+		{"more arguments", ast.FuncExp{
+			Name: "g", Params: []string{"a", "b"}, Body: ast.SubExp{Left: a, Right: b},
+			In: ast.FuncExp{Name: "f", Params: []string{"a"}, Body: ast.LetExp{Name: "b", Value: ast.IntExp{Val: 1}, Body: ast.CallExp{Name: "g", Args: []ast.Exp{b, a}}}, In: f},
+		}, -4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := Compile(tt.exp)
+			if err != nil {
+				t.Fatalf("Compile returned error: %v", err)
+			}
+			if got, err := prog.Eval(ast.Env{"x": 5}); err != nil || got != tt.want {
+				t.Errorf("Eval = %d, %v, want %d", got, err, tt.want)
+			}
+			if got := tt.exp.Eval(ast.Env{"x": 5}); Value(got) != tt.want {
+				t.Errorf("ast Eval = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTailCallTrace(t *testing.T) {
+	// fn div(a) = 10 / a in fn f(a) = div(a - 1) in 1 + f(x)
+	a := ast.VarExp{Name: "a"}
+	prog, err := Compile(ast.FuncExp{
+		Name: "div", Params: []string{"a"}, Body: ast.DivExp{Left: ast.IntExp{Val: 10}, Right: a},
+		In: ast.FuncExp{
+			Name: "f", Params: []string{"a"}, Body: ast.CallExp{Name: "div", Args: []ast.Exp{ast.SubExp{Left: a, Right: ast.IntExp{Val: 1}}}},
+			In: ast.PlusExp{Left: ast.IntExp{Val: 1}, Right: ast.CallExp{Name: "f", Args: []ast.Exp{ast.VarExp{Name: "x"}}}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	// f made a tail call, so div returns to the main code directly
+	_, err = prog.Eval(ast.Env{"x": 1})
+	want := TraceError{Err: ErrDivisionByZero{8, DIV}, Frames: []Frame{{"div", 8}, {"<main>", 2}}}
+	if !reflect.DeepEqual(err, want) {
+		t.Errorf("Eval error = %#v, want %#v", err, want)
+	}
+}
+
+func TestClosures(t *testing.T) {
+	x, y, a, b, f := ast.VarExp{Name: "x"}, ast.VarExp{Name: "y"}, ast.VarExp{Name: "a"}, ast.VarExp{Name: "b"}, ast.VarExp{Name: "f"}
+	one := ast.IntExp{Val: 1}
+	call := func(name string, args ...ast.Exp) ast.Exp { return ast.CallExp{Name: name, Args: args} }
+	lambda := func(body ast.Exp, params ...string) ast.LambdaExp { return ast.LambdaExp{Params: params, Body: body} }
+	inc := lambda(ast.PlusExp{Left: a, Right: one}, "a")
+	tests := []struct {
+		exp  ast.Exp
+		want Value
+	}{
+		{ast.AppExp{Fn: inc, Args: []ast.Exp{x}}, 11},
+		{ast.AppExp{Fn: lambda(ast.IntExp{Val: 7})}, 7},
+		{ast.LetExp{Name: "f", Value: inc, Body: call("f", call("f", x))}, 12},
+		// the lambda captures the let and loads the slot
+		{ast.LetExp{Name: "y", Value: ast.IntExp{Val: 5}, Body: ast.AppExp{Fn: lambda(ast.MultExp{Left: y, Right: x}, "a"), Args: []ast.Exp{one}}}, 50},
+		// the captured value is copied when the closure is made
+		{ast.LetExp{Name: "y", Value: ast.IntExp{Val: 5}, Body: ast.LetExp{Name: "f", Value: lambda(ast.PlusExp{Left: a, Right: y}, "a"),
+			Body: ast.LetExp{Name: "y", Value: ast.IntExp{Val: 100}, Body: call("f", y)}}}, 105},
+		// a closure returned by a function keeps the parameter
+		{ast.FuncExp{Name: "adder", Params: []string{"n"}, Body: lambda(ast.PlusExp{Left: a, Right: ast.VarExp{Name: "n"}}, "a"),
+			In: ast.LetExp{Name: "add3", Value: call("adder", ast.IntExp{Val: 3}), Body: call("add3", x)}}, 13},
+		// a nested lambda captures a value the outer lambda captured
+		{ast.LetExp{Name: "y", Value: ast.IntExp{Val: 2}, Body: ast.AppExp{
+			Fn:   ast.AppExp{Fn: lambda(lambda(ast.SubExp{Left: ast.MultExp{Left: a, Right: b}, Right: y}, "b"), "a"), Args: []ast.Exp{x}},
+			Args: []ast.Exp{ast.IntExp{Val: 3}}}}, 28},
+		// a closure passed to a function
+		{ast.FuncExp{Name: "twice", Params: []string{"f", "a"}, Body: call("f", call("f", a)),
+			In: call("twice", lambda(ast.MultExp{Left: a, Right: ast.IntExp{Val: 3}}, "a"), x)}, 90},
+		{ast.AppExp{Fn: ast.IfExp{Cond: ast.GtExp{Left: x, Right: ast.IntExp{Val: 5}}, Then: inc, Else: lambda(a, "a")}, Args: []ast.Exp{ast.IntExp{Val: 2}}}, 3},
+		// a function hides the variable of the same name
+		{ast.LetExp{Name: "f", Value: inc, Body: ast.FuncExp{Name: "f", Params: []string{"a"}, Body: ast.NegExp{Exp: a}, In: call("f", x)}}, -10},
+		// a lambda calls the functions around it
+		{ast.FuncExp{Name: "double", Params: []string{"a"}, Body: ast.MultExp{Left: a, Right: ast.IntExp{Val: 2}},
+			In: ast.AppExp{Fn: lambda(call("double", ast.PlusExp{Left: a, Right: x}), "a"), Args: []ast.Exp{one}}}, 22},
+		{foldExp(f), 55},
+		// a closure bound by a let is used with arguments of different types
+		{ast.LetExp{Name: "id", Value: lambda(a, "a"), Body: ast.AppExp{Fn: call("id", inc), Args: []ast.Exp{call("id", x)}}}, 11},
+	}
+
+	env := ast.Env{"x": 10}
+	for _, tt := range tests {
+		t.Run(tt.exp.Pretty(), func(t *testing.T) {
+			prog, err := Compile(tt.exp)
+			if err != nil {
+				t.Fatalf("Compile returned error: %v", err)
+			}
+			if got, err := prog.Eval(env); err != nil || got != tt.want {
+				t.Errorf("Eval = %d, %v, want %d", got, err, tt.want)
+			}
+			if got, err := ast.Evaluate(tt.exp, env); err != nil || Value(got) != tt.want {
+				t.Errorf("ast Evaluate = %d, %v, want %d", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// fn fold(f, acc, n) = if n == 0 then acc else fold(f, f(acc, n), n - 1)
+// in fold(\acc n -> acc + n, 0, x)
+func foldExp(f ast.Exp) ast.Exp {
+	acc, n := ast.VarExp{Name: "acc"}, ast.VarExp{Name: "n"}
+	return ast.FuncExp{
+		Name:   "fold",
+		Params: []string{"f", "acc", "n"},
+		Body: ast.IfExp{
+			Cond: ast.EqExp{Left: n, Right: ast.IntExp{Val: 0}},
+			Then: acc,
+			Else: ast.CallExp{Name: "fold", Args: []ast.Exp{f, ast.CallExp{Name: "f", Args: []ast.Exp{acc, n}}, ast.SubExp{Left: n, Right: ast.IntExp{Val: 1}}}},
+		},
+		In: ast.CallExp{Name: "fold", Args: []ast.Exp{ast.LambdaExp{Params: []string{"acc", "n"}, Body: ast.PlusExp{Left: acc, Right: n}}, ast.IntExp{Val: 0}, ast.VarExp{Name: "x"}}},
+	}
+}
+
+func TestClosureCode(t *testing.T) {
+	// let y = 5 in (\a -> a + y)(x)
+	exp := ast.LetExp{Name: "y", Value: ast.IntExp{Val: 5}, Body: ast.AppExp{
+		Fn:   ast.LambdaExp{Params: []string{"a"}, Body: ast.PlusExp{Left: ast.VarExp{Name: "a"}, Right: ast.VarExp{Name: "y"}}},
+		Args: []ast.Exp{ast.VarExp{Name: "x"}},
+	}}
+	prog, err := Compile(exp)
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	want := []Code{
+		NewPushCode(5), NewStoreLocalCode(0), NewLoadLocalCode(0), NewMakeClosureCode(7), NewLoadSlotCode(0), NewCallClosureCode(1), NewRetCode(),
+		NewLambdaCode("lambda", 1, 1), NewLoadLocalCode(0), NewLoadUpvalCode(0), NewPlusCode(), NewRetCode(),
+	}
+	if !reflect.DeepEqual(prog.Code(), want) {
+		t.Errorf("Compile = %v, want %v", prog.Code(), want)
+	}
+	if got, err := prog.Eval(ast.Env{"x": 2}); err != nil || got != 7 {
+		t.Errorf("Eval = %d, %v, want 7", got, err)
+	}
+}
+
+func TestClosureErrors(t *testing.T) {
+	a, f := ast.VarExp{Name: "a"}, ast.VarExp{Name: "f"}
+	id := ast.LambdaExp{Params: []string{"a"}, Body: a}
+	// let f = \f -> f(f) in f(f)
+	omega := ast.LetExp{Name: "f", Value: ast.LambdaExp{Params: []string{"f"}, Body: ast.CallExp{Name: "f", Args: []ast.Exp{f}}},
+		Body: ast.CallExp{Name: "f", Args: []ast.Exp{f}}}
+	// both engines check the expression before it runs
+	tests := []struct {
+		exp  ast.Exp
+		want error
+	}{
+		{ast.AppExp{Fn: id}, ast.ArityError{Name: ast.LambdaName, Want: 1, Got: 0}},
+		{ast.AppExp{Fn: ast.IntExp{Val: 3}}, ast.NotAFunctionError{Exp: "3"}},
+		{ast.LetExp{Name: "f", Value: ast.IntExp{Val: -1}, Body: ast.CallExp{Name: "f"}}, ast.NotAFunctionError{Exp: "f"}},
+		{ast.AppExp{Fn: ast.IntExp{Val: 3}, Args: []ast.Exp{ast.DivExp{Left: ast.IntExp{Val: 1}, Right: ast.IntExp{Val: 0}}}}, ast.NotAFunctionError{Exp: "3"}},
+		// let f = \y -> y + 1 in (0)(5)
+		{ast.LetExp{Name: "f", Value: ast.LambdaExp{Params: []string{"y"}, Body: ast.PlusExp{Left: ast.VarExp{Name: "y"}, Right: ast.IntExp{Val: 1}}},
+			Body: ast.AppExp{Fn: ast.IntExp{Val: 0}, Args: []ast.Exp{ast.IntExp{Val: 5}}}}, ast.NotAFunctionError{Exp: "0"}},
+		{ast.PlusExp{Left: id, Right: ast.IntExp{Val: 1}}, ast.TypeError{Exp: `(\a -> a)`, Want: "int", Got: "fn(a) a"}},
+		// a closure is not a result
+		{id, ast.TypeError{Exp: `(\a -> a)`, Want: "int", Got: "fn(a) a"}},
+		{omega, ast.TypeError{Exp: "f", Want: "fn(a) b", Got: "a"}},
+		// a variable of the host is no closure
+		{ast.CallExp{Name: "x", Args: []ast.Exp{ast.IntExp{Val: 1}}}, ast.UndefinedFunctionError{Name: "x"}},
+	}
+
+	env := ast.Env{"x": 3}
+	for _, tt := range tests {
+		if _, err := Compile(tt.exp); !errors.Is(err, tt.want) {
+			t.Errorf("Compile(%s) error = %v, want %v", tt.exp.Pretty(), err, tt.want)
+		}
+		if _, aerr := ast.Evaluate(tt.exp, env); !errors.Is(aerr, tt.want) {
+			t.Errorf("ast Evaluate(%s) error = %v, want %v", tt.exp.Pretty(), aerr, tt.want)
+		}
+	}
+
+	// fn loop(a) = (\b -> loop(b))(a) in loop(0)
+	loop := ast.FuncExp{Name: "loop", Params: []string{"a"},
+		Body: ast.AppExp{Fn: ast.LambdaExp{Params: []string{"b"}, Body: ast.CallExp{Name: "loop", Args: []ast.Exp{ast.VarExp{Name: "b"}}}}, Args: []ast.Exp{a}},
+		In:   ast.CallExp{Name: "loop", Args: []ast.Exp{ast.IntExp{Val: 0}}}}
+	prog, err := Compile(loop)
+	if err != nil {
+		t.Fatalf("Compile(%s) returned error: %v", loop.Pretty(), err)
+	}
+	if _, err := prog.Run(); !errors.Is(err, ast.ErrCallDepth) {
+		t.Errorf("Run(%s) error = %v, want ErrCallDepth", loop.Pretty(), err)
+	}
+	if _, err := ast.Evaluate(loop); !errors.Is(err, ast.ErrCallDepth) {
+		t.Errorf("ast Evaluate(%s) error = %v, want ErrCallDepth", loop.Pretty(), err)
+	}
+
+	// hand written code is not checked, CALL_CLOSURE checks the closure
+	// and its arity, the trace names the lambda
+	code := []Code{
+		NewMakeClosureCode(4), NewPushCode(1), NewCallClosureCode(1), NewRetCode(),
+		NewLambdaCode("lambda", 1, 0), NewMakeClosureCode(8), NewCallClosureCode(0), NewRetCode(),
+		NewLambdaCode("lambda", 1, 0), NewLoadLocalCode(0), NewRetCode(),
+	}
+	_, err = NewVM(code).Run()
+	msg := `function "lambda" expects 1 arguments, got 0 in lambda at pc 6, called from <main> at pc 2`
+	if err == nil || err.Error() != msg {
+		t.Errorf("Run error = %v, want %q", err, msg)
+	}
+	code = []Code{NewPushCode(3), NewCallClosureCode(0), NewRetCode()}
+	if _, err := NewVM(code).Run(); !errors.Is(err, ast.NotAFunctionError{Exp: "3"}) {
+		t.Errorf("Run error = %v, want NotAFunctionError", err)
+	}
+}
+
+func TestClosureMemory(t *testing.T) {
+	// fn loop(n) = if n == 0 then 0 else (\a -> loop(n - 1))(n) in loop(x)
+	n := ast.VarExp{Name: "n"}
+	exp := ast.FuncExp{
+		Name:   "loop",
+		Params: []string{"n"},
+		Body: ast.IfExp{
+			Cond: ast.EqExp{Left: n, Right: ast.IntExp{Val: 0}},
+			Then: ast.IntExp{Val: 0},
+			Else: ast.AppExp{
+				Fn:   ast.LambdaExp{Params: []string{"a"}, Body: ast.CallExp{Name: "loop", Args: []ast.Exp{ast.SubExp{Left: n, Right: ast.IntExp{Val: 1}}}}},
+				Args: []ast.Exp{n},
+			},
+		},
+		In: ast.CallExp{Name: "loop", Args: []ast.Exp{ast.VarExp{Name: "x"}}},
+	}
+	prog, err := Compile(exp)
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	v := VM{Program: prog, Env: ast.Env{"x": 100}}
+	if got, err := v.Run(); err != nil || got != 0 {
+		t.Fatalf("Run = %d, %v, want 0", got, err)
+	}
+	// every closure keeps its captured value after its call returned
+	_, err = v.RunContext(context.Background(), RunOptions{MaxMemory: 100 * valueSize})
+	if !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("RunContext error = %v, want ErrBudgetExceeded", err)
+	}
+}
+
+func TestClosureMemoryBeforeStack(t *testing.T) {
+	// let f = \ -> 1 in let g = \ -> 2 in fn deep(n) = if n == 0 then 0 else 1 + deep(n - 1) in deep(x)
+	n := ast.VarExp{Name: "n"}
+	deep := ast.FuncExp{
+		Name:   "deep",
+		Params: []string{"n"},
+		Body: ast.IfExp{
+			Cond: ast.EqExp{Left: n, Right: ast.IntExp{Val: 0}},
+			Then: ast.IntExp{Val: 0},
+			Else: ast.PlusExp{Left: ast.IntExp{Val: 1}, Right: ast.CallExp{Name: "deep", Args: []ast.Exp{ast.SubExp{Left: n, Right: ast.IntExp{Val: 1}}}}},
+		},
+		In: ast.CallExp{Name: "deep", Args: []ast.Exp{ast.VarExp{Name: "x"}}},
+	}
+	exp := ast.LetExp{Name: "f", Value: ast.LambdaExp{Body: ast.IntExp{Val: 1}},
+		Body: ast.LetExp{Name: "g", Value: ast.LambdaExp{Body: ast.IntExp{Val: 2}}, Body: deep}}
+	prog, err := Compile(exp)
+	if err != nil {
+		t.Fatalf("Compile returned error: %v", err)
+	}
+	v := VM{Program: prog, Env: ast.Env{"x": 50}}
+	// the smallest stack the run needs
+	stack := 1
+	for ; stack < 1000; stack++ {
+		if _, err := v.RunContext(context.Background(), RunOptions{MaxStack: stack}); err == nil {
+			break
+		}
+	}
+	// the two closures are made before the stack grows and need 4 values
+	_, err = v.RunContext(context.Background(), RunOptions{MaxMemory: (stack + 3) * valueSize})
+	if !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("RunContext with %d values error = %v, want ErrBudgetExceeded", stack+3, err)
+	}
+	if got, err := v.RunContext(context.Background(), RunOptions{MaxMemory: (stack + 4) * valueSize}); err != nil || got != 50 {
+		t.Errorf("RunContext with %d values = %d, %v, want 50, nil", stack+4, got, err)
+	}
+}
+
+func TestVariablesDoNotAllocate(t *testing.T) {
+	load := NewVM([]Code{NewLoadCode("x"), NewLoadCode("y"), NewPlusCode()})
+	loadSlot := NewVM([]Code{NewLoadSlotCode(0), NewLoadSlotCode(1), NewPlusCode()})
+	env, slots := ast.Env{"x": 1, "y": 2}, []Value{1, 2}
+	if allocs := testing.AllocsPerRun(100, func() { load.RunEnv(env) }); allocs != 0 {
+		t.Errorf("RunEnv allocates %v times per run, want 0", allocs)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { loadSlot.RunSlots(slots) }); allocs != 0 {
+		t.Errorf("RunSlots allocates %v times per run, want 0", allocs)
+	}
+}
+
+func TestOptional(t *testing.T) {
+	just := ToOptional(NewVM([]Code{NewPushCode(4)}).Run())
+	if !just.IsJust() || just.Value() != 4 {
+		t.Errorf("Expected Just(4), but got %v", just)
+	}
+	nothing := ToOptional(NewVM([]Code{NewPlusCode()}).Run())
+	if !nothing.IsNothing() {
+		t.Errorf("Expected Nothing, but got %v", nothing)
+	}
+	if val, ok := nothing.Get(); ok || val != 0 {
+		t.Errorf("Expected Get() to return 0, false, but got %d, %v", val, ok)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	tests := []struct {
+		exp  ast.Exp
+		want int
+	}{
+		{ast.IntExp{Val: 1}, 1},
+		{ast.PlusExp{Left: ast.PlusExp{Left: ast.IntExp{Val: 1}, Right: ast.IntExp{Val: 2}}, Right: ast.IntExp{Val: 3}}, 2},
+		{ast.PlusExp{Left: ast.IntExp{Val: 1}, Right: ast.PlusExp{Left: ast.IntExp{Val: 2}, Right: ast.IntExp{Val: 3}}}, 3},
+		{ast.NegExp{Exp: ast.MultExp{Left: ast.IntExp{Val: 1}, Right: ast.NegExp{Exp: ast.IntExp{Val: 2}}}}, 2},
+	}
+
+	for _, tt := range tests {
+		prog, err := Compile(tt.exp)
+		if err != nil {
+			t.Fatalf("Compile(%s) returned error: %v", tt.exp.Pretty(), err)
+		}
+		if prog.maxStack != tt.want {
+			t.Errorf("maxStack of %s = %d, want %d", tt.exp.Pretty(), prog.maxStack, tt.want)
+		}
+	}
+}
+
+// builds a right nested sum 1 + (2 + (3 + ...)) which needs n values on the stack
+func deepSum(n int) ast.Exp {
+	var exp ast.Exp = ast.IntExp{Val: n}
+	for i := n - 1; i > 0; i-- {
+		exp = ast.PlusExp{Left: ast.IntExp{Val: i}, Right: exp}
+	}
+	return exp
+}
+
+// the example expression (1 + 2) * 3 - 4 / 2
+var benchExp = ast.SubExp{
+	Left:  ast.MultExp{Left: ast.PlusExp{Left: ast.IntExp{Val: 1}, Right: ast.IntExp{Val: 2}}, Right: ast.IntExp{Val: 3}},
+	Right: ast.DivExp{Left: ast.IntExp{Val: 4}, Right: ast.IntExp{Val: 2}},
+}
+
+func TestRunDoesNotAllocate(t *testing.T) {
+	prog, err := Compile(benchExp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := NewVM(prog.Code())
+	if allocs := testing.AllocsPerRun(100, func() { vm.Run() }); allocs != 0 {
+		t.Errorf("VM.Run allocates %v times, want 0", allocs)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { prog.Run() }); allocs != 0 {
+		t.Errorf("Program.Run allocates %v times, want 0", allocs)
+	}
+	// deep programs reuse the stack of the vm
+	deep := LoadAst(deepSum(2 * smallStack))
+	if allocs := testing.AllocsPerRun(100, func() { deep.Run() }); allocs != 0 {
+		t.Errorf("VM.Run of a deep program allocates %v times, want 0", allocs)
+	}
+}
+
+func BenchmarkVMRun(b *testing.B) {
+	vm := LoadAst(benchExp)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		vm.Run()
+	}
+}
+
+func BenchmarkProgramRun(b *testing.B) {
+	prog, _ := Compile(benchExp)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		prog.Run()
+	}
+}
+
+func BenchmarkProgramRunDeep(b *testing.B) {
+	prog, _ := Compile(deepSum(2 * smallStack))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		prog.Run()
+	}
+}
+
+// runs the program from many goroutines at the same time,
+// run with go test -race to detect data races
+func TestConcurrentRun(t *testing.T) {
+	small, err := Compile(benchExp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deep, err := Compile(deepSum(2 * smallStack))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := NewVM(small.Code())
+	n := 2 * smallStack
+
+	tests := []struct {
+		name string
+		run  func() (Value, error)
+		want Value
+	}{
+		{"program", small.Run, 7},
+		{"deep program", deep.Run, Value(n * (n + 1) / 2)},
+		{"vm", vm.Run, 7},
+		{"vm copy", func() (Value, error) { vm := vm; return vm.Run() }, 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			errs := make(chan error, 16)
+			for g := 0; g < 16; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < 1000; i++ {
+						result, err := tt.run()
+						if err != nil || result != tt.want {
+							errs <- fmt.Errorf("Run() = %d, %v, want %d", result, err, tt.want)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Error(err)
+			}
+		})
+	}
+}